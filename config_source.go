@@ -0,0 +1,261 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultConfigKey is the key in the Secret or ConfigMap that holds the configuration if not specified otherwise in
+// the config source URL.
+const defaultConfigKey = "config.yaml"
+
+// configSource is the place from which the configuration of the service is loaded.
+type configSource interface {
+	// Load loads the configuration from the source.
+	Load(ctx context.Context) (controllers.FileConfiguration, error)
+
+	// Watch calls the provided function every time the configuration in the source changes until the context is
+	// cancelled. The call doesn't block.
+	Watch(ctx context.Context, onChange func(controllers.FileConfiguration)) error
+}
+
+// fileConfigSource reads the configuration from a file, e.g. the one mounted into the pod.
+type fileConfigSource struct {
+	path string
+}
+
+var _ configSource = (*fileConfigSource)(nil)
+
+// kubernetesConfigSource reads the configuration from a key in a Secret or a ConfigMap in the cluster using
+// the identity of the service itself.
+type kubernetesConfigSource struct {
+	clientset kubernetes.Interface
+	secret    bool
+	namespace string
+	name      string
+	key       string
+
+	// loaded is the data of the last successfully loaded configuration, the watch only reports the other data.
+	lock   sync.Mutex
+	loaded string
+}
+
+var _ configSource = (*kubernetesConfigSource)(nil)
+
+// newConfigSource parses the config source URL and returns the appropriate config source. The supported formats are:
+//
+// * `/path/to/file` or `file:///path/to/file` - the configuration is read from a file
+// * `secret://namespace/name[/key]` - the configuration is read from the key of a Secret, `config.yaml` by default
+// * `configmap://namespace/name[/key]` - the configuration is read from the key of a ConfigMap, `config.yaml` by default
+//
+// The clientset factory is only invoked for the sources in the cluster.
+func newConfigSource(sourceUrl string, clientset func() (kubernetes.Interface, error)) (configSource, error) {
+	if !strings.Contains(sourceUrl, "://") {
+		return &fileConfigSource{path: sourceUrl}, nil
+	}
+
+	u, err := url.Parse(sourceUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the config source URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &fileConfigSource{path: u.Path}, nil
+	case "secret", "configmap":
+		path := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if u.Host == "" || path[0] == "" || len(path) > 2 {
+			return nil, fmt.Errorf("the config source URL must have the form %s://namespace/name[/key]", u.Scheme)
+		}
+
+		key := defaultConfigKey
+		if len(path) == 2 {
+			key = path[1]
+		}
+
+		cs, err := clientset()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the Kubernetes client to read the configuration with: %w", err)
+		}
+
+		return &kubernetesConfigSource{
+			clientset: cs,
+			secret:    u.Scheme == "secret",
+			namespace: u.Host,
+			name:      path[0],
+			key:       key,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported config source scheme: %s", u.Scheme)
+	}
+}
+
+func (f *fileConfigSource) Load(_ context.Context) (controllers.FileConfiguration, error) {
+	return controllers.LoadFileConfiguration(f.path)
+}
+
+func (f *fileConfigSource) Watch(_ context.Context, _ func(controllers.FileConfiguration)) error {
+	// changes in the mounted files are handled by restarting the pod
+	return nil
+}
+
+func (k *kubernetesConfigSource) Load(ctx context.Context) (controllers.FileConfiguration, error) {
+	var data []byte
+	if k.secret {
+		secret, err := k.clientset.CoreV1().Secrets(k.namespace).Get(ctx, k.name, metav1.GetOptions{})
+		if err != nil {
+			return controllers.FileConfiguration{}, err
+		}
+		data = k.objectData(secret)
+	} else {
+		cm, err := k.clientset.CoreV1().ConfigMaps(k.namespace).Get(ctx, k.name, metav1.GetOptions{})
+		if err != nil {
+			return controllers.FileConfiguration{}, err
+		}
+		data = k.objectData(cm)
+	}
+
+	return k.parse(data)
+}
+
+// parse parses the configuration data and records it as the last loaded data if it is valid.
+func (k *kubernetesConfigSource) parse(data []byte) (controllers.FileConfiguration, error) {
+	if len(data) == 0 {
+		return controllers.FileConfiguration{}, fmt.Errorf("no configuration found under the key %s in %s", k.key, k)
+	}
+
+	cfg, err := configFromBytes(data)
+	if err != nil {
+		return controllers.FileConfiguration{}, err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.loaded = string(data)
+	return cfg, nil
+}
+
+// changed checks whether the data differs from the last loaded configuration.
+func (k *kubernetesConfigSource) changed(data []byte) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return string(data) != k.loaded
+}
+
+func (k *kubernetesConfigSource) Watch(ctx context.Context, onChange func(controllers.FileConfiguration)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.clientset, 0, informers.WithNamespace(k.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", k.name).String()
+		}))
+
+	var informer cache.SharedIndexInformer
+	if k.secret {
+		informer = factory.Core().V1().Secrets().Informer()
+	} else {
+		informer = factory.Core().V1().ConfigMaps().Informer()
+	}
+
+	// the object is added when the informer lists it for the first time and also when it is created again after being
+	// deleted, so both the additions and the updates are compared with the last loaded configuration
+	reload := func(obj interface{}) {
+		data := k.objectData(obj)
+		if !k.changed(data) {
+			return
+		}
+
+		cfg, err := k.parse(data)
+		if err != nil {
+			zap.L().Error("failed to reload the changed configuration, keeping the current one", zap.Stringer("source", k), zap.Error(err))
+			return
+		}
+
+		zap.L().Info("configuration changed", zap.Stringer("source", k))
+		onChange(cfg)
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: reload,
+		UpdateFunc: func(_, newObj interface{}) {
+			reload(newObj)
+		},
+		DeleteFunc: func(_ interface{}) {
+			zap.L().Warn("the configuration was deleted, keeping the current one", zap.Stringer("source", k))
+		},
+	})
+
+	factory.Start(ctx.Done())
+
+	return nil
+}
+
+// objectData returns the configuration data in the watched object, nil if the object is not of the watched kind.
+func (k *kubernetesConfigSource) objectData(obj interface{}) []byte {
+	if k.secret {
+		if secret, ok := obj.(*corev1.Secret); ok {
+			return secret.Data[k.key]
+		}
+		return nil
+	}
+
+	if cm, ok := obj.(*corev1.ConfigMap); ok && cm.Data[k.key] != "" {
+		return []byte(cm.Data[k.key])
+	}
+	return nil
+}
+
+func (k *kubernetesConfigSource) String() string {
+	kind := "configmap"
+	if k.secret {
+		kind = "secret"
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", kind, k.namespace, k.name, k.key)
+}
+
+// configFromBytes parses the configuration from the provided data. The shared configuration can only be loaded from
+// files so we need to go through a temporary file here.
+func configFromBytes(data []byte) (controllers.FileConfiguration, error) {
+	f, err := ioutil.TempFile("", "spi-oauth-config-*.yaml")
+	if err != nil {
+		return controllers.FileConfiguration{}, err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return controllers.FileConfiguration{}, err
+	}
+
+	return controllers.LoadFileConfiguration(f.Name())
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testConfig = `
+sharedSecret: secret
+serviceProviders:
+- type: GitHub
+  clientId: "123"
+  clientSecret: "42"
+baseUrl: https://spi.on.my.machine
+`
+
+func TestNewConfigSource(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	clientset := func() (kubernetes.Interface, error) {
+		return cs, nil
+	}
+
+	src, err := newConfigSource("/etc/spi/config.yaml", clientset)
+	assert.NoError(t, err)
+	assert.Equal(t, &fileConfigSource{path: "/etc/spi/config.yaml"}, src)
+
+	src, err = newConfigSource("file:///etc/spi/config.yaml", clientset)
+	assert.NoError(t, err)
+	assert.Equal(t, &fileConfigSource{path: "/etc/spi/config.yaml"}, src)
+
+	src, err = newConfigSource("secret://spi-system/spi-oauth-config", clientset)
+	assert.NoError(t, err)
+	assert.Equal(t, &kubernetesConfigSource{clientset: cs, secret: true, namespace: "spi-system", name: "spi-oauth-config", key: defaultConfigKey}, src)
+
+	src, err = newConfigSource("configmap://spi-system/spi-oauth-config/oauth.yaml", clientset)
+	assert.NoError(t, err)
+	assert.Equal(t, &kubernetesConfigSource{clientset: cs, secret: false, namespace: "spi-system", name: "spi-oauth-config", key: "oauth.yaml"}, src)
+
+	_, err = newConfigSource("secret://spi-system", clientset)
+	assert.Error(t, err)
+
+	_, err = newConfigSource("vault://spi-system/config", clientset)
+	assert.Error(t, err)
+}
+
+func TestKubernetesConfigSource(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "spi-oauth-config",
+			Namespace: "spi-system",
+		},
+		Data: map[string][]byte{
+			defaultConfigKey: []byte(testConfig),
+		},
+	}
+	cs := fake.NewSimpleClientset(secret)
+
+	src := &kubernetesConfigSource{clientset: cs, secret: true, namespace: "spi-system", name: "spi-oauth-config", key: defaultConfigKey}
+
+	cfg, err := src.Load(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://spi.on.my.machine", cfg.BaseUrl)
+	assert.Equal(t, []byte("secret"), cfg.SharedSecret)
+	assert.Len(t, cfg.ServiceProviders, 1)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	changes := make(chan controllers.FileConfiguration, 1)
+	assert.NoError(t, src.Watch(ctx, func(c controllers.FileConfiguration) {
+		changes <- c
+	}))
+
+	// give the informer some time to sync before changing the secret
+	time.Sleep(100 * time.Millisecond)
+
+	secret.Data[defaultConfigKey] = []byte(testConfig + "vaultHost: https://vault.on.my.machine\n")
+	_, err = cs.CoreV1().Secrets("spi-system").Update(ctx, secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	select {
+	case c := <-changes:
+		assert.Equal(t, "https://vault.on.my.machine", c.VaultHost)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "configuration change not detected")
+	}
+}
+
+func TestKubernetesConfigSourceRecreated(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "spi-oauth-config",
+			Namespace: "spi-system",
+		},
+		Data: map[string]string{
+			defaultConfigKey: testConfig,
+		},
+	}
+	cs := fake.NewSimpleClientset(cm)
+
+	src := &kubernetesConfigSource{clientset: cs, secret: false, namespace: "spi-system", name: "spi-oauth-config", key: defaultConfigKey}
+	_, err := src.Load(context.TODO())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	changes := make(chan controllers.FileConfiguration, 1)
+	assert.NoError(t, src.Watch(ctx, func(c controllers.FileConfiguration) {
+		changes <- c
+	}))
+
+	// the initial listing of the loaded configuration is not a change
+	select {
+	case <-changes:
+		assert.Fail(t, "the loaded configuration reported as changed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the deletion keeps the current configuration, the object created again is applied
+	assert.NoError(t, cs.CoreV1().ConfigMaps("spi-system").Delete(ctx, cm.Name, metav1.DeleteOptions{}))
+	cm.Data[defaultConfigKey] = testConfig + "vaultHost: https://vault.on.my.machine\n"
+	_, err = cs.CoreV1().ConfigMaps("spi-system").Create(ctx, cm, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	select {
+	case c := <-changes:
+		assert.Equal(t, "https://vault.on.my.machine", c.VaultHost)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "configuration change not detected")
+	}
+}
+
+func TestKubernetesConfigSourceMissingKey(t *testing.T) {
+	cs := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "spi-oauth-config",
+			Namespace: "spi-system",
+		},
+		Data: map[string]string{
+			"other.yaml": testConfig,
+		},
+	})
+
+	src := &kubernetesConfigSource{clientset: cs, secret: false, namespace: "spi-system", name: "spi-oauth-config", key: defaultConfigKey}
+
+	_, err := src.Load(context.TODO())
+	assert.Error(t, err)
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+)
+
+// The formats of the payload of the alert webhook.
+const (
+	// AlertFormatGeneric is a JSON object with the details of the alert.
+	AlertFormatGeneric = "generic"
+	// AlertFormatSlack is the payload of the Slack incoming webhooks.
+	AlertFormatSlack = "slack"
+)
+
+// The kinds of the alerts.
+const (
+	// ServiceProviderFailuresAlert is raised when too many exchanges with a service provider fail, e.g. because of
+	// a broken client secret.
+	ServiceProviderFailuresAlert = "serviceProviderFailures"
+	// StorageFailuresAlert is raised when too many obtained tokens fail to be stored.
+	StorageFailuresAlert = "storageFailures"
+)
+
+// FailureAlertOptions configure the FailureAlerts.
+type FailureAlertOptions struct {
+	// WebhookUrl is the URL to which the alerts are posted.
+	WebhookUrl string
+	// Format is the format of the payload, either AlertFormatGeneric or AlertFormatSlack. Defaults to
+	// AlertFormatGeneric.
+	Format string
+	// FailureRate is the fraction of the failed operations within the Window that raises the alert.
+	FailureRate float64
+	// MinOperations is the minimum number of the operations within the Window for the failure rate to be considered.
+	// This prevents a single failure from raising the alert.
+	MinOperations int
+	// Window is the duration over which the failure rate is computed. The same alert is not raised again until
+	// the window passes.
+	Window time.Duration
+}
+
+// Alert is the payload of the alert webhook in the generic format.
+type Alert struct {
+	Kind            string                     `json:"kind"`
+	ServiceProvider config.ServiceProviderType `json:"serviceProvider,omitempty"`
+	Failures        int                        `json:"failures"`
+	Operations      int                        `json:"operations"`
+	FailureRate     float64                    `json:"failureRate"`
+	Window          string                     `json:"window"`
+	LastError       string                     `json:"lastError,omitempty"`
+	Message         string                     `json:"message"`
+}
+
+// FailureAlerts watches the flow events and posts an alert to the webhook when the failure rate of the exchanges with
+// a service provider or of the token storage exceeds the configured threshold.
+type FailureAlerts struct {
+	opts   FailureAlertOptions
+	client *http.Client
+	now    func() time.Time
+	// send posts the alert. It is called in a separate goroutine.
+	send func(alert Alert)
+
+	lock      sync.Mutex
+	outcomes  map[alertKey][]outcome
+	lastError map[alertKey]string
+	alerted   map[alertKey]time.Time
+}
+
+var _ FlowEventPublisher = (*FailureAlerts)(nil)
+
+// alertKey identifies the operations whose failure rate is watched.
+type alertKey struct {
+	kind            string
+	serviceProvider config.ServiceProviderType
+}
+
+// outcome is the result of a single operation.
+type outcome struct {
+	time   time.Time
+	failed bool
+}
+
+// NewFailureAlerts creates the failure alerts from the provided options.
+func NewFailureAlerts(opts FailureAlertOptions) (*FailureAlerts, error) {
+	u, err := url.Parse(opts.WebhookUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL of the alert webhook: %w", err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return nil, fmt.Errorf("the URL of the alert webhook must be absolute")
+	}
+	if opts.Format == "" {
+		opts.Format = AlertFormatGeneric
+	}
+	if opts.Format != AlertFormatGeneric && opts.Format != AlertFormatSlack {
+		return nil, fmt.Errorf("unsupported format of the alerts: %s", opts.Format)
+	}
+	if opts.FailureRate <= 0 || opts.FailureRate > 1 {
+		return nil, fmt.Errorf("the failure rate of the alerts must be greater than 0 and at most 1")
+	}
+	if opts.Window <= 0 {
+		return nil, fmt.Errorf("the window of the alerts must be positive")
+	}
+	if opts.MinOperations < 1 {
+		opts.MinOperations = 1
+	}
+
+	a := &FailureAlerts{
+		opts:      opts,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		now:       time.Now,
+		outcomes:  map[alertKey][]outcome{},
+		lastError: map[alertKey]string{},
+		alerted:   map[alertKey]time.Time{},
+	}
+	a.send = a.post
+	return a, nil
+}
+
+// Publish records the outcome of the operation described by the event and raises the alert if needed.
+func (a *FailureAlerts) Publish(event FlowEvent) {
+	switch event.Type {
+	case ExchangeCompletedEvent, ExchangeFailedEvent:
+		a.record(alertKey{kind: ServiceProviderFailuresAlert, serviceProvider: event.ServiceProvider}, event.Type == ExchangeFailedEvent, event.Error)
+	case TokenStoredEvent, StorageFailedEvent:
+		a.record(alertKey{kind: StorageFailuresAlert}, event.Type == StorageFailedEvent, event.Error)
+	}
+}
+
+func (a *FailureAlerts) record(key alertKey, failed bool, errorMessage string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := a.now()
+	windowStart := now.Add(-a.opts.Window)
+
+	outcomes := append(a.outcomes[key], outcome{time: now, failed: failed})
+
+	first := 0
+	for first < len(outcomes) && outcomes[first].time.Before(windowStart) {
+		first++
+	}
+	outcomes = outcomes[first:]
+	a.outcomes[key] = outcomes
+
+	if failed && errorMessage != "" {
+		a.lastError[key] = errorMessage
+	}
+
+	if !failed || len(outcomes) < a.opts.MinOperations {
+		return
+	}
+	if alertedAt, ok := a.alerted[key]; ok && alertedAt.After(windowStart) {
+		return
+	}
+
+	failures := 0
+	for _, o := range outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+	rate := float64(failures) / float64(len(outcomes))
+	if rate < a.opts.FailureRate {
+		return
+	}
+
+	a.alerted[key] = now
+
+	alert := Alert{
+		Kind:            key.kind,
+		ServiceProvider: key.serviceProvider,
+		Failures:        failures,
+		Operations:      len(outcomes),
+		FailureRate:     rate,
+		Window:          a.opts.Window.String(),
+		LastError:       a.lastError[key],
+	}
+	alert.Message = alertMessage(&alert)
+
+	go a.send(alert)
+}
+
+func alertMessage(alert *Alert) string {
+	subject := "the token storage"
+	if alert.Kind == ServiceProviderFailuresAlert {
+		subject = fmt.Sprintf("the token exchanges with %s", alert.ServiceProvider)
+	}
+	msg := fmt.Sprintf("SPI OAuth: %d of %d of %s failed in the last %s", alert.Failures, alert.Operations, subject, alert.Window)
+	if alert.LastError != "" {
+		msg += fmt.Sprintf(". The last error: %s", alert.LastError)
+	}
+	return msg
+}
+
+// post sends the alert to the webhook.
+func (a *FailureAlerts) post(alert Alert) {
+	var payload interface{} = alert
+	if a.opts.Format == AlertFormatSlack {
+		payload = map[string]string{"text": alert.Message}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		zap.L().Error("failed to encode the alert", zap.Error(err))
+		return
+	}
+
+	resp, err := a.client.Post(a.opts.WebhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		zap.L().Warn("failed to send the alert", zap.String("kind", alert.Kind), zap.Error(err))
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		zap.L().Warn("the alert webhook rejected the alert", zap.String("kind", alert.Kind), zap.Int("status", resp.StatusCode))
+	}
+}
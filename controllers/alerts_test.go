@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFailureAlerts(t *testing.T) {
+	valid := FailureAlertOptions{WebhookUrl: "https://hooks.slack.com/services/x", FailureRate: 0.5, Window: time.Minute}
+
+	a, err := NewFailureAlerts(valid)
+	assert.NoError(t, err)
+	assert.Equal(t, AlertFormatGeneric, a.opts.Format)
+	assert.Equal(t, 1, a.opts.MinOperations)
+
+	invalid := func(modify func(opts *FailureAlertOptions)) {
+		opts := valid
+		modify(&opts)
+		_, err := NewFailureAlerts(opts)
+		assert.Error(t, err)
+	}
+	invalid(func(opts *FailureAlertOptions) { opts.WebhookUrl = "relative" })
+	invalid(func(opts *FailureAlertOptions) { opts.Format = "teams" })
+	invalid(func(opts *FailureAlertOptions) { opts.FailureRate = 0 })
+	invalid(func(opts *FailureAlertOptions) { opts.FailureRate = 1.5 })
+	invalid(func(opts *FailureAlertOptions) { opts.Window = 0 })
+}
+
+func TestFailureAlerts(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	a, err := NewFailureAlerts(FailureAlertOptions{WebhookUrl: "https://alerts.local", FailureRate: 0.5, MinOperations: 4, Window: time.Minute})
+	assert.NoError(t, err)
+	a.now = func() time.Time { return now }
+	sent := make(chan Alert, 10)
+	a.send = func(alert Alert) { sent <- alert }
+
+	exchange := func(failed bool) {
+		event := FlowEvent{Type: ExchangeCompletedEvent, ServiceProvider: config.ServiceProviderTypeGitHub}
+		if failed {
+			event.Type = ExchangeFailedEvent
+			event.Error = "bad client secret"
+		}
+		a.Publish(event)
+	}
+
+	noAlert := func() {
+		select {
+		case alert := <-sent:
+			assert.Fail(t, "unexpected alert", alert.Message)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	exchange(true)
+	exchange(false)
+	exchange(true)
+	// not enough operations yet
+	noAlert()
+
+	exchange(true)
+	alert := <-sent
+	assert.Equal(t, ServiceProviderFailuresAlert, alert.Kind)
+	assert.Equal(t, config.ServiceProviderTypeGitHub, alert.ServiceProvider)
+	assert.Equal(t, 3, alert.Failures)
+	assert.Equal(t, 4, alert.Operations)
+	assert.Equal(t, 0.75, alert.FailureRate)
+	assert.Equal(t, "bad client secret", alert.LastError)
+	assert.Contains(t, alert.Message, "3 of 4 of the token exchanges with GitHub failed in the last 1m0s")
+
+	// the same alert is not repeated within the window
+	exchange(true)
+	noAlert()
+
+	// the old outcomes fall out of the window
+	now = now.Add(2 * time.Minute)
+	exchange(true)
+	exchange(false)
+	exchange(false)
+	noAlert()
+	exchange(true)
+	alert = <-sent
+	assert.Equal(t, 2, alert.Failures)
+	assert.Equal(t, 4, alert.Operations)
+}
+
+func TestFailureAlertsStorage(t *testing.T) {
+	a, err := NewFailureAlerts(FailureAlertOptions{WebhookUrl: "https://alerts.local", FailureRate: 1, MinOperations: 2, Window: time.Minute})
+	assert.NoError(t, err)
+	sent := make(chan Alert, 10)
+	a.send = func(alert Alert) { sent <- alert }
+
+	a.Publish(FlowEvent{Type: StorageFailedEvent, ServiceProvider: config.ServiceProviderTypeGitHub, Error: "vault sealed"})
+	a.Publish(FlowEvent{Type: StorageFailedEvent, ServiceProvider: config.ServiceProviderTypeQuay, Error: "vault sealed"})
+
+	alert := <-sent
+	assert.Equal(t, StorageFailuresAlert, alert.Kind)
+	assert.Empty(t, alert.ServiceProvider)
+	assert.Equal(t, 2, alert.Failures)
+	assert.Contains(t, alert.Message, "of the token storage failed")
+}
+
+func TestFailureAlertsPost(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload
+	}))
+	defer webhook.Close()
+
+	alert := Alert{Kind: StorageFailuresAlert, Failures: 1, Operations: 1, FailureRate: 1, Window: "1m0s", Message: "boom"}
+
+	a, err := NewFailureAlerts(FailureAlertOptions{WebhookUrl: webhook.URL, FailureRate: 1, Window: time.Minute})
+	assert.NoError(t, err)
+	a.post(alert)
+	payload := <-received
+	assert.Equal(t, StorageFailuresAlert, payload["kind"])
+	assert.Equal(t, "boom", payload["message"])
+
+	a, err = NewFailureAlerts(FailureAlertOptions{WebhookUrl: webhook.URL, Format: AlertFormatSlack, FailureRate: 1, Window: time.Minute})
+	assert.NoError(t, err)
+	a.post(alert)
+	assert.Equal(t, map[string]interface{}{"text": "boom"}, <-received)
+}
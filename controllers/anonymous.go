@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+// AnonymousMode lets the users initiate the OAuth flows without presenting their Kubernetes token. The service then
+// acts on behalf of the users using its own identity, i.e. it checks that the service itself can update the token data
+// and stores the token using its own token. Meant only for the single-user and development clusters, because anyone
+// able to reach the service can then authorize the SPIAccessTokens in the allowed namespaces.
+type AnonymousMode struct {
+	// Namespaces are the namespaces of the SPIAccessTokens that can be authorized anonymously.
+	Namespaces []string
+
+	// Token returns the Kubernetes token of the service itself.
+	Token func() (string, error)
+}
+
+// allows checks whether the SPIAccessTokens in the namespace can be authorized anonymously. A nil mode allows nothing.
+func (m *AnonymousMode) allows(namespace string) bool {
+	if m == nil || m.Token == nil {
+		return false
+	}
+	for _, ns := range m.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAnonymousNamespaces checks the namespaces allowed in the anonymous mode. The namespaces must be listed
+// explicitly, there is no wildcard.
+func ValidateAnonymousNamespaces(namespaces []string) error {
+	for _, ns := range namespaces {
+		if strings.TrimSpace(ns) == "" || ns == "*" {
+			return fmt.Errorf("invalid namespace '%s' allowed in the anonymous mode, the namespaces must be listed explicitly", ns)
+		}
+	}
+	return nil
+}
+
+// ServiceTokenSource returns the function reading the bearer token the Kubernetes client configuration authenticates
+// with. The token file takes precedence and is re-read every time, so that the rotated service account tokens are
+// picked up. An error is returned if the configuration doesn't use a bearer token.
+func ServiceTokenSource(cfg *rest.Config) (func() (string, error), error) {
+	if cfg.BearerTokenFile != "" {
+		file := cfg.BearerTokenFile
+		return func() (string, error) {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return "", fmt.Errorf("failed to read the token of the service: %w", err)
+			}
+			return strings.TrimSpace(string(data)), nil
+		}, nil
+	}
+	if cfg.BearerToken != "" {
+		token := cfg.BearerToken
+		return func() (string, error) {
+			return token, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("the Kubernetes client of the service doesn't authenticate using a bearer token")
+}
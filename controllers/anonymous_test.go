@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+func TestAnonymousModeAllows(t *testing.T) {
+	var disabled *AnonymousMode
+	assert.False(t, disabled.allows("default"))
+
+	mode := &AnonymousMode{Namespaces: []string{"default", "demo"}, Token: func() (string, error) { return "token", nil }}
+	assert.True(t, mode.allows("default"))
+	assert.True(t, mode.allows("demo"))
+	assert.False(t, mode.allows("other"))
+	assert.False(t, mode.allows(""))
+
+	assert.False(t, (&AnonymousMode{Namespaces: []string{"default"}}).allows("default"))
+}
+
+func TestValidateAnonymousNamespaces(t *testing.T) {
+	assert.NoError(t, ValidateAnonymousNamespaces([]string{"default", "demo"}))
+	assert.Error(t, ValidateAnonymousNamespaces([]string{"default", ""}))
+	assert.Error(t, ValidateAnonymousNamespaces([]string{"*"}))
+}
+
+func TestServiceTokenSource(t *testing.T) {
+	t.Run("token file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "token")
+		assert.NoError(t, ioutil.WriteFile(file, []byte("token-1\n"), 0600))
+
+		source, err := ServiceTokenSource(&rest.Config{BearerToken: "static", BearerTokenFile: file})
+		assert.NoError(t, err)
+		token, err := source()
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+
+		// the rotated token is picked up
+		assert.NoError(t, ioutil.WriteFile(file, []byte("token-2"), 0600))
+		token, err = source()
+		assert.NoError(t, err)
+		assert.Equal(t, "token-2", token)
+	})
+
+	t.Run("static token", func(t *testing.T) {
+		source, err := ServiceTokenSource(&rest.Config{BearerToken: "static"})
+		assert.NoError(t, err)
+		token, err := source()
+		assert.NoError(t, err)
+		assert.Equal(t, "static", token)
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		_, err := ServiceTokenSource(&rest.Config{})
+		assert.Error(t, err)
+	})
+}
+
+func TestAnonymousAuthenticate(t *testing.T) {
+	tmpl, err := LoadTemplates("../static", "", RedirectNoticeTemplate)
+	assert.NoError(t, err)
+
+	c := testController("", nil, nil)
+	c.SessionManager = scs.NewManager(memstore.New(time.Hour))
+	c.Templates = tmpl
+	c.ErrorPages = &ErrorPages{Templates: tmpl}
+	c.Anonymous = &AnonymousMode{Namespaces: []string{"default"}, Token: func() (string, error) { return "service-token", nil }}
+
+	authenticate := func(namespace string) *httptest.ResponseRecorder {
+		codec, err := c.stateCodec()
+		assert.NoError(t, err)
+		state, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+			TokenName:           "mytoken",
+			TokenNamespace:      namespace,
+			IssuedAt:            time.Now().Unix(),
+			ServiceProviderType: c.Config.ServiceProviderType,
+		})
+		assert.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		c.Authenticate(res, httptest.NewRequest("GET", "/github/authenticate?"+url.Values{"state": {state}}.Encode(), nil))
+		return res
+	}
+
+	t.Run("allowed namespace", func(t *testing.T) {
+		res := authenticate("default")
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, cookie := range res.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+		flows := map[string]string{}
+		assert.NoError(t, c.SessionManager.Load(r).GetObject(flowsSessionKey, &flows))
+		assert.Len(t, flows, 1)
+		for key := range flows {
+			token, err := c.getFlow(r, key)
+			assert.NoError(t, err)
+			assert.Equal(t, "service-token", token)
+		}
+	})
+
+	t.Run("other namespace", func(t *testing.T) {
+		res := authenticate("other")
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+	})
+}
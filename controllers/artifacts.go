@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// refreshTokenExpiresInField is the non-standard field of the token response in which some service providers (e.g.
+// GitHub apps) report the lifetime of the refresh token in seconds.
+const refreshTokenExpiresInField = "refresh_token_expires_in"
+
+// tokenArtifacts splits the token obtained from the service provider into the individual artifacts, each with its own
+// expiry. The refresh token and the ID token are only included if the service provider returned them.
+func tokenArtifacts(token *oauth2.Token, requestedScopes []string, capabilities []string, now time.Time) tokenstorage.Artifacts {
+	artifacts := tokenstorage.Artifacts{}
+
+	access := tokenstorage.Artifact{Value: token.AccessToken, TokenType: token.TokenType, Scopes: grantedScopes(token, requestedScopes), Capabilities: capabilities}
+	if !token.Expiry.IsZero() {
+		access.ExpiresAt = token.Expiry.Unix()
+	}
+	artifacts[tokenstorage.AccessTokenArtifact] = access
+
+	if token.RefreshToken != "" {
+		refresh := tokenstorage.Artifact{Value: token.RefreshToken}
+		if expiresIn := extraSeconds(token.Extra(refreshTokenExpiresInField)); expiresIn > 0 {
+			refresh.ExpiresAt = now.Unix() + expiresIn
+		}
+		artifacts[tokenstorage.RefreshTokenArtifact] = refresh
+	}
+
+	if idToken, ok := token.Extra("id_token").(string); ok && idToken != "" {
+		artifacts[tokenstorage.IdTokenArtifact] = tokenstorage.Artifact{Value: idToken, ExpiresAt: idTokenExpiry(idToken)}
+	}
+
+	return artifacts
+}
+
+// grantedScopes returns the scopes granted to the token. The service providers may omit the scopes in the token
+// response if they are identical to the requested ones (RFC 6749, section 5.1).
+func grantedScopes(token *oauth2.Token, requestedScopes []string) []string {
+	if scope, ok := token.Extra("scope").(string); ok {
+		if granted := parseGrantedScopes(scope); len(granted) > 0 {
+			return granted
+		}
+	}
+	if len(requestedScopes) == 0 {
+		return nil
+	}
+	return append([]string{}, requestedScopes...)
+}
+
+// idTokenExpiry reads the expiry of the ID token. The signature of the token is not verified, because the token has
+// been obtained directly from the service provider. Zero is returned if the expiry cannot be determined.
+func idTokenExpiry(idToken string) int64 {
+	parsed, err := jwt.ParseSigned(idToken)
+	if err != nil {
+		zap.L().Debug("failed to parse the ID token, storing it without an expiry", zap.Error(err))
+		return 0
+	}
+
+	claims := jwt.Claims{}
+	if err = parsed.UnsafeClaimsWithoutVerification(&claims); err != nil || claims.Expiry == nil {
+		return 0
+	}
+
+	return claims.Expiry.Time().Unix()
+}
+
+// extraSeconds converts the value of an extra field of the token response to a number of seconds. The value is
+// a number if the response was JSON and a string if it was form-encoded.
+func extraSeconds(value interface{}) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		s, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return s
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenArtifacts(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	t.Run("access token only", func(t *testing.T) {
+		artifacts := tokenArtifacts(&oauth2.Token{AccessToken: "access", TokenType: "bearer"}, nil, nil, now)
+		assert.Equal(t, tokenstorage.Artifacts{
+			tokenstorage.AccessTokenArtifact: {Value: "access", TokenType: "bearer"},
+		}, artifacts)
+	})
+
+	t.Run("all artifacts", func(t *testing.T) {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0123456789abcdef0123456789abcdef")}, nil)
+		assert.NoError(t, err)
+		idToken, err := jwt.Signed(signer).Claims(jwt.Claims{Expiry: jwt.NewNumericDate(time.Unix(3000, 0))}).CompactSerialize()
+		assert.NoError(t, err)
+
+		token := (&oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Unix(2000, 0)}).WithExtra(map[string]interface{}{
+			"id_token":                 idToken,
+			refreshTokenExpiresInField: "500",
+		})
+
+		assert.Equal(t, tokenstorage.Artifacts{
+			tokenstorage.AccessTokenArtifact:  {Value: "access", ExpiresAt: 2000},
+			tokenstorage.RefreshTokenArtifact: {Value: "refresh", ExpiresAt: 1500},
+			tokenstorage.IdTokenArtifact:      {Value: idToken, ExpiresAt: 3000},
+		}, tokenArtifacts(token, nil, nil, now))
+	})
+
+	t.Run("requested scopes", func(t *testing.T) {
+		artifacts := tokenArtifacts(&oauth2.Token{AccessToken: "access"}, []string{"repo", "user"}, nil, now)
+		assert.Equal(t, []string{"repo", "user"}, artifacts[tokenstorage.AccessTokenArtifact].Scopes)
+	})
+
+	t.Run("granted scopes", func(t *testing.T) {
+		token := (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{"scope": "repo,read:org"})
+		artifacts := tokenArtifacts(token, []string{"repo", "user"}, nil, now)
+		assert.Equal(t, []string{"repo", "read:org"}, artifacts[tokenstorage.AccessTokenArtifact].Scopes)
+	})
+
+	t.Run("unparseable id token", func(t *testing.T) {
+		token := (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{"id_token": "not-a-jwt"})
+		assert.Equal(t, tokenstorage.Artifact{Value: "not-a-jwt"}, tokenArtifacts(token, nil, nil, now)[tokenstorage.IdTokenArtifact])
+	})
+}
+
+func TestExtraSeconds(t *testing.T) {
+	assert.Equal(t, int64(42), extraSeconds(float64(42)))
+	assert.Equal(t, int64(42), extraSeconds("42"))
+	assert.Equal(t, int64(0), extraSeconds("x"))
+	assert.Equal(t, int64(0), extraSeconds(nil))
+}
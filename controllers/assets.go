@@ -0,0 +1,187 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// AssetsPath is the path under which the static assets used by the HTML templates are served.
+const AssetsPath = "/assets/"
+
+const (
+	// assetVersionLength is the number of the hex characters of the content hash used as the version of the asset.
+	assetVersionLength = 12
+
+	// assetsImmutableCacheControl is used for the versioned URLs of the assets. Their content never changes because
+	// a change of the content changes the URL.
+	assetsImmutableCacheControl = "public, max-age=31536000, immutable"
+
+	// assetsRevalidatedCacheControl is used for the URLs without the current version so that the browsers always
+	// check them with the service.
+	assetsRevalidatedCacheControl = "no-cache"
+)
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+// asset is a single static asset with its precomputed version and integrity.
+type asset struct {
+	name      string
+	versioned string
+	data      []byte
+	etag      string
+	integrity string
+}
+
+// Assets serves the static assets (the stylesheets, the scripts and the images) referenced by the HTML templates.
+// Every asset is available under a versioned URL containing the hash of its content, so that the responses can be
+// cached by the browsers indefinitely and an upgrade of the service never serves the stale assets with the new pages.
+// The templates link to the assets using the `asset` function and can protect them using the subresource integrity
+// provided by the `integrity` function, e.g.
+//
+//	<link rel="stylesheet" href="{{ asset "spi.css" }}" integrity="{{ integrity "spi.css" }}"/>
+type Assets struct {
+	pathPrefix string
+	byName     map[string]*asset
+}
+
+// NewAssets reads all the files in the provided filesystem and computes their versions and integrity. The path prefix
+// is prepended to the URLs of the assets.
+func NewAssets(fsys fs.FS, pathPrefix string) (*Assets, error) {
+	a := &Assets{
+		pathPrefix: pathPrefix,
+		byName:     map[string]*asset{},
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("failed to read the asset %s: %w", name, err)
+		}
+		a.byName[name] = newAsset(name, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// DefaultAssets returns the assets embedded in the service binary.
+func DefaultAssets(pathPrefix string) (*Assets, error) {
+	fsys, err := fs.Sub(embeddedAssets, "assets")
+	if err != nil {
+		return nil, err
+	}
+	return NewAssets(fsys, pathPrefix)
+}
+
+func newAsset(name string, data []byte) *asset {
+	hash := sha256.Sum256(data)
+	version := hex.EncodeToString(hash[:])[:assetVersionLength]
+	ext := path.Ext(name)
+	integrity := sha512.Sum384(data)
+
+	return &asset{
+		name:      name,
+		versioned: strings.TrimSuffix(name, ext) + "." + version + ext,
+		data:      data,
+		etag:      `"` + version + `"`,
+		integrity: "sha384-" + base64.StdEncoding.EncodeToString(integrity[:]),
+	}
+}
+
+// Path returns the versioned URL of the asset with the provided name. An error is returned for the unknown assets so
+// that a typo in a template fails its rendering instead of producing a broken page.
+func (a *Assets) Path(name string) (string, error) {
+	as, ok := a.byName[name]
+	if !ok {
+		return "", fmt.Errorf("unknown asset %s", name)
+	}
+	return a.pathPrefix + AssetsPath + as.versioned, nil
+}
+
+// Integrity returns the subresource integrity of the asset with the provided name.
+func (a *Assets) Integrity(name string) (string, error) {
+	as, ok := a.byName[name]
+	if !ok {
+		return "", fmt.Errorf("unknown asset %s", name)
+	}
+	return as.integrity, nil
+}
+
+// lookup finds the asset for the path relative to the AssetsPath. The returned flag is true if the path contains
+// the current version of the asset, the paths with any other version are not found.
+func (a *Assets) lookup(name string) (*asset, bool) {
+	if as, ok := a.byName[name]; ok {
+		return as, false
+	}
+
+	// the versioned names are "<name>.<version><ext>"
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 {
+		return nil, false
+	}
+	as, ok := a.byName[base[:dot]+ext]
+	if !ok || as.versioned != name {
+		return nil, false
+	}
+	return as, true
+}
+
+// ServeHTTP serves the asset on the path after the AssetsPath. The current versions are cached indefinitely and
+// the unversioned paths get the current content which the browsers must revalidate. The paths with the other
+// versions are not found: the content of the previous versions is not kept, and serving the current one would only
+// make the browsers reject it for not matching the integrity expected by the page.
+func (a *Assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := a.pathPrefix + AssetsPath
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	as, current := a.lookup(strings.TrimPrefix(r.URL.Path, prefix))
+	if as == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if current {
+		w.Header().Set("Cache-Control", assetsImmutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", assetsRevalidatedCacheControl)
+	}
+	w.Header().Set("ETag", as.etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, as.name, time.Time{}, bytes.NewReader(as.data))
+}
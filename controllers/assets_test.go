@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAssets(t *testing.T) {
+	assets, err := DefaultAssets("")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"spi.css", "redhat-logo.svg"} {
+		p, err := assets.Path(name)
+		assert.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^/assets/`+strings.Replace(name, ".", `\.[0-9a-f]{12}\.`, 1)+`$`), p)
+	}
+}
+
+func TestAssets(t *testing.T) {
+	css := []byte("body{color:#333}")
+	assets, err := NewAssets(fstest.MapFS{
+		"app.css":      {Data: css},
+		"img/logo.svg": {Data: []byte("<svg/>")},
+	}, "/spi")
+	assert.NoError(t, err)
+
+	cssPath, err := assets.Path("app.css")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(cssPath, "/spi/assets/app."))
+	logoPath, err := assets.Path("img/logo.svg")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(logoPath, "/spi/assets/img/logo."))
+
+	hash := sha512.Sum384(css)
+	integrity, err := assets.Integrity("app.css")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha384-"+base64.StdEncoding.EncodeToString(hash[:]), integrity)
+
+	_, err = assets.Path("missing.css")
+	assert.Error(t, err)
+	_, err = assets.Integrity("missing.css")
+	assert.Error(t, err)
+
+	serve := func(path string, header ...string) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res := httptest.NewRecorder()
+		assets.ServeHTTP(res, req)
+		return res.Result()
+	}
+
+	t.Run("current version", func(t *testing.T) {
+		res := serve(cssPath)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, assetsImmutableCacheControl, res.Header.Get("Cache-Control"))
+		assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/css"))
+		assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+		data, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, css, data)
+
+		res = serve(logoPath)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "image/svg+xml", res.Header.Get("Content-Type"))
+	})
+
+	t.Run("revalidation", func(t *testing.T) {
+		res := serve(cssPath)
+		res = serve(cssPath, "If-None-Match", res.Header.Get("ETag"))
+		assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	})
+
+	t.Run("unversioned", func(t *testing.T) {
+		res := serve("/spi/assets/app.css")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, assetsRevalidatedCacheControl, res.Header.Get("Cache-Control"))
+		data, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, css, data)
+	})
+
+	t.Run("other version", func(t *testing.T) {
+		// the current content wouldn't match the integrity expected by the page referencing the other version
+		assert.Equal(t, http.StatusNotFound, serve("/spi/assets/app.0123456789ab.css").StatusCode)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		for _, path := range []string{"/spi/assets/missing.css", "/spi/assets/missing.0123456789ab.css", "/spi/assets/", "/assets/app.css"} {
+			assert.Equal(t, http.StatusNotFound, serve(path).StatusCode, path)
+		}
+	})
+}
@@ -83,7 +83,7 @@ func WithAuthIntoContext(bearerToken string, ctx context.Context) context.Contex
 
 func (f fromContextAuthProvider) WrapTransport(tripper http.RoundTripper) http.RoundTripper {
 	return &httptransport.AuthenticatingRoundTripper{
-		RoundTripper: tripper,
+		RoundTripper: &workspaceRoundTripper{RoundTripper: tripper},
 	}
 }
 
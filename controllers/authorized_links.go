@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultAuthorizedLinkTtl is the default time for which a pre-authorized link can be used to initiate the OAuth flow.
+const DefaultAuthorizedLinkTtl = 5 * time.Minute
+
+// AuthorizedLinks keeps track of the short-lived, single-use links that initiate the OAuth flow without requiring
+// the user to present their Kubernetes token in the browser. The identity of the initiator is checked when the link
+// is minted and the link then carries that authorization until it is consumed or expires.
+//
+// The links are kept in the memory of the replica that minted them, so with multiple replicas of the service the users
+// need to be routed to the same replica (e.g. using the session affinity of the service). The same store must be
+// shared by all the controllers, so that the links survive the reloads of the configuration. The Kubernetes tokens of
+// the initiators are kept encrypted.
+type AuthorizedLinks struct {
+	// Ttl is the time for which the minted links are valid. If not set, DefaultAuthorizedLinkTtl is used.
+	Ttl time.Duration
+
+	lock  sync.Mutex
+	links map[string]authorizedLink
+}
+
+// authorizedLink is the data associated with a single minted link.
+type authorizedLink struct {
+	state          string
+	sealedK8sToken []byte
+	expiresAt      time.Time
+}
+
+// NewAuthorizedLinks creates a new instance of the link store using the provided TTL for the minted links.
+func NewAuthorizedLinks(ttl time.Duration) *AuthorizedLinks {
+	return &AuthorizedLinks{
+		Ttl:   ttl,
+		links: map[string]authorizedLink{},
+	}
+}
+
+// newLinkCipher creates the cipher encrypting the Kubernetes tokens of the minted links.
+func newLinkCipher(sharedSecret []byte) (cipher.AEAD, error) {
+	if len(sharedSecret) == 0 {
+		return nil, fmt.Errorf("the shared secret is needed to encrypt the authorized links")
+	}
+
+	return newAEAD(linkCipherKeyLabel, sharedSecret)
+}
+
+// Mint creates a new link key associated with the provided OAuth state and the Kubernetes token of the initiator.
+// The token is encrypted using the key derived from the shared secret with the link key as the additional data.
+// The caller is responsible for checking that the token has access to the namespace of the state prior to calling
+// this method.
+func (l *AuthorizedLinks) Mint(sharedSecret []byte, state string, k8sToken string) (string, error) {
+	aead, err := newLinkCipher(sharedSecret)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(buf)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(k8sToken), []byte(key))
+
+	ttl := l.Ttl
+	if ttl == 0 {
+		ttl = DefaultAuthorizedLinkTtl
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.links == nil {
+		l.links = map[string]authorizedLink{}
+	}
+
+	// let's use the opportunity to clean up the links that were never used...
+	now := time.Now()
+	for k, v := range l.links {
+		if now.After(v.expiresAt) {
+			delete(l.links, k)
+		}
+	}
+
+	l.links[key] = authorizedLink{
+		state:          state,
+		sealedK8sToken: sealed,
+		expiresAt:      now.Add(ttl),
+	}
+
+	return key, nil
+}
+
+// Consume returns the OAuth state and the Kubernetes token associated with the provided link key. The link is
+// invalidated by this call so any subsequent call with the same key returns false, as does the call for an expired
+// or unknown key and the call for a link whose token cannot be decrypted, e.g. because the shared secret has changed
+// since the link was minted.
+func (l *AuthorizedLinks) Consume(sharedSecret []byte, key string) (state string, k8sToken string, ok bool) {
+	l.lock.Lock()
+	link, ok := l.links[key]
+	delete(l.links, key)
+	l.lock.Unlock()
+
+	if !ok || time.Now().After(link.expiresAt) {
+		return "", "", false
+	}
+
+	aead, err := newLinkCipher(sharedSecret)
+	if err != nil || len(link.sealedK8sToken) < aead.NonceSize() {
+		return "", "", false
+	}
+	nonceSize := aead.NonceSize()
+	token, err := aead.Open(nil, link.sealedK8sToken[:nonceSize], link.sealedK8sToken[nonceSize:], []byte(key))
+	if err != nil {
+		return "", "", false
+	}
+
+	return link.state, string(token), true
+}
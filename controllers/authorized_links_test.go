@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizedLinks(t *testing.T) {
+	secret := []byte("secret")
+
+	t.Run("single use", func(t *testing.T) {
+		links := NewAuthorizedLinks(time.Minute)
+
+		key, err := links.Mint(secret, "state", "token")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, key)
+
+		state, token, ok := links.Consume(secret, key)
+		assert.True(t, ok)
+		assert.Equal(t, "state", state)
+		assert.Equal(t, "token", token)
+
+		_, _, ok = links.Consume(secret, key)
+		assert.False(t, ok)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		links := NewAuthorizedLinks(time.Nanosecond)
+
+		key, err := links.Mint(secret, "state", "token")
+		assert.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+
+		_, _, ok := links.Consume(secret, key)
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		links := &AuthorizedLinks{}
+
+		_, _, ok := links.Consume(secret, "kachny")
+		assert.False(t, ok)
+	})
+
+	t.Run("encrypted token", func(t *testing.T) {
+		links := NewAuthorizedLinks(time.Minute)
+
+		key, err := links.Mint(secret, "state", "token")
+		assert.NoError(t, err)
+		assert.NotContains(t, string(links.links[key].sealedK8sToken), "token")
+
+		// the token cannot be moved to another link
+		link := links.links[key]
+		links.links["other"] = link
+		_, _, ok := links.Consume(secret, "other")
+		assert.False(t, ok)
+	})
+
+	t.Run("changed secret", func(t *testing.T) {
+		links := NewAuthorizedLinks(time.Minute)
+
+		key, err := links.Mint(secret, "state", "token")
+		assert.NoError(t, err)
+
+		_, _, ok := links.Consume([]byte("another secret"), key)
+		assert.False(t, ok)
+		_, _, ok = links.Consume(secret, key)
+		assert.False(t, ok)
+	})
+
+	t.Run("no secret", func(t *testing.T) {
+		_, err := NewAuthorizedLinks(time.Minute).Mint(nil, "state", "token")
+		assert.Error(t, err)
+	})
+
+	t.Run("unique keys", func(t *testing.T) {
+		links := NewAuthorizedLinks(time.Minute)
+
+		key1, err := links.Mint(secret, "state", "token")
+		assert.NoError(t, err)
+		key2, err := links.Mint(secret, "state", "token")
+		assert.NoError(t, err)
+
+		assert.NotEqual(t, key1, key2)
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AutomationLabel is the label put on the SPIAccessTokens whose token has been obtained in an automation flow, i.e.
+// a flow initiated by a service account rather than a human user. The cluster admins can use it to audit
+// the credentials held by the machines separately.
+const AutomationLabel = "spi.appstudio.redhat.com/automation"
+
+// serviceAccountSubjectPrefix is the prefix of the subject of the Kubernetes service account tokens.
+const serviceAccountSubjectPrefix = "system:serviceaccount:"
+
+// AutomationPolicy configures the restrictions of the automation flows of a service provider. The flows of the human
+// users are not affected.
+type AutomationPolicy struct {
+	// AllowedScopes are the only scopes the automation flows can request. If not empty, the automation flows requesting
+	// any other scope, or no scopes at all (which usually means the default broad access), are rejected.
+	AllowedScopes []string `yaml:"allowedScopes,omitempty"`
+
+	// TokenTtl limits the lifetime of the stored tokens obtained in the automation flows, e.g. `24h`. The expiry of
+	// the stored token is capped and the refresh token is not stored at all, so the token cannot outlive the limit and
+	// the automation needs to perform a new flow after it. Not limited if zero.
+	TokenTtl time.Duration `yaml:"tokenTtl,omitempty"`
+}
+
+func validateAutomationPolicy(policy AutomationPolicy) error {
+	if policy.TokenTtl < 0 {
+		return fmt.Errorf("the token TTL of the automation flows cannot be negative")
+	}
+	for _, scope := range policy.AllowedScopes {
+		if strings.TrimSpace(scope) == "" {
+			return fmt.Errorf("the allowed scopes of the automation flows cannot be empty")
+		}
+	}
+	return nil
+}
+
+// checkScopes verifies that the automation flow only requests the allowed scopes.
+func (p AutomationPolicy) checkScopes(requested []string) error {
+	if len(p.AllowedScopes) == 0 {
+		return nil
+	}
+	if len(requested) == 0 {
+		return fmt.Errorf("the automation flows must request some of the allowed scopes %v", p.AllowedScopes)
+	}
+
+	var disallowed []string
+	for _, scope := range requested {
+		if !containsFold(p.AllowedScopes, scope) {
+			disallowed = append(disallowed, scope)
+		}
+	}
+	if len(disallowed) > 0 {
+		return fmt.Errorf("the scopes %v are not allowed in the automation flows, the allowed scopes are %v", disallowed, p.AllowedScopes)
+	}
+	return nil
+}
+
+// restrictToken returns the copy of the token with the expiry capped by the TokenTtl and without the refresh token.
+// The token is returned as is if the TTL is not limited.
+func (p AutomationPolicy) restrictToken(token *oauth2.Token, now time.Time) (*oauth2.Token, bool) {
+	if p.TokenTtl <= 0 {
+		return token, false
+	}
+
+	restricted := *token
+	restricted.RefreshToken = ""
+	if limit := now.Add(p.TokenTtl); restricted.Expiry.IsZero() || restricted.Expiry.After(limit) {
+		restricted.Expiry = limit
+	}
+	return &restricted, true
+}
+
+// isAutomationFlow checks whether the flow is an automation flow. That is either if the operator marked the state as
+// such or if the flow is initiated using a Kubernetes service account token. The signature of the Kubernetes token is
+// not verified here, because it only makes the policy stricter and the token is verified by the cluster anyway.
+func isAutomationFlow(state anonymousState, k8sToken string) bool {
+	if state.Automation {
+		return true
+	}
+
+	return strings.HasPrefix(tokenSubject(k8sToken), serviceAccountSubjectPrefix)
+}
+
+// applyAutomationPolicy restricts the token obtained in the automation flow before it is stored.
+func (c commonController) applyAutomationPolicy(exchange *exchangeResult, now time.Time) {
+	if !exchange.Automation || exchange.token == nil {
+		return
+	}
+	exchange.token, exchange.restricted = c.automationPolicy.restrictToken(exchange.token, now)
+}
+
+// labelAutomationToken puts the AutomationLabel on the SPIAccessToken unless it is already there.
+func (c commonController) labelAutomationToken(ctx context.Context, accessToken *v1beta1.SPIAccessToken) error {
+	if accessToken.Labels[AutomationLabel] == "true" {
+		return nil
+	}
+
+	patch := client.MergeFrom(accessToken.DeepCopy())
+	if accessToken.Labels == nil {
+		accessToken.Labels = map[string]string{}
+	}
+	accessToken.Labels[AutomationLabel] = "true"
+
+	if err := c.K8sClient.Patch(ctx, accessToken, patch); err != nil {
+		return fmt.Errorf("failed to label the SPIAccessToken as held by an automation: %w", err)
+	}
+	LoggerFromContext(ctx).Info("labeled the SPIAccessToken as held by an automation")
+	return nil
+}
+
+// storeRestrictedToken stores the token restricted by the automation policy. Unlike storeToken, the previously stored
+// refresh token is discarded, so that the token cannot be refreshed past the TTL.
+func (c commonController) storeRestrictedToken(ctx context.Context, accessToken *v1beta1.SPIAccessToken, token *oauth2.Token, requestedScopes []string, capabilities []string) error {
+	if err := injectStorageFault(ctx); err != nil {
+		return err
+	}
+
+	if c.ArtifactStorage != nil {
+		if err := c.ArtifactStorage.DeleteArtifact(ctx, accessToken, oauthstorage.RefreshTokenArtifact); err != nil {
+			return err
+		}
+	}
+
+	LoggerFromContext(ctx).Debug("storing the token restricted by the automation policy", zap.Time("expiry", token.Expiry))
+	return c.storeTokenData(ctx, accessToken, token, requestedScopes, capabilities, "")
+}
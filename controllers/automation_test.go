@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	authz "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestValidateAutomationPolicy(t *testing.T) {
+	assert.NoError(t, validateAutomationPolicy(AutomationPolicy{}))
+	assert.NoError(t, validateAutomationPolicy(AutomationPolicy{AllowedScopes: []string{"repo"}, TokenTtl: time.Hour}))
+	assert.Error(t, validateAutomationPolicy(AutomationPolicy{TokenTtl: -time.Hour}))
+	assert.Error(t, validateAutomationPolicy(AutomationPolicy{AllowedScopes: []string{" "}}))
+}
+
+func TestAutomationPolicyCheckScopes(t *testing.T) {
+	assert.NoError(t, AutomationPolicy{}.checkScopes(nil))
+	assert.NoError(t, AutomationPolicy{}.checkScopes([]string{"repo"}))
+
+	policy := AutomationPolicy{AllowedScopes: []string{"repo:status", "read:org"}}
+	assert.NoError(t, policy.checkScopes([]string{"repo:status"}))
+	assert.NoError(t, policy.checkScopes([]string{"READ:ORG", "repo:status"}))
+	assert.Error(t, policy.checkScopes(nil))
+	assert.Error(t, policy.checkScopes([]string{"repo:status", "repo"}))
+}
+
+func TestAutomationPolicyRestrictToken(t *testing.T) {
+	now := time.Now()
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: now.Add(48 * time.Hour)}
+
+	restricted, ok := AutomationPolicy{}.restrictToken(token, now)
+	assert.False(t, ok)
+	assert.Same(t, token, restricted)
+
+	policy := AutomationPolicy{TokenTtl: 24 * time.Hour}
+	restricted, ok = policy.restrictToken(token, now)
+	assert.True(t, ok)
+	assert.Equal(t, "access", restricted.AccessToken)
+	assert.Empty(t, restricted.RefreshToken)
+	assert.Equal(t, now.Add(24*time.Hour), restricted.Expiry)
+	// the original token is left untouched
+	assert.Equal(t, "refresh", token.RefreshToken)
+
+	restricted, _ = policy.restrictToken(&oauth2.Token{AccessToken: "access"}, now)
+	assert.Equal(t, now.Add(24*time.Hour), restricted.Expiry)
+
+	restricted, _ = policy.restrictToken(&oauth2.Token{AccessToken: "access", Expiry: now.Add(time.Hour)}, now)
+	assert.Equal(t, now.Add(time.Hour), restricted.Expiry)
+}
+
+func TestIsAutomationFlow(t *testing.T) {
+	k8sToken := func(subject string) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+		assert.NoError(t, err)
+		token, err := jwt.Signed(signer).Claims(jwt.Claims{Subject: subject}).CompactSerialize()
+		assert.NoError(t, err)
+		return token
+	}
+
+	assert.False(t, isAutomationFlow(anonymousState{}, "opaque-token"))
+	assert.False(t, isAutomationFlow(anonymousState{}, k8sToken("alice")))
+	assert.True(t, isAutomationFlow(anonymousState{}, k8sToken("system:serviceaccount:default:pipeline")))
+	assert.True(t, isAutomationFlow(anonymousState{Automation: true}, "opaque-token"))
+}
+
+func TestCheckIdentityHasAccessOfAutomation(t *testing.T) {
+	c := testController("", nil, nil)
+	cl := c.K8sClient.(*reviewClient)
+	state := anonymousState{AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "token", TokenNamespace: "default"}}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	hasAccess, err := c.checkIdentityHasAccess("human", req, state, false)
+	assert.NoError(t, err)
+	assert.True(t, hasAccess)
+	assert.Len(t, cl.resourceAttributes(), 1)
+
+	// the automation must also be able to label the SPIAccessToken
+	hasAccess, err = c.checkIdentityHasAccess("machine", req, state, true)
+	assert.NoError(t, err)
+	assert.True(t, hasAccess)
+	attributes := cl.resourceAttributes()
+	assert.Len(t, attributes, 3)
+	assert.Equal(t, "spiaccesstokendataupdates", attributes[1].Resource)
+	assert.Equal(t, authz.ResourceAttributes{
+		Namespace: "default",
+		Verb:      "patch",
+		Group:     v1beta1.GroupVersion.Group,
+		Version:   v1beta1.GroupVersion.Version,
+		Resource:  "spiaccesstokens",
+		Name:      "token",
+	}, attributes[2])
+
+	cl.allowed = false
+	hasAccess, err = c.checkIdentityHasAccess("machine", req, state, true)
+	assert.NoError(t, err)
+	assert.False(t, hasAccess)
+	// the next review isn't needed once one is denied
+	assert.Len(t, cl.resourceAttributes(), 4)
+}
+
+func TestSyncAutomationTokenData(t *testing.T) {
+	data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+	c := testController("", data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	c.automationPolicy = AutomationPolicy{TokenTtl: time.Hour}
+
+	exchange := &exchangeResult{
+		exchangeState: exchangeState{
+			AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "token", TokenNamespace: "default"},
+			Automation:          true,
+		},
+		token: &oauth2.Token{AccessToken: "new-access", RefreshToken: "new-refresh"},
+	}
+	now := time.Now()
+	c.applyAutomationPolicy(exchange, now)
+	assert.True(t, exchange.restricted)
+
+	assert.NoError(t, c.syncTokenData(context.TODO(), exchange))
+	assert.Equal(t, "new-access", data["default/token"].AccessToken)
+	assert.Empty(t, data["default/token"].RefreshToken)
+	assert.Equal(t, uint64(now.Add(time.Hour).Unix()), data["default/token"].Expiry)
+
+	accessToken := &v1beta1.SPIAccessToken{}
+	assert.NoError(t, c.K8sClient.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "default"}, accessToken))
+	assert.Equal(t, "true", accessToken.Labels[AutomationLabel])
+}
+
+func TestSyncHumanTokenData(t *testing.T) {
+	data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+	c := testController("", data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	c.automationPolicy = AutomationPolicy{TokenTtl: time.Hour}
+
+	exchange := &exchangeResult{
+		exchangeState: exchangeState{
+			AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "token", TokenNamespace: "default"},
+		},
+		token: &oauth2.Token{AccessToken: "new-access"},
+	}
+	c.applyAutomationPolicy(exchange, time.Now())
+	assert.False(t, exchange.restricted)
+
+	assert.NoError(t, c.syncTokenData(context.TODO(), exchange))
+	assert.Equal(t, "old-refresh", data["default/token"].RefreshToken)
+
+	accessToken := &v1beta1.SPIAccessToken{}
+	assert.NoError(t, c.K8sClient.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "default"}, accessToken))
+	assert.NotContains(t, accessToken.Labels, AutomationLabel)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// validateCallbackUrl checks that the configured callback URL of the service provider is an absolute HTTP(S) URL
+// without a query or a fragment, which the service providers don't allow in the registered redirect URLs.
+func validateCallbackUrl(callbackUrl string) error {
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("the callback URL is not an absolute URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme '%s' of the callback URL", u.Scheme)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("the callback URL cannot contain a query or a fragment")
+	}
+	return nil
+}
+
+// callbackBounceUrl returns the URL of the callback endpoint on the base URL of the service if the request arrived
+// on the host of the configured callback URL that differs from the host of the base URL. The browser doesn't send
+// the session cookie to the other host, so the callback needs to be finished on the base URL. The query, including
+// the state and the authorization code, is kept as is. The code is still exchanged using the configured callback URL
+// as the redirect URL, because that is the one the authorization was requested with.
+func (c *commonController) callbackBounceUrl(r *http.Request) (string, bool) {
+	if c.callbackUrl == "" {
+		return "", false
+	}
+
+	callback, err := url.Parse(c.callbackUrl)
+	if err != nil {
+		return "", false
+	}
+	base, err := url.Parse(c.BaseUrl)
+	if err != nil || strings.EqualFold(callback.Host, base.Host) {
+		return "", false
+	}
+
+	host := r.Host
+	if fwdBase, _, _, ok := c.TrustedProxies.forwardedBase(r); ok {
+		host = strings.TrimPrefix(strings.TrimPrefix(fwdBase, "https://"), "http://")
+	}
+	if !strings.EqualFold(host, callback.Host) {
+		return "", false
+	}
+
+	target := strings.TrimSuffix(c.BaseUrl, "/") + c.PathPrefix + "/" + strings.ToLower(string(c.Config.ServiceProviderType)) + "/callback"
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	return target, true
+}
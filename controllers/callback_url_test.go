@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCallbackUrl(t *testing.T) {
+	assert.NoError(t, validateCallbackUrl("https://oauth.example.com/github/callback"))
+	assert.NoError(t, validateCallbackUrl("http://localhost:8000/callback"))
+	assert.Error(t, validateCallbackUrl("/github/callback"))
+	assert.Error(t, validateCallbackUrl("ftp://oauth.example.com/callback"))
+	assert.Error(t, validateCallbackUrl("https://oauth.example.com/callback?x=y"))
+	assert.Error(t, validateCallbackUrl("https://oauth.example.com/callback#x"))
+	assert.Error(t, validateCallbackUrl("https://%zz"))
+}
+
+func TestConfiguredCallbackUrl(t *testing.T) {
+	cfg := OAuthServiceConfiguration{
+		FileConfiguration: FileConfiguration{
+			Configuration: config.Configuration{BaseUrl: "https://spi.on.my.machine"},
+			PersistedServiceConfiguration: PersistedServiceConfiguration{
+				ServiceProviderExtensions: []ServiceProviderExtensions{{
+					Type:        config.ServiceProviderTypeGitHub,
+					CallbackUrl: "https://oauth.registered.domain/spi/github/callback",
+				}},
+			},
+		},
+	}
+	spConfig := config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+		ClientId:            "id",
+		ClientSecret:        "secret",
+	}
+
+	c, err := FromConfiguration(cfg, spConfig, nil, nil, nil, nil)
+	assert.NoError(t, err)
+
+	cc := c.(*commonController)
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "https://oauth.registered.domain/spi/github/callback", cc.redirectUrl(r))
+	assert.Equal(t, "https://spi.on.my.machine/github/authenticate", cc.authenticateUrl(r))
+
+	cfg.ServiceProviderExtensions[0].CallbackUrl = "oauth.registered.domain/callback"
+	_, err = FromConfiguration(cfg, spConfig, nil, nil, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestCallbackBounceUrl(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.1"})
+	assert.NoError(t, err)
+	c := &commonController{
+		Config:         config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		BaseUrl:        "https://spi.on.my.machine/",
+		PathPrefix:     "/api",
+		TrustedProxies: proxies,
+		callbackUrl:    "https://oauth.registered.domain/spi/github/callback",
+	}
+
+	t.Run("callback host", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "https://oauth.registered.domain/spi/github/callback?state=s&code=c", nil)
+		target, ok := c.callbackBounceUrl(r)
+		assert.True(t, ok)
+		assert.Equal(t, "https://spi.on.my.machine/api/github/callback?state=s&code=c", target)
+	})
+
+	t.Run("forwarded callback host", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/api/github/callback?state=s", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-Host", "oauth.registered.domain")
+		target, ok := c.callbackBounceUrl(r)
+		assert.True(t, ok)
+		assert.Equal(t, "https://spi.on.my.machine/api/github/callback?state=s", target)
+	})
+
+	t.Run("base host", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "https://spi.on.my.machine/api/github/callback?state=s", nil)
+		_, ok := c.callbackBounceUrl(r)
+		assert.False(t, ok)
+	})
+
+	t.Run("same host", func(t *testing.T) {
+		sameHost := *c
+		sameHost.callbackUrl = "https://spi.on.my.machine/other/github/callback"
+		r := httptest.NewRequest("GET", "https://spi.on.my.machine/other/github/callback?state=s", nil)
+		_, ok := sameHost.callbackBounceUrl(r)
+		assert.False(t, ok)
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		notConfigured := *c
+		notConfigured.callbackUrl = ""
+		r := httptest.NewRequest("GET", "https://oauth.registered.domain/spi/github/callback?state=s", nil)
+		_, ok := notConfigured.callbackBounceUrl(r)
+		assert.False(t, ok)
+	})
+
+	t.Run("callback redirects", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "https://oauth.registered.domain/spi/github/callback?state=s&code=c", nil)
+		res := httptest.NewRecorder()
+		c.Callback(r.Context(), res, r)
+		assert.Equal(t, http.StatusFound, res.Code)
+		assert.Equal(t, "https://spi.on.my.machine/api/github/callback?state=s&code=c", res.Header().Get("Location"))
+	})
+}
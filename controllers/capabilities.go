@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// The capabilities of the tokens relevant to SPI. They are recorded with the stored token so that the tokens usable
+// for a request can be found without probing the service provider again.
+const (
+	// CapabilityPush means the token can push to the repositories.
+	CapabilityPush = "push"
+	// CapabilityReadPrivate means the token can read the private repositories.
+	CapabilityReadPrivate = "read_private"
+	// CapabilityCreateWebhooks means the token can create the webhooks of the repositories.
+	CapabilityCreateWebhooks = "create_webhooks"
+)
+
+// githubUserApiUrl is the GitHub API endpoint reporting the scopes of the token in the X-OAuth-Scopes header.
+const githubUserApiUrl = "https://api.github.com/user"
+
+// capabilityProbeTimeout limits the duration of probing the capabilities of the token, so that the callback is not
+// held up by a slow service provider for long.
+const capabilityProbeTimeout = 5 * time.Second
+
+// capabilityScopes lists for each service provider and capability the scopes, any of which grants the capability.
+// The broader scopes granting the listed ones are taken into account (see scopeGranted).
+var capabilityScopes = map[config.ServiceProviderType]map[string][]string{
+	config.ServiceProviderTypeGitHub: {
+		CapabilityPush:           {"repo", "public_repo"},
+		CapabilityReadPrivate:    {"repo"},
+		CapabilityCreateWebhooks: {"repo", "write:repo_hook"},
+	},
+	config.ServiceProviderTypeQuay: {
+		CapabilityPush:           {"repo:write"},
+		CapabilityReadPrivate:    {"repo:read"},
+		CapabilityCreateWebhooks: {"repo:admin"},
+	},
+}
+
+// capabilitiesFromScopes returns the capabilities granted by the scopes of the token, in the order of the capability
+// constants. The result is never nil.
+func capabilitiesFromScopes(spType config.ServiceProviderType, scopes []string) []string {
+	capabilities := []string{}
+	for _, capability := range []string{CapabilityPush, CapabilityReadPrivate, CapabilityCreateWebhooks} {
+		for _, scope := range capabilityScopes[spType][capability] {
+			if scopeGranted(scope, scopes) {
+				capabilities = append(capabilities, capability)
+				break
+			}
+		}
+	}
+	return capabilities
+}
+
+// probeCapabilities determines the capabilities of the token obtained in the OAuth flow. If the service provider can
+// report the actual scopes of the token (e.g. GitHub in the X-OAuth-Scopes header), they are asked for. Otherwise, or if
+// the probe fails, the capabilities are derived from the scopes granted in the token response.
+func (c commonController) probeCapabilities(ctx context.Context, token *oauth2.Token, requestedScopes []string) []string {
+	scopes := grantedScopes(token, requestedScopes)
+
+	if c.capabilityProbeUrl != "" {
+		probed, err := c.probeScopes(ctx, token)
+		switch {
+		case err != nil:
+			LoggerFromContext(ctx).Warn("failed to probe the scopes of the token, using the granted scopes to determine its capabilities", zap.Error(err))
+		case probed != nil:
+			scopes = probed
+		}
+	}
+
+	capabilities := capabilitiesFromScopes(c.Config.ServiceProviderType, scopes)
+	LoggerFromContext(ctx).Debug("determined the capabilities of the token", zap.Strings("capabilities", capabilities))
+	return capabilities
+}
+
+// probeScopes asks the service provider for the scopes of the token. Nil is returned if the service provider doesn't
+// report them, e.g. for the tokens of the GitHub apps.
+func (c commonController) probeScopes(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.capabilityProbeUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(req)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.providerHttpClient(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d of the probe", res.StatusCode)
+	}
+	if _, ok := res.Header[http.CanonicalHeaderKey("X-OAuth-Scopes")]; !ok {
+		return nil, nil
+	}
+	return parseGrantedScopes(res.Header.Get("X-OAuth-Scopes")), nil
+}
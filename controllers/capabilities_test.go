@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestCapabilitiesFromScopes(t *testing.T) {
+	assert.Equal(t, []string{CapabilityPush, CapabilityReadPrivate, CapabilityCreateWebhooks}, capabilitiesFromScopes(config.ServiceProviderTypeGitHub, []string{"repo"}))
+	assert.Equal(t, []string{CapabilityPush}, capabilitiesFromScopes(config.ServiceProviderTypeGitHub, []string{"public_repo", "user"}))
+	assert.Equal(t, []string{CapabilityCreateWebhooks}, capabilitiesFromScopes(config.ServiceProviderTypeGitHub, []string{"admin:repo_hook"}))
+	assert.Equal(t, []string{CapabilityPush, CapabilityReadPrivate}, capabilitiesFromScopes(config.ServiceProviderTypeQuay, []string{"repo:write"}))
+	assert.Equal(t, []string{CapabilityPush, CapabilityReadPrivate, CapabilityCreateWebhooks}, capabilitiesFromScopes(config.ServiceProviderTypeQuay, []string{"repo:admin"}))
+	assert.Equal(t, []string{}, capabilitiesFromScopes(config.ServiceProviderTypeGitHub, nil))
+	assert.Equal(t, []string{}, capabilitiesFromScopes("Unknown", []string{"repo"}))
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	scopesHeader := ""
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer access", r.Header.Get("Authorization"))
+		if scopesHeader != "-" {
+			w.Header().Set("X-OAuth-Scopes", scopesHeader)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	c := commonController{
+		Config:             config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		capabilityProbeUrl: server.URL,
+	}
+	token := (&oauth2.Token{AccessToken: "access", TokenType: "bearer"}).WithExtra(map[string]interface{}{"scope": "repo"})
+
+	t.Run("probed scopes", func(t *testing.T) {
+		scopesHeader, status = "public_repo, read:user", http.StatusOK
+		assert.Equal(t, []string{CapabilityPush}, c.probeCapabilities(context.TODO(), token, nil))
+	})
+
+	t.Run("no scopes", func(t *testing.T) {
+		scopesHeader, status = "", http.StatusOK
+		assert.Equal(t, []string{}, c.probeCapabilities(context.TODO(), token, nil))
+	})
+
+	t.Run("scopes not reported", func(t *testing.T) {
+		scopesHeader, status = "-", http.StatusOK
+		assert.Len(t, c.probeCapabilities(context.TODO(), token, nil), 3)
+	})
+
+	t.Run("failed probe", func(t *testing.T) {
+		scopesHeader, status = "public_repo", http.StatusUnauthorized
+		assert.Len(t, c.probeCapabilities(context.TODO(), token, nil), 3)
+	})
+
+	t.Run("provider client", func(t *testing.T) {
+		c := c
+		c.capabilityProbeUrl = "https://probe.invalid/user"
+		c.tokenEndpointClient = &http.Client{Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+			assert.Equal(t, "probe.invalid", r.URL.Host)
+			header := http.Header{}
+			header.Set("X-OAuth-Scopes", "public_repo")
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(strings.NewReader("{}")), Request: r}, nil
+		})}
+		assert.Equal(t, []string{CapabilityPush}, c.probeCapabilities(context.TODO(), token, nil))
+	})
+
+	t.Run("no probe", func(t *testing.T) {
+		c := commonController{Config: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeQuay}}
+		assert.Equal(t, []string{CapabilityPush, CapabilityReadPrivate}, c.probeCapabilities(context.TODO(), &oauth2.Token{AccessToken: "access"}, []string{"repo:write"}))
+	})
+}
+
+func TestStoreTokenKeepsCapabilities(t *testing.T) {
+	artifacts := testArtifactStorage{}
+	c := testController("", nil, artifacts)
+	owner := lookupTestToken("token", "github.com", "")
+
+	assert.NoError(t, c.storeTokenData(context.TODO(), owner, &oauth2.Token{AccessToken: "a1"}, nil, []string{CapabilityPush}, ""))
+	assert.Equal(t, []string{CapabilityPush}, artifacts["default/token"].Capabilities)
+
+	// refreshed
+	assert.NoError(t, c.storeTokenData(context.TODO(), owner, &oauth2.Token{AccessToken: "a2"}, nil, nil, ""))
+	assert.Equal(t, "a2", artifacts["default/token"].Value)
+	assert.Equal(t, []string{CapabilityPush}, artifacts["default/token"].Capabilities)
+
+	// obtained in a new flow
+	assert.NoError(t, c.storeTokenData(context.TODO(), owner, &oauth2.Token{AccessToken: "a3"}, nil, []string{}, ""))
+	assert.Empty(t, artifacts["default/token"].Capabilities)
+}
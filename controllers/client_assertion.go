@@ -0,0 +1,229 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"golang.org/x/oauth2"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// clientAssertionType is the type of the client assertions as defined in RFC 7523.
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionTtl is the lifetime of the client assertions. They are only used once, right after they are created.
+const clientAssertionTtl = 5 * time.Minute
+
+// clientAssertions creates the JWT client assertions used to authenticate with the token endpoint of the service
+// provider using the private_key_jwt method.
+type clientAssertions struct {
+	cfg  ClientAuthentication
+	fips bool
+}
+
+// newClientAssertions validates the client authentication configuration and returns the client assertions creator.
+// Nil is returned if the configured method doesn't use the client assertions. In the FIPS mode, only the approved
+// signing algorithms and keys are accepted.
+func newClientAssertions(cfg ClientAuthentication, fips bool) (*clientAssertions, error) {
+	switch cfg.Method {
+	case "", ClientSecretBasic, ClientSecretPost, TlsClientAuth, SelfSignedTlsClientAuth:
+		return nil, nil
+	case PrivateKeyJwt:
+	default:
+		return nil, fmt.Errorf("unsupported client authentication method '%s'", cfg.Method)
+	}
+
+	if (cfg.PrivateKeyPath == "") == (cfg.PrivateKey == "") {
+		return nil, fmt.Errorf("exactly one of privateKeyPath and privateKey must be specified for the %s client authentication", PrivateKeyJwt)
+	}
+
+	ca := &clientAssertions{cfg: cfg, fips: fips}
+	// check that the key and the certificate can be used
+	if _, err := ca.signer(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// authStyle returns the style of sending the client credentials to the token endpoint.
+func authStyle(cfg ClientAuthentication) oauth2.AuthStyle {
+	switch cfg.Method {
+	case ClientSecretBasic:
+		return oauth2.AuthStyleInHeader
+	case ClientSecretPost, PrivateKeyJwt, TlsClientAuth, SelfSignedTlsClientAuth:
+		return oauth2.AuthStyleInParams
+	default:
+		return oauth2.AuthStyleAutoDetect
+	}
+}
+
+// exchangeOptions returns the parameters of the token request authenticating the client with the token endpoint.
+func (ca *clientAssertions) exchangeOptions(clientId string, tokenUrl string, now time.Time) ([]oauth2.AuthCodeOption, error) {
+	assertion, err := ca.assertion(clientId, tokenUrl, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("client_assertion_type", clientAssertionType),
+		oauth2.SetAuthURLParam("client_assertion", assertion),
+	}, nil
+}
+
+// assertion creates the signed client assertion. The audience defaults to the URL of the token endpoint, which is also
+// accepted by the pushed authorization request endpoints.
+func (ca *clientAssertions) assertion(clientId string, tokenUrl string, now time.Time) (string, error) {
+	signer, err := ca.signer()
+	if err != nil {
+		return "", err
+	}
+
+	audience := ca.cfg.Audience
+	if audience == "" {
+		audience = tokenUrl
+	}
+
+	assertion, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:    clientId,
+		Subject:   clientId,
+		Audience:  jwt.Audience{audience},
+		ID:        string(uuid.NewUUID()),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(clientAssertionTtl)),
+	}).CompactSerialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the client assertion: %w", err)
+	}
+	return assertion, nil
+}
+
+// signer loads the private key (and the certificate) and creates the signer of the client assertions.
+func (ca *clientAssertions) signer() (jose.Signer, error) {
+	keyPem := []byte(ca.cfg.PrivateKey)
+	if ca.cfg.PrivateKeyPath != "" {
+		var err error
+		if keyPem, err = ioutil.ReadFile(ca.cfg.PrivateKeyPath); err != nil {
+			return nil, fmt.Errorf("failed to read the private key for the client assertions: %w", err)
+		}
+	}
+
+	key, err := parsePrivateKey(keyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := signingAlgorithm(key, ca.cfg.SigningAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if ca.fips {
+		if err := validateFipsSigningKey(key, alg); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if ca.cfg.KeyId != "" {
+		opts = opts.WithHeader("kid", ca.cfg.KeyId)
+	}
+	if ca.cfg.CertificatePath != "" {
+		thumbprint, err := certificateThumbprint(ca.cfg.CertificatePath)
+		if err != nil {
+			return nil, err
+		}
+		opts = opts.WithHeader("x5t", thumbprint)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the signer of the client assertions using the %s algorithm: %w", alg, err)
+	}
+	return signer, nil
+}
+
+// parsePrivateKey parses the PEM-encoded RSA or EC private key either in the PKCS#8 or the algorithm-specific format.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM-encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported type of the private key")
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("failed to parse the private key, only RSA and EC keys are supported")
+}
+
+// signingAlgorithm returns the configured signing algorithm or the default one for the key.
+func signingAlgorithm(key crypto.Signer, configured string) (jose.SignatureAlgorithm, error) {
+	if configured != "" {
+		return jose.SignatureAlgorithm(configured), nil
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	}
+	return "", fmt.Errorf("no default signing algorithm for the private key, configure the signingAlgorithm explicitly")
+}
+
+// certificateThumbprint computes the x5t thumbprint of the first certificate in the PEM file.
+func certificateThumbprint(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the certificate for the client assertions: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no PEM-encoded certificate found in %s", path)
+	}
+
+	// the x5t header is defined as the SHA-1 thumbprint of the DER-encoded certificate
+	thumbprint := sha1.Sum(block.Bytes)
+	return base64.RawURLEncoding.EncodeToString(thumbprint[:]), nil
+}
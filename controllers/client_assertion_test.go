@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func writeRsaKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return key, path
+}
+
+func parseAssertion(t *testing.T, opts []oauth2.AuthCodeOption, key interface{}) (*jwt.JSONWebToken, jwt.Claims) {
+	cfg := oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://sp/authorize"}}
+	u, err := http.NewRequest("GET", cfg.AuthCodeURL("state", opts...), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, clientAssertionType, u.URL.Query().Get("client_assertion_type"))
+
+	parsed, err := jwt.ParseSigned(u.URL.Query().Get("client_assertion"))
+	assert.NoError(t, err)
+	claims := jwt.Claims{}
+	assert.NoError(t, parsed.Claims(key, &claims))
+	return parsed, claims
+}
+
+func TestClientAssertionsRsa(t *testing.T) {
+	key, path := writeRsaKey(t)
+
+	ca, err := newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: path, KeyId: "my-key"}, false)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	opts, err := ca.exchangeOptions("client-id", "https://sp/token", now)
+	assert.NoError(t, err)
+
+	parsed, claims := parseAssertion(t, opts, &key.PublicKey)
+	assert.Equal(t, string(jose.RS256), parsed.Headers[0].Algorithm)
+	assert.Equal(t, "my-key", parsed.Headers[0].KeyID)
+	assert.Equal(t, "client-id", claims.Issuer)
+	assert.Equal(t, "client-id", claims.Subject)
+	assert.Equal(t, jwt.Audience{"https://sp/token"}, claims.Audience)
+	assert.NotEmpty(t, claims.ID)
+	assert.NoError(t, claims.Validate(jwt.Expected{Time: now.Add(time.Minute)}))
+	assert.Error(t, claims.Validate(jwt.Expected{Time: now.Add(10 * time.Minute)}))
+}
+
+func TestClientAssertionsEc(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	certDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "client"}, NotAfter: time.Now().Add(time.Hour)},
+		&x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "client"}}, &key.PublicKey, key)
+	assert.NoError(t, err)
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	assert.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600))
+
+	ca, err := newClientAssertions(ClientAuthentication{
+		Method:          PrivateKeyJwt,
+		PrivateKey:      string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		Audience:        "https://login.example.com",
+		CertificatePath: certPath,
+	}, false)
+	assert.NoError(t, err)
+
+	opts, err := ca.exchangeOptions("client-id", "https://sp/token", time.Now())
+	assert.NoError(t, err)
+
+	parsed, claims := parseAssertion(t, opts, &key.PublicKey)
+	assert.Equal(t, string(jose.ES384), parsed.Headers[0].Algorithm)
+	assert.NotEmpty(t, parsed.Headers[0].ExtraHeaders["x5t"])
+	assert.Equal(t, jwt.Audience{"https://login.example.com"}, claims.Audience)
+}
+
+func TestClientAssertionsValidation(t *testing.T) {
+	_, path := writeRsaKey(t)
+
+	ca, err := newClientAssertions(ClientAuthentication{}, false)
+	assert.NoError(t, err)
+	assert.Nil(t, ca)
+
+	ca, err = newClientAssertions(ClientAuthentication{Method: ClientSecretPost}, false)
+	assert.NoError(t, err)
+	assert.Nil(t, ca)
+
+	_, err = newClientAssertions(ClientAuthentication{Method: "client_secret_jwt"}, false)
+	assert.Error(t, err)
+
+	_, err = newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt}, false)
+	assert.Error(t, err)
+
+	_, err = newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: path, PrivateKey: "key"}, false)
+	assert.Error(t, err)
+
+	_, err = newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: filepath.Join(t.TempDir(), "nonexistent")}, false)
+	assert.Error(t, err)
+
+	_, err = newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: path, SigningAlgorithm: "ES256"}, false)
+	assert.Error(t, err)
+
+	_, err = newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: path, SigningAlgorithm: "PS256"}, false)
+	assert.NoError(t, err)
+}
+
+func TestClientAssertionsInTokenRequest(t *testing.T) {
+	_, path := writeRsaKey(t)
+	ca, err := newClientAssertions(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: path}, false)
+	assert.NoError(t, err)
+
+	var form map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		form = r.PostForm
+		_, hasBasicAuth := r.Header["Authorization"]
+		assert.False(t, hasBasicAuth)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "token", "token_type": "bearer"}`))
+	}))
+	defer srv.Close()
+
+	cfg := oauth2.Config{
+		ClientID: "client-id",
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: authStyle(ClientAuthentication{Method: PrivateKeyJwt})},
+	}
+	opts, err := ca.exchangeOptions(cfg.ClientID, cfg.Endpoint.TokenURL, time.Now())
+	assert.NoError(t, err)
+
+	token, err := cfg.Exchange(context.TODO(), "code", opts...)
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	assert.Equal(t, []string{"client-id"}, form["client_id"])
+	assert.Equal(t, []string{clientAssertionType}, form["client_assertion_type"])
+	assert.NotEmpty(t, form["client_assertion"])
+	assert.NotContains(t, form, "client_secret")
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// newTokenEndpointClient creates the HTTP client presenting the configured TLS client certificate to the token
+// endpoint of the service provider. Nil is returned if no certificate is configured.
+func newTokenEndpointClient(cfg ClientAuthentication) (*http.Client, error) {
+	requiresCertificate := cfg.Method == TlsClientAuth || cfg.Method == SelfSignedTlsClientAuth
+	if cfg.TlsCertificatePath == "" && cfg.TlsKeyPath == "" {
+		if requiresCertificate {
+			return nil, fmt.Errorf("the tlsCertificatePath and tlsKeyPath must be specified for the %s client authentication", cfg.Method)
+		}
+		if cfg.TlsCaPath != "" {
+			return nil, fmt.Errorf("the tlsCaPath can only be used together with the client certificate")
+		}
+		return nil, nil
+	}
+	if cfg.TlsCertificatePath == "" || cfg.TlsKeyPath == "" {
+		return nil, fmt.Errorf("both the tlsCertificatePath and tlsKeyPath must be specified")
+	}
+
+	loadCertificate := func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(cfg.TlsCertificatePath, cfg.TlsKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the TLS client certificate: %w", err)
+		}
+		return &cert, nil
+	}
+	// fail early on a misconfiguration
+	if _, err := loadCertificate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loadCertificate()
+		},
+	}
+
+	if cfg.TlsCaPath != "" {
+		caData, err := ioutil.ReadFile(cfg.TlsCaPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle of the token endpoint: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in the CA bundle of the token endpoint")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return newProviderClient(tlsConfig), nil
+}
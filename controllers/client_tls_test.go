@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func writeClientCertificate(t *testing.T) (certPath string, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "spi-oauth"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath = filepath.Join(dir, "tls.crt")
+	keyPath = filepath.Join(dir, "tls.key")
+	assert.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func TestTokenEndpointClientMutualTls(t *testing.T) {
+	certPath, keyPath := writeClientCertificate(t)
+
+	var form map[string][]string
+	var clientCN string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		form = r.PostForm
+		clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "token", "token_type": "bearer"}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	clientAuth := ClientAuthentication{Method: TlsClientAuth, TlsCertificatePath: certPath, TlsKeyPath: keyPath, TlsCaPath: caPath}
+	cl, err := newTokenEndpointClient(clientAuth)
+	assert.NoError(t, err)
+	assert.NotNil(t, cl)
+
+	cfg := oauth2.Config{ClientID: "client-id", Endpoint: oauth2.Endpoint{TokenURL: srv.URL, AuthStyle: authStyle(clientAuth)}}
+	token, err := cfg.Exchange(context.WithValue(context.TODO(), oauth2.HTTPClient, cl), "code")
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	assert.Equal(t, "spi-oauth", clientCN)
+	assert.Equal(t, []string{"client-id"}, form["client_id"])
+	assert.NotContains(t, form, "client_secret")
+}
+
+func TestTokenEndpointClientValidation(t *testing.T) {
+	certPath, keyPath := writeClientCertificate(t)
+
+	cl, err := newTokenEndpointClient(ClientAuthentication{})
+	assert.NoError(t, err)
+	assert.Nil(t, cl)
+
+	// the certificate can complement the other methods
+	cl, err = newTokenEndpointClient(ClientAuthentication{Method: ClientSecretPost, TlsCertificatePath: certPath, TlsKeyPath: keyPath})
+	assert.NoError(t, err)
+	assert.NotNil(t, cl)
+
+	_, err = newTokenEndpointClient(ClientAuthentication{Method: SelfSignedTlsClientAuth})
+	assert.Error(t, err)
+
+	_, err = newTokenEndpointClient(ClientAuthentication{TlsCertificatePath: certPath})
+	assert.Error(t, err)
+
+	_, err = newTokenEndpointClient(ClientAuthentication{TlsCaPath: certPath})
+	assert.Error(t, err)
+
+	_, err = newTokenEndpointClient(ClientAuthentication{TlsCertificatePath: keyPath, TlsKeyPath: certPath})
+	assert.Error(t, err)
+
+	_, err = newTokenEndpointClient(ClientAuthentication{TlsCertificatePath: certPath, TlsKeyPath: keyPath, TlsCaPath: keyPath})
+	assert.Error(t, err)
+}
+
+func TestUsesClientSecret(t *testing.T) {
+	assert.True(t, usesClientSecret(""))
+	assert.True(t, usesClientSecret(ClientSecretBasic))
+	assert.False(t, usesClientSecret(PrivateKeyJwt))
+	assert.False(t, usesClientSecret(TlsClientAuth))
+	assert.False(t, usesClientSecret(SelfSignedTlsClientAuth))
+}
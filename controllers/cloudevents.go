@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	// cloudEventsTypePrefix is prepended to the FlowEventType to form the type of the CloudEvent.
+	cloudEventsTypePrefix = "com.redhat.appstudio.spi.oauth."
+
+	// DefaultCloudEventsSource is the source of the CloudEvents if none is configured.
+	DefaultCloudEventsSource = "/spi-oauth"
+
+	cloudEventsQueueSize  = 1000
+	cloudEventsMaxRetries = 3
+	cloudEventsRetryDelay = 200 * time.Millisecond
+)
+
+// cloudEvent is the CloudEvents 1.0 envelope in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	Id              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            FlowEvent `json:"data"`
+}
+
+// CloudEventsPublisher sends the flow events as CloudEvents to an HTTP sink, e.g. a Knative broker or a KafkaSink.
+// The events are sent asynchronously in the order they were published. If the sink cannot keep up, the events that
+// don't fit into the queue are dropped.
+type CloudEventsPublisher struct {
+	sink   string
+	source string
+	client *http.Client
+	queue  chan FlowEvent
+}
+
+var _ FlowEventPublisher = (*CloudEventsPublisher)(nil)
+
+// NewCloudEventsPublisher creates the publisher sending the events to the provided sink URL with the provided source
+// attribute. DefaultCloudEventsSource is used if the source is empty. Start must be called for the events to be sent.
+func NewCloudEventsPublisher(sink string, source string) (*CloudEventsPublisher, error) {
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL of the events sink: %w", err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return nil, fmt.Errorf("the URL of the events sink must be absolute")
+	}
+
+	if source == "" {
+		source = DefaultCloudEventsSource
+	}
+
+	return &CloudEventsPublisher{
+		sink:   sink,
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan FlowEvent, cloudEventsQueueSize),
+	}, nil
+}
+
+// Publish enqueues the event to be sent to the sink.
+func (p *CloudEventsPublisher) Publish(event FlowEvent) {
+	select {
+	case p.queue <- event:
+	default:
+		zap.L().Warn("the queue of the CloudEvents is full, dropping the event", zap.String("type", string(event.Type)))
+	}
+}
+
+// Start starts sending the published events to the sink in the background until the context is done.
+func (p *CloudEventsPublisher) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-p.queue:
+				if err := p.sendWithRetries(ctx, event); err != nil {
+					zap.L().Warn("failed to send the CloudEvent", zap.String("type", string(event.Type)), zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+func (p *CloudEventsPublisher) sendWithRetries(ctx context.Context, event FlowEvent) error {
+	envelope := p.envelope(event)
+
+	var err error
+	for attempt := 0; attempt < cloudEventsMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(cloudEventsRetryDelay << (attempt - 1)):
+			}
+		}
+
+		var retry bool
+		if retry, err = p.send(ctx, &envelope); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// envelope wraps the event in the CloudEvents envelope.
+func (p *CloudEventsPublisher) envelope(event FlowEvent) cloudEvent {
+	subject := ""
+	if event.TokenName != "" {
+		subject = event.TokenNamespace + "/" + event.TokenName
+	}
+
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		Id:              string(uuid.NewUUID()),
+		Source:          p.source,
+		Type:            cloudEventsTypePrefix + string(event.Type),
+		Subject:         subject,
+		Time:            event.Time.UTC(),
+		DataContentType: "application/json",
+		Data:            event,
+	}
+}
+
+// send posts the event to the sink. It returns whether it makes sense to retry if the sending fails.
+func (p *CloudEventsPublisher) send(ctx context.Context, envelope *cloudEvent) (bool, error) {
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.sink, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("the events sink responded with %d", resp.StatusCode)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCloudEventsPublisher(t *testing.T) {
+	p, err := NewCloudEventsPublisher("https://broker.local/ns/default", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultCloudEventsSource, p.source)
+
+	_, err = NewCloudEventsPublisher("/relative", "")
+	assert.Error(t, err)
+
+	_, err = NewCloudEventsPublisher("://", "")
+	assert.Error(t, err)
+}
+
+func TestCloudEventsPublisher(t *testing.T) {
+	lock := sync.Mutex{}
+	var received []map[string]interface{}
+	var contentType string
+	failures := 1
+
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		contentType = r.Header.Get("Content-Type")
+		event := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received = append(received, event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer sink.Close()
+
+	p, err := NewCloudEventsPublisher(sink.URL, "/test")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	p.Start(ctx)
+
+	p.Publish(FlowEvent{
+		Type:            ExchangeCompletedEvent,
+		Time:            time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		ServiceProvider: "GitHub",
+		TokenName:       "mytoken",
+		TokenNamespace:  "default",
+		Scopes:          []string{"repo"},
+	})
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	event := received[0]
+	assert.Equal(t, "application/cloudevents+json; charset=utf-8", contentType)
+	assert.Equal(t, "1.0", event["specversion"])
+	assert.Equal(t, "/test", event["source"])
+	assert.Equal(t, "com.redhat.appstudio.spi.oauth.exchange.completed", event["type"])
+	assert.Equal(t, "default/mytoken", event["subject"])
+	assert.Equal(t, "2022-01-02T03:04:05Z", event["time"])
+	assert.NotEmpty(t, event["id"])
+	assert.Equal(t, map[string]interface{}{
+		"serviceProvider": "GitHub",
+		"tokenName":       "mytoken",
+		"tokenNamespace":  "default",
+		"scopes":          []interface{}{"repo"},
+	}, event["data"])
+}
+
+func TestCloudEventsPublisherDoesNotRetryClientErrors(t *testing.T) {
+	lock := sync.Mutex{}
+	requests := 0
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer sink.Close()
+
+	p, err := NewCloudEventsPublisher(sink.URL, "")
+	assert.NoError(t, err)
+
+	envelope := p.envelope(FlowEvent{Type: FlowStartedEvent})
+	assert.Error(t, p.sendWithRetries(context.TODO(), FlowEvent{Type: FlowStartedEvent}))
+	assert.Empty(t, envelope.Subject)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 1, requests)
+}
+
+func TestCloudEventsPublisherDropsEventsWhenFull(t *testing.T) {
+	p, err := NewCloudEventsPublisher("https://broker.local", "")
+	assert.NoError(t, err)
+
+	// not started so nothing consumes the queue
+	for i := 0; i < cloudEventsQueueSize+10; i++ {
+		p.Publish(FlowEvent{Type: FlowStartedEvent})
+	}
+	assert.Len(t, p.queue, cloudEventsQueueSize)
+}
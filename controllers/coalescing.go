@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var coalescedCallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "callback",
+	Name:      "coalesced_total",
+	Help:      "The number of the callbacks that shared the result of a concurrent callback with the same session, state and authorization code instead of repeating the exchange.",
+})
+
+func init() {
+	MetricsRegistry.MustRegister(coalescedCallbacks)
+}
+
+// callbackOutcome is the result of the processing of a callback shared by its concurrent duplicates.
+type callbackOutcome struct {
+	exchange exchangeResult
+	// exchangeErr is the error of the exchange of the authorization code.
+	exchangeErr error
+	// storeErr is the error of storing the obtained token.
+	storeErr error
+	// pending is true if the token failed to be stored and has been queued for storing later.
+	pending bool
+}
+
+// callbackGroup coalesces the concurrent callbacks with the same session, state and authorization code, e.g. after
+// a double-click or a prefetch by the browser. The authorization code can only be used once, so instead of racing on
+// it, the duplicates wait for the first callback and share its outcome. Only the callbacks in progress are
+// coalesced, the outcome is forgotten once the first callback is processed.
+type callbackGroup struct {
+	lock  sync.Mutex
+	calls map[string]*callbackCall
+}
+
+type callbackCall struct {
+	done    chan struct{}
+	outcome callbackOutcome
+	// duplicates is the number of the callbacks waiting for the outcome.
+	duplicates int
+}
+
+// callbackCoalescing coalesces the callbacks of all the service providers. It is shared by all the controllers so that
+// the duplicates are coalesced even across the configuration reloads.
+var callbackCoalescing = newCallbackGroup()
+
+func newCallbackGroup() *callbackGroup {
+	return &callbackGroup{calls: map[string]*callbackCall{}}
+}
+
+// do processes the callback identified by the key using the provided function unless a callback with the same key is
+// in progress, in which case its outcome is waited for. The returned flag is true if the outcome is shared.
+// The callbacks are not coalesced if the group is nil.
+func (g *callbackGroup) do(key string, process func() callbackOutcome) (callbackOutcome, bool) {
+	if g == nil {
+		return process(), false
+	}
+
+	g.lock.Lock()
+	if call, ok := g.calls[key]; ok {
+		call.duplicates++
+		g.lock.Unlock()
+		coalescedCallbacks.Inc()
+		<-call.done
+		return call.outcome, true
+	}
+	call := &callbackCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(call.done)
+	}()
+
+	call.outcome = process()
+	return call.outcome, false
+}
+
+// callbackKey identifies the duplicates of the callback. Only the callbacks in the same session are duplicates, so that
+// a callback replayed from another browser never shares the outcome of the flow of the user.
+func (c commonController) callbackKey(r *http.Request) string {
+	session := ""
+	if c.SessionManager != nil {
+		session = c.SessionManager.Load(r).Token()
+	}
+	return session + "\x00" + requestParam(r, "state") + "\x00" + requestParam(r, "code")
+}
+
+// detachedContext keeps the values of its parent but is never cancelled with it, so that the processing shared by
+// the duplicate callbacks isn't aborted when the client of the first one goes away, e.g. when the browser cancels
+// the first request of a double-click.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
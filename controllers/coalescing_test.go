@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackGroup(t *testing.T) {
+	t.Run("concurrent duplicates", func(t *testing.T) {
+		g := newCallbackGroup()
+		release := make(chan struct{})
+		var calls int32
+
+		process := func() callbackOutcome {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return callbackOutcome{exchangeErr: errors.New("code already used")}
+		}
+
+		first := make(chan callbackOutcome)
+		go func() {
+			outcome, shared := g.do("state\x00code", process)
+			assert.False(t, shared)
+			first <- outcome
+		}()
+		// wait for the first callback to start processing
+		for atomic.LoadInt32(&calls) == 0 {
+			runtime.Gosched()
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				outcome, shared := g.do("state\x00code", process)
+				assert.True(t, shared)
+				assert.EqualError(t, outcome.exchangeErr, "code already used")
+			}()
+		}
+
+		// the duplicates are waiting for the first callback
+		duplicates := func() int {
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			return g.calls["state\x00code"].duplicates
+		}
+		for duplicates() != 3 {
+			runtime.Gosched()
+		}
+		close(release)
+
+		assert.EqualError(t, (<-first).exchangeErr, "code already used")
+		wg.Wait()
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		assert.Empty(t, g.calls)
+	})
+
+	t.Run("sequential callbacks", func(t *testing.T) {
+		g := newCallbackGroup()
+		calls := 0
+		process := func() callbackOutcome {
+			calls++
+			return callbackOutcome{}
+		}
+
+		_, shared := g.do("key", process)
+		assert.False(t, shared)
+		_, shared = g.do("key", process)
+		assert.False(t, shared)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("nil group", func(t *testing.T) {
+		var g *callbackGroup
+		outcome, shared := g.do("key", func() callbackOutcome { return callbackOutcome{pending: true} })
+		assert.False(t, shared)
+		assert.True(t, outcome.pending)
+	})
+}
+
+func TestCallbackKey(t *testing.T) {
+	c := commonController{}
+	assert.Equal(t, c.callbackKey(httptest.NewRequest("GET", "/github/callback?state=s&code=c", nil)), c.callbackKey(httptest.NewRequest("GET", "/github/callback?code=c&state=s&scope=repo", nil)))
+	assert.NotEqual(t, c.callbackKey(httptest.NewRequest("GET", "/github/callback?state=s&code=c", nil)), c.callbackKey(httptest.NewRequest("GET", "/github/callback?state=s&code=d", nil)))
+
+	t.Run("sessions", func(t *testing.T) {
+		c.SessionManager = scs.NewManager(memstore.New(time.Hour))
+		inSession := func() *http.Request {
+			res := httptest.NewRecorder()
+			assert.NoError(t, c.SessionManager.Load(httptest.NewRequest("GET", "/", nil)).PutString(res, "key", "value"))
+			r := httptest.NewRequest("GET", "/github/callback?state=s&code=c", nil)
+			for _, cookie := range res.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+			return r
+		}
+
+		first := inSession()
+		assert.Equal(t, c.callbackKey(first), c.callbackKey(first))
+		// the same callback replayed in another session is not a duplicate
+		assert.NotEqual(t, c.callbackKey(first), c.callbackKey(inSession()))
+		assert.NotEqual(t, c.callbackKey(first), c.callbackKey(httptest.NewRequest("GET", "/github/callback?state=s&code=c", nil)))
+	})
+}
+
+func TestDetachedContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "value"))
+	cancel()
+
+	ctx := detachedContext{parent: parent}
+	assert.NoError(t, ctx.Err())
+	assert.Nil(t, ctx.Done())
+	assert.Equal(t, "value", ctx.Value(key{}))
+}
@@ -15,13 +15,16 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/alexedwards/scs"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
 	v1 "k8s.io/api/authorization/v1"
-	"k8s.io/apimachinery/pkg/util/uuid"
 
 	"strings"
 
@@ -40,10 +43,77 @@ type commonController struct {
 	JwtSigningSecret []byte
 	K8sClient        AuthenticatingClient
 	TokenStorage     tokenstorage.TokenStorage
+	ArtifactStorage  oauthstorage.ArtifactStorage
 	Endpoint         oauth2.Endpoint
 	BaseUrl          string
+	PathPrefix       string
+	TrustedProxies   TrustedProxies
 	SessionManager   *scs.Manager
-	RedirectTemplate *template.Template
+	Templates        *Templates
+	AuthorizedLinks  *AuthorizedLinks
+	AllowedOrigins   []string
+	ErrorPages       *ErrorPages
+	// OrganizationApps are the OAuth applications of the organizations keyed by the organization name.
+	OrganizationApps map[string]OrganizationApp
+	// RepositoryOrganization extracts the organization from the repository URL. Nil if the service provider doesn't
+	// support the organization applications.
+	RepositoryOrganization func(repositoryUrl string) string
+	stateCodecs            *stateCodecCache
+	// clientAssertions authenticate the token exchange using the private_key_jwt method. Nil if the client secret is
+	// used.
+	clientAssertions *clientAssertions
+	// clientAuthMethod is the configured method of the client authentication with the token endpoint.
+	clientAuthMethod string
+	// tokenEndpointClient is the HTTP client presenting the configured TLS client certificate to the token and
+	// the pushed authorization request endpoints. Nil if no certificate is configured.
+	tokenEndpointClient *http.Client
+	// pushedAuthorization configures the pushed authorization requests.
+	pushedAuthorization PushedAuthorization
+	// ConsentPreview enables the consent preview page shown before redirecting to the service provider.
+	ConsentPreview bool
+	// scopeDescriptions are the configured explanations of the scopes shown on the consent preview page.
+	scopeDescriptions map[string]string
+	// tokenValidation configures the checks of the tokens obtained from the service provider.
+	tokenValidation TokenValidation
+	// stateValidation configures the verification of the environment the OAuth states have been issued for.
+	stateValidation StateValidation
+	// maintenance is the maintenance window during which no new flows are started.
+	maintenance Maintenance
+	// callbackUrl is the configured redirect URL of the service provider. Empty if derived from the base URL.
+	callbackUrl string
+	// automationPolicy configures the restrictions of the automation flows.
+	automationPolicy AutomationPolicy
+	// capabilityProbeUrl is the API endpoint of the service provider reporting the actual scopes of the token. Empty if
+	// the capabilities of the tokens are derived from the scopes in the token response.
+	capabilityProbeUrl string
+	// clientSecretExpiresAt is the configured expiry of the client secret of the default OAuth application. Zero if
+	// not known.
+	clientSecretExpiresAt time.Time
+	// clientCertificates are the paths of the certificates authenticating the client keyed by the kind of
+	// the credential. Their expiry is checked by the credentials monitor.
+	clientCertificates map[string]string
+	// features switch the service provider and the features of its flows on and off.
+	features FeatureFlags
+	// discovery configures the discovery of the endpoints of the service provider from its metadata.
+	discovery ProviderDiscovery
+	// fips restricts the algorithms of the signatures of the ID tokens to the ones approved in the FIPS mode.
+	fips bool
+	// ProviderMetadata caches the metadata of the service provider if the discovery is configured.
+	ProviderMetadata *ProviderMetadataCache
+	// Events is the publisher of the flow events. Nil if the events are disabled.
+	Events FlowEventPublisher
+	// Stats aggregates the outcomes of the flows for the stats endpoint. Nil if not collected.
+	Stats *FlowStats
+	// Identities enrich the identities of the users recorded in the flow events and the logs. Nil if only
+	// the Kubernetes usernames are recorded.
+	Identities IdentityEnricher
+	// StorageRetries is the queue of the tokens to store later if the storage fails. Nil if the tokens failing to be
+	// stored are discarded.
+	StorageRetries *StorageRetryQueue
+	// Workers limit the concurrency of the stages of the callback processing. Nil if not limited.
+	Workers *WorkerPool
+	// Anonymous lets the users initiate the flows without their Kubernetes token. Nil if disabled.
+	Anonymous *AnonymousMode
 }
 
 // exchangeState is the state that we're sending out to the SP after checking the anonymous oauth state produced by
@@ -52,7 +122,102 @@ type commonController struct {
 // finishing the OAuth flow.
 type exchangeState struct {
 	oauthstate.AnonymousOAuthState
+	stateClaims
 	Key string `json:"key"`
+	// ResponseMode is the way the callback reports the result of the flow. If empty, the callback redirects, if equal
+	// to responseModeJson, the callback returns a JSON document.
+	ResponseMode string `json:"responseMode,omitempty"`
+	// BindingName is the name of the SPIAccessTokenBinding (in the namespace of the token) that initiated the OAuth
+	// flow. If set, the binding is annotated once the token data is stored so that the operator reconciles it
+	// immediately.
+	BindingName string `json:"bindingName,omitempty"`
+	// Workspace is the kcp workspace of the SPIAccessToken copied from the anonymous state.
+	Workspace string `json:"workspace,omitempty"`
+	// Organization is the organization whose OAuth application is used for the flow. Empty if the default application
+	// of the service provider is used.
+	Organization string `json:"organization,omitempty"`
+	// SuccessUrl is the URL the user is redirected to once the token is stored. Only the URLs of the allowed origins
+	// are accepted.
+	SuccessUrl string `json:"successUrl,omitempty"`
+	// FailureUrl is the URL the user is redirected to if the flow fails, with the error code and the correlation ID
+	// in the query. Only the URLs of the allowed origins are accepted.
+	FailureUrl string `json:"failureUrl,omitempty"`
+	// Automation marks the flow initiated by a service account. The obtained token is restricted by the automation
+	// policy and the SPIAccessToken is labeled with the AutomationLabel.
+	Automation bool `json:"automation,omitempty"`
+	// Deadline is the Unix time by which the flow must be finished. The calls made while processing the callback are
+	// aborted once it passes. Zero in the states issued before the deadlines were introduced.
+	Deadline int64 `json:"deadline,omitempty"`
+}
+
+// anonymousState is the anonymous OAuth state produced by the operator. In kcp-based deployments, the state also
+// carries the workspace in which the SPIAccessToken lives.
+type anonymousState struct {
+	oauthstate.AnonymousOAuthState
+	stateClaims
+	// Workspace is the logical cluster path of the kcp workspace of the SPIAccessToken. All the requests to
+	// the Kubernetes API made on behalf of the flow are sent to this workspace. Empty outside kcp.
+	Workspace string `json:"workspace,omitempty"`
+	// RepositoryUrl is the URL of the repository the token is requested for. It is used to select the OAuth application
+	// of the organization owning the repository, if configured.
+	RepositoryUrl string `json:"repositoryUrl,omitempty"`
+	// Automation marks the flow requested by an automation rather than a human user. The flows initiated using
+	// a service account token are considered automation flows even if not marked.
+	Automation bool `json:"automation,omitempty"`
+}
+
+// parseAnonymousState parses and validates the anonymous OAuth state produced by the operator.
+func parseAnonymousState(codec *oauthstate.Codec, stateString string, validation StateValidation) (anonymousState, error) {
+	state := anonymousState{}
+	if err := codec.ParseInto(stateString, &state); err != nil {
+		return state, err
+	}
+	if err := state.Validate(); err != nil {
+		return state, err
+	}
+	if err := validation.validate(state.stateClaims); err != nil {
+		return state, err
+	}
+	if state.Workspace != "" {
+		if err := acceptWorkspace(state.Workspace); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// bindingRefreshAnnotation is the annotation put on the SPIAccessTokenBinding initiating the OAuth flow once the token
+// data is stored. Changing the annotation triggers the reconciliation of the binding in the operator.
+const bindingRefreshAnnotation = "spi.appstudio.redhat.com/oauth-token-stored-at"
+
+// responseModeJson is the response mode using which the flow initiator requests the callback to respond with a JSON
+// document instead of a redirect. This is useful for single-page apps driving the OAuth flow in popup windows.
+const responseModeJson = "json"
+
+// The error codes reported in the JSON callback result.
+const (
+	callbackErrorK8sAuthRequired      = "kubernetes_authentication_required"
+	callbackErrorExchangeFailed       = "token_exchange_failed"
+	callbackErrorStorageFailed        = "token_storage_failed"
+	callbackErrorInvalidTokenResponse = "invalid_token_response"
+	callbackErrorOverloaded           = "service_overloaded"
+	callbackErrorFlowExpired          = "flow_expired"
+)
+
+// callbackResult is the JSON document returned from the callback when the flow was initiated with the JSON response
+// mode.
+type callbackResult struct {
+	Result    string          `json:"result"`
+	Token     *tokenReference `json:"token,omitempty"`
+	ErrorCode string          `json:"errorCode,omitempty"`
+	// CorrelationId identifies the log entry with the details of the error.
+	CorrelationId string `json:"correlationId,omitempty"`
+}
+
+// tokenReference identifies the SPIAccessToken object for which the OAuth flow was performed.
+type tokenReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
 }
 
 // exchangeResult this the result of the OAuth exchange with all the data necessary to store the token into the storage
@@ -61,148 +226,574 @@ type exchangeResult struct {
 	result              oauthFinishResult
 	token               *oauth2.Token
 	authorizationHeader string
+	// restricted is true if the token has been restricted by the automation policy, in which case the previously stored
+	// refresh token must not be kept.
+	restricted bool
+	// capabilities are the capabilities of the token determined after the exchange.
+	capabilities []string
+	// user is the identity of the user that initiated the flow. Nil if not known.
+	user *UserIdentity
 }
 
 // newOAuth2Config returns a new instance of the oauth2.Config struct with the clientId, clientSecret and redirect URL
-// specific to this controller.
-func (c *commonController) newOAuth2Config() oauth2.Config {
+// specific to this controller. If the organization is not empty, the credentials of its OAuth application are used.
+func (c *commonController) newOAuth2Config(r *http.Request, organization string) (oauth2.Config, error) {
+	clientId, clientSecret := c.Config.ClientId, c.Config.ClientSecret
+	if organization != "" {
+		app, ok := c.OrganizationApps[organization]
+		if !ok {
+			return oauth2.Config{}, fmt.Errorf("no OAuth application configured for the organization '%s'", organization)
+		}
+		clientId, clientSecret = app.ClientId, app.ClientSecret
+	}
+
 	return oauth2.Config{
-		ClientID:     c.Config.ClientId,
-		ClientSecret: c.Config.ClientSecret,
-		RedirectURL:  c.redirectUrl(),
+		ClientID:     clientId,
+		ClientSecret: clientSecret,
+		RedirectURL:  c.redirectUrl(r),
+	}, nil
+}
+
+// organizationOf returns the organization whose OAuth application should be used for the flow targeting the provided
+// repository or an empty string if the default application of the service provider should be used.
+func (c *commonController) organizationOf(repositoryUrl string) string {
+	if repositoryUrl == "" || c.RepositoryOrganization == nil {
+		return ""
+	}
+
+	organization := c.RepositoryOrganization(repositoryUrl)
+	if _, ok := c.OrganizationApps[organization]; !ok {
+		return ""
+	}
+	return organization
+}
+
+// serviceUrl constructs the public URL of the provided path of the service, taking into account the path prefix
+// under which the service is exposed. If the request comes from a trusted proxy, the X-Forwarded-* headers take
+// precedence over the configured base URL and path prefix.
+func (c *commonController) serviceUrl(r *http.Request, path string) string {
+	base := strings.TrimSuffix(c.BaseUrl, "/")
+	prefix := c.PathPrefix
+
+	if fwdBase, fwdPrefix, hasPrefix, ok := c.TrustedProxies.forwardedBase(r); ok {
+		base = fwdBase
+		if hasPrefix {
+			prefix = fwdPrefix
+		}
 	}
+
+	return base + prefix + path
 }
 
-// redirectUrl constructs the URL to the callback endpoint so that it can be handled by this controller.
-func (c *commonController) redirectUrl() string {
-	return strings.TrimSuffix(c.BaseUrl, "/") + "/" + strings.ToLower(string(c.Config.ServiceProviderType)) + "/callback"
+// authenticateUrl constructs the URL to the authenticate endpoint of this controller.
+func (c *commonController) authenticateUrl(r *http.Request) string {
+	return c.serviceUrl(r, "/"+strings.ToLower(string(c.Config.ServiceProviderType))+"/authenticate")
+}
+
+// redirectUrl constructs the URL to the callback endpoint so that it can be handled by this controller. The configured
+// callback URL takes precedence.
+func (c *commonController) redirectUrl(r *http.Request) string {
+	if c.callbackUrl != "" {
+		return c.callbackUrl
+	}
+	return c.serviceUrl(r, "/"+strings.ToLower(string(c.Config.ServiceProviderType))+"/callback")
+}
+
+// stateCodec returns the codec to use for encoding and parsing the OAuth state.
+func (c *commonController) stateCodec() (*oauthstate.Codec, error) {
+	if c.stateCodecs == nil {
+		codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
+		return &codec, err
+	}
+	return c.stateCodecs.get(c.JwtSigningSecret)
 }
 
 func (c commonController) Authenticate(w http.ResponseWriter, r *http.Request) {
-	zap.L().Debug("/authenticate")
+	r = c.withRequestLogger(r)
+	LoggerFromContext(r.Context()).Debug("/authenticate")
 
-	stateString := r.FormValue("state")
-	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
-	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", err)
+	// the flows in progress still finish during the maintenance, only the new ones are not started
+	if remaining, active := c.maintenance.active(time.Now()); active {
+		c.ErrorPages.Unavailable(w, r, remaining, c.maintenance.Message)
+		return
+	}
+	if c.features.Disabled {
+		c.ErrorPages.Unavailable(w, r, 0, disabledProviderMessage)
 		return
 	}
 
-	state, err := codec.ParseAnonymous(stateString)
+	codec, err := c.stateCodec()
 	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", err)
 		return
 	}
 
-	session := c.SessionManager.Load(r)
+	var stateString, token string
+	preAuthorized := false
+
+	if linkKey := requestParam(r, "link"); linkKey != "" {
+		var ok bool
+		stateString, token, ok = c.AuthorizedLinks.Consume(c.JwtSigningSecret, linkKey)
+		if !ok {
+			c.ErrorPages.Debug(w, r, http.StatusUnauthorized, "the authorization link is invalid, expired or has already been used")
+			return
+		}
+		// the identity of the initiator has been checked when minting the link
+		preAuthorized = true
+	} else {
+		stateString = requestParam(r, "state")
+		token = requestParam(r, "k8s_token")
+		if token == "" {
+			token = ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+		}
+	}
 
-	token := r.FormValue("k8s_token")
+	state, err := parseAnonymousState(codec, stateString, c.stateValidation)
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusBadRequest, "failed to decode the OAuth state", err)
+		return
+	}
+	r = r.WithContext(withLoggerFields(r.Context(), zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace)))
 
-	if token == "" {
-		token = ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+	anonymous := false
+	if token == "" && c.Anonymous.allows(state.TokenNamespace) {
+		if token, err = c.Anonymous.Token(); err != nil {
+			c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to obtain the Kubernetes token of the service", err)
+			return
+		}
+		anonymous = true
+		r = r.WithContext(withLoggerFields(r.Context(), zap.Bool("anonymous", true)))
+		LoggerFromContext(r.Context()).Info("initiating the OAuth flow anonymously using the identity of the service")
 	}
 
 	if token == "" {
-		logDebugAndWriteResponse(w, http.StatusUnauthorized, "failed extract authorization info either from headers or form/query parameters")
+		c.ErrorPages.Debug(w, r, http.StatusUnauthorized, "failed extract authorization info either from headers or form/query parameters")
 		return
 	}
 
-	hasAccess, err := c.checkIdentityHasAccess(token, r, state)
-	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to determine if the authenticated user has access", err)
-		return
+	automation := state.Automation
+	if !anonymous {
+		// the token of the service doesn't tell anything about who initiated the anonymous flow
+		automation = isAutomationFlow(state, token)
 	}
 
-	if !hasAccess {
-		logDebugAndWriteResponse(w, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
-		return
+	if !preAuthorized {
+		hasAccess, err := c.checkIdentityHasAccess(token, r, state, automation)
+		if err != nil {
+			c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to determine if the authenticated user has access", err)
+			return
+		}
+
+		if !hasAccess {
+			c.ErrorPages.Debug(w, r, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
+			return
+		}
 	}
 
-	flowKey := string(uuid.NewUUID())
+	user := c.userIdentity(r.Context(), token)
+	r = r.WithContext(withLoggerFields(r.Context(), identityFields(user)...))
 
-	flows := map[string]string{}
+	if automation {
+		if err := c.automationPolicy.checkScopes(state.Scopes); err != nil {
+			c.ErrorPages.Debug(w, r, http.StatusBadRequest, "the automation flow violates the automation policy", zap.NamedError("reason", err))
+			return
+		}
+		r = r.WithContext(withLoggerFields(r.Context(), zap.Bool("automation", true)))
+	}
 
-	if err := session.GetObject("flows", &flows); err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to decode session data", err)
+	// validate the request fully before touching the session
+	responseMode := requestParam(r, "response_mode")
+	if responseMode != "" && responseMode != responseModeJson {
+		c.ErrorPages.Debug(w, r, http.StatusBadRequest, "unsupported response mode", zap.String("response_mode", responseMode))
 		return
 	}
+	successUrl, failureUrl := requestParam(r, "success_url"), requestParam(r, "failure_url")
+	for _, target := range []string{successUrl, failureUrl} {
+		if err := c.validateRedirectTarget(target); err != nil {
+			c.ErrorPages.Debug(w, r, http.StatusBadRequest, "invalid redirect target", zap.String("url", target), zap.NamedError("reason", err))
+			return
+		}
+	}
 
-	flows[flowKey] = token
-
-	if err := session.PutObject(w, "flows", flows); err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to encode session data", err)
+	flowKey, err := c.startFlow(w, r, token)
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to store the flow in the session", err)
 		return
 	}
+	r = r.WithContext(withLoggerFields(r.Context(), zap.String("flowKey", flowKey)))
 
 	keyedState := exchangeState{
-		AnonymousOAuthState: state,
+		AnonymousOAuthState: state.AnonymousOAuthState,
+		stateClaims:         state.stateClaims,
 		Key:                 flowKey,
+		ResponseMode:        responseMode,
+		BindingName:         requestParam(r, "binding"),
+		Workspace:           state.Workspace,
+		Organization:        c.organizationOf(state.RepositoryUrl),
+		SuccessUrl:          successUrl,
+		FailureUrl:          failureUrl,
+		Automation:          automation,
+		Deadline:            flowDeadline(time.Now()),
 	}
 
-	oauthCfg := c.newOAuth2Config()
-	oauthCfg.Endpoint = c.Endpoint
+	oauthCfg, err := c.newOAuth2Config(r, keyedState.Organization)
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to configure the OAuth flow", err)
+		return
+	}
+	oauthCfg.Endpoint, err = c.providerEndpoint(r.Context())
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusBadGateway, "failed to obtain the metadata of the service provider", err)
+		return
+	}
 	oauthCfg.Scopes = keyedState.Scopes
 
 	stateString, err = codec.Encode(&keyedState)
 	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to encode OAuth state", err)
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to encode OAuth state", err)
 		return
 	}
 
-	url := oauthCfg.AuthCodeURL(stateString)
+	pushAuthorization := c.features.enabled(c.Config.ServiceProviderType, FeaturePushedAuthorization, state.TokenNamespace, state.TokenName)
+	authUrl, err := c.authorizationUrl(r.Context(), &oauthCfg, stateString, pushAuthorization)
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusBadGateway, "failed to push the authorization request to the service provider", err)
+		return
+	}
+
+	c.publishFlowEvent(FlowStartedEvent, state.AnonymousOAuthState, state.Workspace, user, nil)
+
+	if c.ConsentPreview {
+		err = c.Templates.Execute(w, ConsentPreviewTemplate, ConsentPreviewData{
+			Url:             authUrl,
+			ServiceProvider: c.Config.ServiceProviderType,
+			Token:           tokenReference{Name: state.TokenName, Namespace: state.TokenNamespace},
+			Scopes:          describeScopes(keyedState.Scopes, defaultScopeDescriptions(c.Config.ServiceProviderType), c.scopeDescriptions),
+			AbortUrl:        abortUrl(&keyedState),
+		})
+		if err != nil {
+			c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to return consent preview HTML page", err)
+			return
+		}
+		LoggerFromContext(r.Context()).Debug("/authenticate ok")
+		return
+	}
 
 	templateData := struct {
 		Url string
 	}{
-		Url: url,
+		Url: authUrl,
+	}
+
+	err = c.Templates.Execute(w, RedirectNoticeTemplate, templateData)
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to return redirect notice HTML page", err)
+		return
+	}
+
+	LoggerFromContext(r.Context()).Debug("/authenticate ok")
+}
+
+func (c commonController) AuthenticateLink(w http.ResponseWriter, r *http.Request) {
+	r = c.withRequestLogger(r)
+	LoggerFromContext(r.Context()).Debug("/authenticate/link")
+
+	stateString := requestParam(r, "state")
+	codec, err := c.stateCodec()
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", err)
+		return
+	}
+
+	state, err := parseAnonymousState(codec, stateString, c.stateValidation)
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusBadRequest, "failed to decode the OAuth state", err)
+		return
+	}
+	r = r.WithContext(withLoggerFields(r.Context(), zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace)))
+
+	token := ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+	if token == "" {
+		c.ErrorPages.Debug(w, r, http.StatusUnauthorized, "failed extract authorization info from headers")
+		return
+	}
+
+	// the flow started by the link later is checked now, the same way as if it was started with the token of the link
+	hasAccess, err := c.checkIdentityHasAccess(token, r, state, isAutomationFlow(state, token))
+	if err != nil {
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to determine if the authenticated user has access", err)
+		return
+	}
+
+	if !hasAccess {
+		c.ErrorPages.Debug(w, r, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
+		return
 	}
 
-	err = c.RedirectTemplate.Execute(w, templateData)
+	linkKey, err := c.AuthorizedLinks.Mint(c.JwtSigningSecret, stateString, token)
 	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to return redirect notice HTML page", err)
+		c.ErrorPages.Error(w, r, http.StatusInternalServerError, "failed to mint the authorization link", err)
 		return
 	}
 
-	zap.L().Debug("/authenticate ok")
+	link := url.Values{}
+	link.Set("link", linkKey)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(map[string]string{"url": c.authenticateUrl(r) + "?" + link.Encode()}); err != nil {
+		LoggerFromContext(r.Context()).Error("failed to write the authorization link response", zap.Error(err))
+		return
+	}
+
+	LoggerFromContext(r.Context()).Debug("/authenticate/link ok")
 }
 
 func (c commonController) Callback(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	zap.L().Debug("/callback")
+	ctx, r = withLogger(ctx, r, LoggerFromContext(ctx).With(c.serviceProviderField()))
+	LoggerFromContext(ctx).Debug("/callback")
+
+	if target, ok := c.callbackBounceUrl(r); ok {
+		LoggerFromContext(ctx).Debug("finishing the callback on the base URL of the service")
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	if spError := requestParam(r, "error"); spError != "" {
+		c.serviceProviderError(w, r, spError, requestParam(r, "error_description"))
+		return
+	}
+
+	outcome, shared := callbackCoalescing.do(string(c.Config.ServiceProviderType)+"/"+c.callbackKey(r), func() callbackOutcome {
+		return c.processCallback(detachedContext{parent: ctx}, r)
+	})
+	if shared {
+		LoggerFromContext(ctx).Debug("the callback shares the outcome of a concurrent callback with the same state")
+	}
 
-	exchange, err := c.finishOAuthExchange(ctx, r, c.Endpoint)
+	exchange, err := outcome.exchange, outcome.exchangeErr
+	if exchange.Key != "" && !errors.Is(err, ErrOverloaded) {
+		// the flow is over one way or the other, so the token of the user is not kept in the session any longer. Only
+		// the callbacks rejected before using the authorization code can be repeated.
+		c.removeFlow(w, r, exchange.Key)
+	}
+	if exchange.TokenName != "" {
+		ctx, r = withLogger(ctx, r, LoggerFromContext(ctx).With(flowFields(&exchange.exchangeState)...))
+	}
 	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusBadRequest, "error in Service Provider token exchange", err)
+		errorCode := callbackErrorExchangeFailed
+		if exchange.result == oauthFinishK8sAuthRequired {
+			errorCode = callbackErrorK8sAuthRequired
+		} else if errors.Is(err, errInvalidTokenResponse) {
+			errorCode = callbackErrorInvalidTokenResponse
+		} else if errors.Is(err, errFlowExpired) {
+			errorCode = callbackErrorFlowExpired
+		} else if errors.Is(err, ErrOverloaded) {
+			// the authorization code has not been used yet, so repeating the callback can still succeed
+			errorCode = callbackErrorOverloaded
+			w.Header().Set("Retry-After", "5")
+		}
+		if exchange.ResponseMode == responseModeJson {
+			c.writeCallbackError(w, r, &exchange, errorCode, "error in Service Provider token exchange", err)
+			return
+		}
+		if errorCode == callbackErrorOverloaded {
+			c.ErrorPages.Error(w, r, http.StatusServiceUnavailable, "too many concurrent token exchanges, try again later", err)
+			return
+		}
+		c.callbackFailed(w, r, &exchange, http.StatusBadRequest, errorCode, "error in Service Provider token exchange", err)
 		return
 	}
 
 	if exchange.result == oauthFinishK8sAuthRequired {
-		logErrorAndWriteResponse(w, http.StatusUnauthorized, "could not authenticate to Kubernetes", err)
+		c.ErrorPages.Error(w, r, http.StatusUnauthorized, "could not authenticate to Kubernetes", err)
 		return
 	}
 
-	err = c.syncTokenData(ctx, &exchange)
-	if err != nil {
-		logErrorAndWriteResponse(w, http.StatusInternalServerError, "failed to store token data to cluster", err)
+	if err = outcome.storeErr; err != nil {
+		if outcome.pending {
+			c.writeCallbackPending(w, r, &exchange)
+			return
+		}
+		if exchange.ResponseMode == responseModeJson {
+			c.writeCallbackError(w, r, &exchange, callbackErrorStorageFailed, "failed to store token data to cluster", err)
+			return
+		}
+		c.callbackFailed(w, r, &exchange, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to store token data to cluster", err)
+		return
+	}
+
+	if exchange.ResponseMode == responseModeJson {
+		c.writeCallbackResult(w, r, http.StatusOK, &callbackResult{
+			Result: "success",
+			Token:  &tokenReference{Name: exchange.TokenName, Namespace: exchange.TokenNamespace},
+		})
+		LoggerFromContext(ctx).Debug("/callback ok")
+		return
+	}
+
+	redirectLocation := exchange.SuccessUrl
+	if redirectLocation == "" {
+		redirectLocation = requestParam(r, "redirect_after_login")
+	}
+	if redirectLocation == "" {
+		redirectLocation = c.serviceUrl(r, "/callback_success")
+	}
+	http.Redirect(w, r, redirectLocation, http.StatusFound)
+
+	LoggerFromContext(ctx).Debug("/callback ok")
+}
+
+// queueTokenData puts the token that failed to be stored into the storage retry queue, if configured. It returns true
+// if the token has been queued and will be stored later.
+func (c commonController) queueTokenData(ctx context.Context, exchange *exchangeResult, storageErr error) bool {
+	if c.StorageRetries == nil || isPermanentStorageError(storageErr) {
+		return false
+	}
+
+	if err := c.StorageRetries.enqueue(c.Config.ServiceProviderType, exchange); err != nil {
+		LoggerFromContext(ctx).Error("failed to queue the token that failed to be stored", zap.NamedError("storageError", storageErr), zap.Error(err))
+		return false
+	}
+
+	LoggerFromContext(ctx).Warn("failed to store the token data, the token has been queued to be stored later", zap.Error(storageErr))
+	return true
+}
+
+// writeCallbackPending tells the user that the authorization succeeded, but the token data will only be stored later.
+func (c commonController) writeCallbackPending(w http.ResponseWriter, r *http.Request, exchange *exchangeResult) {
+	if exchange.ResponseMode == responseModeJson {
+		c.writeCallbackResult(w, r, http.StatusAccepted, &callbackResult{
+			Result: "pending",
+			Token:  &tokenReference{Name: exchange.TokenName, Namespace: exchange.TokenNamespace},
+		})
 		return
 	}
 
-	redirectLocation := r.FormValue("redirect_after_login")
+	redirectLocation := ""
+	if exchange.SuccessUrl != "" {
+		redirectLocation = withQuery(exchange.SuccessUrl, url.Values{"pending": {"true"}})
+	}
+	if redirectLocation == "" {
+		redirectLocation = requestParam(r, "redirect_after_login")
+	}
 	if redirectLocation == "" {
-		redirectLocation = strings.TrimSuffix(c.BaseUrl, "/") + "/" + "callback_success"
+		redirectLocation = c.serviceUrl(r, "/callback_success") + "?pending=true"
 	}
 	http.Redirect(w, r, redirectLocation, http.StatusFound)
+}
+
+// writeCallbackError logs the error and writes the JSON callback result describing it.
+func (c commonController) writeCallbackError(w http.ResponseWriter, r *http.Request, exchange *exchangeResult, errorCode string, msg string, err error) {
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Error(msg, zap.Error(err), zap.String("errorCode", errorCode), zap.String("correlationId", correlationId))
+
+	status := http.StatusBadRequest
+	switch errorCode {
+	case callbackErrorK8sAuthRequired:
+		status = http.StatusUnauthorized
+	case callbackErrorStorageFailed:
+		status = http.StatusInternalServerError
+	case callbackErrorInvalidTokenResponse:
+		status = http.StatusBadGateway
+	case callbackErrorOverloaded:
+		status = http.StatusServiceUnavailable
+	}
+
+	var token *tokenReference
+	if exchange.TokenName != "" {
+		token = &tokenReference{Name: exchange.TokenName, Namespace: exchange.TokenNamespace}
+	}
+
+	w.Header().Set(correlationIdHeader, correlationId)
+	c.writeCallbackResult(w, r, status, &callbackResult{
+		Result:        "error",
+		Token:         token,
+		ErrorCode:     errorCode,
+		CorrelationId: correlationId,
+	})
+}
+
+// writeCallbackResult writes the provided result as JSON along with the CORS headers allowing the allowed origins to
+// read the response.
+func (c commonController) writeCallbackResult(w http.ResponseWriter, r *http.Request, status int, result *callbackResult) {
+	c.writeJsonResult(w, r, status, result)
+}
+
+// writeJsonResult writes the result as JSON, allowing the configured origins to read it.
+func (c commonController) writeJsonResult(w http.ResponseWriter, r *http.Request, status int, result interface{}) {
+	if origin := r.Header.Get("Origin"); origin != "" && c.isAllowedOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		LoggerFromContext(r.Context()).Error("failed to write the result", zap.Error(err))
+	}
+}
+
+// isAllowedOrigin checks whether the provided origin is among the configured allowed origins.
+func (c commonController) isAllowedOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if strings.TrimSuffix(o, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// processCallback exchanges the authorization code of the callback and stores the obtained token. The outcome is
+// shared by the concurrent duplicates of the callback, so everything that must happen only once per flow, like
+// publishing the flow events, is done here.
+func (c commonController) processCallback(ctx context.Context, r *http.Request) callbackOutcome {
+	exchange, err := c.finishOAuthExchange(ctx, r)
+	ctx, cancel := exchange.withFlowDeadline(ctx)
+	defer cancel()
+	if exchange.TokenName != "" {
+		ctx = withLoggerFields(ctx, flowFields(&exchange.exchangeState)...)
+	}
+	if exchange.authorizationHeader != "" {
+		exchange.user = c.userIdentity(ctx, exchange.authorizationHeader)
+		ctx = withLoggerFields(ctx, identityFields(exchange.user)...)
+	}
+	if err != nil {
+		c.publishFlowEvent(ExchangeFailedEvent, exchange.AnonymousOAuthState, exchange.Workspace, exchange.user, err)
+		return callbackOutcome{exchange: exchange, exchangeErr: err}
+	}
+	if exchange.result == oauthFinishK8sAuthRequired {
+		return callbackOutcome{exchange: exchange}
+	}
+
+	c.publishFlowEvent(ExchangeCompletedEvent, exchange.AnonymousOAuthState, exchange.Workspace, exchange.user, nil)
+	c.applyAutomationPolicy(&exchange, time.Now())
+	exchange.capabilities = c.probeCapabilities(ctx, exchange.token, exchange.Scopes)
+
+	if err = c.syncTokenData(ctx, &exchange); err != nil {
+		c.publishFlowEvent(StorageFailedEvent, exchange.AnonymousOAuthState, exchange.Workspace, exchange.user, err)
+		return callbackOutcome{exchange: exchange, storeErr: err, pending: c.queueTokenData(ctx, &exchange, err)}
+	}
 
-	zap.L().Debug("/callback ok")
+	c.publishFlowEvent(TokenStoredEvent, exchange.AnonymousOAuthState, exchange.Workspace, exchange.user, nil)
+
+	if exchange.BindingName != "" {
+		// failing to refresh the binding is not fatal. The operator reconciles it eventually anyway.
+		if err := c.refreshBinding(ctx, &exchange); err != nil {
+			LoggerFromContext(ctx).Warn("failed to trigger the refresh of the SPIAccessTokenBinding", zap.String("binding", exchange.BindingName), zap.Error(err))
+		}
+	}
+	return callbackOutcome{exchange: exchange}
 }
 
 // finishOAuthExchange implements the bulk of the Callback function. It returns the token, if obtained, the decoded
 // state from the oauth flow, if available, and the result of the authentication.
-func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Request, endpoint oauth2.Endpoint) (exchangeResult, error) {
+func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Request) (exchangeResult, error) {
 	// TODO support the implicit flow here, too?
 
 	// check that the state is correct
-	stateString := r.FormValue("state")
-	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
+	stateString := requestParam(r, "state")
+	codec, err := c.stateCodec()
 	if err != nil {
 		return exchangeResult{result: oauthFinishError}, err
 	}
@@ -212,30 +803,72 @@ func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Reque
 	if err != nil {
 		return exchangeResult{result: oauthFinishError}, err
 	}
-
-	session := c.SessionManager.Load(r)
-	flows := map[string]string{}
-	if err = session.GetObject("flows", &flows); err != nil {
+	if err = c.stateValidation.validate(state.stateClaims); err != nil {
 		return exchangeResult{result: oauthFinishError}, err
 	}
+	ctx = withLoggerFields(ctx, flowFields(state)...)
+	if state.expired(time.Now()) {
+		return exchangeResult{exchangeState: *state, result: oauthFinishError}, errFlowExpired
+	}
+	ctx, cancel := state.withFlowDeadline(ctx)
+	defer cancel()
 
-	authHeader := flows[state.Key]
+	authHeader, err := c.getFlow(r, state.Key)
+	if err != nil {
+		return exchangeResult{exchangeState: *state, result: oauthFinishError}, err
+	}
 	if authHeader == "" {
-		return exchangeResult{result: oauthFinishK8sAuthRequired}, fmt.Errorf("no active oauth flow found for the state key")
+		return exchangeResult{exchangeState: *state, result: oauthFinishK8sAuthRequired}, fmt.Errorf("no active oauth flow found for the state key")
 	}
 
 	// the state is ok, let's retrieve the token from the service provider
-	oauthCfg := c.newOAuth2Config()
-	oauthCfg.Endpoint = endpoint
+	oauthCfg, err := c.newOAuth2Config(r, state.Organization)
+	if err != nil {
+		return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: authHeader}, err
+	}
+	oauthCfg.Endpoint, err = c.providerEndpoint(ctx)
+	if err != nil {
+		return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: authHeader}, err
+	}
 
-	code := r.FormValue("code")
+	code := requestParam(r, "code")
 
 	// adding scopes to code exchange request is little out of spec, but quay wants them,
 	// while other providers will just ignore this parameter
-	scopeOption := oauth2.SetAuthURLParam("scope", r.FormValue("scope"))
-	token, err := oauthCfg.Exchange(ctx, code, scopeOption)
+	opts := []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("scope", requestParam(r, "scope"))}
+
+	if !usesClientSecret(c.clientAuthMethod) {
+		oauthCfg.ClientSecret = ""
+	}
+	if c.clientAssertions != nil {
+		assertionOpts, err := c.clientAssertions.exchangeOptions(oauthCfg.ClientID, oauthCfg.Endpoint.TokenURL, time.Now())
+		if err != nil {
+			return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: authHeader}, err
+		}
+		opts = append(opts, assertionOpts...)
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.providerHttpClient(ctx))
+
+	var token *oauth2.Token
+	err = c.Workers.run(ctx, WorkerStageExchange, func(ctx context.Context) error {
+		if err := injectExchangeDelay(ctx); err != nil {
+			return err
+		}
+		var err error
+		token, err = oauthCfg.Exchange(ctx, code, opts...)
+		return err
+	})
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %s", errFlowExpired, err.Error())
+	}
 	if err != nil {
-		return exchangeResult{result: oauthFinishError}, err
+		return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: authHeader}, err
+	}
+	if err = c.tokenValidation.validateToken(ctx, token, state.Scopes); err != nil {
+		return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: authHeader}, err
+	}
+	if err = c.verifyIdToken(ctx, token, oauthCfg.ClientID); err != nil {
+		return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: authHeader}, err
 	}
 	return exchangeResult{
 		exchangeState:       *state,
@@ -245,56 +878,152 @@ func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Reque
 	}, nil
 }
 
-// syncTokenData stores the data of the token to the configured TokenStorage.
+// syncTokenData stores the data of the token obtained in the exchange to the configured TokenStorage.
 func (c commonController) syncTokenData(ctx context.Context, exchange *exchangeResult) error {
-	ctx = WithAuthIntoContext(exchange.authorizationHeader, ctx)
+	ctx = WithWorkspaceIntoContext(exchange.Workspace, WithAuthIntoContext(exchange.authorizationHeader, ctx))
 
 	accessToken := &v1beta1.SPIAccessToken{}
-	if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: exchange.TokenName, Namespace: exchange.TokenNamespace}, accessToken); err != nil {
+	err := c.Workers.run(ctx, WorkerStageKubernetes, func(ctx context.Context) error {
+		if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: exchange.TokenName, Namespace: exchange.TokenNamespace}, accessToken); err != nil {
+			return err
+		}
+		if exchange.Automation {
+			// the token is labeled first so that no machine-held token is ever stored unlabeled
+			return c.labelAutomationToken(ctx, accessToken)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	apiToken := v1beta1.Token{
-		AccessToken:  exchange.token.AccessToken,
-		TokenType:    exchange.token.TokenType,
-		RefreshToken: exchange.token.RefreshToken,
-		Expiry:       uint64(exchange.token.Expiry.Unix()),
+	return c.Workers.run(ctx, WorkerStageStorage, func(ctx context.Context) error {
+		if exchange.restricted {
+			return c.storeRestrictedToken(ctx, accessToken, exchange.token, exchange.Scopes, exchange.capabilities)
+		}
+		return c.storeToken(ctx, accessToken, exchange.token, exchange.Scopes, exchange.capabilities)
+	})
+}
+
+// storeToken stores the token obtained from the service provider. If the storage supports it, the individual artifacts
+// of the token are also stored separately. They are stored first so that they are already available when the operator
+// is notified about the new token data.
+//
+// The stored refresh token is only replaced if the service provider issued a new one. The service providers rotating
+// the refresh tokens issue a new one every time, the others keep the previous one valid (RFC 6749, section 6).
+//
+// The requested scopes are recorded as the scopes granted to the access token unless the service provider reports
+// the granted scopes in the token response. The capabilities are recorded along with them. If nil, the capabilities
+// recorded previously are kept, e.g. when the token is refreshed.
+func (c commonController) storeToken(ctx context.Context, accessToken *v1beta1.SPIAccessToken, token *oauth2.Token, requestedScopes []string, capabilities []string) error {
+	if err := injectStorageFault(ctx); err != nil {
+		return err
 	}
 
-	return c.TokenStorage.Store(ctx, accessToken, &apiToken)
-}
+	refreshToken := token.RefreshToken
+	if refreshToken == "" {
+		previous, err := c.TokenStorage.Get(ctx, accessToken)
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			refreshToken = previous.RefreshToken
+		}
+	}
 
-func logErrorAndWriteResponse(w http.ResponseWriter, status int, msg string, err error) {
-	w.WriteHeader(status)
-	_, _ = fmt.Fprintf(w, "%s: %s", msg, err.Error())
-	zap.L().Error(msg, zap.Error(err))
+	return c.storeTokenData(ctx, accessToken, token, requestedScopes, capabilities, refreshToken)
 }
 
-func logDebugAndWriteResponse(w http.ResponseWriter, status int, msg string, fields ...zap.Field) {
-	w.WriteHeader(status)
-	_, _ = fmt.Fprint(w, msg)
-	zap.L().Debug(msg, fields...)
+// storeTokenData stores the artifacts of the token and the token itself with the provided refresh token. The SPIAccessToken
+// is then labeled with the fingerprint of the token.
+func (c commonController) storeTokenData(ctx context.Context, accessToken *v1beta1.SPIAccessToken, token *oauth2.Token, requestedScopes []string, capabilities []string, refreshToken string) error {
+	if c.ArtifactStorage != nil {
+		if capabilities == nil {
+			previous, err := c.ArtifactStorage.GetArtifact(ctx, accessToken, oauthstorage.AccessTokenArtifact)
+			if err != nil {
+				return err
+			}
+			if previous != nil {
+				capabilities = previous.Capabilities
+			}
+		}
+
+		// the artifacts missing in the token, like the refresh token that hasn't been rotated, are left untouched
+		if err := c.ArtifactStorage.StoreArtifacts(ctx, accessToken, tokenArtifacts(token, requestedScopes, capabilities, time.Now())); err != nil {
+			return err
+		}
+	}
+
+	apiToken := v1beta1.Token{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: refreshToken,
+		Expiry:       uint64(token.Expiry.Unix()),
+	}
+
+	if err := c.TokenStorage.Store(ctx, accessToken, &apiToken); err != nil {
+		return err
+	}
+
+	// the token is already stored, so the failure to link it with the other SPIAccessTokens doesn't fail the flow
+	if err := c.recordTokenFingerprint(ctx, accessToken, token.AccessToken); err != nil {
+		LoggerFromContext(ctx).Warn("failed to record the fingerprint of the stored token", zap.Error(err))
+	}
+	return nil
 }
 
-func (c *commonController) checkIdentityHasAccess(token string, req *http.Request, state oauthstate.AnonymousOAuthState) (bool, error) {
-	review := v1.SelfSubjectAccessReview{
-		Spec: v1.SelfSubjectAccessReviewSpec{
-			ResourceAttributes: &v1.ResourceAttributes{
-				Namespace: state.TokenNamespace,
-				Verb:      "create",
-				Group:     v1beta1.GroupVersion.Group,
-				Version:   v1beta1.GroupVersion.Version,
-				Resource:  "spiaccesstokendataupdates",
-			},
-		},
+// refreshBinding annotates the SPIAccessTokenBinding that initiated the OAuth flow so that the operator reconciles it
+// without waiting for the next resync.
+func (c commonController) refreshBinding(ctx context.Context, exchange *exchangeResult) error {
+	ctx = WithWorkspaceIntoContext(exchange.Workspace, WithAuthIntoContext(exchange.authorizationHeader, ctx))
+
+	binding := &v1beta1.SPIAccessTokenBinding{}
+	if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: exchange.BindingName, Namespace: exchange.TokenNamespace}, binding); err != nil {
+		return err
 	}
 
-	ctx := WithAuthIntoContext(token, req.Context())
+	patch := client.MergeFrom(binding.DeepCopy())
+	if binding.Annotations == nil {
+		binding.Annotations = map[string]string{}
+	}
+	binding.Annotations[bindingRefreshAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	return c.K8sClient.Patch(ctx, binding, patch)
+}
 
-	if err := c.K8sClient.Create(ctx, &review); err != nil {
-		return false, err
+// checkIdentityHasAccess checks that the identity is allowed to update the token data. In the automation flows,
+// the identity must also be allowed to patch the SPIAccessToken, because it is labeled after the code is exchanged.
+func (c *commonController) checkIdentityHasAccess(token string, req *http.Request, state anonymousState, automation bool) (bool, error) {
+	attributes := []v1.ResourceAttributes{{
+		Namespace: state.TokenNamespace,
+		Verb:      "create",
+		Group:     v1beta1.GroupVersion.Group,
+		Version:   v1beta1.GroupVersion.Version,
+		Resource:  "spiaccesstokendataupdates",
+	}}
+	if automation {
+		attributes = append(attributes, v1.ResourceAttributes{
+			Namespace: state.TokenNamespace,
+			Verb:      "patch",
+			Group:     v1beta1.GroupVersion.Group,
+			Version:   v1beta1.GroupVersion.Version,
+			Resource:  "spiaccesstokens",
+			Name:      state.TokenName,
+		})
 	}
 
-	zap.L().Debug("self subject review result", zap.Stringer("review", &review))
-	return review.Status.Allowed, nil
+	ctx := WithWorkspaceIntoContext(state.Workspace, WithAuthIntoContext(token, req.Context()))
+
+	for i := range attributes {
+		review := v1.SelfSubjectAccessReview{Spec: v1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes[i]}}
+		if err := c.K8sClient.Create(ctx, &review); err != nil {
+			return false, err
+		}
+
+		LoggerFromContext(req.Context()).Debug("self subject review result", zap.Stringer("review", &review))
+		if !review.Status.Allowed {
+			return false, nil
+		}
+	}
+	return true, nil
 }
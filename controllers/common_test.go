@@ -11,6 +11,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !release
+// +build !release
+
 package controllers
 
 import (
@@ -18,7 +21,6 @@ import (
 	"context"
 	"fmt"
 	"html"
-	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -84,7 +86,7 @@ var _ = Describe("Controller", func() {
 	}
 
 	prepareController := func(g Gomega) *commonController {
-		tmpl, err := template.ParseFiles("../static/redirect_notice.html")
+		tmpl, err := LoadTemplates("../static", "", RedirectNoticeTemplate, ConsentPreviewTemplate)
 		g.Expect(err).NotTo(HaveOccurred())
 
 		return &commonController{
@@ -101,9 +103,12 @@ var _ = Describe("Controller", func() {
 				TokenURL:  "https://special.sp/toekn",
 				AuthStyle: oauth2.AuthStyleAutoDetect,
 			},
-			BaseUrl:          "https://spi.on.my.machine",
-			SessionManager:   scs.NewManager(memstore.New(1000000 * time.Hour)),
-			RedirectTemplate: tmpl,
+			BaseUrl:         "https://spi.on.my.machine",
+			SessionManager:  scs.NewManager(memstore.New(1000000 * time.Hour)),
+			Templates:       tmpl,
+			AuthorizedLinks: NewAuthorizedLinks(DefaultAuthorizedLinkTtl),
+			ErrorPages:      &ErrorPages{Templates: tmpl},
+			stateCodecs:     &stateCodecCache{},
 		}
 	}
 
@@ -137,6 +142,31 @@ var _ = Describe("Controller", func() {
 		return redirect
 	}
 
+	// fakeServiceProviderContext returns a context that makes the OAuth exchange reach a fake service provider
+	// returning a token instead of the real one.
+	fakeServiceProviderContext := func() context.Context {
+		bakedResponse, _ := json.Marshal(oauth2.Token{
+			AccessToken:  "token",
+			TokenType:    "bearer",
+			RefreshToken: "refresh",
+			Expiry:       time.Now(),
+		})
+		return context.WithValue(context.TODO(), oauth2.HTTPClient, &http.Client{
+			Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+				if strings.HasPrefix(r.URL.String(), "https://special.sp") {
+					return &http.Response{
+						StatusCode: 200,
+						Header:     http.Header{},
+						Body:       ioutil.NopCloser(bytes.NewBuffer(bakedResponse)),
+						Request:    r,
+					}, nil
+				}
+
+				return nil, fmt.Errorf("unexpected request to: %s", r.URL.String())
+			}),
+		})
+	}
+
 	It("additionally accepts data in POST", func() {
 		token := grabK8sToken(Default)
 
@@ -153,6 +183,40 @@ var _ = Describe("Controller", func() {
 		Expect(res.Code).To(Equal(http.StatusOK))
 	})
 
+	It("initiates the flow using a pre-authorized link", func() {
+		token := grabK8sToken(Default)
+		c := prepareController(Default)
+
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Form = url.Values{}
+		req.Form.Set("state", prepareAnonymousState())
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+
+		c.AuthenticateLink(res, req)
+		Expect(res.Code).To(Equal(http.StatusOK))
+
+		link := map[string]string{}
+		Expect(json.NewDecoder(res.Body).Decode(&link)).To(Succeed())
+		linkUrl, err := url.Parse(link["url"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(linkUrl.Path).To(Equal("/github/authenticate"))
+		Expect(linkUrl.Query().Get("link")).NotTo(BeEmpty())
+
+		// no authorization is required when following the link...
+		req = httptest.NewRequest("GET", "/?"+linkUrl.RawQuery, nil)
+		res = httptest.NewRecorder()
+		c.Authenticate(res, req)
+		Expect(res.Code).To(Equal(http.StatusOK))
+		Expect(getRedirectUrlFromAuthenticateResponse(Default, res).Query().Get("state")).NotTo(BeEmpty())
+
+		// ... but the link can only be used once
+		req = httptest.NewRequest("GET", "/?"+linkUrl.RawQuery, nil)
+		res = httptest.NewRecorder()
+		c.Authenticate(res, req)
+		Expect(res.Code).To(Equal(http.StatusUnauthorized))
+	})
+
 	It("redirects to SP OAuth URL with state and scopes", func() {
 		_, res := authenticateFlow(Default)
 
@@ -171,6 +235,26 @@ var _ = Describe("Controller", func() {
 		Expect(res.Result().Cookies()).NotTo(BeEmpty())
 	})
 
+	It("shows the consent preview before redirecting to SP", func() {
+		token := grabK8sToken(Default)
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", prepareAnonymousState()), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+
+		c := prepareController(Default)
+		c.ConsentPreview = true
+		c.Authenticate(res, req)
+
+		Expect(res.Code).To(Equal(http.StatusOK))
+		body := res.Body.String()
+		Expect(body).To(ContainSubstring(IT.Namespace + "/mytoken"))
+		Expect(body).To(ContainSubstring("<code>a</code>"))
+		Expect(body).To(ContainSubstring("<code>b</code>"))
+		Expect(body).To(ContainSubstring(`href="https://special.sp/login?`))
+		Expect(body).NotTo(ContainSubstring("http-equiv = \"refresh\""))
+	})
+
 	When("OAuth initiated", func() {
 		BeforeEach(func() {
 			Expect(IT.Client.Create(IT.Context, &v1beta1.SPIAccessToken{
@@ -219,7 +303,7 @@ var _ = Describe("Controller", func() {
 				// response...
 				bakedResponse, _ := json.Marshal(oauth2.Token{
 					AccessToken:  "token",
-					TokenType:    "jwt",
+					TokenType:    "bearer",
 					RefreshToken: "refresh",
 					Expiry:       time.Now(),
 				})
@@ -246,6 +330,82 @@ var _ = Describe("Controller", func() {
 			}).Should(Succeed())
 		})
 
+		It("responds with JSON in the json response mode", func() {
+			Eventually(func(g Gomega) {
+				token := grabK8sToken(g)
+				controller := prepareController(g)
+				controller.AllowedOrigins = []string{"https://console.my.machine"}
+
+				req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&response_mode=json", prepareAnonymousState()), nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				res := httptest.NewRecorder()
+				controller.Authenticate(res, req)
+				g.Expect(res.Code).To(Equal(http.StatusOK))
+
+				redirect := getRedirectUrlFromAuthenticateResponse(g, res)
+				state := redirect.Query().Get("state")
+
+				req = httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&code=123", state), nil)
+				req.Header.Set("Cookie", res.Result().Cookies()[0].String())
+				req.Header.Set("Origin", "https://console.my.machine")
+				res = httptest.NewRecorder()
+
+				controller.Callback(fakeServiceProviderContext(), res, req)
+
+				g.Expect(res.Code).To(Equal(http.StatusOK))
+				g.Expect(res.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://console.my.machine"))
+				g.Expect(res.Header().Get("Content-Type")).To(Equal("application/json"))
+
+				result := callbackResult{}
+				g.Expect(json.NewDecoder(res.Body).Decode(&result)).To(Succeed())
+				g.Expect(result.Result).To(Equal("success"))
+				g.Expect(result.Token).NotTo(BeNil())
+				g.Expect(result.Token.Name).To(Equal("mytoken"))
+				g.Expect(result.Token.Namespace).To(Equal(IT.Namespace))
+				g.Expect(result.ErrorCode).To(BeEmpty())
+			}).Should(Succeed())
+		})
+
+		It("annotates the initiating binding", func() {
+			binding := &v1beta1.SPIAccessTokenBinding{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mybinding",
+					Namespace: IT.Namespace,
+				},
+				Spec: v1beta1.SPIAccessTokenBindingSpec{
+					RepoUrl: "https://special.sp/repo",
+				},
+			}
+			Expect(IT.Client.Create(IT.Context, binding)).To(Succeed())
+			defer func() {
+				Expect(IT.Client.Delete(IT.Context, binding)).To(Succeed())
+			}()
+
+			Eventually(func(g Gomega) {
+				token := grabK8sToken(g)
+				controller := prepareController(g)
+
+				req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&binding=mybinding", prepareAnonymousState()), nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				res := httptest.NewRecorder()
+				controller.Authenticate(res, req)
+				g.Expect(res.Code).To(Equal(http.StatusOK))
+
+				state := getRedirectUrlFromAuthenticateResponse(g, res).Query().Get("state")
+
+				req = httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&code=123", state), nil)
+				req.Header.Set("Cookie", res.Result().Cookies()[0].String())
+				res = httptest.NewRecorder()
+
+				controller.Callback(fakeServiceProviderContext(), res, req)
+				g.Expect(res.Code).To(Equal(http.StatusFound))
+
+				b := &v1beta1.SPIAccessTokenBinding{}
+				g.Expect(IT.Client.Get(IT.Context, client.ObjectKeyFromObject(binding), b)).To(Succeed())
+				g.Expect(b.Annotations).To(HaveKey(bindingRefreshAnnotation))
+			}).Should(Succeed())
+		})
+
 		It("redirects to specified url", func() {
 			// this may fail at times because we're updating the token during the flow and we may intersect with
 			// operator's work. Wrapping it in an Eventually block makes sure we retry on such occurrences. Note that
@@ -267,7 +427,7 @@ var _ = Describe("Controller", func() {
 				// response...
 				bakedResponse, _ := json.Marshal(oauth2.Token{
 					AccessToken:  "token",
-					TokenType:    "jwt",
+					TokenType:    "bearer",
 					RefreshToken: "refresh",
 					Expiry:       time.Now(),
 				})
@@ -0,0 +1,255 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionMinSize is the minimum size of the response body worth compressing. Smaller responses fit into a single
+// packet anyway.
+const CompressionMinSize = 1024
+
+// compressibleContentTypes are the media types of the responses that are compressed. The binary formats are usually
+// compressed already.
+var compressibleContentTypes = map[string]bool{
+	"text/html":              true,
+	"text/plain":             true,
+	"text/css":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/json":       true,
+	"application/yaml":       true,
+	"application/x-yaml":     true,
+	"image/svg+xml":          true,
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// CompressionMiddleware compresses the textual responses using gzip or deflate, whichever the client prefers according
+// to its Accept-Encoding header. The responses smaller than CompressionMinSize, the responses that already specify
+// their Content-Encoding and the responses of other media types are sent as they are.
+func CompressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressingWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the supported content coding with the highest quality in the provided Accept-Encoding
+// header, preferring gzip over deflate on equal quality. An empty string is returned if the client accepts neither.
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		qualities[coding] = q
+	}
+
+	quality := func(coding string) float64 {
+		if q, ok := qualities[coding]; ok {
+			return q
+		}
+		return qualities["*"]
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		if q := quality(coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// isCompressible checks whether the responses of the provided content type should be compressed.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressibleContentTypes[mediaType] || strings.HasSuffix(mediaType, "+json")
+}
+
+// compressingWriter buffers the beginning of the response until it can decide whether the response is worth
+// compressing and then either compresses or passes through the rest of it.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status     int
+	decided    bool
+	buffer     bytes.Buffer
+	compressor io.WriteCloser
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	// the responses without the body are not postponed
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.decided = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *compressingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if w.decided {
+		if w.compressor != nil {
+			return w.compressor.Write(data)
+		}
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buffer.Write(data)
+	if w.buffer.Len() < CompressionMinSize {
+		return len(data), nil
+	}
+
+	if err := w.decide(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// decide inspects the headers and the buffered beginning of the response, sends the headers to the client and writes
+// out the buffered data.
+func (w *compressingWriter) decide() error {
+	w.decided = true
+
+	header := w.Header()
+	if header.Get("Content-Type") == "" && w.buffer.Len() > 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buffer.Bytes()))
+	}
+
+	compressible := isCompressible(header.Get("Content-Type"))
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if compressible && header.Get("Content-Encoding") == "" && w.buffer.Len() >= CompressionMinSize {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		w.compressor = w.newCompressor()
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(w.buffer.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+	w.buffer.Reset()
+	return err
+}
+
+func (w *compressingWriter) newCompressor() io.WriteCloser {
+	if w.encoding == "gzip" {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w.ResponseWriter)
+		return &pooledGzipWriter{Writer: gz}
+	}
+
+	// the error is only returned for an invalid compression level
+	fl, _ := flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+	return fl
+}
+
+// Flush sends the data written so far to the client. The response is compressed only if enough data has been buffered
+// before the first flush.
+func (w *compressingWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 && w.buffer.Len() == 0 {
+			return
+		}
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		_ = w.decide()
+	}
+
+	if f, ok := w.compressor.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes out the rest of the response. It must be called after the handler has finished.
+func (w *compressingWriter) Close() {
+	if !w.decided && w.status != 0 {
+		_ = w.decide()
+	}
+
+	if w.compressor != nil {
+		_ = w.compressor.Close()
+	}
+}
+
+// pooledGzipWriter returns the gzip writer to the pool once the response is finished.
+type pooledGzipWriter struct {
+	*gzip.Writer
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Reset(io.Discard)
+	gzipWriters.Put(w.Writer)
+	w.Writer = nil
+	return err
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate, br"))
+	assert.Equal(t, "gzip", negotiateEncoding("deflate, gzip"))
+	assert.Equal(t, "deflate", negotiateEncoding("deflate"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0.5, deflate"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0, *"))
+	assert.Equal(t, "gzip", negotiateEncoding("*"))
+	assert.Equal(t, "", negotiateEncoding("br"))
+	assert.Equal(t, "", negotiateEncoding("identity"))
+	assert.Equal(t, "", negotiateEncoding(""))
+}
+
+func TestIsCompressible(t *testing.T) {
+	assert.True(t, isCompressible("text/html; charset=utf-8"))
+	assert.True(t, isCompressible("application/json"))
+	assert.True(t, isCompressible("application/problem+json"))
+	assert.False(t, isCompressible("image/png"))
+	assert.False(t, isCompressible(""))
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	body := strings.Repeat("<p>Hello, world!</p>", 100)
+
+	serve := func(acceptEncoding string, handler http.HandlerFunc) *http.Response {
+		req := httptest.NewRequest("GET", "/", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res := httptest.NewRecorder()
+		CompressionMiddleware(handler).ServeHTTP(res, req)
+		return res.Result()
+	}
+
+	html := func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(body))
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		res := serve("gzip", html)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+
+		r, err := gzip.NewReader(res.Body)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(data))
+	})
+
+	t.Run("deflate", func(t *testing.T) {
+		res := serve("deflate", html)
+		assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+
+		data, err := ioutil.ReadAll(flate.NewReader(res.Body))
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(data))
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		res := serve("", html)
+		assert.Empty(t, res.Header.Get("Content-Encoding"))
+
+		data, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, body, string(data))
+	})
+
+	t.Run("small response", func(t *testing.T) {
+		res := serve("gzip", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		})
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		assert.Empty(t, res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+
+		data, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, `{"ok":true}`, string(data))
+	})
+
+	t.Run("binary response", func(t *testing.T) {
+		res := serve("gzip", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(body))
+		})
+		assert.Empty(t, res.Header.Get("Content-Encoding"))
+		assert.Empty(t, res.Header.Get("Vary"))
+	})
+
+	t.Run("already encoded", func(t *testing.T) {
+		res := serve("gzip", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = w.Write([]byte(body))
+		})
+		assert.Equal(t, "br", res.Header.Get("Content-Encoding"))
+
+		data, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, body, string(data))
+	})
+
+	t.Run("sniffed content type", func(t *testing.T) {
+		res := serve("gzip", func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("<!DOCTYPE html>" + body))
+		})
+		assert.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/html"))
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		res := serve("gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", "https://sp.com")
+			w.WriteHeader(http.StatusFound)
+		})
+		assert.Equal(t, http.StatusFound, res.StatusCode)
+		assert.Equal(t, "https://sp.com", res.Header.Get("Location"))
+		assert.Empty(t, res.Header.Get("Content-Encoding"))
+		assert.Empty(t, res.Header.Get("Content-Type"))
+	})
+}
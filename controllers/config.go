@@ -0,0 +1,332 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"gopkg.in/yaml.v3"
+)
+
+// OAuthServiceConfiguration is the configuration of the OAuth service. It extends the configuration read from
+// the configuration file with the options that are specified on the command line.
+type OAuthServiceConfiguration struct {
+	FileConfiguration
+
+	// AllowedOrigins is the list of origins that are allowed to read the JSON responses of the OAuth service using
+	// CORS.
+	AllowedOrigins []string
+
+	// PathPrefix is the path under which all the endpoints of the service are exposed, e.g. `/api/spi-oauth` when
+	// the service is running behind an ingress path. It is either empty or starts with a slash and has no trailing
+	// slash (see NormalizePathPrefix).
+	PathPrefix string
+
+	// TrustedProxies is the list of networks of the reverse proxies allowed to override the base URL and the path
+	// prefix of the service using the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers.
+	TrustedProxies TrustedProxies
+
+	// VerboseErrors enables showing the details of the errors to the end users. By default, the users only see
+	// a generic message and a correlation ID, and the details are only logged.
+	VerboseErrors bool
+
+	// ConsentPreview enables the page listing the requested scopes and the target SPIAccessToken that the users need
+	// to confirm before they are redirected to the service provider.
+	ConsentPreview bool
+
+	// DisableCompression turns off the gzip and deflate compression of the HTML and JSON responses.
+	DisableCompression bool
+
+	// Events is the optional publisher of the events of the OAuth flows.
+	Events FlowEventPublisher
+
+	// AuthorizedLinks is the store of the pre-authorized links shared by all the service providers. It survives
+	// the configuration reloads, so that the links minted before a reload can still be used.
+	AuthorizedLinks *AuthorizedLinks
+
+	// Stats optionally aggregates the outcomes of the OAuth flows served by the stats endpoint. It survives
+	// the configuration reloads.
+	Stats *FlowStats
+
+	// Identities optionally enrich the Kubernetes usernames recorded in the flow events and the logs with
+	// the organizational identities of the users.
+	Identities IdentityEnricher
+
+	// Anonymous is the optional mode letting the users initiate the OAuth flows without their Kubernetes token.
+	Anonymous *AnonymousMode
+
+	// DryRun makes the service perform the OAuth flows without storing the tokens or changing anything in the cluster.
+	// The would-be actions are logged instead.
+	DryRun bool
+
+	// StorageRetries is the optional queue of the tokens that failed to be stored at the time of the callback. If not
+	// set, the tokens that fail to be stored are discarded and the users need to repeat the OAuth flow.
+	StorageRetries *StorageRetryQueue
+
+	// Workers is the optional limit of the concurrency of the stages of the callback processing. It is shared by all
+	// the service providers and survives the configuration reloads.
+	Workers *WorkerPool
+
+	// StorageGc is the optional garbage collection of the data of the deleted SPIAccessTokens in the token storage.
+	StorageGc *StorageGarbageCollector
+
+	// CredentialsMonitor optionally validates the client credentials of the service providers in the background and
+	// warns about the credentials that are rejected or about to expire.
+	CredentialsMonitor *CredentialsMonitor
+
+	// ProviderMetadata caches the metadata of the service providers configured with the discovery and refreshes it in
+	// the background. It survives the configuration reloads.
+	ProviderMetadata *ProviderMetadataCache
+
+	// KubernetesMonitor optionally checks that the Kubernetes API server accepts the credentials of the service and
+	// re-initializes the Kubernetes client if it doesn't.
+	KubernetesMonitor *KubernetesClientMonitor
+
+	// Fips restricts the signing of the client assertions and the verification of the ID tokens to the algorithms and
+	// keys approved in the FIPS mode. The rest of the configuration needs to be checked using ValidateFips before
+	// the service starts.
+	Fips bool
+
+	// FaultInjection enables injecting the faults into the processing of the requests, either the Faults or the ones
+	// requested in the FaultInjectionHeader of the requests. Meant only for the end-to-end testing.
+	FaultInjection bool
+
+	// Faults are the faults injected into the processing of every request if the FaultInjection is enabled.
+	Faults Faults
+}
+
+// FileConfiguration is the configuration of the OAuth service read from the configuration file. It consists of
+// the configuration shared with the SPI operator and the options that only make sense for the OAuth service.
+type FileConfiguration struct {
+	config.Configuration
+	PersistedServiceConfiguration
+}
+
+// PersistedServiceConfiguration is the part of the configuration file specific to the OAuth service. These options are
+// ignored by the SPI operator.
+type PersistedServiceConfiguration struct {
+	// Storage selects the token storage backend and its options.
+	Storage tokenstorage.Configuration `yaml:"storage,omitempty"`
+
+	// ServiceProviderExtensions are the options of the service providers specific to the OAuth service. They are read
+	// from the same `serviceProviders` entries as the configuration shared with the SPI operator and are matched with
+	// it using the type of the service provider.
+	ServiceProviderExtensions []ServiceProviderExtensions `yaml:"serviceProviders,omitempty"`
+
+	// State configures the verification of the environment the OAuth states have been issued for.
+	State StateValidation `yaml:"state,omitempty"`
+
+	// Maintenance configures the maintenance window during which no new flows are started.
+	Maintenance Maintenance `yaml:"maintenance,omitempty"`
+}
+
+// ServiceProviderExtensions are the options of a single service provider that only the OAuth service understands.
+type ServiceProviderExtensions struct {
+	// Type is the type of the service provider the options apply to.
+	Type config.ServiceProviderType `yaml:"type"`
+
+	// CallbackUrl overrides the redirect URL sent to the service provider, which is otherwise derived from the base URL
+	// of the service. This is needed if the service provider only accepts the redirect URLs on a registered domain
+	// different from the one of the base URL. The URL must be routed to the callback endpoint of the service provider.
+	CallbackUrl string `yaml:"callbackUrl,omitempty"`
+
+	// OrganizationApps are the OAuth applications owned by the organizations in the service provider. The flows
+	// targeting a repository of such an organization use its application instead of the one configured by clientId and
+	// clientSecret. Only supported by Quay.
+	OrganizationApps []OrganizationApp `yaml:"organizationApps,omitempty"`
+
+	// ClientAuthentication configures how the OAuth service authenticates with the token endpoint of the service
+	// provider.
+	ClientAuthentication ClientAuthentication `yaml:"clientAuthentication,omitempty"`
+
+	// PushedAuthorization configures the pushed authorization requests (RFC 9126).
+	PushedAuthorization PushedAuthorization `yaml:"pushedAuthorization,omitempty"`
+
+	// ScopeDescriptions are the plain-language explanations of the scopes shown on the consent preview page, keyed by
+	// the scope. They take precedence over the built-in explanations.
+	ScopeDescriptions map[string]string `yaml:"scopeDescriptions,omitempty"`
+
+	// TokenValidation configures the checks of the tokens returned by the token endpoint before they are stored.
+	TokenValidation TokenValidation `yaml:"tokenValidation,omitempty"`
+
+	// Automation configures the restrictions of the flows initiated by the automations instead of the human users.
+	Automation AutomationPolicy `yaml:"automation,omitempty"`
+
+	// ClientSecretExpiresAt is the time at which the client secret of the default OAuth application expires, e.g. as
+	// shown by Azure AD when the secret is created. The service providers don't tell the applications themselves, so
+	// the time has to be configured for the credentials monitor to warn before the secret expires.
+	ClientSecretExpiresAt time.Time `yaml:"clientSecretExpiresAt,omitempty"`
+
+	// Features switch the service provider and the features of its flows on and off, also for only a fraction of
+	// the SPIAccessTokens.
+	Features FeatureFlags `yaml:"features,omitempty"`
+
+	// Discovery takes the endpoints of the service provider and the keys signing its ID tokens from its metadata
+	// document instead of the built-in ones.
+	Discovery ProviderDiscovery `yaml:"discovery,omitempty"`
+}
+
+// The modes of the pushed authorization requests.
+const (
+	// PushedAuthorizationDisabled sends the authorization parameters through the browser. This is the default.
+	PushedAuthorizationDisabled = "disabled"
+	// PushedAuthorizationPreferred pushes the authorization parameters to the service provider and falls back to
+	// sending them through the browser if the push fails.
+	PushedAuthorizationPreferred = "preferred"
+	// PushedAuthorizationRequired pushes the authorization parameters to the service provider and fails the flow if
+	// the push fails.
+	PushedAuthorizationRequired = "required"
+)
+
+// PushedAuthorization configures the pushed authorization requests. When enabled, the authorization parameters
+// (including the scopes and the state) are sent to the service provider directly and the browser is redirected with
+// only the returned request_uri.
+type PushedAuthorization struct {
+	// Mode is one of `disabled`, `preferred` or `required`. Defaults to `disabled`.
+	Mode string `yaml:"mode,omitempty"`
+
+	// Endpoint is the URL of the pushed authorization request endpoint of the service provider. Required unless
+	// the mode is `disabled`.
+	Endpoint string `yaml:"endpoint,omitempty"`
+}
+
+// enabled checks whether the pushed authorization requests are used.
+func (p *PushedAuthorization) enabled() bool {
+	return p.Mode != "" && p.Mode != PushedAuthorizationDisabled
+}
+
+// The methods of the client authentication with the token endpoint of the service provider.
+const (
+	// ClientSecretBasic sends the client secret in the Authorization header.
+	ClientSecretBasic = "client_secret_basic"
+	// ClientSecretPost sends the client secret in the body of the request.
+	ClientSecretPost = "client_secret_post"
+	// PrivateKeyJwt sends a JWT client assertion signed by the private key of the client instead of the client secret.
+	PrivateKeyJwt = "private_key_jwt"
+	// TlsClientAuth authenticates using the TLS client certificate issued by a CA trusted by the service provider
+	// (RFC 8705).
+	TlsClientAuth = "tls_client_auth"
+	// SelfSignedTlsClientAuth authenticates using the self-signed TLS client certificate registered with the service
+	// provider (RFC 8705).
+	SelfSignedTlsClientAuth = "self_signed_tls_client_auth"
+)
+
+// usesClientSecret checks whether the client authentication method sends the client secret to the token endpoint.
+func usesClientSecret(method string) bool {
+	switch method {
+	case PrivateKeyJwt, TlsClientAuth, SelfSignedTlsClientAuth:
+		return false
+	default:
+		return true
+	}
+}
+
+// ClientAuthentication configures the client authentication with the token endpoint of the service provider.
+type ClientAuthentication struct {
+	// Method is one of `client_secret_basic`, `client_secret_post`, `private_key_jwt`, `tls_client_auth` or
+	// `self_signed_tls_client_auth`. By default, the client secret is sent in the way the token endpoint accepts.
+	Method string `yaml:"method,omitempty"`
+
+	// PrivateKeyPath is the path to the PEM-encoded private key signing the client assertions, e.g. mounted from
+	// a Secret. Only used with the `private_key_jwt` method. The file is re-read for every token exchange so that
+	// the rotated keys are picked up.
+	PrivateKeyPath string `yaml:"privateKeyPath,omitempty"`
+
+	// PrivateKey is the PEM-encoded private key signing the client assertions. It is an alternative to PrivateKeyPath
+	// useful when the whole configuration is read from a Secret.
+	PrivateKey string `yaml:"privateKey,omitempty"`
+
+	// KeyId is the optional ID of the key put in the `kid` header of the client assertions.
+	KeyId string `yaml:"keyId,omitempty"`
+
+	// CertificatePath is the optional path to the PEM-encoded certificate of the private key. If set, its thumbprint is
+	// put in the `x5t` header of the client assertions as required e.g. by Azure AD.
+	CertificatePath string `yaml:"certificatePath,omitempty"`
+
+	// Audience is the audience of the client assertions. Defaults to the URL of the token endpoint.
+	Audience string `yaml:"audience,omitempty"`
+
+	// SigningAlgorithm is the algorithm used to sign the client assertions, e.g. `RS256` or `ES256`. Defaults to
+	// `RS256` for RSA keys and to the algorithm matching the curve for EC keys.
+	SigningAlgorithm string `yaml:"signingAlgorithm,omitempty"`
+
+	// TlsCertificatePath and TlsKeyPath are the paths to the PEM-encoded client certificate and its private key
+	// presented to the token endpoint. Required by the `tls_client_auth` and `self_signed_tls_client_auth` methods.
+	// With the other methods, the certificate is presented in addition to the other credentials, e.g. to obtain
+	// certificate-bound access tokens. The files are re-read for every new connection so that the rotated
+	// certificates are picked up.
+	TlsCertificatePath string `yaml:"tlsCertificatePath,omitempty"`
+	TlsKeyPath         string `yaml:"tlsKeyPath,omitempty"`
+
+	// TlsCaPath is the optional path to the PEM-encoded bundle used to verify the certificate of the token endpoint
+	// instead of the system roots.
+	TlsCaPath string `yaml:"tlsCaPath,omitempty"`
+}
+
+// OrganizationApp is an OAuth application owned by an organization in the service provider.
+type OrganizationApp struct {
+	Organization string `yaml:"organization"`
+	ClientId     string `yaml:"clientId"`
+	ClientSecret string `yaml:"clientSecret"`
+	// ClientSecretExpiresAt is the optional time at which the client secret of the application expires.
+	ClientSecretExpiresAt time.Time `yaml:"clientSecretExpiresAt,omitempty"`
+}
+
+// ServiceProviderExtensionsFor returns the extensions configured for the service provider of the provided type.
+func (c *FileConfiguration) ServiceProviderExtensionsFor(spType config.ServiceProviderType) ServiceProviderExtensions {
+	for _, ext := range c.ServiceProviderExtensions {
+		if ext.Type == spType {
+			return ext
+		}
+	}
+	return ServiceProviderExtensions{Type: spType}
+}
+
+// LoadFileConfiguration loads the configuration of the service from the provided file.
+func LoadFileConfiguration(path string) (FileConfiguration, error) {
+	shared, err := config.LoadFrom(path)
+	if err != nil {
+		return FileConfiguration{}, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return FileConfiguration{}, err
+	}
+
+	service := PersistedServiceConfiguration{}
+	if err = yaml.Unmarshal(data, &service); err != nil {
+		return FileConfiguration{}, fmt.Errorf("failed to parse the OAuth service configuration: %w", err)
+	}
+
+	return FileConfiguration{
+		Configuration:                 shared,
+		PersistedServiceConfiguration: service,
+	}, nil
+}
+
+// NormalizePathPrefix converts the user-provided path prefix to the form expected in the OAuthServiceConfiguration,
+// i.e. adds the leading slash and removes the trailing one. The root path is represented by an empty string.
+func NormalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePathPrefix(t *testing.T) {
+	assert.Equal(t, "", NormalizePathPrefix(""))
+	assert.Equal(t, "", NormalizePathPrefix("/"))
+	assert.Equal(t, "/api/spi-oauth", NormalizePathPrefix("api/spi-oauth"))
+	assert.Equal(t, "/api/spi-oauth", NormalizePathPrefix("/api/spi-oauth/"))
+}
+
+func TestPathPrefixInGeneratedUrls(t *testing.T) {
+	cfg := OAuthServiceConfiguration{
+		FileConfiguration: FileConfiguration{Configuration: config.Configuration{BaseUrl: "https://spi.on.my.machine/"}},
+		PathPrefix:        "/api/spi-oauth",
+	}
+
+	c, err := FromConfiguration(cfg, config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+		ClientId:            "id",
+		ClientSecret:        "secret",
+	}, nil, nil, nil, nil)
+	assert.NoError(t, err)
+
+	cc := c.(*commonController)
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "https://spi.on.my.machine/api/spi-oauth/github/callback", cc.redirectUrl(r))
+	assert.Equal(t, "https://spi.on.my.machine/api/spi-oauth/github/authenticate", cc.authenticateUrl(r))
+	assert.Equal(t, "https://spi.on.my.machine/api/spi-oauth/callback_success", cc.serviceUrl(r, "/callback_success"))
+}
+
+func TestSharedAuthorizedLinks(t *testing.T) {
+	links := NewAuthorizedLinks(DefaultAuthorizedLinkTtl)
+	cfg := OAuthServiceConfiguration{AuthorizedLinks: links}
+	sp := config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub, ClientId: "id", ClientSecret: "secret"}
+
+	// the controllers re-created after a configuration reload keep using the same links
+	first, err := FromConfiguration(cfg, sp, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	second, err := FromConfiguration(cfg, sp, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Same(t, links, first.(*commonController).AuthorizedLinks)
+	assert.Same(t, links, second.(*commonController).AuthorizedLinks)
+}
+
+func TestLoadFileConfiguration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+sharedSecret: secret
+baseUrl: https://spi.on.my.machine
+serviceProviders:
+- type: GitHub
+  clientId: id
+  clientSecret: secret
+- type: Quay
+  clientId: quay-id
+  clientSecret: quay-secret
+  organizationApps:
+  - organization: myorg
+    clientId: org-id
+    clientSecret: org-secret
+storage:
+  type: vault
+  options:
+    role: custom-role
+`), 0600))
+
+	cfg, err := LoadFileConfiguration(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://spi.on.my.machine", cfg.BaseUrl)
+	assert.Len(t, cfg.ServiceProviders, 2)
+	assert.Equal(t, "vault", cfg.Storage.Type)
+	assert.Empty(t, cfg.ServiceProviderExtensionsFor(config.ServiceProviderTypeGitHub).OrganizationApps)
+	assert.Equal(t, []OrganizationApp{{Organization: "myorg", ClientId: "org-id", ClientSecret: "org-secret"}},
+		cfg.ServiceProviderExtensionsFor(config.ServiceProviderTypeQuay).OrganizationApps)
+	assert.Contains(t, FileConfigurationSecrets(cfg), "org-secret")
+
+	opts := struct {
+		Role string `yaml:"role"`
+	}{}
+	assert.NoError(t, cfg.Storage.Options.Decode(&opts))
+	assert.Equal(t, "custom-role", opts.Role)
+
+	_, err = LoadFileConfiguration(filepath.Join(t.TempDir(), "nonexistent.yaml"))
+	assert.Error(t, err)
+}
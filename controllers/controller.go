@@ -16,10 +16,12 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"html/template"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/alexedwards/scs"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
 	"golang.org/x/oauth2"
@@ -33,8 +35,44 @@ type Controller interface {
 	// compose the authenticated OAuth state and return a redirect to the service-provider OAuth endpoint with the state.
 	Authenticate(w http.ResponseWriter, r *http.Request)
 
+	// AuthenticateLink checks that the request is authenticated in Kubernetes and mints a short-lived single-use link
+	// that initiates the OAuth flow on behalf of the authenticated user when opened in the browser. This way, the user
+	// doesn't need to present the Kubernetes token in the browser at all.
+	AuthenticateLink(w http.ResponseWriter, r *http.Request)
+
 	// Callback finishes the OAuth flow. It handles the final redirect from the OAuth flow of the service provider.
 	Callback(ctx context.Context, w http.ResponseWriter, r *http.Request)
+
+	// Refresh obtains a new access token for the SPIAccessToken using its stored refresh token. The request needs to be
+	// authenticated in Kubernetes. The rotated refresh token replaces the stored one, an invalidated refresh token
+	// causes the token data to be deleted so that the SPIAccessToken needs to be authorized again.
+	Refresh(w http.ResponseWriter, r *http.Request)
+
+	// Lookup finds an already stored token in the namespace that is usable for the repository with the required scopes,
+	// so that the user doesn't need to go through the OAuth flow again. The request needs to be authenticated in
+	// Kubernetes.
+	Lookup(w http.ResponseWriter, r *http.Request)
+
+	// Reauthorize mints a link initiating a new OAuth flow for an existing SPIAccessToken whose stored token is missing,
+	// expired or invalid, with the same scopes as the original one. The request needs to be authenticated in
+	// Kubernetes.
+	Reauthorize(w http.ResponseWriter, r *http.Request)
+
+	// SelfCheck checks that the configuration of the service provider still works in the environment, i.e. that
+	// the callback URL resolves and that the service provider accepts the client credentials.
+	SelfCheck(r *http.Request) []SelfCheckResult
+
+	// CheckCredentials validates the client credentials of all the OAuth applications of the service provider and
+	// finds out when they expire, if that is known. It is called periodically by the CredentialsMonitor.
+	CheckCredentials(ctx context.Context) []CredentialsStatus
+
+	// DiscoveryUrl returns the URL of the metadata document of the service provider, whose metadata is kept fresh by
+	// the ProviderMetadataCache. Empty if the discovery isn't configured.
+	DiscoveryUrl() string
+
+	// DiscoveryClient returns the HTTP client fetching the metadata of the service provider, i.e. the one presenting
+	// the configured TLS client certificate, if any, or the one provided in the context.
+	DiscoveryClient(ctx context.Context) *http.Client
 }
 
 // oauthFinishResult is an enum listing the possible results of authentication during the commonController.finishOAuthExchange
@@ -49,32 +87,171 @@ const (
 
 // FromConfiguration is a factory function to create instances of the Controller based on the service provider
 // configuration.
-func FromConfiguration(fullConfig config.Configuration, spConfig config.ServiceProviderConfiguration, sessionManager *scs.Manager, cl AuthenticatingClient, storage tokenstorage.TokenStorage, redirectTemplate *template.Template) (Controller, error) {
+func FromConfiguration(fullConfig OAuthServiceConfiguration, spConfig config.ServiceProviderConfiguration, sessionManager *scs.Manager, cl AuthenticatingClient, storage tokenstorage.TokenStorage, templates *Templates) (Controller, error) {
 	// use the notifying token storage to automatically inform the cluster about changes in the token storage
 	ts := &tokenstorage.NotifyingTokenStorage{
 		Client:       cl,
 		TokenStorage: storage,
 	}
 
+	extensions := fullConfig.ServiceProviderExtensionsFor(spConfig.ServiceProviderType)
+	if err := validateServiceProviderConfiguration(spConfig, extensions); err != nil {
+		return nil, err
+	}
+
 	var endpoint oauth2.Endpoint
+	var repositoryOrganization func(string) string
+	var capabilityProbeUrl string
 
 	switch spConfig.ServiceProviderType {
 	case config.ServiceProviderTypeGitHub:
 		endpoint = github.Endpoint
+		capabilityProbeUrl = githubUserApiUrl
 	case config.ServiceProviderTypeQuay:
 		endpoint = quayEndpoint
+		repositoryOrganization = quayRepositoryOrganization
 	default:
-		return nil, fmt.Errorf("not implemented yet")
+		return nil, fmt.Errorf("service provider type %s not implemented yet", spConfig.ServiceProviderType)
+	}
+
+	if len(extensions.OrganizationApps) > 0 && repositoryOrganization == nil {
+		return nil, fmt.Errorf("the service provider %s doesn't support organization applications", spConfig.ServiceProviderType)
+	}
+	orgApps, err := organizationApps(extensions.OrganizationApps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid organization applications of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+
+	if err = fullConfig.Maintenance.validate(); err != nil {
+		return nil, fmt.Errorf("invalid maintenance window: %w", err)
+	}
+
+	assertions, err := newClientAssertions(extensions.ClientAuthentication, fullConfig.Fips)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client authentication of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	if extensions.ClientAuthentication.Method != "" {
+		endpoint.AuthStyle = authStyle(extensions.ClientAuthentication)
+	}
+	tokenClient, err := newTokenEndpointClient(extensions.ClientAuthentication)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client authentication of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	if err = validatePushedAuthorization(extensions.PushedAuthorization); err != nil {
+		return nil, fmt.Errorf("invalid pushed authorization configuration of the service provider %s: %w", spConfig.ServiceProviderType, err)
 	}
+	if err = validateTokenValidation(extensions.TokenValidation); err != nil {
+		return nil, fmt.Errorf("invalid token validation configuration of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	if err = validateAutomationPolicy(extensions.Automation); err != nil {
+		return nil, fmt.Errorf("invalid automation policy of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	if err = validateFeatureFlags(extensions.Features); err != nil {
+		return nil, fmt.Errorf("invalid features of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	if err = validateProviderDiscovery(extensions.Discovery); err != nil {
+		return nil, fmt.Errorf("invalid discovery of the service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	metadata := fullConfig.ProviderMetadata
+	if metadata == nil {
+		metadata = NewProviderMetadataCache(0, 0)
+	}
+	links := fullConfig.AuthorizedLinks
+	if links == nil {
+		links = NewAuthorizedLinks(DefaultAuthorizedLinkTtl)
+	}
+
+	// the artifacts are stored directly, the operator is notified when the token itself is stored
+	artifacts, _ := storage.(oauthstorage.ArtifactStorage)
 
 	return &commonController{
-		Config:           spConfig,
-		JwtSigningSecret: fullConfig.SharedSecret,
-		K8sClient:        cl,
-		TokenStorage:     ts,
-		Endpoint:         endpoint,
-		BaseUrl:          fullConfig.BaseUrl,
-		SessionManager:   sessionManager,
-		RedirectTemplate: redirectTemplate,
+		Config:                 spConfig,
+		JwtSigningSecret:       fullConfig.SharedSecret,
+		K8sClient:              cl,
+		TokenStorage:           ts,
+		ArtifactStorage:        artifacts,
+		Endpoint:               endpoint,
+		BaseUrl:                fullConfig.BaseUrl,
+		PathPrefix:             fullConfig.PathPrefix,
+		TrustedProxies:         fullConfig.TrustedProxies,
+		SessionManager:         sessionManager,
+		Templates:              templates,
+		AuthorizedLinks:        links,
+		AllowedOrigins:         fullConfig.AllowedOrigins,
+		ErrorPages:             &ErrorPages{Templates: templates, Verbose: fullConfig.VerboseErrors},
+		OrganizationApps:       orgApps,
+		RepositoryOrganization: repositoryOrganization,
+		stateCodecs:            &stateCodecCache{},
+		clientAssertions:       assertions,
+		clientAuthMethod:       extensions.ClientAuthentication.Method,
+		tokenEndpointClient:    tokenClient,
+		pushedAuthorization:    extensions.PushedAuthorization,
+		ConsentPreview:         fullConfig.ConsentPreview,
+		scopeDescriptions:      extensions.ScopeDescriptions,
+		tokenValidation:        extensions.TokenValidation,
+		stateValidation:        fullConfig.State,
+		maintenance:            fullConfig.Maintenance,
+		callbackUrl:            extensions.CallbackUrl,
+		automationPolicy:       extensions.Automation,
+		capabilityProbeUrl:     capabilityProbeUrl,
+		clientSecretExpiresAt:  extensions.ClientSecretExpiresAt,
+		clientCertificates:     clientCertificates(extensions.ClientAuthentication),
+		features:               extensions.Features,
+		fips:                   fullConfig.Fips,
+		discovery:              extensions.Discovery,
+		ProviderMetadata:       metadata,
+		Events:                 fullConfig.Events,
+		Stats:                  fullConfig.Stats,
+		Identities:             fullConfig.Identities,
+		StorageRetries:         fullConfig.StorageRetries,
+		Workers:                fullConfig.Workers,
+		Anonymous:              fullConfig.Anonymous,
 	}, nil
 }
+
+// organizationApps validates the configured organization applications and indexes them by the organization.
+func organizationApps(apps []OrganizationApp) (map[string]OrganizationApp, error) {
+	ret := make(map[string]OrganizationApp, len(apps))
+	for _, app := range apps {
+		if app.Organization == "" || app.ClientId == "" || app.ClientSecret == "" {
+			return nil, fmt.Errorf("the organization, clientId and clientSecret must be specified for all the organization applications")
+		}
+		org := strings.ToLower(app.Organization)
+		if _, ok := ret[org]; ok {
+			return nil, fmt.Errorf("duplicate application of the organization '%s'", app.Organization)
+		}
+		ret[org] = app
+	}
+	return ret, nil
+}
+
+// validateServiceProviderConfiguration checks that the service provider configuration contains all the information
+// needed to perform the OAuth flow.
+func validateServiceProviderConfiguration(spConfig config.ServiceProviderConfiguration, extensions ServiceProviderExtensions) error {
+	if spConfig.ClientId == "" {
+		return fmt.Errorf("the client ID of the service provider %s is not configured", spConfig.ServiceProviderType)
+	}
+
+	// the client secret is not needed when authenticating using the client assertions or certificates
+	if spConfig.ClientSecret == "" && usesClientSecret(extensions.ClientAuthentication.Method) {
+		return fmt.Errorf("the client secret of the service provider %s is not configured", spConfig.ServiceProviderType)
+	}
+
+	if extensions.CallbackUrl != "" {
+		if err := validateCallbackUrl(extensions.CallbackUrl); err != nil {
+			return fmt.Errorf("invalid callback URL of the service provider %s: %w", spConfig.ServiceProviderType, err)
+		}
+	}
+
+	if spConfig.ServiceProviderBaseUrl != "" {
+		u, err := url.Parse(spConfig.ServiceProviderBaseUrl)
+		if err != nil {
+			return fmt.Errorf("invalid base URL of the service provider %s: %w", spConfig.ServiceProviderType, err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("the base URL of the service provider %s is not an absolute URL", spConfig.ServiceProviderType)
+		}
+	}
+
+	return nil
+}
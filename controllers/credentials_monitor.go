@@ -0,0 +1,288 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultCredentialsCheckInterval is the default interval between the checks of the client credentials.
+	DefaultCredentialsCheckInterval = 6 * time.Hour
+
+	// DefaultCredentialsExpiryWarning is the default time before the expiry of a client credential since which
+	// the credentials monitor warns about it.
+	DefaultCredentialsExpiryWarning = 14 * 24 * time.Hour
+)
+
+// The kinds of the client credentials whose expiry is monitored.
+const (
+	credentialClientSecret         = "client-secret"
+	credentialAssertionCertificate = "assertion-certificate"
+	credentialTlsCertificate       = "tls-certificate"
+)
+
+var (
+	clientCredentialsValid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client_credentials",
+		Name:      "valid",
+		Help:      "Whether the token endpoint of the service provider accepted (1) or rejected (0) the client credentials of the OAuth application in the last check. Missing if the credentials could not be validated.",
+	}, []string{"service_provider", "organization"})
+	clientCredentialsExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client_credentials",
+		Name:      "expiry_timestamp_seconds",
+		Help:      "The time at which the client credential of the OAuth application expires as a Unix timestamp. Only reported for the credentials whose expiry is known.",
+	}, []string{"service_provider", "organization", "credential"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(clientCredentialsValid, clientCredentialsExpiry)
+}
+
+// CredentialExpiry is the known expiry of a single client credential.
+type CredentialExpiry struct {
+	// Credential is the kind of the credential, i.e. `client-secret`, `assertion-certificate` or `tls-certificate`.
+	Credential string
+	ExpiresAt  time.Time
+}
+
+// CredentialsStatus is the result of the check of the client credentials of a single OAuth application.
+type CredentialsStatus struct {
+	ServiceProvider string
+	// Organization is the organization owning the OAuth application. Empty for the default application.
+	Organization string
+	// Accepted is true if the token endpoint accepted the client credentials.
+	Accepted bool
+	// Err explains why the client credentials were not accepted. It wraps errClientCredentialsRejected if the token
+	// endpoint rejected them, the other errors mean that the credentials could not be validated. Both Accepted and
+	// Err are zero if the service provider has no token endpoint to validate the credentials with.
+	Err error
+	// Expiries are the known expiries of the client credentials.
+	Expiries []CredentialExpiry
+}
+
+// Rejected checks whether the token endpoint rejected the client credentials.
+func (s CredentialsStatus) Rejected() bool {
+	return errors.Is(s.Err, errClientCredentialsRejected)
+}
+
+// CredentialsMonitor periodically validates the client credentials of all the configured service providers and
+// checks when they expire, so that a revoked or silently expired client secret is noticed before the OAuth flows
+// start failing. The outcomes are logged and exposed in the metrics. The credentials are validated the same way as
+// by the self-check, i.e. by exchanging a made-up authorization code at the token endpoint. The expiry of the
+// certificates is read from the certificates themselves, the expiry of the client secrets needs to be configured.
+type CredentialsMonitor struct {
+	interval time.Duration
+	warning  time.Duration
+
+	lock             sync.Mutex
+	serviceProviders *ServiceProviders
+}
+
+// NewCredentialsMonitor creates the credentials monitor running every interval and warning about the credentials
+// expiring within the warning period. The zero durations are replaced by DefaultCredentialsCheckInterval and
+// DefaultCredentialsExpiryWarning. SetServiceProviders must be called before the monitor is started.
+func NewCredentialsMonitor(interval time.Duration, warning time.Duration) *CredentialsMonitor {
+	if interval <= 0 {
+		interval = DefaultCredentialsCheckInterval
+	}
+	if warning <= 0 {
+		warning = DefaultCredentialsExpiryWarning
+	}
+	return &CredentialsMonitor{interval: interval, warning: warning}
+}
+
+// SetServiceProviders sets the service providers whose credentials are checked. It is called again when
+// the configuration changes.
+func (m *CredentialsMonitor) SetServiceProviders(sps *ServiceProviders) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.serviceProviders = sps
+}
+
+// Start checks the credentials right away and then in the background every interval until the context is done.
+func (m *CredentialsMonitor) Start(ctx context.Context) {
+	go func() {
+		m.Check(ctx, time.Now())
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.Check(ctx, now)
+			}
+		}
+	}()
+}
+
+// Check performs a single check of the credentials of all the service providers, logs the problems found and records
+// the outcome in the metrics. The service providers whose controllers fail to initialize are skipped, their failure
+// is reported when the router is built.
+func (m *CredentialsMonitor) Check(ctx context.Context, now time.Time) []CredentialsStatus {
+	m.lock.Lock()
+	sps := m.serviceProviders
+	m.lock.Unlock()
+
+	statuses := []CredentialsStatus{}
+	if sps == nil {
+		return statuses
+	}
+	for _, sp := range sps.Providers {
+		controller, err := sp.Controller()
+		if err != nil {
+			continue
+		}
+		statuses = append(statuses, controller.CheckCredentials(ctx)...)
+	}
+	if ctx.Err() != nil {
+		// keep the outcome of the previous check instead of the one of the interrupted check
+		return statuses
+	}
+
+	clientCredentialsValid.Reset()
+	clientCredentialsExpiry.Reset()
+	for _, status := range statuses {
+		m.record(status, now)
+	}
+	return statuses
+}
+
+// record logs the problems of the credentials of a single OAuth application and records them in the metrics.
+func (m *CredentialsMonitor) record(status CredentialsStatus, now time.Time) {
+	log := zap.L().With(zap.String("serviceProvider", status.ServiceProvider), zap.String("organization", status.Organization))
+
+	switch {
+	case status.Accepted:
+		clientCredentialsValid.WithLabelValues(status.ServiceProvider, status.Organization).Set(1)
+	case status.Rejected():
+		clientCredentialsValid.WithLabelValues(status.ServiceProvider, status.Organization).Set(0)
+		log.Error("the service provider rejected the client credentials, the OAuth flows will fail until they are fixed", zap.Error(status.Err))
+	case status.Err != nil:
+		log.Warn("failed to validate the client credentials", zap.Error(status.Err))
+	}
+
+	for _, expiry := range status.Expiries {
+		clientCredentialsExpiry.WithLabelValues(status.ServiceProvider, status.Organization, expiry.Credential).Set(float64(expiry.ExpiresAt.Unix()))
+
+		remaining := expiry.ExpiresAt.Sub(now)
+		if remaining <= 0 {
+			log.Error("the client credential has expired", zap.String("credential", expiry.Credential), zap.Time("expiresAt", expiry.ExpiresAt))
+		} else if remaining < m.warning {
+			log.Warn("the client credential expires soon", zap.String("credential", expiry.Credential), zap.Time("expiresAt", expiry.ExpiresAt), zap.Duration("remaining", remaining))
+		}
+	}
+}
+
+func (c commonController) CheckCredentials(ctx context.Context) []CredentialsStatus {
+	spType := string(c.Config.ServiceProviderType)
+
+	// there is no request of a user, so the callback URL sent with the probe is derived from the base URL
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+
+	statuses := []CredentialsStatus{}
+	for _, organization := range c.applicationOrganizations() {
+		status := CredentialsStatus{ServiceProvider: spType, Organization: organization}
+		if c.Endpoint.TokenURL != "" || c.discovery.Url != "" {
+			status.Err = c.probeClientCredentials(r, organization)
+			status.Accepted = status.Err == nil
+		}
+
+		secretExpiresAt := c.clientSecretExpiresAt
+		if organization != "" {
+			secretExpiresAt = c.OrganizationApps[organization].ClientSecretExpiresAt
+		}
+		if !secretExpiresAt.IsZero() {
+			status.Expiries = append(status.Expiries, CredentialExpiry{Credential: credentialClientSecret, ExpiresAt: secretExpiresAt})
+		}
+
+		// the client authentication, and therefore the certificates, is shared by all the applications
+		if organization == "" {
+			status.Expiries = append(status.Expiries, c.certificateExpiries()...)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// certificateExpiries reads the expiry of the certificates authenticating the client. The certificates are re-read
+// every time, so that the rotated ones are picked up. The certificates that cannot be read are only logged, using them
+// fails the validation of the credentials anyway.
+func (c commonController) certificateExpiries() []CredentialExpiry {
+	expiries := []CredentialExpiry{}
+	for _, credential := range []string{credentialAssertionCertificate, credentialTlsCertificate} {
+		path, ok := c.clientCertificates[credential]
+		if !ok {
+			continue
+		}
+		notAfter, err := certificateNotAfter(path)
+		if err != nil {
+			zap.L().Warn("failed to read the expiry of the client certificate", zap.String("serviceProvider", string(c.Config.ServiceProviderType)), zap.String("credential", credential), zap.Error(err))
+			continue
+		}
+		expiries = append(expiries, CredentialExpiry{Credential: credential, ExpiresAt: notAfter})
+	}
+	return expiries
+}
+
+// clientCertificates returns the paths of the certificates configured for the client authentication keyed by the kind
+// of the credential.
+func clientCertificates(cfg ClientAuthentication) map[string]string {
+	ret := map[string]string{}
+	if cfg.CertificatePath != "" {
+		ret[credentialAssertionCertificate] = cfg.CertificatePath
+	}
+	if cfg.TlsCertificatePath != "" {
+		ret[credentialTlsCertificate] = cfg.TlsCertificatePath
+	}
+	return ret
+}
+
+// certificateNotAfter returns the expiry of the first certificate in the PEM file.
+func certificateNotAfter(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the certificate: %w", err)
+	}
+	return pemCertificateNotAfter(data, path)
+}
+
+// pemCertificateNotAfter returns the expiry of the first PEM-encoded certificate in the data read from the source.
+func pemCertificateNotAfter(data []byte, source string) (time.Time, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("no PEM-encoded certificate found in %s", source)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse the certificate in %s: %w", source, err)
+	}
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestControllerCheckCredentials(t *testing.T) {
+	srv := selfCheckTokenEndpoint(t)
+	secretExpiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("accepted and rejected", func(t *testing.T) {
+		c := testController(srv.URL, nil, nil)
+		c.OrganizationApps = map[string]OrganizationApp{"org": {ClientId: "org-id", ClientSecret: "org-secret", ClientSecretExpiresAt: secretExpiry}}
+
+		statuses := c.CheckCredentials(context.TODO())
+		assert.Len(t, statuses, 2)
+
+		assert.Equal(t, "GitHub", statuses[0].ServiceProvider)
+		assert.Empty(t, statuses[0].Organization)
+		assert.True(t, statuses[0].Accepted)
+		assert.NoError(t, statuses[0].Err)
+		assert.Empty(t, statuses[0].Expiries)
+
+		assert.Equal(t, "org", statuses[1].Organization)
+		assert.False(t, statuses[1].Accepted)
+		assert.True(t, statuses[1].Rejected())
+		assert.Contains(t, statuses[1].Err.Error(), "incorrect_client_credentials")
+		assert.Equal(t, []CredentialExpiry{{Credential: credentialClientSecret, ExpiresAt: secretExpiry}}, statuses[1].Expiries)
+	})
+
+	t.Run("unreachable token endpoint", func(t *testing.T) {
+		statuses := testController("http://127.0.0.1:1/token", nil, nil).CheckCredentials(context.TODO())
+		assert.False(t, statuses[0].Accepted)
+		assert.Error(t, statuses[0].Err)
+		assert.False(t, statuses[0].Rejected())
+	})
+
+	t.Run("no token endpoint", func(t *testing.T) {
+		c := testController("", nil, nil)
+		c.clientSecretExpiresAt = secretExpiry
+
+		statuses := c.CheckCredentials(context.TODO())
+		assert.False(t, statuses[0].Accepted)
+		assert.NoError(t, statuses[0].Err)
+		assert.Equal(t, []CredentialExpiry{{Credential: credentialClientSecret, ExpiresAt: secretExpiry}}, statuses[0].Expiries)
+	})
+
+	t.Run("certificates", func(t *testing.T) {
+		certPath, _ := writeClientCertificate(t)
+		notAfter, err := certificateNotAfter(certPath)
+		assert.NoError(t, err)
+
+		c := testController("", nil, nil)
+		c.clientCertificates = clientCertificates(ClientAuthentication{TlsCertificatePath: certPath, CertificatePath: filepath.Join(t.TempDir(), "missing.crt")})
+
+		statuses := c.CheckCredentials(context.TODO())
+		assert.Equal(t, []CredentialExpiry{{Credential: credentialTlsCertificate, ExpiresAt: notAfter}}, statuses[0].Expiries)
+	})
+}
+
+func TestCertificateNotAfter(t *testing.T) {
+	certPath, keyPath := writeClientCertificate(t)
+
+	notAfter, err := certificateNotAfter(certPath)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), notAfter, time.Minute)
+
+	_, err = certificateNotAfter(keyPath)
+	assert.Error(t, err)
+
+	garbage := filepath.Join(t.TempDir(), "garbage.crt")
+	assert.NoError(t, ioutil.WriteFile(garbage, []byte("-----BEGIN CERTIFICATE-----\nZ2FyYmFnZQ==\n-----END CERTIFICATE-----\n"), 0600))
+	_, err = certificateNotAfter(garbage)
+	assert.Error(t, err)
+}
+
+func TestCredentialsMonitor(t *testing.T) {
+	srv := selfCheckTokenEndpoint(t)
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	expiring := now.Add(24 * time.Hour)
+
+	sps := NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		{ServiceProviderType: config.ServiceProviderTypeQuay},
+	}, func(spc config.ServiceProviderConfiguration) (Controller, error) {
+		if spc.ServiceProviderType == config.ServiceProviderTypeQuay {
+			return nil, errors.New("misconfigured")
+		}
+		c := testController(srv.URL, nil, nil)
+		c.clientSecretExpiresAt = expiring
+		c.OrganizationApps = map[string]OrganizationApp{"org": {ClientId: "org-id", ClientSecret: "org-secret"}}
+		return c, nil
+	})
+
+	m := NewCredentialsMonitor(0, 0)
+	assert.Equal(t, DefaultCredentialsCheckInterval, m.interval)
+	assert.Equal(t, DefaultCredentialsExpiryWarning, m.warning)
+	assert.Empty(t, m.Check(context.TODO(), now))
+
+	m.SetServiceProviders(sps)
+	statuses := m.Check(context.TODO(), now)
+	assert.Len(t, statuses, 2)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(clientCredentialsValid.WithLabelValues("GitHub", "")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(clientCredentialsValid.WithLabelValues("GitHub", "org")))
+	assert.Equal(t, float64(expiring.Unix()), testutil.ToFloat64(clientCredentialsExpiry.WithLabelValues("GitHub", "", credentialClientSecret)))
+
+	t.Run("interrupted check keeps the metrics", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		m.Check(ctx, now)
+		assert.Equal(t, float64(expiring.Unix()), testutil.ToFloat64(clientCredentialsExpiry.WithLabelValues("GitHub", "", credentialClientSecret)))
+	})
+
+	t.Run("removed service providers are not reported", func(t *testing.T) {
+		m.SetServiceProviders(NewServiceProviders(nil, nil))
+		assert.Empty(t, m.Check(context.TODO(), now))
+		assert.Equal(t, 0, testutil.CollectAndCount(clientCredentialsValid))
+		assert.Equal(t, 0, testutil.CollectAndCount(clientCredentialsExpiry))
+	})
+}
+
+func TestClientSecretExpiresAtConfiguration(t *testing.T) {
+	ext := ServiceProviderExtensions{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+type: GitHub
+clientSecretExpiresAt: 2030-01-01T00:00:00Z
+organizationApps:
+- organization: org
+  clientId: org-id
+  clientSecret: org-secret
+  clientSecretExpiresAt: "2031-06-30T12:00:00Z"
+`), &ext))
+
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), ext.ClientSecretExpiresAt.UTC())
+	assert.Equal(t, time.Date(2031, 6, 30, 12, 0, 0, 0, time.UTC), ext.OrganizationApps[0].ClientSecretExpiresAt.UTC())
+}
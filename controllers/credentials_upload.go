@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maxCredentialsUploadSize is the maximum size of the body of the credentials upload request.
+const maxCredentialsUploadSize = 10 * 1024 * 1024
+
+// CredentialsUploader stores the arbitrary credentials associated with an SPIAccessToken. Similarly to the tokens,
+// the credentials can only be uploaded by the users that can read the SPIAccessToken object.
+type CredentialsUploader struct {
+	K8sClient client.Client
+	Storage   tokenstorage.CredentialsStorage
+}
+
+// credentialsUpload is the body of the credentials upload request. It mimics the Kubernetes secrets, i.e. the values in
+// data are base64-encoded while the values in stringData are used as is. The stringData take precedence.
+type credentialsUpload struct {
+	Data       map[string][]byte `json:"data,omitempty"`
+	StringData map[string]string `json:"stringData,omitempty"`
+}
+
+func (u *CredentialsUploader) Handle(r *http.Request) error {
+	ctx, err := WithAuthFromRequestIntoContext(r, r.Context())
+	if err != nil {
+		return err
+	}
+
+	vars := mux.Vars(r)
+
+	token := &api.SPIAccessToken{}
+	if err := u.K8sClient.Get(ctx, client.ObjectKey{Name: vars["name"], Namespace: vars["namespace"]}, token); err != nil {
+		return err
+	}
+
+	upload := &credentialsUpload{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxCredentialsUploadSize)).Decode(upload); err != nil {
+		return err
+	}
+
+	credentials := tokenstorage.Credentials{}
+	for k, v := range upload.Data {
+		credentials[k] = v
+	}
+	for k, v := range upload.StringData {
+		credentials[k] = []byte(v)
+	}
+
+	if err := u.Storage.StoreCredentials(ctx, token, credentials); err != nil {
+		return err
+	}
+
+	// let the operator know that the data of the token changed
+	return u.K8sClient.Create(ctx, &api.SPIAccessTokenDataUpdate{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "token-update-",
+			Namespace:    token.Namespace,
+		},
+		Spec: api.SPIAccessTokenDataUpdateSpec{
+			TokenName: token.Name,
+		},
+	})
+}
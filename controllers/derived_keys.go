@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+)
+
+// The labels of the keys derived from the shared secret, one for each purpose.
+const (
+	flowCipherKeyLabel       = "session"
+	flowKeyMacKeyLabel       = "flow-key"
+	linkCipherKeyLabel       = "link"
+	storageRetryKeyLabel     = "storage-retry"
+	tokenFingerprintKeyLabel = "token-fingerprint"
+)
+
+// deriveKey derives the key for the purpose identified by the label from the shared secret, so that the shared secret
+// itself is never used for two different purposes.
+func deriveKey(label string, sharedSecret []byte) []byte {
+	key := sha256.Sum256(append([]byte("spi-oauth-"+label+":"), sharedSecret...))
+	return key[:]
+}
+
+// newAEAD creates the AES-GCM cipher using the key derived from the shared secret for the purpose identified by
+// the label.
+func newAEAD(label string, sharedSecret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(label, sharedSecret))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
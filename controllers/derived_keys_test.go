@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// the keys must not change, the queued tokens and the session data encrypted by the previous versions are read
+	expected := sha256.Sum256([]byte("spi-oauth-session:secret"))
+	assert.Equal(t, expected[:], deriveKey(flowCipherKeyLabel, []byte("secret")))
+
+	assert.NotEqual(t, deriveKey(flowCipherKeyLabel, []byte("secret")), deriveKey(linkCipherKeyLabel, []byte("secret")))
+	assert.NotEqual(t, deriveKey(flowCipherKeyLabel, []byte("secret")), deriveKey(flowCipherKeyLabel, []byte("other")))
+}
+
+func TestNewAEAD(t *testing.T) {
+	aead, err := newAEAD(storageRetryKeyLabel, []byte("secret"))
+	assert.NoError(t, err)
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, []byte("data"), nil)
+
+	other, err := newAEAD(linkCipherKeyLabel, []byte("secret"))
+	assert.NoError(t, err)
+	_, err = other.Open(nil, nonce, sealed, nil)
+	assert.Error(t, err)
+
+	opened, err := aead.Open(nil, nonce, sealed, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), opened)
+}
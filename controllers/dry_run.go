@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	authz "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// dryRunClient is the Kubernetes client that sends all the mutations as server-side dry runs. The API server still
+// authorizes, validates and admits the requests, so the permissions of the users are checked the same way as normally,
+// but nothing is persisted.
+type dryRunClient struct {
+	client.Client
+}
+
+var _ client.Client = (*dryRunClient)(nil)
+
+// NewDryRunClient wraps the provided client such that it never mutates any objects in the cluster. The would-be
+// mutations are logged instead.
+func NewDryRunClient(cl AuthenticatingClient) AuthenticatingClient {
+	return &dryRunClient{Client: cl}
+}
+
+func (c *dryRunClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	// the access reviews don't mutate anything and their results are needed for the flow to proceed
+	if _, ok := obj.(*authz.SelfSubjectAccessReview); ok {
+		return c.Client.Create(ctx, obj, opts...)
+	}
+
+	logDryRun(ctx, "create", obj)
+	return c.Client.Create(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *dryRunClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	logDryRun(ctx, "update", obj)
+	return c.Client.Update(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *dryRunClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	logDryRun(ctx, "patch", obj)
+	return c.Client.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...)
+}
+
+func (c *dryRunClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	logDryRun(ctx, "delete", obj)
+	return c.Client.Delete(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *dryRunClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	logDryRun(ctx, "delete all of", obj)
+	return c.Client.DeleteAllOf(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (c *dryRunClient) Status() client.StatusWriter {
+	return &dryRunStatusWriter{StatusWriter: c.Client.Status()}
+}
+
+type dryRunStatusWriter struct {
+	client.StatusWriter
+}
+
+func (w *dryRunStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	logDryRun(ctx, "update the status of", obj)
+	return w.StatusWriter.Update(ctx, obj, append(opts, client.DryRunAll)...)
+}
+
+func (w *dryRunStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	logDryRun(ctx, "patch the status of", obj)
+	return w.StatusWriter.Patch(ctx, obj, patch, append(opts, client.DryRunAll)...)
+}
+
+func logDryRun(ctx context.Context, action string, obj client.Object) {
+	name := obj.GetName()
+	if name == "" {
+		name = obj.GetGenerateName() + "*"
+	}
+	LoggerFromContext(ctx).Info("dry run: would "+action+" the object in the cluster",
+		zap.String("type", fmt.Sprintf("%T", obj)),
+		zap.String("namespace", obj.GetNamespace()),
+		zap.String("name", name))
+}
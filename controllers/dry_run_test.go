@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDryRunClient(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+
+	binding := &v1beta1.SPIAccessTokenBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "binding",
+			Namespace: "default",
+		},
+	}
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(binding).Build()
+	dryRun := NewDryRunClient(cl)
+	ctx := context.TODO()
+
+	assert.NoError(t, dryRun.Create(ctx, &v1beta1.SPIAccessTokenDataUpdate{
+		ObjectMeta: metav1.ObjectMeta{Name: "update", Namespace: "default"},
+		Spec:       v1beta1.SPIAccessTokenDataUpdateSpec{TokenName: "token"},
+	}))
+	updates := &v1beta1.SPIAccessTokenDataUpdateList{}
+	assert.NoError(t, dryRun.List(ctx, updates))
+	assert.Empty(t, updates.Items)
+
+	patched := &v1beta1.SPIAccessTokenBinding{}
+	assert.NoError(t, dryRun.Get(ctx, client.ObjectKeyFromObject(binding), patched))
+	patch := client.MergeFrom(patched.DeepCopy())
+	patched.Annotations = map[string]string{bindingRefreshAnnotation: "now"}
+	assert.NoError(t, dryRun.Patch(ctx, patched, patch))
+
+	current := &v1beta1.SPIAccessTokenBinding{}
+	assert.NoError(t, cl.Get(ctx, client.ObjectKeyFromObject(binding), current))
+	assert.Empty(t, current.Annotations)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// correlationIdHeader is the response header carrying the correlation ID of the error. The same ID is logged with the
+// details of the error so that the support can find them based on what the user sees.
+const correlationIdHeader = "X-Correlation-Id"
+
+// ErrorPageData is the data rendered by the error page template.
+type ErrorPageData struct {
+	Title   string
+	Message string
+	// CorrelationId identifies the log entry with the details of the error.
+	CorrelationId string
+	// Details is the internal description of the error. It is only filled when the verbose errors are enabled.
+	Details string
+}
+
+// ErrorPages renders the errors to the end users. By default, the users only see a generic message and the correlation
+// ID using which the details can be found in the logs. The details are only shown to the users when Verbose is true,
+// which is useful in the debugging environments. A nil instance writes plain-text errors without the details.
+type ErrorPages struct {
+	Templates *Templates
+	Verbose   bool
+}
+
+// NewCorrelationId generates a new random ID used to correlate the error shown to the user with the log entry.
+func NewCorrelationId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Error logs the error with all its details using the logger of the request and writes the error page with
+// the provided status.
+func (e *ErrorPages) Error(w http.ResponseWriter, r *http.Request, status int, msg string, err error, fields ...zap.Field) {
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Error(msg, append(fields, zap.Error(err), zap.String("correlationId", correlationId))...)
+	e.write(w, r, status, correlationId, fmt.Sprintf("%s: %s", msg, DefaultRedactor.Redact(err.Error())))
+}
+
+// Debug logs the message on the debug level and writes the error page with the provided status. This is meant for
+// the expected errors, like unauthorized requests, that are not worth being logged on the error level.
+func (e *ErrorPages) Debug(w http.ResponseWriter, r *http.Request, status int, msg string, fields ...zap.Field) {
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Debug(msg, append(fields, zap.String("correlationId", correlationId))...)
+	e.write(w, r, status, correlationId, msg)
+}
+
+func (e *ErrorPages) write(w http.ResponseWriter, r *http.Request, status int, correlationId string, details string) {
+	data := ErrorPageData{
+		Title:         http.StatusText(status),
+		Message:       friendlyErrorMessage(status),
+		CorrelationId: correlationId,
+	}
+	if e != nil && e.Verbose {
+		data.Details = details
+	}
+	e.writePage(w, r, status, correlationId, data)
+}
+
+// writePage writes the error page with the provided data, or its plain-text form if there are no templates.
+func (e *ErrorPages) writePage(w http.ResponseWriter, r *http.Request, status int, correlationId string, data ErrorPageData) {
+	w.Header().Set(correlationIdHeader, correlationId)
+
+	if e == nil || e.Templates == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, "%s (correlation ID: %s)", data.Message, correlationId)
+		if data.Details != "" {
+			_, _ = fmt.Fprintf(w, "\n%s", data.Details)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := e.Templates.Execute(w, CallbackErrorTemplate, data); err != nil {
+		LoggerFromContext(r.Context()).Error("failed to render the error page", zap.Error(err), zap.String("correlationId", correlationId))
+	}
+}
+
+// friendlyErrorMessage returns the message describing the class of the error to the end user.
+func friendlyErrorMessage(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "You are not authorized to perform this action. Please make sure you're logged in and try again."
+	case status == http.StatusServiceUnavailable:
+		return "The service is temporarily unavailable. Please try again later."
+	case status >= 400 && status < 500:
+		return "The request could not be processed. Please restart the process from the beginning."
+	default:
+		return "An unexpected error occurred. Please try again later or contact the support with the correlation ID below."
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorPagesError(t *testing.T) {
+	templates, err := LoadTemplates("../static", "", CallbackErrorTemplate)
+	assert.NoError(t, err)
+
+	t.Run("hides details by default", func(t *testing.T) {
+		pages := &ErrorPages{Templates: templates}
+		rr := httptest.NewRecorder()
+
+		pages.Error(rr, httptest.NewRequest("GET", "/", nil), http.StatusInternalServerError, "failed to store the token", errors.New("vault says Bearer xyz is invalid"))
+
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		correlationId := rr.Header().Get(correlationIdHeader)
+		assert.NotEmpty(t, correlationId)
+		assert.Contains(t, rr.Body.String(), correlationId)
+		assert.Contains(t, rr.Body.String(), "An unexpected error occurred")
+		assert.NotContains(t, rr.Body.String(), "failed to store the token")
+		assert.NotContains(t, rr.Body.String(), "vault says")
+	})
+
+	t.Run("shows redacted details in verbose mode", func(t *testing.T) {
+		pages := &ErrorPages{Templates: templates, Verbose: true}
+		rr := httptest.NewRecorder()
+
+		pages.Error(rr, httptest.NewRequest("GET", "/", nil), http.StatusInternalServerError, "failed to store the token", errors.New("vault says Bearer xyz is invalid"))
+
+		assert.Contains(t, rr.Body.String(), "failed to store the token: vault says Bearer [REDACTED] is invalid")
+		assert.NotContains(t, rr.Body.String(), "xyz")
+	})
+}
+
+func TestErrorPagesDebug(t *testing.T) {
+	rr := httptest.NewRecorder()
+	var pages *ErrorPages
+
+	pages.Debug(rr, httptest.NewRequest("GET", "/", nil), http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "You are not authorized")
+	assert.Contains(t, rr.Body.String(), rr.Header().Get(correlationIdHeader))
+	assert.NotContains(t, rr.Body.String(), "Kubernetes")
+}
+
+func TestNewCorrelationId(t *testing.T) {
+	id1 := NewCorrelationId()
+	id2 := NewCorrelationId()
+	assert.Len(t, id1, 16)
+	assert.NotEqual(t, id1, id2)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+)
+
+// FlowEventType is the type of the event happening during the OAuth flow.
+type FlowEventType string
+
+const (
+	// FlowStartedEvent is published when the user is sent to the service provider to authorize the access.
+	FlowStartedEvent FlowEventType = "flow.started"
+	// ExchangeCompletedEvent is published when the authorization code has been exchanged for the token.
+	ExchangeCompletedEvent FlowEventType = "exchange.completed"
+	// ExchangeFailedEvent is published when the callback from the service provider could not be exchanged for
+	// the token.
+	ExchangeFailedEvent FlowEventType = "exchange.failed"
+	// TokenStoredEvent is published when the obtained token has been stored.
+	TokenStoredEvent FlowEventType = "token.stored"
+	// StorageFailedEvent is published when the obtained token could not be stored.
+	StorageFailedEvent FlowEventType = "storage.failed"
+	// TokenDownloadedEvent is published when a user has downloaded the stored token.
+	TokenDownloadedEvent FlowEventType = "token.downloaded"
+)
+
+// FlowEvent describes something that happened during the OAuth flow. It never contains the tokens or the codes.
+type FlowEvent struct {
+	Type FlowEventType `json:"-"`
+	Time time.Time     `json:"-"`
+
+	ServiceProvider config.ServiceProviderType `json:"serviceProvider"`
+	TokenName       string                     `json:"tokenName,omitempty"`
+	TokenNamespace  string                     `json:"tokenNamespace,omitempty"`
+	// Workspace is the kcp workspace of the SPIAccessToken. Empty outside kcp.
+	Workspace string   `json:"workspace,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	// User is the identity of the user that initiated the flow. Nil if not known, e.g. for the opaque Kubernetes
+	// tokens.
+	User *UserIdentity `json:"user,omitempty"`
+	// Error is the redacted error message of the failure events.
+	Error string `json:"error,omitempty"`
+}
+
+// FlowEventPublisher publishes the events of the OAuth flows, e.g. to the audit systems. Publish must not block
+// the flow.
+type FlowEventPublisher interface {
+	Publish(event FlowEvent)
+}
+
+// FlowEventPublishers publishes the events to all the publishers in the list.
+type FlowEventPublishers []FlowEventPublisher
+
+func (p FlowEventPublishers) Publish(event FlowEvent) {
+	for _, publisher := range p {
+		publisher.Publish(event)
+	}
+}
+
+// publishFlowEvent publishes the event about the flow of the provided state initiated by the provided user if
+// the events are enabled and records it in the flow statistics if they are collected.
+func (c commonController) publishFlowEvent(eventType FlowEventType, state oauthstate.AnonymousOAuthState, workspace string, user *UserIdentity, err error) {
+	if c.Events == nil && c.Stats == nil {
+		return
+	}
+
+	event := FlowEvent{
+		Type:            eventType,
+		Time:            time.Now(),
+		ServiceProvider: c.Config.ServiceProviderType,
+		TokenName:       state.TokenName,
+		TokenNamespace:  state.TokenNamespace,
+		Workspace:       workspace,
+		Scopes:          state.Scopes,
+		User:            user,
+	}
+	if err != nil {
+		event.Error = DefaultRedactor.Redact(err.Error())
+	}
+
+	if c.Stats != nil {
+		c.Stats.Publish(event)
+	}
+	if c.Events != nil {
+		c.Events.Publish(event)
+	}
+}
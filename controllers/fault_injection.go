@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !release
+// +build !release
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// FaultInjectionAvailable reports whether the fault injection is compiled in. It is left out of the builds with
+// the release tag.
+const FaultInjectionAvailable = true
+
+// FaultInjectionHeader is the header of the requests using which the clients (e.g. the end-to-end tests) select
+// the faults injected into the processing of the request, e.g. `storage-write-failure, slow-exchange=5s`.
+const FaultInjectionHeader = "X-Spi-Fault-Injection"
+
+// The names of the faults that can be injected.
+const (
+	faultStorageWriteFailure = "storage-write-failure"
+	faultSlowExchange        = "slow-exchange"
+	faultExpiredSession      = "expired-session"
+)
+
+// Faults are the faults injected into the processing of a request.
+type Faults struct {
+	// StorageWriteFailure makes the writes of the token data fail with a transient error.
+	StorageWriteFailure bool
+	// ExchangeDelay delays the exchanges with the token endpoint of the service provider.
+	ExchangeDelay time.Duration
+	// ExpiredSession makes the request appear as if its session has expired.
+	ExpiredSession bool
+}
+
+type faultsContextKey struct{}
+
+// ParseFaults parses the comma-separated list of the faults, e.g. `storage-write-failure, slow-exchange=5s`.
+func ParseFaults(spec string) (Faults, error) {
+	faults := Faults{}
+	return faults, faults.merge(spec)
+}
+
+// merge adds the faults in the comma-separated list to the faults.
+func (f *Faults) merge(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		name, value := strings.TrimSpace(item), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+
+		switch name {
+		case "":
+			continue
+		case faultStorageWriteFailure:
+			f.StorageWriteFailure = true
+		case faultExpiredSession:
+			f.ExpiredSession = true
+		case faultSlowExchange:
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay <= 0 {
+				return fmt.Errorf("the %s fault requires a positive duration, e.g. %s=5s", faultSlowExchange, faultSlowExchange)
+			}
+			f.ExchangeDelay = delay
+		default:
+			return fmt.Errorf("unknown fault '%s'", name)
+		}
+	}
+	return nil
+}
+
+// FaultInjectionMiddleware injects the provided faults and the faults requested in the FaultInjectionHeader into
+// the processing of every request. The expired session is simulated by removing the session cookie of the provided
+// name from the request. The requests with an invalid header are rejected so that a typo in a test doesn't go
+// unnoticed.
+func FaultInjectionMiddleware(faults Faults, sessionCookieName string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestFaults := faults
+			if err := requestFaults.merge(r.Header.Get(FaultInjectionHeader)); err != nil {
+				http.Error(w, "invalid "+FaultInjectionHeader+" header: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if requestFaults == (Faults{}) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			zap.L().Debug("injecting faults", zap.String("path", r.URL.Path), zap.Any("faults", requestFaults))
+			if requestFaults.ExpiredSession {
+				r = withoutCookie(r, sessionCookieName)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), faultsContextKey{}, requestFaults)))
+		})
+	}
+}
+
+// withoutCookie returns a shallow copy of the request without the cookie of the provided name.
+func withoutCookie(r *http.Request, name string) *http.Request {
+	cookies := r.Cookies()
+	r = r.Clone(r.Context())
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+	return r
+}
+
+// injectedFaults returns the faults to inject into the processing of the request with the provided context.
+func injectedFaults(ctx context.Context) Faults {
+	faults, _ := ctx.Value(faultsContextKey{}).(Faults)
+	return faults
+}
+
+// injectStorageFault returns the error to fail the write of the token data with if requested.
+func injectStorageFault(ctx context.Context) error {
+	if !injectedFaults(ctx).StorageWriteFailure {
+		return nil
+	}
+	return kerrors.NewServiceUnavailable("injected fault: " + faultStorageWriteFailure)
+}
+
+// injectExchangeDelay waits before the exchange with the token endpoint if requested. The error of the context is
+// returned if it is done before the delay elapses.
+func injectExchangeDelay(ctx context.Context) error {
+	delay := injectedFaults(ctx).ExchangeDelay
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build release
+// +build release
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// FaultInjectionAvailable reports whether the fault injection is compiled in. It is left out of the builds with
+// the release tag.
+const FaultInjectionAvailable = false
+
+// Faults are the faults injected into the processing of a request. The release builds don't support any.
+type Faults struct{}
+
+// ParseFaults fails for any non-empty list of the faults, because the release builds don't support the fault injection.
+func ParseFaults(spec string) (Faults, error) {
+	if strings.TrimSpace(spec) != "" {
+		return Faults{}, errors.New("the fault injection is not available in the release builds")
+	}
+	return Faults{}, nil
+}
+
+// FaultInjectionMiddleware doesn't inject anything in the release builds.
+func FaultInjectionMiddleware(_ Faults, _ string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return next
+	}
+}
+
+func injectStorageFault(_ context.Context) error {
+	return nil
+}
+
+func injectExchangeDelay(_ context.Context) error {
+	return nil
+}
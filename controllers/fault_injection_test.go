@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !release
+// +build !release
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestParseFaults(t *testing.T) {
+	faults, err := ParseFaults(" storage-write-failure, slow-exchange=2s ,expired-session")
+	assert.NoError(t, err)
+	assert.Equal(t, Faults{StorageWriteFailure: true, ExchangeDelay: 2 * time.Second, ExpiredSession: true}, faults)
+
+	faults, err = ParseFaults("")
+	assert.NoError(t, err)
+	assert.Equal(t, Faults{}, faults)
+
+	_, err = ParseFaults("slow-exchange")
+	assert.Error(t, err)
+	_, err = ParseFaults("slow-exchange=-1s")
+	assert.Error(t, err)
+	_, err = ParseFaults("fire")
+	assert.Error(t, err)
+}
+
+func TestFaultInjectionMiddleware(t *testing.T) {
+	serve := func(faults Faults, header string) (*httptest.ResponseRecorder, *http.Request) {
+		var served *http.Request
+		handler := FaultInjectionMiddleware(faults, "session")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served = r
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "s"})
+		req.AddCookie(&http.Cookie{Name: "other", Value: "o"})
+		if header != "" {
+			req.Header.Set(FaultInjectionHeader, header)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res, served
+	}
+
+	t.Run("no faults", func(t *testing.T) {
+		_, r := serve(Faults{}, "")
+		assert.Equal(t, Faults{}, injectedFaults(r.Context()))
+		assert.Len(t, r.Cookies(), 2)
+	})
+
+	t.Run("configured and requested faults", func(t *testing.T) {
+		_, r := serve(Faults{StorageWriteFailure: true}, "slow-exchange=1s")
+		assert.Equal(t, Faults{StorageWriteFailure: true, ExchangeDelay: time.Second}, injectedFaults(r.Context()))
+	})
+
+	t.Run("expired session", func(t *testing.T) {
+		_, r := serve(Faults{}, "expired-session")
+		_, err := r.Cookie("session")
+		assert.ErrorIs(t, err, http.ErrNoCookie)
+		other, err := r.Cookie("other")
+		assert.NoError(t, err)
+		assert.Equal(t, "o", other.Value)
+	})
+
+	t.Run("invalid header", func(t *testing.T) {
+		res, r := serve(Faults{}, "fire")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Nil(t, r)
+	})
+}
+
+func TestInjectStorageFault(t *testing.T) {
+	assert.NoError(t, injectStorageFault(context.TODO()))
+
+	ctx := context.WithValue(context.TODO(), faultsContextKey{}, Faults{StorageWriteFailure: true})
+	err := injectStorageFault(ctx)
+	assert.True(t, kerrors.IsServiceUnavailable(err))
+	assert.False(t, isPermanentStorageError(err))
+
+	data := map[string]*v1beta1.Token{}
+	c := testController("", data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	assert.Error(t, c.storeToken(ctx, lookupTestToken("token", "github.com", ""), nil, nil, nil))
+	assert.Empty(t, data)
+}
+
+func TestInjectExchangeDelay(t *testing.T) {
+	assert.NoError(t, injectExchangeDelay(context.TODO()))
+
+	ctx := context.WithValue(context.TODO(), faultsContextKey{}, Faults{ExchangeDelay: 10 * time.Millisecond})
+	start := time.Now()
+	assert.NoError(t, injectExchangeDelay(ctx))
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	ctx = context.WithValue(context.TODO(), faultsContextKey{}, Faults{ExchangeDelay: time.Hour})
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, injectExchangeDelay(ctx), context.Canceled)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// The features of the flows that can be rolled out gradually.
+const (
+	// FeaturePushedAuthorization pushes the authorization requests to the service provider if they are configured.
+	FeaturePushedAuthorization = "pushedAuthorization"
+	// FeatureRefresh allows refreshing the stored tokens using the refresh endpoint.
+	FeatureRefresh = "refresh"
+)
+
+// rolloutFeatures are all the features that can be rolled out gradually.
+var rolloutFeatures = map[string]bool{
+	FeaturePushedAuthorization: true,
+	FeatureRefresh:             true,
+}
+
+// disabledProviderMessage is shown to the users starting a flow with a disabled service provider.
+const disabledProviderMessage = "The authorization with the service provider is temporarily disabled. Please try again later."
+
+var featureRolloutDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "feature_rollout",
+	Name:      "decisions_total",
+	Help:      "The number of the times a gradually rolled out feature was enabled or not for an SPIAccessToken.",
+}, []string{"service_provider", "feature", "enabled"})
+
+func init() {
+	MetricsRegistry.MustRegister(featureRolloutDecisions)
+}
+
+// FeatureFlags switch the service provider and the features of its flows on and off at runtime. Because
+// the configuration is reloaded on change, a misbehaving service provider or feature can be switched off without
+// a restart.
+type FeatureFlags struct {
+	// Disabled stops starting the new flows and refreshing the tokens with the service provider. The flows already in
+	// progress can still finish.
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Rollout are the percentages of the SPIAccessTokens for which the features are enabled, keyed by the feature,
+	// i.e. `pushedAuthorization` or `refresh`. The features not listed are enabled for all the SPIAccessTokens, as far
+	// as they are configured. Whether a feature is enabled is decided by the hash of the SPIAccessToken, so the same
+	// token gets the same decision as long as the percentage doesn't decrease.
+	Rollout map[string]int `yaml:"rollout,omitempty"`
+}
+
+// validateFeatureFlags checks that only the known features are rolled out and that the percentages are valid.
+func validateFeatureFlags(flags FeatureFlags) error {
+	for feature, percentage := range flags.Rollout {
+		if !rolloutFeatures[feature] {
+			return fmt.Errorf("unknown feature '%s'", feature)
+		}
+		if percentage < 0 || percentage > 100 {
+			return fmt.Errorf("the rollout percentage of the feature '%s' must be between 0 and 100", feature)
+		}
+	}
+	return nil
+}
+
+// enabled checks whether the feature is enabled for the SPIAccessToken of the service provider.
+func (f FeatureFlags) enabled(spType config.ServiceProviderType, feature string, namespace string, name string) bool {
+	if f.Disabled {
+		return false
+	}
+	percentage, ok := f.Rollout[feature]
+	if !ok {
+		return true
+	}
+
+	enabled := rolloutBucket(string(spType), feature, namespace, name) < percentage
+	featureRolloutDecisions.WithLabelValues(string(spType), feature, strconv.FormatBool(enabled)).Inc()
+	return enabled
+}
+
+// rolloutBucket deterministically assigns the provided values to one of 100 buckets. The feature is among the values so
+// that the features are not rolled out to the same SPIAccessTokens first.
+func rolloutBucket(values ...string) int {
+	h := fnv.New32a()
+	for _, value := range values {
+		_, _ = h.Write([]byte(value))
+		// separate the values so that e.g. "ab", "c" and "a", "bc" differ
+		_, _ = h.Write([]byte{0})
+	}
+	return int(h.Sum32() % 100)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidateFeatureFlags(t *testing.T) {
+	assert.NoError(t, validateFeatureFlags(FeatureFlags{}))
+	assert.NoError(t, validateFeatureFlags(FeatureFlags{Disabled: true, Rollout: map[string]int{FeaturePushedAuthorization: 0, FeatureRefresh: 100}}))
+	assert.Error(t, validateFeatureFlags(FeatureFlags{Rollout: map[string]int{"teleportation": 50}}))
+	assert.Error(t, validateFeatureFlags(FeatureFlags{Rollout: map[string]int{FeatureRefresh: 101}}))
+	assert.Error(t, validateFeatureFlags(FeatureFlags{Rollout: map[string]int{FeatureRefresh: -1}}))
+}
+
+func TestFeatureFlagsEnabled(t *testing.T) {
+	gh := config.ServiceProviderTypeGitHub
+
+	assert.True(t, FeatureFlags{}.enabled(gh, FeatureRefresh, "default", "token"))
+	assert.False(t, FeatureFlags{Disabled: true}.enabled(gh, FeatureRefresh, "default", "token"))
+	assert.False(t, FeatureFlags{Rollout: map[string]int{FeatureRefresh: 0}}.enabled(gh, FeatureRefresh, "default", "token"))
+	assert.True(t, FeatureFlags{Rollout: map[string]int{FeatureRefresh: 100}}.enabled(gh, FeatureRefresh, "default", "token"))
+	assert.True(t, FeatureFlags{Rollout: map[string]int{FeatureRefresh: 0}}.enabled(gh, FeaturePushedAuthorization, "default", "token"))
+
+	t.Run("percentage", func(t *testing.T) {
+		flags := FeatureFlags{Rollout: map[string]int{FeatureRefresh: 30}}
+		before := testutil.ToFloat64(featureRolloutDecisions.WithLabelValues(string(gh), FeatureRefresh, "true"))
+
+		enabled := 0
+		for i := 0; i < 1000; i++ {
+			if flags.enabled(gh, FeatureRefresh, "default", fmt.Sprintf("token-%d", i)) {
+				enabled++
+			}
+		}
+		assert.InDelta(t, 300, enabled, 60)
+		assert.Equal(t, before+float64(enabled), testutil.ToFloat64(featureRolloutDecisions.WithLabelValues(string(gh), FeatureRefresh, "true")))
+	})
+
+	t.Run("stable decisions", func(t *testing.T) {
+		// the tokens enabled at a lower percentage stay enabled when the percentage increases
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("token-%d", i)
+			if (FeatureFlags{Rollout: map[string]int{FeatureRefresh: 20}}).enabled(gh, FeatureRefresh, "default", name) {
+				assert.True(t, FeatureFlags{Rollout: map[string]int{FeatureRefresh: 50}}.enabled(gh, FeatureRefresh, "default", name))
+			}
+		}
+	})
+}
+
+func TestRolloutBucket(t *testing.T) {
+	assert.Equal(t, rolloutBucket("GitHub", FeatureRefresh, "default", "token"), rolloutBucket("GitHub", FeatureRefresh, "default", "token"))
+	assert.NotEqual(t, rolloutBucket("ab", "c"), rolloutBucket("a", "bc"))
+	for i := 0; i < 100; i++ {
+		bucket := rolloutBucket(fmt.Sprint(i))
+		assert.True(t, bucket >= 0 && bucket < 100)
+	}
+}
+
+func TestFeatureFlagsConfiguration(t *testing.T) {
+	ext := ServiceProviderExtensions{}
+	assert.NoError(t, yaml.Unmarshal([]byte("type: GitHub\nfeatures:\n  disabled: true\n  rollout:\n    pushedAuthorization: 10\n"), &ext))
+	assert.Equal(t, FeatureFlags{Disabled: true, Rollout: map[string]int{FeaturePushedAuthorization: 10}}, ext.Features)
+}
+
+func TestPushedAuthorizationNotRolledOut(t *testing.T) {
+	c := testController("", nil, nil)
+	c.pushedAuthorization = PushedAuthorization{Mode: PushedAuthorizationRequired, Endpoint: "http://127.0.0.1:1/par"}
+	authUrl, err := c.authorizationUrl(context.TODO(), oauthConfigOf(t, c), "the-state", false)
+	assert.NoError(t, err)
+	assert.Contains(t, authUrl, "state=the-state")
+}
+
+func TestAuthenticateDisabledServiceProvider(t *testing.T) {
+	c := commonController{
+		JwtSigningSecret: []byte("secret"),
+		SessionManager:   scs.NewManager(memstore.New(time.Hour)),
+		features:         FeatureFlags{Disabled: true},
+	}
+
+	res := httptest.NewRecorder()
+	c.Authenticate(res, httptest.NewRequest("GET", "/github/authenticate?state=abc", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Empty(t, res.Header().Get("Retry-After"))
+	assert.Contains(t, res.Body.String(), disabledProviderMessage)
+
+	// the callbacks of the flows in progress are not affected
+	res = httptest.NewRecorder()
+	c.Callback(context.TODO(), res, httptest.NewRequest("GET", "/github/callback?state=abc&code=def", nil))
+	assert.NotEqual(t, http.StatusServiceUnavailable, res.Code)
+}
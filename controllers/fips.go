@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// fipsMinSharedSecretLength is the minimum length in bytes of the shared secret in the FIPS mode. The secret is
+// the HMAC-SHA256 key of the OAuth states and the input of the AES-256 key of the storage retry queue, so it needs to
+// carry the full 256 bits of security.
+const fipsMinSharedSecretLength = 32
+
+// fipsMinRsaKeySize is the minimum size in bits of the RSA keys signing the client assertions in the FIPS mode.
+const fipsMinRsaKeySize = 2048
+
+// fipsSigningAlgorithms are the algorithms approved for signing the client assertions in the FIPS mode, i.e.
+// the RSA and ECDSA signatures of FIPS 186-4 using the SHA-2 digests.
+var fipsSigningAlgorithms = map[jose.SignatureAlgorithm]bool{
+	jose.RS256: true,
+	jose.RS384: true,
+	jose.RS512: true,
+	jose.PS256: true,
+	jose.PS384: true,
+	jose.PS512: true,
+	jose.ES256: true,
+	jose.ES384: true,
+	jose.ES512: true,
+}
+
+// ValidateFips checks the parts of the configuration that select the cryptography in the FIPS mode: the shared secret
+// must be long enough to key the HS256 signatures of the OAuth states and the AES-256-GCM encryption derived from it,
+// and the client assertions of all the service providers must be signed using the approved algorithms and keys.
+// The service must refuse to start if the configuration is not compliant.
+func ValidateFips(cfg FileConfiguration) error {
+	if len(cfg.SharedSecret) < fipsMinSharedSecretLength {
+		return fmt.Errorf("the shared secret must be at least %d bytes long in the FIPS mode", fipsMinSharedSecretLength)
+	}
+
+	for _, sp := range cfg.ServiceProviders {
+		auth := cfg.ServiceProviderExtensionsFor(sp.ServiceProviderType).ClientAuthentication
+		if _, err := newClientAssertions(auth, true); err != nil {
+			return fmt.Errorf("invalid client authentication of the service provider %s: %w", sp.ServiceProviderType, err)
+		}
+	}
+	return nil
+}
+
+// validateFipsSigningKey checks that the signing algorithm and the key of the client assertions are approved in
+// the FIPS mode.
+func validateFipsSigningKey(key crypto.Signer, alg jose.SignatureAlgorithm) error {
+	if !fipsSigningAlgorithms[alg] {
+		return fmt.Errorf("the %s signing algorithm is not approved in the FIPS mode", alg)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < fipsMinRsaKeySize {
+			return fmt.Errorf("the RSA key must have at least %d bits in the FIPS mode", fipsMinRsaKeySize)
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return fmt.Errorf("the curve of the EC key is not approved in the FIPS mode")
+		}
+	default:
+		return fmt.Errorf("the type of the private key is not approved in the FIPS mode")
+	}
+	return nil
+}
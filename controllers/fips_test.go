@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func fipsTestConfiguration(auth ClientAuthentication) FileConfiguration {
+	cfg := FileConfiguration{}
+	cfg.SharedSecret = []byte(strings.Repeat("s", fipsMinSharedSecretLength))
+	cfg.ServiceProviders = []config.ServiceProviderConfiguration{{ServiceProviderType: config.ServiceProviderTypeGitHub}}
+	cfg.ServiceProviderExtensions = []ServiceProviderExtensions{{Type: config.ServiceProviderTypeGitHub, ClientAuthentication: auth}}
+	return cfg
+}
+
+func writePkcs8Key(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return path
+}
+
+func TestValidateFips(t *testing.T) {
+	_, rsaPath := writeRsaKey(t)
+
+	assert.NoError(t, ValidateFips(fipsTestConfiguration(ClientAuthentication{})))
+	assert.NoError(t, ValidateFips(fipsTestConfiguration(ClientAuthentication{Method: ClientSecretBasic})))
+	assert.NoError(t, ValidateFips(fipsTestConfiguration(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: rsaPath})))
+	assert.NoError(t, ValidateFips(fipsTestConfiguration(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: rsaPath, SigningAlgorithm: "PS384"})))
+
+	t.Run("short shared secret", func(t *testing.T) {
+		cfg := fipsTestConfiguration(ClientAuthentication{})
+		cfg.SharedSecret = []byte("secret")
+		assert.Error(t, ValidateFips(cfg))
+	})
+
+	t.Run("unapproved algorithm", func(t *testing.T) {
+		assert.Error(t, ValidateFips(fipsTestConfiguration(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: rsaPath, SigningAlgorithm: "EdDSA"})))
+	})
+
+	t.Run("small RSA key", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.NoError(t, err)
+		path := writePkcs8Key(t, key)
+
+		auth := ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: path}
+		assert.Error(t, ValidateFips(fipsTestConfiguration(auth)))
+		// the key is fine outside of the FIPS mode
+		_, err = newClientAssertions(auth, false)
+		assert.NoError(t, err)
+	})
+
+	t.Run("EC keys", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		assert.NoError(t, err)
+		assert.NoError(t, ValidateFips(fipsTestConfiguration(ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: writePkcs8Key(t, key)})))
+
+		key, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		assert.NoError(t, err)
+		assert.Error(t, validateFipsSigningKey(key, "ES256"))
+	})
+
+	t.Run("unconfigured service provider", func(t *testing.T) {
+		cfg := fipsTestConfiguration(ClientAuthentication{})
+		cfg.ServiceProviderExtensions = nil
+		assert.NoError(t, ValidateFips(cfg))
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MaxFlowDuration is the time within which the OAuth flow needs to be finished once it has been started. The deadline
+// of the flow is carried in the state sent to the service provider, the callbacks of the older flows are rejected and
+// the processing of a callback is aborted once the deadline passes, so that a dying flow doesn't keep the connections
+// to the service provider, the Kubernetes API server and the token storage open. It matches the idle timeout of
+// the sessions keeping the flows, after which the flow cannot be finished anyway.
+const MaxFlowDuration = 15 * time.Minute
+
+// errFlowExpired is returned when the callback comes after the deadline of the flow or cannot be processed before it.
+var errFlowExpired = errors.New("the OAuth flow has not been finished before its deadline")
+
+// flowDeadline returns the deadline of a flow started at the provided time as carried in the state.
+func flowDeadline(startedAt time.Time) int64 {
+	return startedAt.Add(MaxFlowDuration).Unix()
+}
+
+// expired checks whether the deadline of the flow has passed. The states issued before the deadlines were introduced
+// never expire.
+func (s *exchangeState) expired(now time.Time) bool {
+	return s.Deadline != 0 && !now.Before(time.Unix(s.Deadline, 0))
+}
+
+// withFlowDeadline bounds the context by the deadline of the flow, if the state has one.
+func (s *exchangeState) withFlowDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Deadline == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, time.Unix(s.Deadline, 0))
+}
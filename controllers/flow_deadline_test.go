@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeStateExpired(t *testing.T) {
+	now := time.Now()
+	assert.False(t, (&exchangeState{}).expired(now))
+	assert.False(t, (&exchangeState{Deadline: now.Add(time.Minute).Unix()}).expired(now))
+	assert.True(t, (&exchangeState{Deadline: now.Add(-time.Minute).Unix()}).expired(now))
+	assert.Equal(t, now.Add(MaxFlowDuration).Unix(), flowDeadline(now))
+}
+
+func TestExchangeStateWithFlowDeadline(t *testing.T) {
+	ctx, cancel := (&exchangeState{}).withFlowDeadline(context.TODO())
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+
+	deadline := time.Now().Add(time.Minute).Truncate(time.Second)
+	ctx, cancel = (&exchangeState{Deadline: deadline.Unix()}).withFlowDeadline(context.TODO())
+	defer cancel()
+	actual, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.True(t, deadline.Equal(actual))
+}
+
+// deadlineTestCallback starts a flow with the provided deadline and returns the controller exchanging the codes at
+// the provided token endpoint along with the request of the callback of the flow.
+func deadlineTestCallback(t *testing.T, tokenUrl string, deadline time.Time) (*commonController, *http.Request) {
+	c := testController(tokenUrl, nil, nil)
+	c.SessionManager = scs.NewManager(memstore.New(time.Hour))
+
+	res := httptest.NewRecorder()
+	flowKey, err := c.startFlow(res, httptest.NewRequest("GET", "/github/authenticate", nil), "Bearer k8s-token")
+	assert.NoError(t, err)
+
+	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
+	assert.NoError(t, err)
+	state, err := codec.Encode(&exchangeState{
+		AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "token", TokenNamespace: "default"},
+		Key:                 flowKey,
+		ResponseMode:        responseModeJson,
+		Deadline:            deadline.Unix(),
+	})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/github/callback?"+url.Values{"state": {state}, "code": {"the-code"}}.Encode(), nil)
+	for _, cookie := range res.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return c, r
+}
+
+func TestCallbackFlowDeadline(t *testing.T) {
+	t.Run("expired flow", func(t *testing.T) {
+		exchanged := false
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			exchanged = true
+		}))
+		defer srv.Close()
+
+		c, r := deadlineTestCallback(t, srv.URL, time.Now().Add(-time.Second))
+		res := httptest.NewRecorder()
+		c.Callback(context.TODO(), res, r)
+
+		result := callbackResult{}
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &result))
+		assert.Equal(t, callbackErrorFlowExpired, result.ErrorCode)
+		assert.False(t, exchanged)
+	})
+
+	t.Run("deadline passing during the exchange", func(t *testing.T) {
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer srv.Close()
+		defer close(release)
+
+		c, r := deadlineTestCallback(t, srv.URL, time.Now().Add(time.Second))
+		started := time.Now()
+		_, err := c.finishOAuthExchange(context.TODO(), r)
+		assert.True(t, errors.Is(err, errFlowExpired))
+		assert.Less(t, time.Since(started), 5*time.Second)
+	})
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	authz "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// FlowStatsNonResourceUrl is the non-resource URL the users need to be allowed to get in the cluster to read
+	// the flow statistics.
+	FlowStatsNonResourceUrl = "/spi-oauth/stats"
+
+	// MaxFlowStatsWindow is the longest window the flow statistics can be aggregated over. The finished flows are only
+	// kept for this long.
+	MaxFlowStatsWindow = 24 * time.Hour
+
+	// flowStatsPendingTimeout is how long a started flow is considered pending. The flows not finished by then have
+	// passed their deadline.
+	flowStatsPendingTimeout = MaxFlowDuration
+
+	// flowStatsMaxFinished limits the number of the finished flows kept for the statistics.
+	flowStatsMaxFinished = 100000
+)
+
+// DefaultFlowStatsWindows are the windows the flow statistics are aggregated over if the request doesn't specify any.
+var DefaultFlowStatsWindows = []time.Duration{time.Hour, MaxFlowStatsWindow}
+
+// FlowStats aggregates the outcomes of the OAuth flows of this instance of the service for the dashboards. It records
+// the flow events as a FlowEventPublisher: a flow is pending since it started until the token is stored (completed) or
+// the exchange or the storage fails (failed). The flows are matched by the service provider and the SPIAccessToken, so
+// the concurrent flows for the same SPIAccessToken are counted as one. The tokens stored later by the storage retry
+// queue are not counted again. Create it using NewFlowStats.
+type FlowStats struct {
+	lock     sync.Mutex
+	pending  map[flowStatsKey]time.Time
+	finished []finishedFlow
+}
+
+// flowStatsKey identifies the flow in the statistics.
+type flowStatsKey struct {
+	serviceProvider config.ServiceProviderType
+	workspace       string
+	namespace       string
+	name            string
+}
+
+// finishedFlow is the outcome of a single flow.
+type finishedFlow struct {
+	serviceProvider config.ServiceProviderType
+	finishedAt      time.Time
+	failed          bool
+	// duration is the time since the flow started. Zero if the start of the flow is not known.
+	duration time.Duration
+}
+
+// FlowStatsReport are the flow statistics returned by the stats endpoint.
+type FlowStatsReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// Pending is the number of the flows in progress by the service provider.
+	Pending map[config.ServiceProviderType]int `json:"pending"`
+	Windows []FlowStatsWindow                  `json:"windows"`
+}
+
+// FlowStatsWindow are the statistics of the flows finished within the window.
+type FlowStatsWindow struct {
+	// Window is the duration of the window ending at the time of the report, e.g. `1h0m0s`.
+	Window           string                                                  `json:"window"`
+	ServiceProviders map[config.ServiceProviderType]ServiceProviderFlowStats `json:"serviceProviders"`
+}
+
+// ServiceProviderFlowStats are the statistics of the flows of a single service provider.
+type ServiceProviderFlowStats struct {
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	// MedianCompletionSeconds is the median time from the start of the completed flows to storing the token. Nil if
+	// there are no completed flows with the known start.
+	MedianCompletionSeconds *float64 `json:"medianCompletionSeconds,omitempty"`
+}
+
+// NewFlowStats creates the empty flow statistics.
+func NewFlowStats() *FlowStats {
+	return &FlowStats{pending: map[flowStatsKey]time.Time{}}
+}
+
+// Publish records the flow event.
+func (s *FlowStats) Publish(event FlowEvent) {
+	key := flowStatsKey{
+		serviceProvider: event.ServiceProvider,
+		workspace:       event.Workspace,
+		namespace:       event.TokenNamespace,
+		name:            event.TokenName,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch event.Type {
+	case FlowStartedEvent:
+		s.pending[key] = event.Time
+		s.prune(event.Time)
+		return
+	case TokenStoredEvent, ExchangeFailedEvent, StorageFailedEvent:
+	default:
+		return
+	}
+
+	finished := finishedFlow{
+		serviceProvider: event.ServiceProvider,
+		finishedAt:      event.Time,
+		failed:          event.Type != TokenStoredEvent,
+	}
+	if started, ok := s.pending[key]; ok {
+		delete(s.pending, key)
+		if event.Time.Sub(started) <= flowStatsPendingTimeout {
+			finished.duration = event.Time.Sub(started)
+		}
+	}
+	s.finished = append(s.finished, finished)
+	s.prune(event.Time)
+}
+
+// prune forgets the abandoned flows and the flows finished before the longest window. It must be called with the lock
+// held.
+func (s *FlowStats) prune(now time.Time) {
+	for key, started := range s.pending {
+		if now.Sub(started) > flowStatsPendingTimeout {
+			delete(s.pending, key)
+		}
+	}
+
+	drop := len(s.finished) - flowStatsMaxFinished
+	if drop < 0 {
+		drop = 0
+	}
+	for drop < len(s.finished) && now.Sub(s.finished[drop].finishedAt) > MaxFlowStatsWindow {
+		drop++
+	}
+	if drop > 0 {
+		s.finished = append([]finishedFlow(nil), s.finished[drop:]...)
+	}
+}
+
+// Report aggregates the statistics of the flows finished within the provided windows ending at the provided time.
+// The provided service providers are always included in the report, even if they have no flows.
+func (s *FlowStats) Report(now time.Time, windows []time.Duration, serviceProviders []config.ServiceProviderType) *FlowStatsReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prune(now)
+
+	report := &FlowStatsReport{GeneratedAt: now.UTC(), Pending: map[config.ServiceProviderType]int{}}
+	for _, sp := range serviceProviders {
+		report.Pending[sp] = 0
+	}
+	for key := range s.pending {
+		report.Pending[key.serviceProvider]++
+	}
+
+	for _, window := range windows {
+		stats := map[config.ServiceProviderType]ServiceProviderFlowStats{}
+		durations := map[config.ServiceProviderType][]time.Duration{}
+		for _, sp := range serviceProviders {
+			stats[sp] = ServiceProviderFlowStats{}
+		}
+
+		for _, flow := range s.finished {
+			if now.Sub(flow.finishedAt) > window {
+				continue
+			}
+			spStats := stats[flow.serviceProvider]
+			if flow.failed {
+				spStats.Failed++
+			} else {
+				spStats.Completed++
+				if flow.duration > 0 {
+					durations[flow.serviceProvider] = append(durations[flow.serviceProvider], flow.duration)
+				}
+			}
+			stats[flow.serviceProvider] = spStats
+		}
+
+		for sp, spDurations := range durations {
+			median := medianDuration(spDurations).Seconds()
+			spStats := stats[sp]
+			spStats.MedianCompletionSeconds = &median
+			stats[sp] = spStats
+		}
+
+		report.Windows = append(report.Windows, FlowStatsWindow{Window: window.String(), ServiceProviders: stats})
+	}
+	return report
+}
+
+// medianDuration returns the median of the non-empty durations.
+func medianDuration(durations []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if len(sorted)%2 == 1 {
+		return sorted[len(sorted)/2]
+	}
+	return (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+}
+
+// FlowStatsReporter serves the flow statistics to the users allowed to get the FlowStatsNonResourceUrl.
+type FlowStatsReporter struct {
+	K8sClient        AuthenticatingClient
+	Stats            *FlowStats
+	ServiceProviders *ServiceProviders
+}
+
+// Report authorizes the request and returns the statistics over the windows in the `window` query parameters (e.g.
+// `?window=15m&window=1h`), or over DefaultFlowStatsWindows if there are none.
+func (s *FlowStatsReporter) Report(r *http.Request) (*FlowStatsReport, error) {
+	ctx, err := WithAuthFromRequestIntoContext(r, r.Context())
+	if err != nil {
+		return nil, k8serrors.NewUnauthorized(err.Error())
+	}
+
+	windows, err := parseFlowStatsWindows(r.URL.Query()["window"])
+	if err != nil {
+		return nil, k8serrors.NewBadRequest(err.Error())
+	}
+
+	review := authz.SelfSubjectAccessReview{
+		Spec: authz.SelfSubjectAccessReviewSpec{
+			NonResourceAttributes: &authz.NonResourceAttributes{
+				Path: FlowStatsNonResourceUrl,
+				Verb: "get",
+			},
+		},
+	}
+	if err := s.K8sClient.Create(ctx, &review); err != nil {
+		return nil, err
+	}
+	if !review.Status.Allowed {
+		return nil, k8serrors.NewForbidden(schema.GroupResource{}, FlowStatsNonResourceUrl, errors.New("the flow statistics require the permission to get the non-resource URL"))
+	}
+
+	var serviceProviders []config.ServiceProviderType
+	if s.ServiceProviders != nil {
+		for _, sp := range s.ServiceProviders.Providers {
+			serviceProviders = append(serviceProviders, sp.Config.ServiceProviderType)
+		}
+	}
+	return s.Stats.Report(time.Now(), windows, serviceProviders), nil
+}
+
+// parseFlowStatsWindows parses the requested windows of the flow statistics.
+func parseFlowStatsWindows(values []string) ([]time.Duration, error) {
+	if len(values) == 0 {
+		return DefaultFlowStatsWindows, nil
+	}
+
+	windows := make([]time.Duration, 0, len(values))
+	for _, value := range values {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window '%s': %w", value, err)
+		}
+		if window <= 0 || window > MaxFlowStatsWindow {
+			return nil, fmt.Errorf("the window '%s' must be positive and at most %s", value, MaxFlowStatsWindow)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
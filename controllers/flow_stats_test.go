@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func flowStatsEvent(eventType FlowEventType, sp config.ServiceProviderType, token string, at time.Time) FlowEvent {
+	return FlowEvent{Type: eventType, Time: at, ServiceProvider: sp, TokenName: token, TokenNamespace: "default"}
+}
+
+func TestFlowStats(t *testing.T) {
+	github, quay, gitlab := config.ServiceProviderTypeGitHub, config.ServiceProviderTypeQuay, config.ServiceProviderType("GitLab")
+	now := time.Now()
+	stats := NewFlowStats()
+
+	// completed in 10s two hours ago and in 20s and 60s half an hour ago
+	completed := func(token string, started time.Time, duration time.Duration) {
+		stats.Publish(flowStatsEvent(FlowStartedEvent, github, token, started))
+		stats.Publish(flowStatsEvent(ExchangeCompletedEvent, github, token, started.Add(duration/2)))
+		stats.Publish(flowStatsEvent(TokenStoredEvent, github, token, started.Add(duration)))
+	}
+	completed("a", now.Add(-2*time.Hour), 10*time.Second)
+	completed("b", now.Add(-30*time.Minute), 20*time.Second)
+	completed("c", now.Add(-30*time.Minute), time.Minute)
+	// failed
+	stats.Publish(flowStatsEvent(FlowStartedEvent, quay, "d", now.Add(-time.Minute)))
+	stats.Publish(flowStatsEvent(ExchangeFailedEvent, quay, "d", now.Add(-50*time.Second)))
+	// pending
+	stats.Publish(flowStatsEvent(FlowStartedEvent, github, "e", now.Add(-time.Minute)))
+	// abandoned
+	stats.Publish(flowStatsEvent(FlowStartedEvent, github, "f", now.Add(-time.Hour)))
+	// finished without the known start, e.g. after a restart
+	stats.Publish(flowStatsEvent(StorageFailedEvent, github, "g", now.Add(-time.Second)))
+	// not flow outcomes
+	stats.Publish(flowStatsEvent(TokenDownloadedEvent, github, "a", now))
+
+	report := stats.Report(now, []time.Duration{time.Hour, MaxFlowStatsWindow}, []config.ServiceProviderType{github, quay, gitlab})
+	assert.Equal(t, map[config.ServiceProviderType]int{github: 1, quay: 0, gitlab: 0}, report.Pending)
+	assert.Len(t, report.Windows, 2)
+
+	hour := report.Windows[0]
+	assert.Equal(t, "1h0m0s", hour.Window)
+	assert.Equal(t, 2, hour.ServiceProviders[github].Completed)
+	assert.Equal(t, 1, hour.ServiceProviders[github].Failed)
+	assert.Equal(t, 40.0, *hour.ServiceProviders[github].MedianCompletionSeconds)
+	assert.Equal(t, 1, hour.ServiceProviders[quay].Failed)
+	assert.Nil(t, hour.ServiceProviders[quay].MedianCompletionSeconds)
+	assert.Equal(t, ServiceProviderFlowStats{}, hour.ServiceProviders[gitlab])
+
+	day := report.Windows[1]
+	assert.Equal(t, 3, day.ServiceProviders[github].Completed)
+	assert.Equal(t, 20.0, *day.ServiceProviders[github].MedianCompletionSeconds)
+
+	// the flows finished before the longest window are forgotten
+	report = stats.Report(now.Add(MaxFlowStatsWindow-time.Hour), []time.Duration{MaxFlowStatsWindow}, nil)
+	assert.Equal(t, 2, report.Windows[0].ServiceProviders[github].Completed)
+	assert.Empty(t, report.Pending)
+}
+
+func TestMedianDuration(t *testing.T) {
+	assert.Equal(t, time.Second, medianDuration([]time.Duration{time.Second}))
+	assert.Equal(t, 2*time.Second, medianDuration([]time.Duration{3 * time.Second, time.Second, 2 * time.Second}))
+	assert.Equal(t, 1500*time.Millisecond, medianDuration([]time.Duration{2 * time.Second, time.Second}))
+}
+
+func TestParseFlowStatsWindows(t *testing.T) {
+	windows, err := parseFlowStatsWindows(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultFlowStatsWindows, windows)
+
+	windows, err = parseFlowStatsWindows([]string{"15m", "2h"})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{15 * time.Minute, 2 * time.Hour}, windows)
+
+	for _, invalid := range []string{"abc", "0s", "-1h", "25h"} {
+		_, err = parseFlowStatsWindows([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestFlowStatsReporter(t *testing.T) {
+	cl := &reviewClient{allowed: true}
+	stats := NewFlowStats()
+	reporter := &FlowStatsReporter{K8sClient: cl, Stats: stats}
+	c := commonController{Config: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub}, Stats: stats}
+	c.publishFlowEvent(FlowStartedEvent, oauthstate.AnonymousOAuthState{TokenName: "a", TokenNamespace: "default"}, "", nil, nil)
+	c.publishFlowEvent(TokenStoredEvent, oauthstate.AnonymousOAuthState{TokenName: "a", TokenNamespace: "default"}, "", nil, nil)
+
+	_, err := reporter.Report(httptest.NewRequest("GET", "/stats", nil))
+	assert.True(t, k8serrors.IsUnauthorized(err))
+
+	req := httptest.NewRequest("GET", "/stats?window=5m", nil)
+	req.Header.Set("Authorization", "Bearer dashboard")
+	report, err := reporter.Report(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []authz.NonResourceAttributes{{Path: FlowStatsNonResourceUrl, Verb: "get"}}, cl.nonResourceAttributes())
+	assert.Len(t, report.Windows, 1)
+	assert.Equal(t, 1, report.Windows[0].ServiceProviders[config.ServiceProviderTypeGitHub].Completed)
+
+	req = httptest.NewRequest("GET", "/stats?window=forever", nil)
+	req.Header.Set("Authorization", "Bearer dashboard")
+	_, err = reporter.Report(req)
+	assert.True(t, k8serrors.IsBadRequest(err))
+
+	cl.allowed = false
+	req = httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Authorization", "Bearer dashboard")
+	_, err = reporter.Report(req)
+	assert.True(t, k8serrors.IsForbidden(err))
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies is the list of networks of the reverse proxies whose X-Forwarded-* headers are honored when
+// constructing the public URLs of the service.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses the list of IP addresses or CIDR ranges of the trusted proxies.
+func ParseTrustedProxies(specs []string) (TrustedProxies, error) {
+	ret := TrustedProxies{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address of the trusted proxy: %s", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR of the trusted proxies: %w", err)
+		}
+		ret = append(ret, ipNet)
+	}
+
+	return ret, nil
+}
+
+// Trusts checks whether the request comes directly from one of the trusted proxies.
+func (t TrustedProxies) Trusts(r *http.Request) bool {
+	if len(t) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedBase returns the scheme+host and the path prefix of the service as seen by the client of the trusted proxy
+// that forwarded the request. The ok return value is false if the request doesn't come from a trusted proxy or
+// doesn't contain the X-Forwarded-Host header. The path prefix is only returned if the X-Forwarded-Prefix header is
+// present.
+func (t TrustedProxies) forwardedBase(r *http.Request) (base string, prefix string, hasPrefix bool, ok bool) {
+	if !t.Trusts(r) {
+		return "", "", false, false
+	}
+
+	host := firstHeaderValue(r, "X-Forwarded-Host")
+	if host == "" || strings.ContainsAny(host, "/?#@\\ ") {
+		return "", "", false, false
+	}
+
+	proto := firstHeaderValue(r, "X-Forwarded-Proto")
+	if proto != "http" && proto != "https" {
+		proto = "https"
+	}
+
+	if values, present := r.Header[http.CanonicalHeaderKey("X-Forwarded-Prefix")]; present && len(values) > 0 {
+		prefix = NormalizePathPrefix(strings.TrimSpace(strings.Split(values[0], ",")[0]))
+		hasPrefix = true
+	}
+
+	return proto + "://" + host, prefix, hasPrefix, true
+}
+
+// firstHeaderValue returns the first value of the possibly comma-separated header, as appended by the chain of proxies.
+func firstHeaderValue(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(name), ",")[0])
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.1", " 192.168.0.0/16", "", "::1"})
+	assert.NoError(t, err)
+	assert.Len(t, proxies, 3)
+
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/123"})
+	assert.Error(t, err)
+}
+
+func TestTrustedProxiesTrusts(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "::1"})
+	assert.NoError(t, err)
+
+	test := func(remoteAddr string, expected bool) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		assert.Equal(t, expected, proxies.Trusts(r), remoteAddr)
+	}
+
+	test("10.0.0.1:1234", true)
+	test("10.0.0.2:1234", false)
+	test("192.168.42.42:1234", true)
+	test("[::1]:1234", true)
+	test("garbage", false)
+
+	assert.False(t, TrustedProxies{}.Trusts(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestServiceUrlFromForwardedHeaders(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.1"})
+	assert.NoError(t, err)
+
+	c := &commonController{
+		BaseUrl:        "https://spi.on.my.machine",
+		PathPrefix:     "/spi",
+		TrustedProxies: proxies,
+	}
+
+	request := func(remoteAddr string, headers map[string]string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+
+	t.Run("no headers", func(t *testing.T) {
+		assert.Equal(t, "https://spi.on.my.machine/spi/callback_success", c.serviceUrl(request("10.0.0.1:1234", nil), "/callback_success"))
+	})
+
+	t.Run("untrusted proxy", func(t *testing.T) {
+		r := request("10.0.0.2:1234", map[string]string{"X-Forwarded-Host": "evil.com"})
+		assert.Equal(t, "https://spi.on.my.machine/spi/callback_success", c.serviceUrl(r, "/callback_success"))
+	})
+
+	t.Run("host and proto", func(t *testing.T) {
+		r := request("10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "other.host, inner.host", "X-Forwarded-Proto": "http"})
+		assert.Equal(t, "http://other.host/spi/callback_success", c.serviceUrl(r, "/callback_success"))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		r := request("10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "other.host", "X-Forwarded-Prefix": "/api/spi-oauth/"})
+		assert.Equal(t, "https://other.host/api/spi-oauth/callback_success", c.serviceUrl(r, "/callback_success"))
+	})
+
+	t.Run("empty prefix", func(t *testing.T) {
+		r := request("10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "other.host", "X-Forwarded-Prefix": ""})
+		assert.Equal(t, "https://other.host/callback_success", c.serviceUrl(r, "/callback_success"))
+	})
+
+	t.Run("invalid host", func(t *testing.T) {
+		r := request("10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "evil.com/path"})
+		assert.Equal(t, "https://spi.on.my.machine/spi/callback_success", c.serviceUrl(r, "/callback_success"))
+	})
+}
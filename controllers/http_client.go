@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// providerRequestTimeout limits the duration of a single request to the service provider including reading
+	// the response.
+	providerRequestTimeout = 30 * time.Second
+
+	// providerMaxIdleConnsPerHost is the number of the kept-alive connections per service provider. The default of
+	// the standard library (2) makes the concurrent exchanges open new connections all the time.
+	providerMaxIdleConnsPerHost = 32
+
+	// providerTlsSessionCacheSize is the number of the TLS sessions to the service providers that can be resumed
+	// without the full handshake.
+	providerTlsSessionCacheSize = 64
+)
+
+// sharedProviderClient is the HTTP client used for all the calls to the service providers that don't need a TLS client
+// certificate. It is shared by all the controllers (and survives the configuration reloads) so that the pooled
+// connections and the TLS sessions are reused across the flows.
+var sharedProviderClient = newProviderClient(nil)
+
+// newProviderTransport creates the HTTP transport tuned for the calls to the service providers. The provided TLS
+// configuration is used if not nil; the session cache is added to it if it doesn't have one.
+func newProviderTransport(tlsConfig *tls.Config) *http.Transport {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(providerTlsSessionCacheSize)
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   providerMaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// newProviderClient creates the HTTP client calling the service providers using the tuned transport.
+func newProviderClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: newProviderTransport(tlsConfig),
+		Timeout:   providerRequestTimeout,
+	}
+}
+
+// providerHttpClient returns the HTTP client to call the service provider with. The client presenting the TLS client
+// certificate takes precedence, then the client provided in the context using the oauth2.HTTPClient key and finally
+// the shared one.
+func (c commonController) providerHttpClient(ctx context.Context) *http.Client {
+	if c.tokenEndpointClient != nil {
+		return c.tokenEndpointClient
+	}
+	if cl, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && cl != nil {
+		return cl
+	}
+	return sharedProviderClient
+}
+
+// newClientAuthenticatedRequest creates the POST request sending the form with the provided parameters to the endpoint
+// of the service provider. The client authenticates the same way as with the token endpoint.
+func (c commonController) newClientAuthenticatedRequest(ctx context.Context, oauthCfg *oauth2.Config, endpoint string, params url.Values) (*http.Request, error) {
+	useBasicAuth := false
+	if usesClientSecret(c.clientAuthMethod) && oauthCfg.ClientSecret != "" {
+		if oauthCfg.Endpoint.AuthStyle == oauth2.AuthStyleInParams {
+			params.Set("client_secret", oauthCfg.ClientSecret)
+		} else {
+			useBasicAuth = true
+		}
+	}
+	if c.clientAssertions != nil {
+		assertion, err := c.clientAssertions.assertion(oauthCfg.ClientID, oauthCfg.Endpoint.TokenURL, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		params.Set("client_assertion_type", clientAssertionType)
+		params.Set("client_assertion", assertion)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasicAuth {
+		req.SetBasicAuth(url.QueryEscape(oauthCfg.ClientID), url.QueryEscape(oauthCfg.ClientSecret))
+	}
+	return req, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestNewProviderTransport(t *testing.T) {
+	transport := newProviderTransport(nil)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, providerMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.NotNil(t, transport.TLSClientConfig.ClientSessionCache)
+	assert.Equal(t, uint16(tls.VersionTLS12), transport.TLSClientConfig.MinVersion)
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS13}
+	transport = newProviderTransport(tlsConfig)
+	assert.Same(t, tlsConfig, transport.TLSClientConfig)
+	assert.NotNil(t, tlsConfig.ClientSessionCache)
+}
+
+func TestProviderHttpClient(t *testing.T) {
+	assert.Same(t, sharedProviderClient, commonController{}.providerHttpClient(context.TODO()))
+
+	fromContext := &http.Client{}
+	ctx := context.WithValue(context.TODO(), oauth2.HTTPClient, fromContext)
+	assert.Same(t, fromContext, commonController{}.providerHttpClient(ctx))
+
+	withCertificate := &http.Client{}
+	assert.Same(t, withCertificate, commonController{tokenEndpointClient: withCertificate}.providerHttpClient(ctx))
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// identityLookupTimeout limits the time the enrichment of the identity can delay the flow.
+	identityLookupTimeout = 3 * time.Second
+
+	// DefaultIdentityCacheTtl is the time for which the identities looked up over HTTP are cached if no TTL is
+	// configured.
+	DefaultIdentityCacheTtl = 10 * time.Minute
+
+	// identityCacheMaxSize limits the number of the cached identities.
+	identityCacheMaxSize = 1024
+
+	// maxIdentityResponseSize limits the size of the response of the identity lookup.
+	maxIdentityResponseSize = 64 * 1024
+
+	// IdentityUsernamePlaceholder is replaced by the Kubernetes username in the URL of the HTTP identity lookup.
+	IdentityUsernamePlaceholder = "{username}"
+)
+
+// UserIdentity is the identity of the user that initiated the OAuth flow as recorded in the flow events and the logs.
+type UserIdentity struct {
+	// Username is the Kubernetes username of the user, taken from the subject of the Kubernetes token.
+	Username string `json:"username" yaml:"-"`
+	// Email is the organizational email of the user, e.g. in the SSO. Empty if not known.
+	Email string `json:"email,omitempty" yaml:"email,omitempty"`
+	// DisplayName is the human-readable name of the user. Empty if not known.
+	DisplayName string `json:"displayName,omitempty" yaml:"displayName,omitempty"`
+}
+
+// IdentityEnricher maps the Kubernetes usernames to the organizational identities of the users so that the people
+// reviewing the audit records see who the users are.
+type IdentityEnricher interface {
+	// Enrich returns the organizational identity of the Kubernetes user. Nil is returned if the user is not known.
+	Enrich(ctx context.Context, username string) (*UserIdentity, error)
+}
+
+// IdentityEnrichers enrich the identity using the first enricher in the list that knows the user.
+type IdentityEnrichers []IdentityEnricher
+
+func (e IdentityEnrichers) Enrich(ctx context.Context, username string) (*UserIdentity, error) {
+	for _, enricher := range e {
+		identity, err := enricher.Enrich(ctx, username)
+		if err != nil || identity != nil {
+			return identity, err
+		}
+	}
+	return nil, nil
+}
+
+// IdentityDirectory is the static mapping of the Kubernetes usernames to the identities of the users.
+type IdentityDirectory map[string]UserIdentity
+
+// LoadIdentityDirectory reads the identity directory from the YAML file mapping the Kubernetes usernames to
+// the objects with the email and the displayName of the users.
+func LoadIdentityDirectory(path string) (IdentityDirectory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the identity directory: %w", err)
+	}
+	directory := IdentityDirectory{}
+	if err = yaml.Unmarshal(data, &directory); err != nil {
+		return nil, fmt.Errorf("failed to parse the identity directory: %w", err)
+	}
+	return directory, nil
+}
+
+func (d IdentityDirectory) Enrich(_ context.Context, username string) (*UserIdentity, error) {
+	identity, ok := d[username]
+	if !ok {
+		return nil, nil
+	}
+	identity.Username = username
+	return &identity, nil
+}
+
+// HttpIdentityLookup looks the identities of the users up in an HTTP service, e.g. the user directory of the SSO.
+// The service is expected to return a JSON object with the email and the displayName of the user, or 404 if the user
+// is not known. The results are cached, including the unknown users, but not the failures.
+type HttpIdentityLookup struct {
+	urlTemplate string
+	ttl         time.Duration
+	client      *http.Client
+	now         func() time.Time
+
+	lock  sync.Mutex
+	cache map[string]cachedIdentity
+}
+
+type cachedIdentity struct {
+	identity *UserIdentity
+	expires  time.Time
+}
+
+var _ IdentityEnricher = (*HttpIdentityLookup)(nil)
+
+// NewHttpIdentityLookup creates the lookup calling the URL in which the IdentityUsernamePlaceholder is replaced by
+// the escaped Kubernetes username. The zero TTL is replaced by DefaultIdentityCacheTtl.
+func NewHttpIdentityLookup(urlTemplate string, ttl time.Duration) (*HttpIdentityLookup, error) {
+	if !strings.Contains(urlTemplate, IdentityUsernamePlaceholder) {
+		return nil, fmt.Errorf("the URL of the identity lookup must contain the %s placeholder", IdentityUsernamePlaceholder)
+	}
+	u, err := url.Parse(strings.ReplaceAll(urlTemplate, IdentityUsernamePlaceholder, "user"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL of the identity lookup: %w", err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return nil, fmt.Errorf("the URL of the identity lookup must be absolute")
+	}
+	if ttl <= 0 {
+		ttl = DefaultIdentityCacheTtl
+	}
+
+	return &HttpIdentityLookup{
+		urlTemplate: urlTemplate,
+		ttl:         ttl,
+		client:      &http.Client{Timeout: identityLookupTimeout},
+		now:         time.Now,
+		cache:       map[string]cachedIdentity{},
+	}, nil
+}
+
+func (l *HttpIdentityLookup) Enrich(ctx context.Context, username string) (*UserIdentity, error) {
+	if identity, ok := l.cached(username); ok {
+		return identity, nil
+	}
+
+	identity, err := l.lookup(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.cache) >= identityCacheMaxSize {
+		l.evictExpired()
+		if len(l.cache) >= identityCacheMaxSize {
+			l.cache = map[string]cachedIdentity{}
+		}
+	}
+	l.cache[username] = cachedIdentity{identity: identity, expires: l.now().Add(l.ttl)}
+	return copyIdentity(identity), nil
+}
+
+func (l *HttpIdentityLookup) cached(username string) (*UserIdentity, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry, ok := l.cache[username]
+	if !ok || !l.now().Before(entry.expires) {
+		return nil, false
+	}
+	return copyIdentity(entry.identity), true
+}
+
+// evictExpired removes the expired entries from the cache. It must be called with the lock held.
+func (l *HttpIdentityLookup) evictExpired() {
+	now := l.now()
+	for username, entry := range l.cache {
+		if !now.Before(entry.expires) {
+			delete(l.cache, username)
+		}
+	}
+}
+
+func (l *HttpIdentityLookup) lookup(ctx context.Context, username string) (*UserIdentity, error) {
+	lookupUrl := strings.ReplaceAll(l.urlTemplate, IdentityUsernamePlaceholder, url.PathEscape(username))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookupUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the identity: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the identity lookup failed with status %d", resp.StatusCode)
+	}
+
+	identity := &UserIdentity{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxIdentityResponseSize)).Decode(identity); err != nil {
+		return nil, fmt.Errorf("failed to parse the response of the identity lookup: %w", err)
+	}
+	identity.Username = username
+	return identity, nil
+}
+
+func copyIdentity(identity *UserIdentity) *UserIdentity {
+	if identity == nil {
+		return nil
+	}
+	copied := *identity
+	return &copied
+}
+
+// tokenSubject returns the subject of the Kubernetes token if it is a JWT, e.g. a service account token or an OIDC
+// token. The signature is not verified, the token is verified by the cluster when it is used. An empty string is
+// returned for the opaque tokens.
+func tokenSubject(k8sToken string) string {
+	parsed, err := jwt.ParseSigned(k8sToken)
+	if err != nil {
+		return ""
+	}
+	claims := jwt.Claims{}
+	if err = parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// userIdentity returns the identity of the user presenting the Kubernetes token, enriched if the enrichment is
+// configured. Nil is returned if the token doesn't tell who the user is. The failures of the enrichment are only
+// logged, so that they never break the flow. Because the subject of the token is not verified, it must only be called
+// for the tokens the cluster has already authenticated, i.e. after a self subject access review made with the token
+// succeeded, otherwise anyone could attach any identity to the logs and the events.
+func (c commonController) userIdentity(ctx context.Context, k8sToken string) *UserIdentity {
+	username := tokenSubject(k8sToken)
+	if username == "" {
+		return nil
+	}
+	if c.Identities == nil {
+		return &UserIdentity{Username: username}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, identityLookupTimeout)
+	defer cancel()
+
+	identity, err := c.Identities.Enrich(ctx, username)
+	if err != nil {
+		LoggerFromContext(ctx).Warn("failed to enrich the identity of the user", zap.String("user", username), zap.Error(err))
+	}
+	if identity == nil {
+		return &UserIdentity{Username: username}
+	}
+	identity.Username = username
+	return identity
+}
+
+// flowUserIdentity returns the identity of the user that initiated the flow stored in the session under the flow key.
+// Nil is returned if the flow is not found.
+func (c commonController) flowUserIdentity(r *http.Request, flowKey string) *UserIdentity {
+	if c.SessionManager == nil || flowKey == "" {
+		return nil
+	}
+	k8sToken, err := c.getFlow(r, flowKey)
+	if err != nil || k8sToken == "" {
+		return nil
+	}
+	return c.userIdentity(r.Context(), k8sToken)
+}
+
+// identityFields are the log fields identifying the user.
+func identityFields(identity *UserIdentity) []zap.Field {
+	if identity == nil {
+		return nil
+	}
+	fields := []zap.Field{zap.String("user", identity.Username)}
+	if identity.Email != "" {
+		fields = append(fields, zap.String("userEmail", identity.Email))
+	}
+	return fields
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func subjectToken(t *testing.T, subject string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+	assert.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{Subject: subject}).CompactSerialize()
+	assert.NoError(t, err)
+	return token
+}
+
+func TestTokenSubject(t *testing.T) {
+	assert.Equal(t, "alice", tokenSubject(subjectToken(t, "alice")))
+	assert.Equal(t, "system:serviceaccount:default:pipeline", tokenSubject(subjectToken(t, "system:serviceaccount:default:pipeline")))
+	assert.Empty(t, tokenSubject("sha256~opaque-token"))
+}
+
+func TestLoadIdentityDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identities.yaml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`
+alice:
+  email: alice@example.com
+  displayName: Alice Liddell
+system:serviceaccount:ci:pipeline:
+  displayName: CI pipeline
+`), 0600))
+
+	directory, err := LoadIdentityDirectory(file)
+	assert.NoError(t, err)
+
+	identity, err := directory.Enrich(context.TODO(), "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserIdentity{Username: "alice", Email: "alice@example.com", DisplayName: "Alice Liddell"}, identity)
+
+	identity, err = directory.Enrich(context.TODO(), "system:serviceaccount:ci:pipeline")
+	assert.NoError(t, err)
+	assert.Equal(t, "CI pipeline", identity.DisplayName)
+
+	identity, err = directory.Enrich(context.TODO(), "bob")
+	assert.NoError(t, err)
+	assert.Nil(t, identity)
+
+	_, err = LoadIdentityDirectory(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestNewHttpIdentityLookup(t *testing.T) {
+	_, err := NewHttpIdentityLookup("https://directory/users", 0)
+	assert.Error(t, err)
+	_, err = NewHttpIdentityLookup("/users/{username}", 0)
+	assert.Error(t, err)
+
+	lookup, err := NewHttpIdentityLookup("https://directory/users/{username}", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultIdentityCacheTtl, lookup.ttl)
+}
+
+func TestHttpIdentityLookup(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.EscapedPath() {
+		case "/users/alice":
+			_, _ = w.Write([]byte(`{"email":"alice@example.com","displayName":"Alice Liddell","username":"someone-else"}`))
+		case "/users/system:serviceaccount:ci:pipeline":
+			_, _ = w.Write([]byte(`{"displayName":"CI pipeline"}`))
+		case "/users/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	lookup, err := NewHttpIdentityLookup(srv.URL+"/users/{username}", time.Minute)
+	assert.NoError(t, err)
+	now := time.Now()
+	lookup.now = func() time.Time { return now }
+
+	identity, err := lookup.Enrich(context.TODO(), "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserIdentity{Username: "alice", Email: "alice@example.com", DisplayName: "Alice Liddell"}, identity)
+
+	identity, err = lookup.Enrich(context.TODO(), "system:serviceaccount:ci:pipeline")
+	assert.NoError(t, err)
+	assert.Equal(t, "CI pipeline", identity.DisplayName)
+
+	identity, err = lookup.Enrich(context.TODO(), "bob")
+	assert.NoError(t, err)
+	assert.Nil(t, identity)
+
+	_, err = lookup.Enrich(context.TODO(), "broken")
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	t.Run("cached", func(t *testing.T) {
+		identity, err := lookup.Enrich(context.TODO(), "alice")
+		assert.NoError(t, err)
+		assert.Equal(t, "alice@example.com", identity.Email)
+
+		// the unknown users are cached too, the failures are not
+		identity, err = lookup.Enrich(context.TODO(), "bob")
+		assert.NoError(t, err)
+		assert.Nil(t, identity)
+		_, err = lookup.Enrich(context.TODO(), "broken")
+		assert.Error(t, err)
+		assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+
+		// the cached identity cannot be modified by the callers
+		identity, _ = lookup.Enrich(context.TODO(), "alice")
+		identity.Email = "mallory@example.com"
+		identity, _ = lookup.Enrich(context.TODO(), "alice")
+		assert.Equal(t, "alice@example.com", identity.Email)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		_, err := lookup.Enrich(context.TODO(), "alice")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+	})
+}
+
+// failingEnricher fails to enrich any identity.
+type failingEnricher struct{}
+
+func (failingEnricher) Enrich(context.Context, string) (*UserIdentity, error) {
+	return nil, errors.New("the directory is down")
+}
+
+func TestIdentityEnrichers(t *testing.T) {
+	enrichers := IdentityEnrichers{
+		IdentityDirectory{"alice": {Email: "alice@example.com"}},
+		IdentityDirectory{"alice": {Email: "alice@other.com"}, "bob": {Email: "bob@example.com"}},
+	}
+
+	identity, err := enrichers.Enrich(context.TODO(), "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", identity.Email)
+
+	identity, err = enrichers.Enrich(context.TODO(), "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob@example.com", identity.Email)
+
+	identity, err = enrichers.Enrich(context.TODO(), "carol")
+	assert.NoError(t, err)
+	assert.Nil(t, identity)
+}
+
+func TestUserIdentity(t *testing.T) {
+	assert.Nil(t, commonController{}.userIdentity(context.TODO(), "sha256~opaque-token"))
+	assert.Equal(t, &UserIdentity{Username: "alice"}, commonController{}.userIdentity(context.TODO(), subjectToken(t, "alice")))
+
+	c := commonController{Identities: IdentityDirectory{"alice": {Email: "alice@example.com", DisplayName: "Alice Liddell"}}}
+	assert.Equal(t, &UserIdentity{Username: "alice", Email: "alice@example.com", DisplayName: "Alice Liddell"}, c.userIdentity(context.TODO(), subjectToken(t, "alice")))
+	assert.Equal(t, &UserIdentity{Username: "bob"}, c.userIdentity(context.TODO(), subjectToken(t, "bob")))
+
+	// the failures of the enrichment don't lose the username
+	c = commonController{Identities: failingEnricher{}}
+	assert.Equal(t, &UserIdentity{Username: "alice"}, c.userIdentity(context.TODO(), subjectToken(t, "alice")))
+}
+
+func TestIdentityFields(t *testing.T) {
+	assert.Empty(t, identityFields(nil))
+	assert.Len(t, identityFields(&UserIdentity{Username: "alice"}), 1)
+	assert.Len(t, identityFields(&UserIdentity{Username: "alice", Email: "alice@example.com"}), 2)
+}
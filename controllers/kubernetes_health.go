@@ -0,0 +1,343 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	authz "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultKubernetesCheckInterval is the default interval between the checks of the Kubernetes client.
+	DefaultKubernetesCheckInterval = time.Minute
+
+	// DefaultKubernetesExpiryWarning is the default time before the expiry of the Kubernetes credentials of the service
+	// since which the monitor warns about it. The kubelet rotates the projected service account tokens well before.
+	DefaultKubernetesExpiryWarning = 10 * time.Minute
+
+	// kubernetesCheckTimeout limits the duration of a single check of the Kubernetes client.
+	kubernetesCheckTimeout = 10 * time.Second
+)
+
+// errKubernetesCredentialsExpired is returned when the token or the client certificate the service authenticates with
+// to the Kubernetes API server has expired.
+var errKubernetesCredentialsExpired = errors.New("the Kubernetes credentials of the service have expired")
+
+var (
+	kubernetesClientHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "kubernetes_client",
+		Name:      "healthy",
+		Help:      "Whether the Kubernetes API server accepted (1) or not (0) the credentials of the service in the last check.",
+	})
+	kubernetesCredentialsExpiresAt = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "kubernetes_client",
+		Name:      "credentials_expiry_timestamp_seconds",
+		Help:      "The time at which the Kubernetes credentials of the service expire as a Unix timestamp. Zero if not known.",
+	})
+	kubernetesClientReinitializations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "kubernetes_client",
+		Name:      "reinitializations_total",
+		Help:      "The number of the times the Kubernetes client was re-initialized because its credentials were rejected or expired.",
+	})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(kubernetesClientHealthy, kubernetesCredentialsExpiresAt, kubernetesClientReinitializations)
+}
+
+// ReloadableClient is the Kubernetes client delegating to another client that can be replaced at runtime, e.g. when
+// the client is re-initialized with the refreshed credentials. The users of the client don't need to be recreated.
+type ReloadableClient struct {
+	lock    sync.RWMutex
+	current client.Client
+}
+
+var _ client.Client = (*ReloadableClient)(nil)
+
+// NewReloadableClient creates the reloadable client delegating to the provided client.
+func NewReloadableClient(cl AuthenticatingClient) *ReloadableClient {
+	return &ReloadableClient{current: cl}
+}
+
+// Reload makes the client delegate to the provided client from now on.
+func (c *ReloadableClient) Reload(cl AuthenticatingClient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.current = cl
+}
+
+func (c *ReloadableClient) client() client.Client {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.current
+}
+
+func (c *ReloadableClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.client().Get(ctx, key, obj)
+}
+
+func (c *ReloadableClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.client().List(ctx, list, opts...)
+}
+
+func (c *ReloadableClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.client().Create(ctx, obj, opts...)
+}
+
+func (c *ReloadableClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.client().Delete(ctx, obj, opts...)
+}
+
+func (c *ReloadableClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.client().Update(ctx, obj, opts...)
+}
+
+func (c *ReloadableClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.client().Patch(ctx, obj, patch, opts...)
+}
+
+func (c *ReloadableClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return c.client().DeleteAllOf(ctx, obj, opts...)
+}
+
+func (c *ReloadableClient) Status() client.StatusWriter {
+	return c.client().Status()
+}
+
+func (c *ReloadableClient) Scheme() *runtime.Scheme {
+	return c.client().Scheme()
+}
+
+func (c *ReloadableClient) RESTMapper() meta.RESTMapper {
+	return c.client().RESTMapper()
+}
+
+// KubernetesClientReinitializer creates a new Kubernetes client with the freshly loaded configuration. The returned
+// configuration is the one the client authenticates with.
+type KubernetesClientReinitializer func() (AuthenticatingClient, *rest.Config, error)
+
+// KubernetesClientMonitor periodically checks that the Kubernetes API server accepts the credentials the service
+// authenticates with when there is no token of a user, i.e. its service account token, and that they don't expire
+// soon, so that a revoked or expired token is noticed before the users start getting errors. The check creates
+// a SelfSubjectAccessReview, which changes nothing in the cluster. If the credentials are rejected or expired, the client
+// is re-initialized with the freshly loaded configuration. The outcome of the last check is reported as the health of
+// the component owning the client and in the metrics.
+type KubernetesClientMonitor struct {
+	interval time.Duration
+	warning  time.Duration
+
+	lock         sync.Mutex
+	client       *ReloadableClient
+	config       *rest.Config
+	reinitialize KubernetesClientReinitializer
+	err          error
+}
+
+// NewKubernetesClientMonitor creates the monitor checking the client every interval and warning about the credentials
+// expiring within the warning period. The zero durations are replaced by DefaultKubernetesCheckInterval and
+// DefaultKubernetesExpiryWarning. SetClient must be called before the monitor is started.
+func NewKubernetesClientMonitor(interval time.Duration, warning time.Duration) *KubernetesClientMonitor {
+	if interval <= 0 {
+		interval = DefaultKubernetesCheckInterval
+	}
+	if warning <= 0 {
+		warning = DefaultKubernetesExpiryWarning
+	}
+	return &KubernetesClientMonitor{interval: interval, warning: warning}
+}
+
+// HasServiceCredentials checks whether the Kubernetes client configuration contains any credentials of the service
+// itself. The clients configured to only authenticate with the tokens of the users cannot be checked.
+func HasServiceCredentials(cfg *rest.Config) bool {
+	return cfg != nil && (cfg.BearerToken != "" || cfg.BearerTokenFile != "" || cfg.CertFile != "" || len(cfg.CertData) > 0 || cfg.ExecProvider != nil)
+}
+
+// SetClient sets the client to check, the configuration it was created from and the function re-initializing it.
+func (m *KubernetesClientMonitor) SetClient(cl *ReloadableClient, cfg *rest.Config, reinitialize KubernetesClientReinitializer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.client = cl
+	m.config = cfg
+	m.reinitialize = reinitialize
+}
+
+// Start checks the client right away and then in the background every interval until the context is done.
+func (m *KubernetesClientMonitor) Start(ctx context.Context) {
+	go func() {
+		m.Check(ctx, time.Now())
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.Check(ctx, now)
+			}
+		}
+	}()
+}
+
+// Health returns the error of the last check. Nil until the client has been checked.
+func (m *KubernetesClientMonitor) Health() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+// Check performs a single check of the client, re-initializes it if its credentials are rejected or expired and
+// records the outcome.
+func (m *KubernetesClientMonitor) Check(ctx context.Context, now time.Time) error {
+	m.lock.Lock()
+	cl, cfg, reinitialize := m.client, m.config, m.reinitialize
+	m.lock.Unlock()
+	if cl == nil {
+		return nil
+	}
+
+	err := m.check(ctx, cl, cfg, now)
+	if isCredentialsFailure(err) && reinitialize != nil {
+		zap.L().Warn("the Kubernetes credentials of the service don't work, re-initializing the Kubernetes client", zap.Error(err))
+		newClient, newConfig, reinitErr := reinitialize()
+		if reinitErr != nil {
+			err = fmt.Errorf("%w (failed to re-initialize the Kubernetes client: %s)", err, reinitErr.Error())
+		} else {
+			cl.Reload(newClient)
+			kubernetesClientReinitializations.Inc()
+			cfg = newConfig
+
+			m.lock.Lock()
+			m.config = newConfig
+			m.lock.Unlock()
+
+			err = m.check(ctx, cl, cfg, now)
+		}
+	}
+	if ctx.Err() != nil {
+		// keep the outcome of the previous check instead of the one of the interrupted check
+		return err
+	}
+
+	if err != nil {
+		kubernetesClientHealthy.Set(0)
+		zap.L().Error("the Kubernetes client of the service doesn't work, the OAuth flows will fail", zap.Error(err))
+	} else {
+		kubernetesClientHealthy.Set(1)
+	}
+
+	m.lock.Lock()
+	m.err = err
+	m.lock.Unlock()
+	return err
+}
+
+// check verifies that the credentials in the configuration haven't expired and that the Kubernetes API server accepts
+// them.
+func (m *KubernetesClientMonitor) check(ctx context.Context, cl client.Client, cfg *rest.Config, now time.Time) error {
+	credential, expiresAt, err := kubernetesCredentialsExpiry(cfg)
+	if err != nil {
+		zap.L().Warn("failed to read the expiry of the Kubernetes credentials of the service", zap.Error(err))
+	}
+	if expiresAt.IsZero() {
+		kubernetesCredentialsExpiresAt.Set(0)
+	} else {
+		kubernetesCredentialsExpiresAt.Set(float64(expiresAt.Unix()))
+
+		remaining := expiresAt.Sub(now)
+		if remaining <= 0 {
+			return fmt.Errorf("%w: the %s expired at %s", errKubernetesCredentialsExpired, credential, expiresAt.Format(time.RFC3339))
+		} else if remaining < m.warning {
+			zap.L().Warn("the Kubernetes credentials of the service expire soon", zap.String("credential", credential), zap.Time("expiresAt", expiresAt), zap.Duration("remaining", remaining))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kubernetesCheckTimeout)
+	defer cancel()
+
+	// the review is created without the token of any user, so it is authenticated by the credentials of the service
+	review := &authz.SelfSubjectAccessReview{
+		Spec: authz.SelfSubjectAccessReviewSpec{
+			NonResourceAttributes: &authz.NonResourceAttributes{Path: "/readyz", Verb: "get"},
+		},
+	}
+	if err = cl.Create(ctx, review); err != nil {
+		return fmt.Errorf("the Kubernetes API server failed to review the credentials of the service: %w", err)
+	}
+	return nil
+}
+
+// isCredentialsFailure checks whether the error means that the credentials of the service don't work, as opposed to
+// the failures to reach the Kubernetes API server.
+func isCredentialsFailure(err error) bool {
+	return err != nil && (errors.Is(err, errKubernetesCredentialsExpired) || apierrors.IsUnauthorized(err))
+}
+
+// kubernetesCredentialsExpiry returns the kind and the expiry of the credentials in the configuration, if known.
+// The token file is re-read every time, so that the rotated tokens are picked up.
+func kubernetesCredentialsExpiry(cfg *rest.Config) (string, time.Time, error) {
+	token := cfg.BearerToken
+	if cfg.BearerTokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.BearerTokenFile)
+		if err != nil {
+			return "token", time.Time{}, fmt.Errorf("failed to read the token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		return "token", jwtExpiry(token), nil
+	}
+
+	if len(cfg.CertData) > 0 {
+		notAfter, err := pemCertificateNotAfter(cfg.CertData, "the client certificate data")
+		return "client certificate", notAfter, err
+	}
+	if cfg.CertFile != "" {
+		notAfter, err := certificateNotAfter(cfg.CertFile)
+		return "client certificate", notAfter, err
+	}
+	return "", time.Time{}, nil
+}
+
+// jwtExpiry returns the expiry of the token if it is a JWT with an expiry. The token is not verified, it is only
+// inspected. Zero time is returned otherwise, e.g. for the legacy service account tokens that never expire.
+func jwtExpiry(token string) time.Time {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return time.Time{}
+	}
+	claims := jwt.Claims{}
+	if err = parsed.UnsafeClaimsWithoutVerification(&claims); err != nil || claims.Expiry == nil {
+		return time.Time{}
+	}
+	return claims.Expiry.Time()
+}
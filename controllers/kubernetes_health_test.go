@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func writeServiceAccountToken(t *testing.T, expiresAt time.Time) string {
+	token := idToken(t, signingKey(t, "k1"), jwt.Claims{Subject: "system:serviceaccount:spi:spi-oauth", Expiry: jwt.NewNumericDate(expiresAt)})
+	path := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(token+"\n"), 0600))
+	return path
+}
+
+func TestJwtExpiry(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	assert.True(t, expiresAt.Equal(jwtExpiry(idToken(t, signingKey(t, "k1"), jwt.Claims{Expiry: jwt.NewNumericDate(expiresAt)}))))
+	assert.True(t, jwtExpiry(idToken(t, signingKey(t, "k1"), jwt.Claims{Subject: "legacy"})).IsZero())
+	assert.True(t, jwtExpiry("sha256~static-token").IsZero())
+}
+
+func TestKubernetesCredentialsExpiry(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	credential, actual, err := kubernetesCredentialsExpiry(&rest.Config{BearerTokenFile: writeServiceAccountToken(t, expiresAt)})
+	assert.NoError(t, err)
+	assert.Equal(t, "token", credential)
+	assert.True(t, expiresAt.Equal(actual))
+
+	_, actual, err = kubernetesCredentialsExpiry(&rest.Config{BearerToken: "static-token"})
+	assert.NoError(t, err)
+	assert.True(t, actual.IsZero())
+
+	_, _, err = kubernetesCredentialsExpiry(&rest.Config{BearerTokenFile: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+
+	certPath, _ := writeClientCertificate(t)
+	credential, actual, err = kubernetesCredentialsExpiry(&rest.Config{TLSClientConfig: rest.TLSClientConfig{CertFile: certPath}})
+	assert.NoError(t, err)
+	assert.Equal(t, "client certificate", credential)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), actual, time.Minute)
+
+	certData, err := ioutil.ReadFile(certPath)
+	assert.NoError(t, err)
+	_, fromData, err := kubernetesCredentialsExpiry(&rest.Config{TLSClientConfig: rest.TLSClientConfig{CertData: certData}})
+	assert.NoError(t, err)
+	assert.Equal(t, actual, fromData)
+
+	credential, actual, err = kubernetesCredentialsExpiry(&rest.Config{})
+	assert.NoError(t, err)
+	assert.Empty(t, credential)
+	assert.True(t, actual.IsZero())
+}
+
+func TestHasServiceCredentials(t *testing.T) {
+	assert.False(t, HasServiceCredentials(nil))
+	assert.False(t, HasServiceCredentials(&rest.Config{Host: "https://api"}))
+	assert.True(t, HasServiceCredentials(&rest.Config{BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token"}))
+	assert.True(t, HasServiceCredentials(&rest.Config{TLSClientConfig: rest.TLSClientConfig{CertFile: "tls.crt"}}))
+}
+
+func TestReloadableClient(t *testing.T) {
+	first := &reviewClient{Client: fake.NewClientBuilder().Build()}
+	second := &reviewClient{Client: fake.NewClientBuilder().Build()}
+
+	cl := NewReloadableClient(first)
+	assert.NoError(t, cl.Create(context.TODO(), &authz.SelfSubjectAccessReview{}))
+	cl.Reload(second)
+	assert.NoError(t, cl.Create(context.TODO(), &authz.SelfSubjectAccessReview{}))
+
+	assert.Equal(t, 1, first.reviewCount())
+	assert.Equal(t, 1, second.reviewCount())
+	assert.NotNil(t, cl.Scheme())
+}
+
+func TestKubernetesClientMonitor(t *testing.T) {
+	unauthorized := apierrors.NewUnauthorized("the token has been revoked")
+	validToken := writeServiceAccountToken(t, time.Now().Add(time.Hour))
+
+	monitor := func(current *reviewClient, cfg *rest.Config, reinitialized *reviewClient, reinitErr error) (*KubernetesClientMonitor, *ReloadableClient) {
+		m := NewKubernetesClientMonitor(0, 0)
+		cl := NewReloadableClient(current)
+		m.SetClient(cl, cfg, func() (AuthenticatingClient, *rest.Config, error) {
+			if reinitErr != nil {
+				return nil, nil, reinitErr
+			}
+			return reinitialized, &rest.Config{BearerTokenFile: validToken}, nil
+		})
+		return m, cl
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		m, _ := monitor(&reviewClient{Client: fake.NewClientBuilder().Build()}, &rest.Config{BearerTokenFile: validToken}, nil, errors.New("not expected"))
+		assert.NoError(t, m.Check(context.TODO(), time.Now()))
+		assert.NoError(t, m.Health())
+		assert.Equal(t, 1.0, testutil.ToFloat64(kubernetesClientHealthy))
+	})
+
+	t.Run("revoked credentials", func(t *testing.T) {
+		before := testutil.ToFloat64(kubernetesClientReinitializations)
+		reinitialized := &reviewClient{Client: fake.NewClientBuilder().Build()}
+		m, cl := monitor(&reviewClient{Client: fake.NewClientBuilder().Build(), err: unauthorized}, &rest.Config{BearerTokenFile: validToken}, reinitialized, nil)
+
+		assert.NoError(t, m.Check(context.TODO(), time.Now()))
+		assert.NoError(t, m.Health())
+		assert.Equal(t, before+1, testutil.ToFloat64(kubernetesClientReinitializations))
+
+		// the users of the client use the re-initialized one
+		assert.NoError(t, cl.Create(context.TODO(), &authz.SelfSubjectAccessReview{}))
+		assert.Equal(t, 2, reinitialized.reviewCount())
+	})
+
+	t.Run("expired credentials", func(t *testing.T) {
+		reinitialized := &reviewClient{Client: fake.NewClientBuilder().Build()}
+		expired := &rest.Config{BearerTokenFile: writeServiceAccountToken(t, time.Now().Add(-time.Minute))}
+		m, _ := monitor(&reviewClient{Client: fake.NewClientBuilder().Build()}, expired, reinitialized, nil)
+
+		assert.NoError(t, m.Check(context.TODO(), time.Now()))
+		assert.Equal(t, 1, reinitialized.reviewCount())
+	})
+
+	t.Run("failed re-initialization", func(t *testing.T) {
+		m, _ := monitor(&reviewClient{Client: fake.NewClientBuilder().Build(), err: unauthorized}, &rest.Config{BearerTokenFile: validToken}, nil, errors.New("no kubeconfig"))
+
+		err := m.Check(context.TODO(), time.Now())
+		assert.True(t, apierrors.IsUnauthorized(err))
+		assert.Contains(t, err.Error(), "no kubeconfig")
+		assert.Equal(t, err, m.Health())
+		assert.Equal(t, 0.0, testutil.ToFloat64(kubernetesClientHealthy))
+	})
+
+	t.Run("unreachable API server", func(t *testing.T) {
+		current := &reviewClient{Client: fake.NewClientBuilder().Build(), err: errors.New("connection refused")}
+		m, _ := monitor(current, &rest.Config{BearerTokenFile: validToken}, nil, errors.New("not expected"))
+
+		// the client is not re-initialized because its credentials are not the problem
+		assert.Error(t, m.Check(context.TODO(), time.Now()))
+		assert.Error(t, m.Health())
+		assert.Equal(t, 1, current.reviewCount())
+	})
+}
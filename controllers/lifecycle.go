@@ -0,0 +1,336 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultShutdownTimeout is the default limit of the time the components have to stop.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// ComponentState is the state of a component managed by the Lifecycle.
+type ComponentState string
+
+const (
+	ComponentPending  ComponentState = "pending"
+	ComponentStarting ComponentState = "starting"
+	ComponentRunning  ComponentState = "running"
+	ComponentStopping ComponentState = "stopping"
+	ComponentStopped  ComponentState = "stopped"
+	ComponentFailed   ComponentState = "failed"
+)
+
+// Component is a subsystem of the service, e.g. the HTTP server or a background job, started and stopped by
+// the Lifecycle.
+type Component struct {
+	// Name identifies the component in the dependencies, the logs and the health reports.
+	Name string
+	// DependsOn are the names of the components that must be started before this one and stopped after it.
+	DependsOn []string
+	// Start starts the component. It must not block longer than necessary to start the component, the background
+	// work of the component should run until the context passed to Start is cancelled, which happens when
+	// the component is stopped.
+	Start func(ctx context.Context) error
+	// Stop stops the component within the deadline of the context. Optional, the components that stop with
+	// the cancellation of their start context don't need it.
+	Stop func(ctx context.Context) error
+	// Health checks whether the running component works. Optional, the running components are considered healthy if
+	// not specified.
+	Health func() error
+}
+
+// ComponentStatus is the reported status of a component.
+type ComponentStatus struct {
+	Name  string         `json:"name"`
+	State ComponentState `json:"state"`
+	Error string         `json:"error,omitempty"`
+}
+
+// Lifecycle starts the components in the order of their dependencies, stops them in the reverse order and reports
+// their health. It is safe for concurrent use.
+type Lifecycle struct {
+	// ShutdownTimeout limits the time the components have to stop when Run finishes. DefaultShutdownTimeout is used if
+	// not specified.
+	ShutdownTimeout time.Duration
+
+	lock       sync.Mutex
+	components []*managedComponent
+	started    []*managedComponent
+	failures   chan error
+}
+
+type managedComponent struct {
+	Component
+	state  ComponentState
+	err    error
+	cancel context.CancelFunc
+}
+
+// NewLifecycle creates a new lifecycle without any components.
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{failures: make(chan error, 1)}
+}
+
+// Add registers the component. The components must be added before the lifecycle is started, the components are
+// validated when it is.
+func (l *Lifecycle) Add(component Component) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.components = append(l.components, &managedComponent{Component: component, state: ComponentPending})
+}
+
+// Start starts all the components in the order of their dependencies. If any of them fails to start, the already
+// started ones are stopped and the error is returned.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.lock.Lock()
+	ordered, err := l.order()
+	l.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range ordered {
+		if err = ctx.Err(); err == nil {
+			err = l.start(c)
+		}
+		if err != nil {
+			stopCtx, cancel := context.WithTimeout(context.Background(), l.shutdownTimeout())
+			defer cancel()
+			_ = l.Stop(stopCtx)
+			return fmt.Errorf("failed to start the component '%s': %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func (l *Lifecycle) start(c *managedComponent) error {
+	l.setState(c, ComponentStarting, nil)
+	zap.L().Debug("starting the component", zap.String("component", c.Name))
+
+	// the components run until they are stopped, not until the context of the start is done
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.Start(ctx); err != nil {
+		cancel()
+		l.setState(c, ComponentFailed, err)
+		return err
+	}
+
+	l.lock.Lock()
+	c.cancel = cancel
+	c.state = ComponentRunning
+	l.started = append(l.started, c)
+	l.lock.Unlock()
+
+	zap.L().Info("component started", zap.String("component", c.Name))
+	return nil
+}
+
+// Stop stops the started components in the reverse order of their start. All the components are stopped even if some
+// of them fail to, the errors are joined in the returned error.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.lock.Lock()
+	started := l.started
+	l.started = nil
+	l.lock.Unlock()
+
+	var failed []string
+	for i := len(started) - 1; i >= 0; i-- {
+		c := started[i]
+		l.lock.Lock()
+		// the failure reported by the component is kept in its status
+		alreadyFailed := c.state == ComponentFailed
+		if !alreadyFailed {
+			c.state = ComponentStopping
+		}
+		l.lock.Unlock()
+
+		var err error
+		if c.Stop != nil {
+			err = c.Stop(ctx)
+		}
+		c.cancel()
+
+		if err != nil {
+			zap.L().Error("failed to stop the component", zap.String("component", c.Name), zap.Error(err))
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, err))
+			l.setState(c, ComponentFailed, err)
+			continue
+		}
+		if !alreadyFailed {
+			l.setState(c, ComponentStopped, nil)
+		}
+		zap.L().Info("component stopped", zap.String("component", c.Name))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to stop the components: %v", failed)
+	}
+	return nil
+}
+
+// Fail marks the running component as failed and makes Run stop all the components. It is meant for the components
+// whose background work cannot continue, e.g. the HTTP server that cannot serve anymore.
+func (l *Lifecycle) Fail(name string, err error) {
+	l.lock.Lock()
+	c := l.find(name)
+	if c != nil {
+		c.state = ComponentFailed
+		c.err = err
+	}
+	l.lock.Unlock()
+
+	zap.L().Error("component failed", zap.String("component", name), zap.Error(err))
+	select {
+	case l.failures <- fmt.Errorf("the component '%s' failed: %w", name, err):
+	default:
+		// a failure is already being handled
+	}
+}
+
+// Run starts all the components, waits until the context is done or a component fails and stops all the components
+// within the ShutdownTimeout. The error of the start, of the failed component or of the stop is returned.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	if err := l.Start(ctx); err != nil {
+		return err
+	}
+
+	var failure error
+	select {
+	case <-ctx.Done():
+		zap.L().Info("shutting down")
+	case failure = <-l.failures:
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), l.shutdownTimeout())
+	defer cancel()
+	if err := l.Stop(stopCtx); err != nil && failure == nil {
+		failure = err
+	}
+	return failure
+}
+
+// Status reports the status of all the components in the order of their registration. The health of the running
+// components is checked.
+func (l *Lifecycle) Status() []ComponentStatus {
+	l.lock.Lock()
+	components := append([]*managedComponent{}, l.components...)
+	l.lock.Unlock()
+
+	statuses := make([]ComponentStatus, 0, len(components))
+	for _, c := range components {
+		l.lock.Lock()
+		status := ComponentStatus{Name: c.Name, State: c.state}
+		if c.err != nil {
+			status.Error = c.err.Error()
+		}
+		l.lock.Unlock()
+
+		if status.State == ComponentRunning && c.Health != nil {
+			if err := c.Health(); err != nil {
+				status.Error = err.Error()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Healthy checks that all the components are running and healthy.
+func (l *Lifecycle) Healthy() bool {
+	for _, status := range l.Status() {
+		if status.State != ComponentRunning || status.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// order validates the components and returns them sorted so that each comes after its dependencies. The order of
+// the registration is kept among the independent components.
+func (l *Lifecycle) order() ([]*managedComponent, error) {
+	names := map[string]bool{}
+	for _, c := range l.components {
+		if c.Name == "" || c.Start == nil {
+			return nil, fmt.Errorf("all the components must have a name and a start function")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate component '%s'", c.Name)
+		}
+		names[c.Name] = true
+	}
+
+	ordered := make([]*managedComponent, 0, len(l.components))
+	visiting := map[string]bool{}
+	visited := map[string]bool{}
+
+	var visit func(c *managedComponent) error
+	visit = func(c *managedComponent) error {
+		if visited[c.Name] {
+			return nil
+		}
+		if visiting[c.Name] {
+			return fmt.Errorf("the component '%s' depends on itself", c.Name)
+		}
+		visiting[c.Name] = true
+		for _, name := range c.DependsOn {
+			dependency := l.find(name)
+			if dependency == nil {
+				return fmt.Errorf("the component '%s' depends on the unknown component '%s'", c.Name, name)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		visiting[c.Name] = false
+		visited[c.Name] = true
+		ordered = append(ordered, c)
+		return nil
+	}
+
+	for _, c := range l.components {
+		if err := visit(c); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+func (l *Lifecycle) find(name string) *managedComponent {
+	for _, c := range l.components {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (l *Lifecycle) setState(c *managedComponent, state ComponentState, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	c.state = state
+	c.err = err
+}
+
+func (l *Lifecycle) shutdownTimeout() time.Duration {
+	if l.ShutdownTimeout > 0 {
+		return l.ShutdownTimeout
+	}
+	return DefaultShutdownTimeout
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingComponent returns a component recording its start and stop into the provided list.
+func recordingComponent(name string, events *[]string, dependsOn ...string) Component {
+	return Component{
+		Name:      name,
+		DependsOn: dependsOn,
+		Start: func(_ context.Context) error {
+			*events = append(*events, "start "+name)
+			return nil
+		},
+		Stop: func(_ context.Context) error {
+			*events = append(*events, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestLifecycleOrder(t *testing.T) {
+	var events []string
+	l := NewLifecycle()
+	l.Add(recordingComponent("server", &events, "storage", "client"))
+	l.Add(recordingComponent("events", &events))
+	l.Add(recordingComponent("storage", &events, "client"))
+	l.Add(recordingComponent("client", &events))
+
+	assert.NoError(t, l.Start(context.TODO()))
+	assert.Equal(t, []string{"start client", "start storage", "start server", "start events"}, events)
+	assert.True(t, l.Healthy())
+
+	events = nil
+	assert.NoError(t, l.Stop(context.TODO()))
+	assert.Equal(t, []string{"stop events", "stop server", "stop storage", "stop client"}, events)
+	assert.False(t, l.Healthy())
+	for _, status := range l.Status() {
+		assert.Equal(t, ComponentStopped, status.State)
+	}
+}
+
+func TestLifecycleInvalidComponents(t *testing.T) {
+	test := func(components ...Component) {
+		l := NewLifecycle()
+		for _, c := range components {
+			l.Add(c)
+		}
+		assert.Error(t, l.Start(context.TODO()))
+	}
+
+	var events []string
+	test(recordingComponent("a", &events, "unknown"))
+	test(recordingComponent("a", &events, "b"), recordingComponent("b", &events, "a"))
+	test(recordingComponent("a", &events), recordingComponent("a", &events))
+	test(Component{Name: "a"})
+	assert.Empty(t, events)
+}
+
+func TestLifecycleStartFailure(t *testing.T) {
+	var events []string
+	l := NewLifecycle()
+	l.Add(recordingComponent("client", &events))
+	l.Add(Component{
+		Name:      "storage",
+		DependsOn: []string{"client"},
+		Start: func(_ context.Context) error {
+			return errors.New("no vault")
+		},
+	})
+	l.Add(recordingComponent("server", &events, "storage"))
+
+	err := l.Start(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no vault")
+	assert.Equal(t, []string{"start client", "stop client"}, events)
+
+	statuses := l.Status()
+	assert.Equal(t, ComponentStatus{Name: "client", State: ComponentStopped}, statuses[0])
+	assert.Equal(t, ComponentStatus{Name: "storage", State: ComponentFailed, Error: "no vault"}, statuses[1])
+	assert.Equal(t, ComponentStatus{Name: "server", State: ComponentPending}, statuses[2])
+}
+
+func TestLifecycleHealth(t *testing.T) {
+	var healthErr error
+	l := NewLifecycle()
+	l.Add(Component{
+		Name:   "storage",
+		Start:  func(_ context.Context) error { return nil },
+		Health: func() error { return healthErr },
+	})
+	assert.NoError(t, l.Start(context.TODO()))
+	assert.True(t, l.Healthy())
+
+	healthErr = errors.New("vault sealed")
+	assert.False(t, l.Healthy())
+	assert.Equal(t, []ComponentStatus{{Name: "storage", State: ComponentRunning, Error: "vault sealed"}}, l.Status())
+}
+
+func TestLifecycleRun(t *testing.T) {
+	t.Run("cancelled", func(t *testing.T) {
+		started, stopped := make(chan struct{}), make(chan struct{})
+		l := NewLifecycle()
+		l.Add(Component{
+			Name: "job",
+			Start: func(ctx context.Context) error {
+				close(started)
+				go func() {
+					<-ctx.Done()
+					close(stopped)
+				}()
+				return nil
+			},
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- l.Run(ctx) }()
+
+		<-started
+		cancel()
+		assert.NoError(t, <-done)
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("the context of the component has not been cancelled")
+		}
+	})
+
+	t.Run("component failure", func(t *testing.T) {
+		var events []string
+		l := NewLifecycle()
+		l.Add(recordingComponent("client", &events))
+		l.Add(Component{
+			Name:      "server",
+			DependsOn: []string{"client"},
+			Start: func(_ context.Context) error {
+				go l.Fail("server", errors.New("address in use"))
+				return nil
+			},
+		})
+
+		err := l.Run(context.Background())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "address in use")
+		assert.Equal(t, []string{"start client", "stop client"}, events)
+		assert.Equal(t, ComponentStatus{Name: "server", State: ComponentFailed, Error: "address in use"}, l.Status()[1])
+	})
+
+	t.Run("stop timeout", func(t *testing.T) {
+		l := NewLifecycle()
+		l.ShutdownTimeout = 10 * time.Millisecond
+		l.Add(Component{
+			Name:  "server",
+			Start: func(_ context.Context) error { return nil },
+			Stop: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Error(t, l.Run(ctx))
+	})
+}
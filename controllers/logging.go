@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"go.uber.org/zap"
+)
+
+// RequestIdHeader is the header carrying the ID of the request. The ID provided by the client (e.g. the ingress) is
+// used if valid, otherwise a new one is generated. The ID is returned in the same header of the response.
+const RequestIdHeader = "X-Request-Id"
+
+// requestIdRegexp matches the request IDs accepted from the clients.
+var requestIdRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type loggerContextKey struct{}
+
+// WithLoggerIntoContext stores the logger into the returned context which is based on the provided context.
+func WithLoggerIntoContext(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFromContext returns the logger stored in the context or the global logger if there is none.
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*zap.Logger); ok && logger != nil {
+		return logger
+	}
+	return zap.L()
+}
+
+// withLoggerFields returns the context with the logger of the provided context extended with the fields.
+func withLoggerFields(ctx context.Context, fields ...zap.Field) context.Context {
+	return WithLoggerIntoContext(ctx, LoggerFromContext(ctx).With(fields...))
+}
+
+// RequestLoggerMiddleware puts the logger carrying the ID of the request into the context of every request.
+func RequestLoggerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if !requestIdRegexp.MatchString(requestId) {
+			requestId = NewCorrelationId()
+		}
+		w.Header().Set(RequestIdHeader, requestId)
+
+		ctx := WithLoggerIntoContext(r.Context(), zap.L().With(zap.String("requestId", requestId)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withRequestLogger adds the type of the service provider to the logger of the request.
+func (c commonController) withRequestLogger(r *http.Request) *http.Request {
+	return r.WithContext(withLoggerFields(r.Context(), c.serviceProviderField()))
+}
+
+// withLogger stores the logger into both the context and the request. The callback keeps the two separate, because
+// the context may carry the HTTP client to call the service provider with.
+func withLogger(ctx context.Context, r *http.Request, logger *zap.Logger) (context.Context, *http.Request) {
+	return WithLoggerIntoContext(ctx, logger), r.WithContext(WithLoggerIntoContext(r.Context(), logger))
+}
+
+func (c commonController) serviceProviderField() zap.Field {
+	return zap.String("serviceProvider", string(c.Config.ServiceProviderType))
+}
+
+// flowFields are the log fields identifying the OAuth flow and its SPIAccessToken.
+func flowFields(state *exchangeState) []zap.Field {
+	fields := []zap.Field{zap.String("token", state.TokenName), zap.String("namespace", state.TokenNamespace)}
+	if state.Key != "" {
+		fields = append(fields, zap.String("flowKey", state.Key))
+	}
+	return fields
+}
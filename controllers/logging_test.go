@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLoggerFromContext(t *testing.T) {
+	assert.Same(t, zap.L(), LoggerFromContext(context.TODO()))
+
+	logger := zap.NewNop()
+	assert.Same(t, logger, LoggerFromContext(WithLoggerIntoContext(context.TODO(), logger)))
+}
+
+func TestRequestLoggerMiddleware(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	serve := func(requestId string) *httptest.ResponseRecorder {
+		handler := RequestLoggerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			LoggerFromContext(r.Context()).Info("handled")
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		if requestId != "" {
+			req.Header.Set(RequestIdHeader, requestId)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("provided request ID", func(t *testing.T) {
+		res := serve("abc-123")
+		assert.Equal(t, "abc-123", res.Header().Get(RequestIdHeader))
+		assert.Equal(t, "abc-123", logs.TakeAll()[0].ContextMap()["requestId"])
+	})
+
+	t.Run("generated request ID", func(t *testing.T) {
+		res := serve("")
+		requestId := res.Header().Get(RequestIdHeader)
+		assert.NotEmpty(t, requestId)
+		assert.Equal(t, requestId, logs.TakeAll()[0].ContextMap()["requestId"])
+	})
+
+	t.Run("invalid request ID", func(t *testing.T) {
+		res := serve("a b\nc")
+		assert.NotEqual(t, "a b\nc", res.Header().Get(RequestIdHeader))
+		logs.TakeAll()
+	})
+}
+
+func TestFlowLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	state := &exchangeState{Key: "flow"}
+	state.TokenName = "token"
+	state.TokenNamespace = "default"
+
+	c := commonController{ErrorPages: &ErrorPages{}}
+	c.Config.ServiceProviderType = "GitHub"
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(WithLoggerIntoContext(req.Context(), zap.New(core)))
+	req = c.withRequestLogger(req)
+	_, req = withLogger(req.Context(), req, LoggerFromContext(req.Context()).With(flowFields(state)...))
+
+	c.ErrorPages.Debug(httptest.NewRecorder(), req, http.StatusBadRequest, "bad request")
+
+	entries := logs.TakeAll()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, map[string]interface{}{
+		"serviceProvider": "GitHub",
+		"token":           "token",
+		"namespace":       "default",
+		"flowKey":         "flow",
+		"correlationId":   entries[0].ContextMap()["correlationId"],
+	}, entries[0].ContextMap())
+}
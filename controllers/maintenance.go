@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maintenanceTitle is the title of the page shown to the users starting a flow during the maintenance.
+const maintenanceTitle = "Authorization temporarily unavailable"
+
+// defaultMaintenanceMessage is shown to the users during the maintenance if no message is configured.
+const defaultMaintenanceMessage = "The authorization with the service provider is temporarily unavailable due to a scheduled maintenance. Please try again later."
+
+// Maintenance configures the maintenance window, e.g. of the token storage backend, during which no new flows are
+// started. The users get the maintenance page instead of the errors while the flows already in progress can still
+// finish. The window is always time-boxed so that a forgotten maintenance doesn't keep the service unavailable. Because
+// the configuration is reloaded on change, the maintenance can be toggled without a restart.
+type Maintenance struct {
+	// Start is the beginning of the maintenance window. The window starts immediately if not specified.
+	Start time.Time `yaml:"start,omitempty"`
+
+	// End is the end of the maintenance window. There is no maintenance if not specified.
+	End time.Time `yaml:"end,omitempty"`
+
+	// Message is shown to the users instead of the default message, e.g. to link to the status page.
+	Message string `yaml:"message,omitempty"`
+}
+
+// validate checks that the window has a valid end.
+func (m Maintenance) validate() error {
+	if m.End.IsZero() {
+		if !m.Start.IsZero() || m.Message != "" {
+			return fmt.Errorf("the end of the maintenance window must be specified")
+		}
+		return nil
+	}
+	if !m.Start.IsZero() && !m.Start.Before(m.End) {
+		return fmt.Errorf("the maintenance window must start before it ends")
+	}
+	return nil
+}
+
+// active checks whether the maintenance window is in progress at the provided time. If it is, the remaining time of
+// the window is returned, too.
+func (m Maintenance) active(now time.Time) (time.Duration, bool) {
+	if m.End.IsZero() || !now.Before(m.End) || (!m.Start.IsZero() && now.Before(m.Start)) {
+		return 0, false
+	}
+	return m.End.Sub(now), true
+}
+
+// Unavailable logs the message on the debug level and writes the maintenance page with the 503 status. The Retry-After
+// header tells the clients when the maintenance ends. It is omitted if the remaining time is not known.
+func (e *ErrorPages) Unavailable(w http.ResponseWriter, r *http.Request, remaining time.Duration, message string) {
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Debug("rejecting the request while the new flows are unavailable", zap.Duration("remaining", remaining), zap.String("correlationId", correlationId))
+
+	if remaining > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(remaining.Seconds()))))
+	}
+	e.writePage(w, r, http.StatusServiceUnavailable, correlationId, ErrorPageData{
+		Title:         maintenanceTitle,
+		Message:       message,
+		CorrelationId: correlationId,
+	})
+}
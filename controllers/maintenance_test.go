@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMaintenanceValidate(t *testing.T) {
+	now := time.Now()
+	assert.NoError(t, Maintenance{}.validate())
+	assert.NoError(t, Maintenance{End: now}.validate())
+	assert.NoError(t, Maintenance{Start: now, End: now.Add(time.Hour)}.validate())
+	assert.Error(t, Maintenance{Start: now}.validate())
+	assert.Error(t, Maintenance{Message: "down"}.validate())
+	assert.Error(t, Maintenance{Start: now, End: now}.validate())
+}
+
+func TestMaintenanceActive(t *testing.T) {
+	now := time.Now()
+
+	_, active := Maintenance{}.active(now)
+	assert.False(t, active)
+
+	remaining, active := Maintenance{End: now.Add(time.Hour)}.active(now)
+	assert.True(t, active)
+	assert.Equal(t, time.Hour, remaining)
+
+	_, active = Maintenance{End: now}.active(now)
+	assert.False(t, active)
+
+	_, active = Maintenance{Start: now.Add(time.Minute), End: now.Add(time.Hour)}.active(now)
+	assert.False(t, active)
+
+	remaining, active = Maintenance{Start: now, End: now.Add(time.Hour)}.active(now)
+	assert.True(t, active)
+	assert.Equal(t, time.Hour, remaining)
+}
+
+func TestMaintenanceConfiguration(t *testing.T) {
+	cfg := PersistedServiceConfiguration{}
+	assert.NoError(t, yaml.Unmarshal([]byte("maintenance:\n  start: 2026-10-14T20:00:00Z\n  end: 2026-10-14T22:00:00Z\n  message: Vault upgrade\n"), &cfg))
+	assert.Equal(t, time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC), cfg.Maintenance.Start.UTC())
+	assert.Equal(t, time.Date(2026, 10, 14, 22, 0, 0, 0, time.UTC), cfg.Maintenance.End.UTC())
+	assert.Equal(t, "Vault upgrade", cfg.Maintenance.Message)
+}
+
+func TestErrorPagesUnavailable(t *testing.T) {
+	templates, err := LoadTemplates("../static", "", CallbackErrorTemplate)
+	assert.NoError(t, err)
+	pages := &ErrorPages{Templates: templates}
+
+	res := httptest.NewRecorder()
+	pages.Unavailable(res, httptest.NewRequest("GET", "/", nil), 90*time.Second+time.Millisecond, "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Equal(t, "91", res.Header().Get("Retry-After"))
+	assert.NotEmpty(t, res.Header().Get(correlationIdHeader))
+	assert.Contains(t, res.Body.String(), maintenanceTitle)
+	assert.Contains(t, res.Body.String(), "scheduled maintenance")
+
+	res = httptest.NewRecorder()
+	pages.Unavailable(res, httptest.NewRequest("GET", "/", nil), time.Minute, "See the status page.")
+	assert.Contains(t, res.Body.String(), "See the status page.")
+
+	// the end of the unavailability is not always known
+	res = httptest.NewRecorder()
+	pages.Unavailable(res, httptest.NewRequest("GET", "/", nil), 0, disabledProviderMessage)
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Empty(t, res.Header().Get("Retry-After"))
+}
+
+func TestAuthenticateDuringMaintenance(t *testing.T) {
+	c := commonController{
+		JwtSigningSecret: []byte("secret"),
+		SessionManager:   scs.NewManager(memstore.New(time.Hour)),
+		maintenance:      Maintenance{End: time.Now().Add(time.Hour)},
+	}
+
+	res := httptest.NewRecorder()
+	c.Authenticate(res, httptest.NewRequest("GET", "/github/authenticate?state=abc", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.NotEmpty(t, res.Header().Get("Retry-After"))
+	assert.Contains(t, res.Body.String(), defaultMaintenanceMessage)
+
+	// the callbacks of the flows in progress are not affected
+	res = httptest.NewRecorder()
+	c.Callback(context.TODO(), res, httptest.NewRequest("GET", "/github/callback?state=abc&code=def", nil))
+	assert.NotEqual(t, http.StatusServiceUnavailable, res.Code)
+
+	c.maintenance = Maintenance{End: time.Now().Add(-time.Minute)}
+	res = httptest.NewRecorder()
+	c.Authenticate(res, httptest.NewRequest("GET", "/github/authenticate?state=abc", nil))
+	assert.NotEqual(t, http.StatusServiceUnavailable, res.Code)
+}
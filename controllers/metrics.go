@@ -0,0 +1,39 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+)
+
+// metricsNamespace is the prefix of the names of all the metrics of the service.
+const metricsNamespace = tokenstorage.MetricsNamespace
+
+// MetricsRegistry is the registry of the metrics of the service. It is separate from the default registry so that
+// only the metrics of the service and of the Go runtime are exposed.
+var MetricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	MetricsRegistry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	MetricsRegistry.MustRegister(tokenstorage.ShadowCollectors()...)
+}
+
+// MetricsHandler serves the metrics in the MetricsRegistry in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+}
@@ -11,18 +11,23 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !release
-// +build !release
-
 package controllers
 
-import "net/http"
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
 
-// fakeRoundTrip casts a function into a http.RoundTripper
-type fakeRoundTrip func(r *http.Request) (*http.Response, error)
+	"github.com/stretchr/testify/assert"
+)
 
-var _ http.RoundTripper = fakeRoundTrip(nil)
+func TestMetricsHandler(t *testing.T) {
+	res := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
 
-func (f fakeRoundTrip) RoundTrip(r *http.Request) (*http.Response, error) {
-	return f(r)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "spi_oauth_storage_gc_reclaimed_entries_total")
+	assert.Contains(t, string(body), "go_goroutines")
 }
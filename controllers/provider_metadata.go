@@ -0,0 +1,439 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultMetadataRefreshInterval is the default interval between the refreshes of the metadata of the service
+	// providers.
+	DefaultMetadataRefreshInterval = time.Hour
+
+	// DefaultMetadataMaxStale is the default time for which the metadata of a service provider is used after it has
+	// been fetched if it cannot be refreshed.
+	DefaultMetadataMaxStale = 24 * time.Hour
+
+	// metadataMinRefreshInterval limits how often the metadata is fetched again because an ID token is signed by
+	// an unknown key, so that the tokens with made-up key IDs cannot make the service hammer the service provider.
+	metadataMinRefreshInterval = time.Minute
+
+	// maxMetadataSize is the maximum size of the discovery document and of the JWKS.
+	maxMetadataSize = 1 << 20
+)
+
+// idTokenSigningAlgorithms are the asymmetric algorithms the ID tokens can be signed with. The symmetric ones are
+// refused so that the public keys in the JWKS cannot be used as HMAC secrets. Only the fipsSigningAlgorithms are
+// accepted in the FIPS mode.
+var idTokenSigningAlgorithms = map[jose.SignatureAlgorithm]bool{
+	jose.RS256: true,
+	jose.RS384: true,
+	jose.RS512: true,
+	jose.PS256: true,
+	jose.PS384: true,
+	jose.PS512: true,
+	jose.ES256: true,
+	jose.ES384: true,
+	jose.ES512: true,
+	jose.EdDSA: true,
+}
+
+var (
+	providerMetadataFetched = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "provider_metadata",
+		Name:      "fetched_timestamp_seconds",
+		Help:      "The time at which the metadata of the service provider was last fetched as a Unix timestamp.",
+	}, []string{"service_provider"})
+	providerMetadataFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "provider_metadata",
+		Name:      "fetch_failures_total",
+		Help:      "The number of the failed attempts to fetch the metadata of the service provider.",
+	}, []string{"service_provider"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(providerMetadataFetched, providerMetadataFailures)
+}
+
+// ProviderDiscovery configures the discovery of the endpoints of the service provider from its metadata, i.e.
+// the OpenID Connect discovery document or the OAuth authorization server metadata (RFC 8414).
+type ProviderDiscovery struct {
+	// Url is the URL of the metadata document, e.g. `https://sp.com/.well-known/openid-configuration`. The endpoints
+	// of the service provider are taken from it instead of the built-in ones and the ID tokens are verified using its
+	// JWKS. The discovery is disabled if empty.
+	Url string `yaml:"url,omitempty"`
+}
+
+func validateProviderDiscovery(cfg ProviderDiscovery) error {
+	if cfg.Url == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Url)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("the discovery URL must be an absolute URL")
+	}
+	return nil
+}
+
+// providerMetadata is the part of the metadata of the service provider the OAuth service uses.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+
+	// keys are the keys signing the ID tokens. Nil if the service provider doesn't publish them.
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// metadataEntry is the cached metadata of a single metadata document.
+type metadataEntry struct {
+	// fetch serializes the fetches of the document, so that the concurrent flows wait for a single fetch.
+	fetch sync.Mutex
+
+	// metadata and revalidating are guarded by the lock of the cache.
+	metadata     *providerMetadata
+	revalidating bool
+}
+
+// ProviderMetadataCache fetches the metadata of the service providers configured with the discovery and keeps it in
+// memory. The metadata is fetched when the service starts and refreshed in the background every refresh interval, so
+// that the flows don't wait for it. The metadata that couldn't be refreshed is still used until it is older than
+// the max stale duration, so that an outage of the metadata endpoints doesn't fail the flows right away. A flow using
+// the metadata older than the refresh interval triggers its refresh in the background.
+type ProviderMetadataCache struct {
+	refreshInterval time.Duration
+	maxStale        time.Duration
+
+	lock             sync.Mutex
+	entries          map[string]*metadataEntry
+	serviceProviders *ServiceProviders
+}
+
+// NewProviderMetadataCache creates the cache refreshing the metadata every refresh interval and using the metadata
+// for at most maxStale if it cannot be refreshed. The zero durations are replaced by DefaultMetadataRefreshInterval
+// and DefaultMetadataMaxStale. The max stale duration is never shorter than the refresh interval.
+func NewProviderMetadataCache(refreshInterval time.Duration, maxStale time.Duration) *ProviderMetadataCache {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultMetadataRefreshInterval
+	}
+	if maxStale <= 0 {
+		maxStale = DefaultMetadataMaxStale
+	}
+	if maxStale < refreshInterval {
+		maxStale = refreshInterval
+	}
+	return &ProviderMetadataCache{refreshInterval: refreshInterval, maxStale: maxStale, entries: map[string]*metadataEntry{}}
+}
+
+// SetServiceProviders sets the service providers whose metadata is refreshed in the background. It is called again
+// when the configuration changes.
+func (m *ProviderMetadataCache) SetServiceProviders(sps *ServiceProviders) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.serviceProviders = sps
+}
+
+// Start fetches the metadata of the service providers right away and then refreshes it in the background every
+// refresh interval until the context is done.
+func (m *ProviderMetadataCache) Start(ctx context.Context) {
+	go func() {
+		m.Refresh(ctx)
+
+		ticker := time.NewTicker(m.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Refresh(ctx)
+			}
+		}
+	}()
+}
+
+// Refresh fetches the metadata of all the service providers configured with the discovery. The errors are returned
+// keyed by the service provider type. The metadata that failed to be refreshed is kept until it is older than the max
+// stale duration. The service providers whose controllers fail to initialize are skipped, their failure is reported
+// when the router is built.
+func (m *ProviderMetadataCache) Refresh(ctx context.Context) map[string]error {
+	m.lock.Lock()
+	sps := m.serviceProviders
+	m.lock.Unlock()
+
+	errs := map[string]error{}
+	if sps == nil {
+		return errs
+	}
+	for _, sp := range sps.Providers {
+		controller, err := sp.Controller()
+		if err != nil || controller.DiscoveryUrl() == "" {
+			continue
+		}
+		spType := string(sp.Config.ServiceProviderType)
+		if _, err := m.fetch(ctx, controller.DiscoveryClient(ctx), spType, controller.DiscoveryUrl(), 0); err != nil {
+			zap.L().Warn("failed to refresh the metadata of the service provider", zap.String("serviceProvider", spType), zap.Error(err))
+			errs[spType] = err
+		}
+	}
+	return errs
+}
+
+// get returns the metadata from the provided URL. The cached metadata is returned as long as it is not older than
+// the max stale duration, the metadata older than the refresh interval is refreshed in the background. Otherwise,
+// the metadata is fetched right away. The metadata is fetched using the provided HTTP client.
+func (m *ProviderMetadataCache) get(ctx context.Context, cl *http.Client, spType string, metadataUrl string) (*providerMetadata, error) {
+	entry := m.entry(metadataUrl)
+
+	m.lock.Lock()
+	metadata := entry.metadata
+	m.lock.Unlock()
+
+	if metadata != nil {
+		age := time.Since(metadata.fetchedAt)
+		if age < m.refreshInterval {
+			return metadata, nil
+		}
+		if age < m.maxStale {
+			m.revalidate(cl, spType, metadataUrl, entry)
+			return metadata, nil
+		}
+	}
+
+	metadata, err := m.fetch(ctx, cl, spType, metadataUrl, m.refreshInterval)
+	return usableMetadata(ctx, metadata, err)
+}
+
+// usableMetadata returns the fetched metadata if there is any, ignoring the failure to refresh it.
+func usableMetadata(ctx context.Context, metadata *providerMetadata, err error) (*providerMetadata, error) {
+	if metadata == nil {
+		return nil, err
+	}
+	if err != nil {
+		LoggerFromContext(ctx).Debug("using the stale metadata of the service provider", zap.Time("fetchedAt", metadata.fetchedAt), zap.Error(err))
+	}
+	return metadata, nil
+}
+
+// fetch fetches the metadata from the provided URL unless the cached one is younger than minAge, e.g. because it has
+// been fetched by a concurrent flow in the meantime. If the fetch fails, the error is returned along with the cached
+// metadata, if still usable.
+func (m *ProviderMetadataCache) fetch(ctx context.Context, cl *http.Client, spType string, metadataUrl string, minAge time.Duration) (*providerMetadata, error) {
+	entry := m.entry(metadataUrl)
+	entry.fetch.Lock()
+	defer entry.fetch.Unlock()
+
+	m.lock.Lock()
+	cached := entry.metadata
+	m.lock.Unlock()
+	if cached != nil && time.Since(cached.fetchedAt) < minAge {
+		return cached, nil
+	}
+
+	metadata, err := fetchProviderMetadata(ctx, cl, metadataUrl)
+	if err != nil {
+		providerMetadataFailures.WithLabelValues(spType).Inc()
+		err = fmt.Errorf("failed to obtain the metadata of the service provider from %s: %w", metadataUrl, err)
+		if cached != nil && time.Since(cached.fetchedAt) < m.maxStale {
+			return cached, err
+		}
+		return nil, err
+	}
+
+	providerMetadataFetched.WithLabelValues(spType).Set(float64(metadata.fetchedAt.Unix()))
+	m.lock.Lock()
+	entry.metadata = metadata
+	m.lock.Unlock()
+	return metadata, nil
+}
+
+// refreshKeys fetches the metadata again if an ID token is signed by a key not found in the cached JWKS, i.e. because
+// the service provider has rotated its keys. The metadata is fetched at most once per metadataMinRefreshInterval.
+func (m *ProviderMetadataCache) refreshKeys(ctx context.Context, cl *http.Client, spType string, metadataUrl string) (*providerMetadata, error) {
+	metadata, err := m.fetch(ctx, cl, spType, metadataUrl, metadataMinRefreshInterval)
+	return usableMetadata(ctx, metadata, err)
+}
+
+// revalidate refreshes the metadata in the background unless it is already being refreshed.
+func (m *ProviderMetadataCache) revalidate(cl *http.Client, spType string, metadataUrl string, entry *metadataEntry) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if entry.revalidating {
+		return
+	}
+	entry.revalidating = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), providerRequestTimeout)
+		defer cancel()
+		if _, err := m.fetch(ctx, cl, spType, metadataUrl, m.refreshInterval); err != nil {
+			zap.L().Warn("failed to refresh the metadata of the service provider", zap.String("serviceProvider", spType), zap.Error(err))
+		}
+
+		m.lock.Lock()
+		entry.revalidating = false
+		m.lock.Unlock()
+	}()
+}
+
+func (m *ProviderMetadataCache) entry(metadataUrl string) *metadataEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.entries[metadataUrl]
+	if !ok {
+		entry = &metadataEntry{}
+		m.entries[metadataUrl] = entry
+	}
+	return entry
+}
+
+// fetchProviderMetadata fetches the metadata document and the JWKS it refers to using the provided HTTP client.
+func fetchProviderMetadata(ctx context.Context, cl *http.Client, metadataUrl string) (*providerMetadata, error) {
+	metadata := &providerMetadata{}
+	if err := getProviderDocument(ctx, cl, metadataUrl, metadata); err != nil {
+		return nil, err
+	}
+	for name, endpoint := range map[string]string{"authorization_endpoint": metadata.AuthorizationEndpoint, "token_endpoint": metadata.TokenEndpoint} {
+		if u, err := url.Parse(endpoint); err != nil || !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("the metadata document has no valid %s", name)
+		}
+	}
+
+	if metadata.JwksUri != "" {
+		keys := &jose.JSONWebKeySet{}
+		if err := getProviderDocument(ctx, cl, metadata.JwksUri, keys); err != nil {
+			return nil, fmt.Errorf("failed to fetch the JWKS: %w", err)
+		}
+		metadata.keys = keys
+	}
+
+	metadata.fetchedAt = time.Now()
+	return metadata, nil
+}
+
+// getProviderDocument reads the JSON document from the service provider into the provided value.
+func getProviderDocument(ctx context.Context, cl *http.Client, documentUrl string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, documentUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d of %s", resp.StatusCode, documentUrl)
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxMetadataSize)).Decode(into); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", documentUrl, err)
+	}
+	return nil
+}
+
+func (c commonController) DiscoveryUrl() string {
+	return c.discovery.Url
+}
+
+func (c commonController) DiscoveryClient(ctx context.Context) *http.Client {
+	return c.providerHttpClient(ctx)
+}
+
+// providerEndpoint returns the endpoints of the service provider, taken from its metadata if the discovery is
+// configured.
+func (c commonController) providerEndpoint(ctx context.Context) (oauth2.Endpoint, error) {
+	if c.discovery.Url == "" {
+		return c.Endpoint, nil
+	}
+
+	metadata, err := c.ProviderMetadata.get(ctx, c.providerHttpClient(ctx), string(c.Config.ServiceProviderType), c.discovery.Url)
+	if err != nil {
+		return oauth2.Endpoint{}, err
+	}
+	endpoint := c.Endpoint
+	endpoint.AuthURL = metadata.AuthorizationEndpoint
+	endpoint.TokenURL = metadata.TokenEndpoint
+	return endpoint, nil
+}
+
+// verifyIdToken verifies the signature, the issuer, the audience and the expiry of the ID token in the token response,
+// if any, using the metadata of the service provider. The ID tokens are only verified if the discovery is configured
+// and the service provider publishes its JWKS. The tokens signed using the algorithms other than the
+// idTokenSigningAlgorithms, or the fipsSigningAlgorithms in the FIPS mode, are refused.
+func (c commonController) verifyIdToken(ctx context.Context, token *oauth2.Token, clientId string) error {
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" || c.discovery.Url == "" {
+		return nil
+	}
+
+	spType := string(c.Config.ServiceProviderType)
+	cl := c.providerHttpClient(ctx)
+	metadata, err := c.ProviderMetadata.get(ctx, cl, spType, c.discovery.Url)
+	if err != nil {
+		return err
+	}
+	if metadata.keys == nil {
+		return nil
+	}
+
+	parsed, err := jwt.ParseSigned(idToken)
+	if err != nil {
+		return fmt.Errorf("%w: malformed ID token: %s", errInvalidTokenResponse, err.Error())
+	}
+	allowed := idTokenSigningAlgorithms
+	if c.fips {
+		allowed = fipsSigningAlgorithms
+	}
+	if alg := jose.SignatureAlgorithm(parsed.Headers[0].Algorithm); !allowed[alg] {
+		return fmt.Errorf("%w: the ID token is signed using the %s algorithm which is not accepted", errInvalidTokenResponse, alg)
+	}
+
+	claims := jwt.Claims{}
+	if err = parsed.Claims(metadata.keys, &claims); err != nil {
+		// the service provider may have rotated the keys since they were fetched
+		if refreshed, refreshErr := c.ProviderMetadata.refreshKeys(ctx, cl, spType, c.discovery.Url); refreshErr == nil && refreshed.keys != nil && refreshed != metadata {
+			metadata = refreshed
+			err = parsed.Claims(metadata.keys, &claims)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: the signature of the ID token cannot be verified: %s", errInvalidTokenResponse, err.Error())
+	}
+
+	if err = claims.ValidateWithLeeway(jwt.Expected{Issuer: metadata.Issuer, Audience: jwt.Audience{clientId}, Time: time.Now()}, jwt.DefaultLeeway); err != nil {
+		return fmt.Errorf("%w: invalid ID token: %s", errInvalidTokenResponse, err.Error())
+	}
+	return nil
+}
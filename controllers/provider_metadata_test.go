@@ -0,0 +1,340 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// metadataServer serves the discovery document and the JWKS of a made-up service provider.
+type metadataServer struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	keys      []jose.JSONWebKey
+	failing   bool
+	documents int
+}
+
+func newMetadataServer(keys ...jose.JSONWebKey) *metadataServer {
+	s := &metadataServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			s.documents++
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 s.URL,
+				"authorization_endpoint": s.URL + "/authorize",
+				"token_endpoint":         s.URL + "/token",
+				"jwks_uri":               s.URL + "/jwks",
+			})
+		case "/jwks":
+			public := make([]jose.JSONWebKey, 0, len(s.keys))
+			for _, key := range s.keys {
+				public = append(public, key.Public())
+			}
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: public})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func (s *metadataServer) discoveryUrl() string {
+	return s.URL + "/.well-known/openid-configuration"
+}
+
+func (s *metadataServer) setFailing(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = failing
+}
+
+func (s *metadataServer) setKeys(keys ...jose.JSONWebKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = keys
+}
+
+func (s *metadataServer) fetches() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.documents
+}
+
+func signingKey(t *testing.T, kid string) jose.JSONWebKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+}
+
+func idToken(t *testing.T, key jose.JSONWebKey, claims jwt.Claims) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	assert.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.NoError(t, err)
+	return token
+}
+
+// setFetchedAt makes the cached metadata look fetched at the provided time.
+func setFetchedAt(cache *ProviderMetadataCache, metadataUrl string, fetchedAt time.Time) {
+	entry := cache.entry(metadataUrl)
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry.metadata.fetchedAt = fetchedAt
+}
+
+func TestValidateProviderDiscovery(t *testing.T) {
+	assert.NoError(t, validateProviderDiscovery(ProviderDiscovery{}))
+	assert.NoError(t, validateProviderDiscovery(ProviderDiscovery{Url: "https://sp.com/.well-known/openid-configuration"}))
+	assert.Error(t, validateProviderDiscovery(ProviderDiscovery{Url: "/.well-known/openid-configuration"}))
+}
+
+func TestProviderMetadataCacheGet(t *testing.T) {
+	srv := newMetadataServer(signingKey(t, "k1"))
+	defer srv.Close()
+	cache := NewProviderMetadataCache(time.Hour, 24*time.Hour)
+
+	metadata, err := cache.get(context.TODO(), srv.Client(), "GitHub", srv.discoveryUrl())
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/token", metadata.TokenEndpoint)
+	assert.Len(t, metadata.keys.Key("k1"), 1)
+
+	t.Run("fresh", func(t *testing.T) {
+		_, err := cache.get(context.TODO(), srv.Client(), "GitHub", srv.discoveryUrl())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, srv.fetches())
+	})
+
+	t.Run("stale while revalidating", func(t *testing.T) {
+		setFetchedAt(cache, srv.discoveryUrl(), time.Now().Add(-2*time.Hour))
+
+		stale, err := cache.get(context.TODO(), srv.Client(), "GitHub", srv.discoveryUrl())
+		assert.NoError(t, err)
+		assert.Equal(t, srv.URL+"/token", stale.TokenEndpoint)
+		assert.Eventually(t, func() bool { return srv.fetches() == 2 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("outage", func(t *testing.T) {
+		srv.setFailing(true)
+		defer srv.setFailing(false)
+
+		setFetchedAt(cache, srv.discoveryUrl(), time.Now().Add(-2*time.Hour))
+		stale, err := cache.fetch(context.TODO(), srv.Client(), "GitHub", srv.discoveryUrl(), 0)
+		assert.Error(t, err)
+		assert.NotNil(t, stale)
+		stale, err = cache.get(context.TODO(), srv.Client(), "GitHub", srv.discoveryUrl())
+		assert.NoError(t, err)
+		assert.NotNil(t, stale)
+
+		setFetchedAt(cache, srv.discoveryUrl(), time.Now().Add(-25*time.Hour))
+		_, err = cache.get(context.TODO(), srv.Client(), "GitHub", srv.discoveryUrl())
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid document", func(t *testing.T) {
+		_, err := cache.get(context.TODO(), srv.Client(), "GitHub", srv.URL+"/jwks")
+		assert.Error(t, err)
+	})
+}
+
+func TestProviderMetadataCacheRefresh(t *testing.T) {
+	srv := newMetadataServer()
+	defer srv.Close()
+	cache := NewProviderMetadataCache(time.Hour, 24*time.Hour)
+
+	sps := NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		{ServiceProviderType: config.ServiceProviderTypeQuay},
+	}, func(sp config.ServiceProviderConfiguration) (Controller, error) {
+		c := &commonController{Config: sp, ProviderMetadata: cache}
+		if sp.ServiceProviderType == config.ServiceProviderTypeGitHub {
+			c.discovery = ProviderDiscovery{Url: srv.discoveryUrl()}
+		}
+		return c, nil
+	})
+	cache.SetServiceProviders(sps)
+
+	assert.Empty(t, cache.Refresh(context.TODO()))
+	assert.Equal(t, 1, srv.fetches())
+
+	// the flows use the pre-warmed metadata
+	gh, err := sps.Providers[0].Controller()
+	assert.NoError(t, err)
+	endpoint, err := gh.(*commonController).providerEndpoint(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/authorize", endpoint.AuthURL)
+	assert.Equal(t, 1, srv.fetches())
+
+	srv.setFailing(true)
+	errs := cache.Refresh(context.TODO())
+	assert.Contains(t, errs, string(config.ServiceProviderTypeGitHub))
+	assert.NotContains(t, errs, string(config.ServiceProviderTypeQuay))
+
+	// the flows still use the metadata that failed to be refreshed
+	_, err = gh.(*commonController).providerEndpoint(context.TODO())
+	assert.NoError(t, err)
+}
+
+func TestProviderEndpoint(t *testing.T) {
+	srv := newMetadataServer()
+	defer srv.Close()
+
+	c := &commonController{
+		Config:           config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		Endpoint:         oauth2.Endpoint{AuthURL: "https://sp.com/authorize", TokenURL: "https://sp.com/token", AuthStyle: oauth2.AuthStyleInParams},
+		ProviderMetadata: NewProviderMetadataCache(0, 0),
+	}
+
+	endpoint, err := c.providerEndpoint(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, c.Endpoint, endpoint)
+
+	c.discovery = ProviderDiscovery{Url: srv.discoveryUrl()}
+	endpoint, err = c.providerEndpoint(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/authorize", endpoint.AuthURL)
+	assert.Equal(t, srv.URL+"/token", endpoint.TokenURL)
+	assert.Equal(t, oauth2.AuthStyleInParams, endpoint.AuthStyle)
+
+	srv.setFailing(true)
+	c.discovery = ProviderDiscovery{Url: srv.URL + "/other"}
+	_, err = c.providerEndpoint(context.TODO())
+	assert.Error(t, err)
+
+	t.Run("provided client", func(t *testing.T) {
+		srv.setFailing(false)
+		var requested []string
+		cl := &http.Client{Transport: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+			requested = append(requested, r.URL.Path)
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+
+		c.discovery = ProviderDiscovery{Url: srv.discoveryUrl() + "?client=provided"}
+		endpoint, err := c.providerEndpoint(context.WithValue(context.TODO(), oauth2.HTTPClient, cl))
+		assert.NoError(t, err)
+		assert.Equal(t, srv.URL+"/token", endpoint.TokenURL)
+		assert.Equal(t, []string{"/.well-known/openid-configuration", "/jwks"}, requested)
+	})
+}
+
+func TestVerifyIdToken(t *testing.T) {
+	key := signingKey(t, "k1")
+	srv := newMetadataServer(key)
+	defer srv.Close()
+
+	c := &commonController{
+		Config:           config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		discovery:        ProviderDiscovery{Url: srv.discoveryUrl()},
+		ProviderMetadata: NewProviderMetadataCache(0, 0),
+	}
+	claims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   srv.URL,
+			Subject:  "user",
+			Audience: jwt.Audience{"client-id"},
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}
+	}
+	verify := func(idToken string) error {
+		token := (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{"id_token": idToken})
+		return c.verifyIdToken(context.TODO(), token, "client-id")
+	}
+
+	assert.NoError(t, c.verifyIdToken(context.TODO(), &oauth2.Token{AccessToken: "access"}, "client-id"))
+	assert.NoError(t, verify(idToken(t, key, claims())))
+
+	t.Run("invalid claims", func(t *testing.T) {
+		wrongAudience := claims()
+		wrongAudience.Audience = jwt.Audience{"other-client"}
+		assert.True(t, errors.Is(verify(idToken(t, key, wrongAudience)), errInvalidTokenResponse))
+
+		wrongIssuer := claims()
+		wrongIssuer.Issuer = "https://other.com"
+		assert.True(t, errors.Is(verify(idToken(t, key, wrongIssuer)), errInvalidTokenResponse))
+
+		expired := claims()
+		expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+		assert.True(t, errors.Is(verify(idToken(t, key, expired)), errInvalidTokenResponse))
+
+		assert.True(t, errors.Is(verify("not-a-jwt"), errInvalidTokenResponse))
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		fetches := srv.fetches()
+		assert.True(t, errors.Is(verify(idToken(t, signingKey(t, "k1"), claims())), errInvalidTokenResponse))
+		// the keys have just been fetched, so they are not fetched again
+		assert.Equal(t, fetches, srv.fetches())
+	})
+
+	t.Run("signing algorithm", func(t *testing.T) {
+		sign := func(alg jose.SignatureAlgorithm, key interface{}) string {
+			signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+			assert.NoError(t, err)
+			token, err := jwt.Signed(signer).Claims(claims()).CompactSerialize()
+			assert.NoError(t, err)
+			return token
+		}
+		assert.True(t, errors.Is(verify(sign(jose.HS256, []byte("the-public-key-as-a-secret"))), errInvalidTokenResponse))
+
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		srv.setKeys(key, jose.JSONWebKey{Key: edKey, KeyID: "ed", Algorithm: string(jose.EdDSA), Use: "sig"})
+		defer srv.setKeys(key)
+		setFetchedAt(c.ProviderMetadata, srv.discoveryUrl(), time.Now().Add(-2*metadataMinRefreshInterval))
+		edToken := sign(jose.EdDSA, jose.JSONWebKey{Key: edKey, KeyID: "ed"})
+		assert.NoError(t, verify(edToken))
+
+		// only the algorithms of FIPS 186-4 are accepted in the FIPS mode
+		c.fips = true
+		defer func() { c.fips = false }()
+		assert.True(t, errors.Is(verify(edToken), errInvalidTokenResponse))
+		assert.NoError(t, verify(idToken(t, key, claims())))
+	})
+
+	t.Run("rotated key", func(t *testing.T) {
+		rotated := signingKey(t, "k2")
+		srv.setKeys(rotated)
+		setFetchedAt(c.ProviderMetadata, srv.discoveryUrl(), time.Now().Add(-2*metadataMinRefreshInterval))
+
+		assert.NoError(t, verify(idToken(t, rotated, claims())))
+	})
+}
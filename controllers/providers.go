@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// ControllerFactory creates the controller for the provided service provider configuration.
+type ControllerFactory func(spConfig config.ServiceProviderConfiguration) (Controller, error)
+
+// The reasons of the service providers not being ready reported in their status.
+const (
+	ServiceProviderReasonDuplicate            = "duplicate_configuration"
+	ServiceProviderReasonInitializationFailed = "initialization_failed"
+)
+
+// ServiceProvider is a configured service provider whose controller is initialized once, on the first call of
+// Controller. The router does so eagerly when it is built, so that the misconfigured service providers are logged
+// right away. If the initialization fails, the error is remembered and reported on every subsequent use so that
+// a single misconfigured service provider doesn't prevent the others from working.
+type ServiceProvider struct {
+	Config config.ServiceProviderConfiguration
+
+	factory    ControllerFactory
+	once       sync.Once
+	controller Controller
+	err        error
+	reason     string
+}
+
+// ServiceProviderStatus describes the state of a configured service provider. It is served by the unauthenticated
+// endpoints, so it only carries the stable reason of the failure, never the error itself which can contain the details
+// of the configuration.
+type ServiceProviderStatus struct {
+	Type    config.ServiceProviderType `json:"type"`
+	BaseUrl string                     `json:"baseUrl,omitempty"`
+	Ready   bool                       `json:"ready"`
+	Reason  string                     `json:"reason,omitempty"`
+}
+
+// ServiceProviders is the collection of all the configured service providers.
+type ServiceProviders struct {
+	Providers []*ServiceProvider
+}
+
+// NewServiceProviders creates the collection of service providers from the configuration. The controllers are not
+// initialized by this call.
+func NewServiceProviders(spConfigs []config.ServiceProviderConfiguration, factory ControllerFactory) *ServiceProviders {
+	ret := &ServiceProviders{}
+	seen := map[string]bool{}
+
+	for _, spc := range spConfigs {
+		sp := &ServiceProvider{
+			Config:  spc,
+			factory: factory,
+		}
+
+		prefix := sp.UrlPrefix()
+		if seen[prefix] {
+			sp.err = fmt.Errorf("duplicate configuration of the service provider type %s", spc.ServiceProviderType)
+			sp.reason = ServiceProviderReasonDuplicate
+			sp.once.Do(func() {})
+		}
+		seen[prefix] = true
+
+		ret.Providers = append(ret.Providers, sp)
+	}
+
+	return ret
+}
+
+// UrlPrefix returns the path prefix under which the endpoints of the service provider are exposed.
+func (sp *ServiceProvider) UrlPrefix() string {
+	return strings.ToLower(string(sp.Config.ServiceProviderType))
+}
+
+// Controller returns the controller of the service provider, initializing it, if necessary.
+func (sp *ServiceProvider) Controller() (Controller, error) {
+	sp.once.Do(func() {
+		sp.controller, sp.err = sp.factory(sp.Config)
+		if sp.err != nil {
+			sp.reason = ServiceProviderReasonInitializationFailed
+		}
+	})
+
+	return sp.controller, sp.err
+}
+
+// Status returns the status of the service provider. This initializes the controller of the service provider, if
+// it has not been initialized yet. The error of the initialization is only logged by the one initializing
+// the controller.
+func (sp *ServiceProvider) Status() ServiceProviderStatus {
+	_, err := sp.Controller()
+
+	return ServiceProviderStatus{
+		Type:    sp.Config.ServiceProviderType,
+		BaseUrl: sp.Config.ServiceProviderBaseUrl,
+		Ready:   err == nil,
+		Reason:  sp.reason,
+	}
+}
+
+// Status returns the statuses of all the configured service providers.
+func (sps *ServiceProviders) Status() []ServiceProviderStatus {
+	ret := make([]ServiceProviderStatus, 0, len(sps.Providers))
+	for _, sp := range sps.Providers {
+		ret = append(ret, sp.Status())
+	}
+	return ret
+}
+
+// Ready returns true if there are no service providers configured or at least one of them is ready to be used.
+func (sps *ServiceProviders) Ready() bool {
+	if len(sps.Providers) == 0 {
+		return true
+	}
+
+	for _, sp := range sps.Providers {
+		if _, err := sp.Controller(); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
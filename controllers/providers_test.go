@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestServiceProviders(t *testing.T) {
+	initCount := 0
+	factory := func(spConfig config.ServiceProviderConfiguration) (Controller, error) {
+		initCount++
+		if spConfig.ServiceProviderType == config.ServiceProviderTypeQuay {
+			return nil, fmt.Errorf("broken")
+		}
+		return &commonController{Config: spConfig}, nil
+	}
+
+	sps := NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		{ServiceProviderType: config.ServiceProviderTypeQuay},
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, factory)
+
+	assert.Len(t, sps.Providers, 3)
+	assert.Equal(t, 0, initCount, "controllers should be initialized lazily")
+
+	c, err := sps.Providers[0].Controller()
+	assert.NoError(t, err)
+	assert.NotNil(t, c)
+
+	_, err = sps.Providers[1].Controller()
+	assert.Error(t, err)
+
+	_, err = sps.Providers[2].Controller()
+	assert.Error(t, err, "duplicate service provider types should be rejected")
+
+	// repeated calls should not re-initialize the controllers
+	_, _ = sps.Providers[0].Controller()
+	_, _ = sps.Providers[1].Controller()
+	assert.Equal(t, 2, initCount)
+
+	statuses := sps.Status()
+	assert.Len(t, statuses, 3)
+	assert.True(t, statuses[0].Ready)
+	assert.Empty(t, statuses[0].Reason)
+	assert.False(t, statuses[1].Ready)
+	assert.Equal(t, ServiceProviderReasonInitializationFailed, statuses[1].Reason)
+	assert.False(t, statuses[2].Ready)
+	assert.Equal(t, ServiceProviderReasonDuplicate, statuses[2].Reason)
+
+	assert.True(t, sps.Ready())
+}
+
+func TestServiceProvidersNotReady(t *testing.T) {
+	sps := NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, func(spConfig config.ServiceProviderConfiguration) (Controller, error) {
+		return nil, fmt.Errorf("broken")
+	})
+
+	assert.False(t, sps.Ready())
+	assert.True(t, NewServiceProviders(nil, nil).Ready())
+}
+
+func TestFromConfigurationValidation(t *testing.T) {
+	_, err := FromConfiguration(OAuthServiceConfiguration{}, config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+		ClientId:            "id",
+	}, nil, nil, nil, nil)
+	assert.Error(t, err)
+
+	_, err = FromConfiguration(OAuthServiceConfiguration{}, config.ServiceProviderConfiguration{
+		ServiceProviderType:    config.ServiceProviderTypeGitHub,
+		ClientId:               "id",
+		ClientSecret:           "secret",
+		ServiceProviderBaseUrl: "not-a-url",
+	}, nil, nil, nil, nil)
+	assert.Error(t, err)
+
+	c, err := FromConfiguration(OAuthServiceConfiguration{}, config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+		ClientId:            "id",
+		ClientSecret:        "secret",
+	}, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, c)
+
+	// the client secret is not required with the private_key_jwt client authentication
+	_, keyPath := writeRsaKey(t)
+	c, err = FromConfiguration(OAuthServiceConfiguration{FileConfiguration: FileConfiguration{
+		PersistedServiceConfiguration: PersistedServiceConfiguration{ServiceProviderExtensions: []ServiceProviderExtensions{{
+			Type:                 config.ServiceProviderTypeGitHub,
+			ClientAuthentication: ClientAuthentication{Method: PrivateKeyJwt, PrivateKeyPath: keyPath},
+		}}},
+	}}, config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+		ClientId:            "id",
+	}, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, c.(*commonController).clientAssertions)
+	assert.Equal(t, oauth2.AuthStyleInParams, c.(*commonController).Endpoint.AuthStyle)
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// maxPushedAuthorizationResponseSize limits the size of the response read from the pushed authorization request
+// endpoint.
+const maxPushedAuthorizationResponseSize = 1 << 20
+
+// pushedAuthorizationResponse is the successful response of the pushed authorization request endpoint.
+type pushedAuthorizationResponse struct {
+	RequestUri string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// validatePushedAuthorization checks the configuration of the pushed authorization requests.
+func validatePushedAuthorization(cfg PushedAuthorization) error {
+	switch cfg.Mode {
+	case "", PushedAuthorizationDisabled:
+		return nil
+	case PushedAuthorizationPreferred, PushedAuthorizationRequired:
+	default:
+		return fmt.Errorf("unsupported pushed authorization mode '%s'", cfg.Mode)
+	}
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("the pushed authorization endpoint must be an absolute URL")
+	}
+	return nil
+}
+
+// authorizationUrl returns the URL of the authorization endpoint of the service provider to which the user is
+// redirected. If the pushed authorization requests are enabled, the URL only contains the client_id and
+// the request_uri obtained by pushing the authorization parameters to the service provider. The push can be turned off
+// for the flows to which the pushed authorization requests are not rolled out.
+func (c *commonController) authorizationUrl(ctx context.Context, oauthCfg *oauth2.Config, state string, push bool) (string, error) {
+	frontChannelUrl := oauthCfg.AuthCodeURL(state)
+	if !push || !c.pushedAuthorization.enabled() {
+		return frontChannelUrl, nil
+	}
+
+	requestUri, err := c.pushAuthorizationRequest(ctx, oauthCfg, frontChannelUrl)
+	if err != nil {
+		if c.pushedAuthorization.Mode == PushedAuthorizationRequired {
+			return "", err
+		}
+		LoggerFromContext(ctx).Warn("the pushed authorization request failed, sending the authorization parameters through the browser", zap.Error(err))
+		return frontChannelUrl, nil
+	}
+
+	authUrl, err := url.Parse(oauthCfg.Endpoint.AuthURL)
+	if err != nil {
+		return "", err
+	}
+	query := authUrl.Query()
+	query.Set("client_id", oauthCfg.ClientID)
+	query.Set("request_uri", requestUri)
+	authUrl.RawQuery = query.Encode()
+	return authUrl.String(), nil
+}
+
+// pushAuthorizationRequest pushes the parameters of the authorization request to the service provider and returns
+// the request_uri referencing them.
+func (c *commonController) pushAuthorizationRequest(ctx context.Context, oauthCfg *oauth2.Config, frontChannelUrl string) (string, error) {
+	parsedUrl, err := url.Parse(frontChannelUrl)
+	if err != nil {
+		return "", err
+	}
+	// the pushed parameters are exactly the ones that would otherwise be sent through the browser
+	req, err := c.newClientAuthenticatedRequest(ctx, oauthCfg, c.pushedAuthorization.Endpoint, parsedUrl.Query())
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.providerHttpClient(ctx).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to push the authorization request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPushedAuthorizationResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the response of the pushed authorization request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the pushed authorization request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	parResponse := pushedAuthorizationResponse{}
+	if err = json.Unmarshal(body, &parResponse); err != nil {
+		return "", fmt.Errorf("failed to parse the response of the pushed authorization request: %w", err)
+	}
+	if parResponse.RequestUri == "" {
+		return "", fmt.Errorf("no request_uri in the response of the pushed authorization request")
+	}
+	return parResponse.RequestUri, nil
+}
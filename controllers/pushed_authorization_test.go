@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func oauthConfigOf(t *testing.T, c *commonController) *oauth2.Config {
+	oauthCfg, err := c.newOAuth2Config(httptest.NewRequest("GET", "/", nil), "")
+	assert.NoError(t, err)
+	oauthCfg.Endpoint = c.Endpoint
+	oauthCfg.Scopes = []string{"repo"}
+	return &oauthCfg
+}
+
+func TestPushedAuthorizationRequest(t *testing.T) {
+	var pushed url.Values
+	var user, password string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		pushed = r.PostForm
+		user, password, _ = r.BasicAuth()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"request_uri": "urn:ietf:params:oauth:request_uri:abc", "expires_in": 60}`))
+	}))
+	defer srv.Close()
+
+	c := testController("", nil, nil)
+	c.pushedAuthorization = PushedAuthorization{Mode: PushedAuthorizationRequired, Endpoint: srv.URL}
+
+	authUrl, err := c.authorizationUrl(context.TODO(), oauthConfigOf(t, c), "the-state", true)
+	assert.NoError(t, err)
+
+	parsed, err := url.Parse(authUrl)
+	assert.NoError(t, err)
+	assert.Equal(t, "github.com", parsed.Host)
+	assert.Equal(t, url.Values{"client_id": {"client-id"}, "request_uri": {"urn:ietf:params:oauth:request_uri:abc"}}, parsed.Query())
+
+	assert.Equal(t, "the-state", pushed.Get("state"))
+	assert.Equal(t, "repo", pushed.Get("scope"))
+	assert.Equal(t, "code", pushed.Get("response_type"))
+	assert.Equal(t, "https://spi/github/callback", pushed.Get("redirect_uri"))
+	assert.Equal(t, "client-id", user)
+	assert.Equal(t, "client-secret", password)
+
+	// with the secret in the params
+	c = testController("", nil, nil)
+	c.pushedAuthorization = PushedAuthorization{Mode: PushedAuthorizationRequired, Endpoint: srv.URL}
+	c.clientAuthMethod = ClientSecretPost
+	c.Endpoint.AuthStyle = authStyle(ClientAuthentication{Method: ClientSecretPost})
+	_, err = c.authorizationUrl(context.TODO(), oauthConfigOf(t, c), "the-state", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "client-secret", pushed.Get("client_secret"))
+	assert.Equal(t, "", user)
+}
+
+func TestPushedAuthorizationFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "invalid_request"}`))
+	}))
+	defer srv.Close()
+
+	c := testController("", nil, nil)
+	c.pushedAuthorization = PushedAuthorization{Mode: PushedAuthorizationRequired, Endpoint: srv.URL}
+	_, err := c.authorizationUrl(context.TODO(), oauthConfigOf(t, c), "the-state", true)
+	assert.Error(t, err)
+
+	// the preferred mode falls back to the front channel
+	c = testController("", nil, nil)
+	c.pushedAuthorization = PushedAuthorization{Mode: PushedAuthorizationPreferred, Endpoint: srv.URL}
+	authUrl, err := c.authorizationUrl(context.TODO(), oauthConfigOf(t, c), "the-state", true)
+	assert.NoError(t, err)
+	parsed, err := url.Parse(authUrl)
+	assert.NoError(t, err)
+	assert.Equal(t, "the-state", parsed.Query().Get("state"))
+	assert.Empty(t, parsed.Query().Get("request_uri"))
+}
+
+func TestPushedAuthorizationDisabled(t *testing.T) {
+	c := testController("", nil, nil)
+	c.pushedAuthorization = PushedAuthorization{Mode: PushedAuthorizationDisabled}
+	authUrl, err := c.authorizationUrl(context.TODO(), oauthConfigOf(t, c), "the-state", true)
+	assert.NoError(t, err)
+	assert.Contains(t, authUrl, "state=the-state")
+}
+
+func TestValidatePushedAuthorization(t *testing.T) {
+	assert.NoError(t, validatePushedAuthorization(PushedAuthorization{}))
+	assert.NoError(t, validatePushedAuthorization(PushedAuthorization{Mode: PushedAuthorizationDisabled}))
+	assert.NoError(t, validatePushedAuthorization(PushedAuthorization{Mode: PushedAuthorizationPreferred, Endpoint: "https://sp/par"}))
+	assert.Error(t, validatePushedAuthorization(PushedAuthorization{Mode: PushedAuthorizationRequired}))
+	assert.Error(t, validatePushedAuthorization(PushedAuthorization{Mode: PushedAuthorizationRequired, Endpoint: "/par"}))
+	assert.Error(t, validatePushedAuthorization(PushedAuthorization{Mode: "always", Endpoint: "https://sp/par"}))
+}
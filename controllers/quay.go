@@ -14,6 +14,9 @@
 package controllers
 
 import (
+	"net/url"
+	"strings"
+
 	"golang.org/x/oauth2"
 )
 
@@ -22,3 +25,24 @@ var quayEndpoint = oauth2.Endpoint{
 	AuthURL:  "https://quay.io/oauth/authorize",
 	TokenURL: "https://quay.io/oauth/access_token",
 }
+
+// quayRepositoryOrganization returns the organization (or the user) owning the Quay repository. The repository can be
+// specified with or without the scheme, e.g. `quay.io/org/repo`, `https://quay.io/org/repo` or
+// `https://quay.io/repository/org/repo`.
+func quayRepositoryOrganization(repositoryUrl string) string {
+	if !strings.Contains(repositoryUrl, "://") {
+		repositoryUrl = "https://" + repositoryUrl
+	}
+
+	u, err := url.Parse(repositoryUrl)
+	if err != nil {
+		return ""
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) > 1 && segments[0] == "repository" {
+		segments = segments[1:]
+	}
+
+	return strings.ToLower(segments[0])
+}
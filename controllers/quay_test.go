@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuayRepositoryOrganization(t *testing.T) {
+	assert.Equal(t, "myorg", quayRepositoryOrganization("quay.io/myorg/repo"))
+	assert.Equal(t, "myorg", quayRepositoryOrganization("https://quay.io/MyOrg/repo:latest"))
+	assert.Equal(t, "myorg", quayRepositoryOrganization("https://quay.io/repository/myorg/repo"))
+	assert.Equal(t, "", quayRepositoryOrganization("quay.io"))
+}
+
+func TestQuayOrganizationApps(t *testing.T) {
+	spConfig := config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeQuay,
+		ClientId:            "id",
+		ClientSecret:        "secret",
+	}
+	withApps := func(apps ...OrganizationApp) OAuthServiceConfiguration {
+		return OAuthServiceConfiguration{FileConfiguration: FileConfiguration{
+			PersistedServiceConfiguration: PersistedServiceConfiguration{ServiceProviderExtensions: []ServiceProviderExtensions{
+				{Type: config.ServiceProviderTypeQuay, OrganizationApps: apps},
+			}},
+		}}
+	}
+
+	c, err := FromConfiguration(withApps(OrganizationApp{Organization: "MyOrg", ClientId: "org-id", ClientSecret: "org-secret"}), spConfig, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	cc := c.(*commonController)
+
+	assert.Equal(t, "myorg", cc.organizationOf("quay.io/myorg/repo"))
+	assert.Equal(t, "", cc.organizationOf("quay.io/otherorg/repo"))
+	assert.Equal(t, "", cc.organizationOf(""))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	oauthCfg, err := cc.newOAuth2Config(r, "myorg")
+	assert.NoError(t, err)
+	assert.Equal(t, "org-id", oauthCfg.ClientID)
+	assert.Equal(t, "org-secret", oauthCfg.ClientSecret)
+
+	oauthCfg, err = cc.newOAuth2Config(r, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "id", oauthCfg.ClientID)
+
+	_, err = cc.newOAuth2Config(r, "otherorg")
+	assert.Error(t, err)
+
+	_, err = FromConfiguration(withApps(OrganizationApp{Organization: "myorg", ClientId: "org-id"}), spConfig, nil, nil, nil, nil)
+	assert.Error(t, err)
+
+	_, err = FromConfiguration(withApps(
+		OrganizationApp{Organization: "myorg", ClientId: "org-id", ClientSecret: "org-secret"},
+		OrganizationApp{Organization: "MYORG", ClientId: "org-id2", ClientSecret: "org-secret2"},
+	), spConfig, nil, nil, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestOrganizationAppsNotSupported(t *testing.T) {
+	cfg := OAuthServiceConfiguration{FileConfiguration: FileConfiguration{
+		PersistedServiceConfiguration: PersistedServiceConfiguration{ServiceProviderExtensions: []ServiceProviderExtensions{
+			{Type: config.ServiceProviderTypeGitHub, OrganizationApps: []OrganizationApp{{Organization: "org", ClientId: "id", ClientSecret: "secret"}}},
+		}},
+	}}
+
+	_, err := FromConfiguration(cfg, config.ServiceProviderConfiguration{
+		ServiceProviderType: config.ServiceProviderTypeGitHub,
+		ClientId:            "id",
+		ClientSecret:        "secret",
+	}, nil, nil, nil, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	reauthorizeErrorNotNeeded        = "reauthorization_not_needed"
+	reauthorizeErrorProviderMismatch = "service_provider_mismatch"
+	reauthorizeErrorFailed           = "reauthorization_failed"
+)
+
+// reauthorizeResult is the JSON result of the re-authorization request.
+type reauthorizeResult struct {
+	// Url is the single-use link initiating the OAuth flow when opened in the browser.
+	Url   string          `json:"url"`
+	Token *tokenReference `json:"token"`
+	// Scopes are the scopes requested in the new OAuth flow.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Reauthorize mints the link initiating a new OAuth flow for the SPIAccessToken on behalf of the authenticated user,
+// the same way AuthenticateLink does for the OAuth URL of the operator. The flow requests the scopes recorded for
+// the stored token and any additional scopes in the request. This is only allowed if the SPIAccessToken is not ready
+// or its stored token is missing or expired without a refresh token (e.g. because the refresh found it revoked),
+// the tokens that are still usable are not replaced.
+func (c commonController) Reauthorize(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenRef := &tokenReference{Name: vars["name"], Namespace: vars["namespace"]}
+	r = c.withRequestLogger(r)
+	r = r.WithContext(withLoggerFields(r.Context(), zap.String("token", tokenRef.Name), zap.String("namespace", tokenRef.Namespace)))
+
+	k8sToken := ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+	if k8sToken == "" {
+		c.writeRefreshError(w, r, tokenRef, http.StatusUnauthorized, callbackErrorK8sAuthRequired, "the re-authorization request is not authenticated", nil)
+		return
+	}
+	ctx := WithAuthIntoContext(k8sToken, r.Context())
+
+	workspace := requestParam(r, "workspace")
+	if workspace != "" {
+		if err := acceptWorkspace(workspace); err != nil {
+			c.writeRefreshError(w, r, tokenRef, http.StatusBadRequest, refreshErrorInvalidRequest, "unsupported workspace", err)
+			return
+		}
+		ctx = WithWorkspaceIntoContext(workspace, ctx)
+	}
+
+	accessToken := &v1beta1.SPIAccessToken{}
+	if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: tokenRef.Name, Namespace: tokenRef.Namespace}, accessToken); err != nil {
+		status, errorCode := accessTokenGetError(err, reauthorizeErrorFailed)
+		c.writeRefreshError(w, r, tokenRef, status, errorCode, "failed to get the SPIAccessToken", err)
+		return
+	}
+	if spType, ok := accessToken.Labels[v1beta1.ServiceProviderTypeLabel]; ok && spType != string(c.Config.ServiceProviderType) {
+		c.writeRefreshError(w, r, tokenRef, http.StatusBadRequest, reauthorizeErrorProviderMismatch, "the SPIAccessToken is for a different service provider", nil)
+		return
+	}
+
+	needed, err := c.reauthorizationNeeded(ctx, accessToken, time.Now())
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to read the stored token", err)
+		return
+	}
+	if !needed {
+		c.writeRefreshError(w, r, tokenRef, http.StatusConflict, reauthorizeErrorNotNeeded, "the stored token of the SPIAccessToken is still usable", nil)
+		return
+	}
+
+	scopes, err := c.storedScopes(ctx, accessToken)
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to read the scopes of the stored token", err)
+		return
+	}
+	for _, scope := range parseGrantedScopes(requestParam(r, "scopes")) {
+		if !scopeGranted(scope, scopes) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	codec, err := c.stateCodec()
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, reauthorizeErrorFailed, "failed to instantiate OAuth state codec", err)
+		return
+	}
+	state := anonymousState{
+		AnonymousOAuthState: oauthstate.AnonymousOAuthState{
+			TokenName:           accessToken.Name,
+			TokenNamespace:      accessToken.Namespace,
+			IssuedAt:            time.Now().Unix(),
+			Scopes:              scopes,
+			ServiceProviderType: c.Config.ServiceProviderType,
+			ServiceProviderUrl:  accessToken.Spec.ServiceProviderUrl,
+		},
+		stateClaims:   c.stateValidation.claims(),
+		Workspace:     workspace,
+		RepositoryUrl: requestParam(r, "repository_url"),
+		Automation:    accessToken.Labels[AutomationLabel] == "true",
+	}
+
+	// the link skips the check when it is opened, so the user needs to be allowed to finish the flow now
+	hasAccess, err := c.checkIdentityHasAccess(k8sToken, r, state, isAutomationFlow(state, k8sToken))
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, reauthorizeErrorFailed, "failed to determine if the authenticated user has access", err)
+		return
+	}
+	if !hasAccess {
+		c.writeRefreshError(w, r, tokenRef, http.StatusForbidden, callbackErrorK8sAuthRequired, "the authenticated user is not allowed to update the token data", nil)
+		return
+	}
+
+	stateString, err := codec.Encode(&state)
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, reauthorizeErrorFailed, "failed to encode OAuth state", err)
+		return
+	}
+
+	linkKey, err := c.AuthorizedLinks.Mint(c.JwtSigningSecret, stateString, k8sToken)
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, reauthorizeErrorFailed, "failed to mint the authorization link", err)
+		return
+	}
+	link := url.Values{}
+	link.Set("link", linkKey)
+
+	LoggerFromContext(ctx).Info("minted the re-authorization link", zap.Strings("scopes", scopes))
+	c.writeJsonResult(w, r, http.StatusOK, &reauthorizeResult{
+		Url:    c.authenticateUrl(r) + "?" + link.Encode(),
+		Token:  tokenRef,
+		Scopes: scopes,
+	})
+}
+
+// reauthorizationNeeded checks whether the SPIAccessToken needs a new authorization, i.e. it is not ready or its stored
+// token is missing or expired without the possibility to refresh it.
+func (c commonController) reauthorizationNeeded(ctx context.Context, accessToken *v1beta1.SPIAccessToken, now time.Time) (bool, error) {
+	if accessToken.Status.Phase != v1beta1.SPIAccessTokenPhaseReady {
+		return true, nil
+	}
+
+	stored, err := c.TokenStorage.Get(ctx, accessToken)
+	if err != nil {
+		return false, err
+	}
+	if stored == nil {
+		return true, nil
+	}
+	return stored.Expiry != 0 && now.Unix() >= int64(stored.Expiry) && stored.RefreshToken == "", nil
+}
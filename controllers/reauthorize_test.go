@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveReauthorize(c *commonController, authorization string, path string, form url.Values) (*httptest.ResponseRecorder, reauthorizeResult) {
+	router := mux.NewRouter()
+	router.HandleFunc("/github/reauthorize/{namespace}/{name}", c.Reauthorize).Methods("POST")
+
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	result := reauthorizeResult{}
+	_ = json.Unmarshal(res.Body.Bytes(), &result)
+	return res, result
+}
+
+func TestReauthorize(t *testing.T) {
+	expired := uint64(time.Now().Add(-time.Hour).Unix())
+	token := lookupTestToken("mytoken", "github.com", v1beta1.SPIAccessTokenPhaseReady)
+	token.Spec.ServiceProviderUrl = "https://github.com"
+	c := testController("",
+		map[string]*v1beta1.Token{"default/mytoken": {AccessToken: "expired", Expiry: expired}},
+		testArtifactStorage{"default/mytoken": {Scopes: []string{"repo", "user"}}},
+		token)
+	c.stateValidation = StateValidation{Issuer: "spi-operator", Audience: "spi-oauth"}
+
+	res, result := serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/mytoken", url.Values{"scopes": {"repo admin:org"}, "repository_url": {"https://github.com/org/repo"}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, &tokenReference{Name: "mytoken", Namespace: "default"}, result.Token)
+	assert.Equal(t, []string{"repo", "user", "admin:org"}, result.Scopes)
+
+	link, err := url.Parse(result.Url)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://spi/github/authenticate", link.Scheme+"://"+link.Host+link.Path)
+
+	stateString, k8sToken, ok := c.AuthorizedLinks.Consume(c.JwtSigningSecret, link.Query().Get("link"))
+	assert.True(t, ok)
+	assert.Equal(t, "k8s-token", k8sToken)
+
+	codec, err := c.stateCodec()
+	assert.NoError(t, err)
+	state, err := parseAnonymousState(codec, stateString, c.stateValidation)
+	assert.NoError(t, err)
+	assert.Equal(t, "mytoken", state.TokenName)
+	assert.Equal(t, "default", state.TokenNamespace)
+	assert.Equal(t, []string{"repo", "user", "admin:org"}, state.Scopes)
+	assert.Equal(t, config.ServiceProviderTypeGitHub, state.ServiceProviderType)
+	assert.Equal(t, "https://github.com", state.ServiceProviderUrl)
+	assert.Equal(t, "https://github.com/org/repo", state.RepositoryUrl)
+}
+
+func TestReauthorizeNeeded(t *testing.T) {
+	expired := uint64(time.Now().Add(-time.Hour).Unix())
+	data := map[string]*v1beta1.Token{
+		"default/valid":       {AccessToken: "valid"},
+		"default/refreshable": {AccessToken: "expired", Expiry: expired, RefreshToken: "refresh"},
+		"default/invalid":     {AccessToken: "revoked"},
+	}
+	c := testController("", data, testArtifactStorage{},
+		lookupTestToken("valid", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("refreshable", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("invalid", "github.com", v1beta1.SPIAccessTokenPhaseInvalid),
+		lookupTestToken("missing", "github.com", v1beta1.SPIAccessTokenPhaseReady, "repo"))
+	c.stateValidation = StateValidation{Issuer: "spi-operator", Audience: "spi-oauth"}
+
+	for _, name := range []string{"valid", "refreshable"} {
+		res, _ := serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/"+name, nil)
+		assert.Equal(t, http.StatusConflict, res.Code, name)
+		assert.Contains(t, res.Body.String(), reauthorizeErrorNotNeeded, name)
+	}
+
+	res, _ := serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/invalid", nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// the scopes fall back to the token metadata
+	res, result := serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/missing", nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, []string{"repo"}, result.Scopes)
+}
+
+func TestReauthorizeErrors(t *testing.T) {
+	gitlab := lookupTestToken("gitlab", "gitlab.com", v1beta1.SPIAccessTokenPhaseInvalid)
+	gitlab.Labels[v1beta1.ServiceProviderTypeLabel] = "GitLab"
+	c := testController("", nil, testArtifactStorage{},
+		lookupTestToken("mytoken", "github.com", v1beta1.SPIAccessTokenPhaseInvalid), gitlab)
+	c.stateValidation = StateValidation{Issuer: "spi-operator", Audience: "spi-oauth"}
+
+	res, _ := serveReauthorize(c, "", "/github/reauthorize/default/mytoken", nil)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	assert.Contains(t, res.Body.String(), callbackErrorK8sAuthRequired)
+
+	res, _ = serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/mytoken", url.Values{"workspace": {"Invalid!"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res, _ = serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/nonexistent", nil)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Contains(t, res.Body.String(), refreshErrorTokenNotFound)
+
+	res, _ = serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/gitlab", nil)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), reauthorizeErrorProviderMismatch)
+
+	c.K8sClient.(*reviewClient).allowed = false
+	res, _ = serveReauthorize(c, "Bearer k8s-token", "/github/reauthorize/default/mytoken", nil)
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Contains(t, res.Body.String(), callbackErrorK8sAuthRequired)
+}
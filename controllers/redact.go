@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactedPlaceholder replaces the sensitive data in the redacted strings.
+const redactedPlaceholder = "[REDACTED]"
+
+// minRedactedSecretLength is the minimum length of a configured secret for it to be redacted. Redacting very short
+// strings would make the messages unreadable without providing any real protection.
+const minRedactedSecretLength = 6
+
+var (
+	// bearerTokenRegex matches the bearer tokens, e.g. in the echoed Authorization headers.
+	bearerTokenRegex = regexp.MustCompile(`(?i)(bearer\s+)[^\s"',;]+`)
+	// sensitiveParamRegex matches the sensitive parameters of the URLs and form-encoded bodies.
+	sensitiveParamRegex = regexp.MustCompile(`(?i)\b(code|access_token|refresh_token|id_token|client_secret|client_assertion|code_verifier|k8s_token|token|password)=[^&\s"']+`)
+	// sensitiveJsonRegex matches the sensitive properties of JSON documents, e.g. the token responses.
+	sensitiveJsonRegex = regexp.MustCompile(`(?i)("(?:code|access_token|refresh_token|id_token|client_secret|token|password)"\s*:\s*")[^"]*"`)
+	// wellKnownTokenRegex matches the tokens with the well-known formats, i.e. the GitHub and Vault tokens.
+	wellKnownTokenRegex = regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{20,}|hv[sbr]\.[A-Za-z0-9_-]{20,})`)
+)
+
+// Redactor scrubs the sensitive data like tokens, authorization codes and client secrets from the strings before they
+// are logged or shown to the users. Apart from the well-known patterns, it also redacts the explicitly configured
+// secrets.
+type Redactor struct {
+	lock    sync.RWMutex
+	secrets []string
+}
+
+// DefaultRedactor is the redactor used by the service. Its secrets are updated every time the configuration is loaded.
+var DefaultRedactor = &Redactor{}
+
+// SetSecrets replaces the literal secrets redacted by this redactor.
+func (r *Redactor) SetSecrets(secrets ...string) {
+	filtered := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		if len(s) >= minRedactedSecretLength {
+			filtered = append(filtered, s)
+		}
+	}
+
+	// redact the longest secrets first so that a secret containing another one is redacted fully
+	sort.Slice(filtered, func(i, j int) bool {
+		return len(filtered[i]) > len(filtered[j])
+	})
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.secrets = filtered
+}
+
+// Redact returns the provided string with all the sensitive data replaced by a placeholder.
+func (r *Redactor) Redact(s string) string {
+	r.lock.RLock()
+	secrets := r.secrets
+	r.lock.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redactedPlaceholder)
+	}
+
+	s = bearerTokenRegex.ReplaceAllString(s, "${1}"+redactedPlaceholder)
+	s = sensitiveParamRegex.ReplaceAllString(s, "${1}="+redactedPlaceholder)
+	s = sensitiveJsonRegex.ReplaceAllString(s, "${1}"+redactedPlaceholder+`"`)
+	s = wellKnownTokenRegex.ReplaceAllString(s, redactedPlaceholder)
+
+	return s
+}
+
+// RedactError returns an error with the redacted message of the provided error. The original error is still available
+// using errors.Unwrap, errors.Is or errors.As.
+func (r *Redactor) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{msg: r.Redact(err.Error()), cause: err}
+}
+
+// WrapCore wraps the provided logging core so that the messages and the string and error fields of all the log
+// entries are redacted. It is meant to be used with zap.WrapCore.
+func (r *Redactor) WrapCore(core zapcore.Core) zapcore.Core {
+	return &redactingCore{Core: core, redactor: r}
+}
+
+// ConfigurationSecrets returns the secrets contained in the configuration that should never appear in the logs or
+// the responses.
+func ConfigurationSecrets(cfg config.Configuration) []string {
+	secrets := []string{string(cfg.SharedSecret)}
+	for _, sp := range cfg.ServiceProviders {
+		secrets = append(secrets, sp.ClientSecret)
+	}
+	return secrets
+}
+
+// FileConfigurationSecrets returns the secrets contained in the configuration file, including the options specific to
+// the OAuth service.
+func FileConfigurationSecrets(cfg FileConfiguration) []string {
+	secrets := ConfigurationSecrets(cfg.Configuration)
+	for _, ext := range cfg.ServiceProviderExtensions {
+		for _, app := range ext.OrganizationApps {
+			secrets = append(secrets, app.ClientSecret)
+		}
+		secrets = append(secrets, ext.ClientAuthentication.PrivateKey)
+	}
+	return secrets
+}
+
+// redactedError is an error with the redacted message of the wrapped error.
+type redactedError struct {
+	msg   string
+	cause error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.cause
+}
+
+// redactingCore is the logging core redacting the log entries before passing them to the wrapped core.
+type redactingCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+var _ zapcore.Core = (*redactingCore)(nil)
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.redactFields(fields)), redactor: c.redactor}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = c.redactor.Redact(entry.Message)
+	return c.Core.Write(entry, c.redactFields(fields))
+}
+
+func (c *redactingCore) redactFields(fields []zapcore.Field) []zapcore.Field {
+	ret := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = c.redactor.Redact(f.String)
+		case zapcore.ByteStringType:
+			if b, ok := f.Interface.([]byte); ok {
+				f = zap.String(f.Key, c.redactor.Redact(string(b)))
+			}
+		case zapcore.StringerType:
+			if s, ok := f.Interface.(interface{ String() string }); ok {
+				f = zap.String(f.Key, c.redactor.Redact(s.String()))
+			}
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zap.NamedError(f.Key, c.redactor.RedactError(err))
+			}
+		}
+		ret[i] = f
+	}
+	return ret
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+// validateRedirectTarget checks that the success or failure URL requested by the initiator of the flow is an absolute
+// HTTP(S) URL of one of the allowed origins. Any other targets would make the service an open redirector. An empty
+// target is valid and means the default behavior.
+func (c commonController) validateRedirectTarget(target string) error {
+	if target == "" {
+		return nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("the redirect target must be an absolute HTTP(S) URL")
+	}
+	if !c.isAllowedOrigin(u.Scheme + "://" + u.Host) {
+		return fmt.Errorf("the origin of the redirect target is not allowed")
+	}
+	return nil
+}
+
+// withQuery adds the provided parameters to the query of the URL, keeping the parameters already present in it.
+func withQuery(target string, params url.Values) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// failureRedirect returns the failure URL of the flow with the details of the failure in the query.
+func failureRedirect(exchange *exchangeResult, errorCode string, errorDescription string, correlationId string) string {
+	params := url.Values{"error": {errorCode}}
+	if errorDescription != "" {
+		params.Set("error_description", errorDescription)
+	}
+	if correlationId != "" {
+		params.Set("correlation_id", correlationId)
+	}
+	if exchange.TokenName != "" {
+		params.Set("token", exchange.TokenName)
+		params.Set("namespace", exchange.TokenNamespace)
+	}
+	return withQuery(exchange.FailureUrl, params)
+}
+
+// abortUrl returns the URL the user is sent to when aborting the flow on the consent preview page. Empty if the flow
+// has no failure URL.
+func abortUrl(state *exchangeState) string {
+	if state.FailureUrl == "" {
+		return ""
+	}
+	return failureRedirect(&exchangeResult{exchangeState: *state}, "access_denied", "The authorization was aborted", "")
+}
+
+// callbackFailed logs the error and redirects the user to the failure URL of the flow if there is one. Otherwise,
+// the error page is shown.
+func (c commonController) callbackFailed(w http.ResponseWriter, r *http.Request, exchange *exchangeResult, status int, errorCode string, msg string, err error) {
+	if exchange.FailureUrl == "" {
+		c.ErrorPages.Error(w, r, status, msg, err)
+		return
+	}
+
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Error(msg, zap.Error(err), zap.String("errorCode", errorCode), zap.String("correlationId", correlationId))
+
+	w.Header().Set(correlationIdHeader, correlationId)
+	http.Redirect(w, r, failureRedirect(exchange, errorCode, "", correlationId), http.StatusFound)
+}
+
+// serviceProviderError handles the callback with the error reported by the service provider, e.g. when the user
+// denied the authorization. If the state can be verified, the user is redirected to the failure URL of the flow or
+// the JSON result is returned when requested.
+func (c commonController) serviceProviderError(w http.ResponseWriter, r *http.Request, spError string, description string) {
+	r = c.withRequestLogger(r)
+	LoggerFromContext(r.Context()).Debug("the service provider reported an error in the OAuth flow", zap.String("error", spError), zap.String("error_description", description))
+
+	exchange := exchangeResult{}
+	if codec, err := c.stateCodec(); err == nil {
+		if err = codec.ParseInto(requestParam(r, "state"), &exchange.exchangeState); err != nil || c.stateValidation.validate(exchange.stateClaims) != nil {
+			// the unverified state must not be used for anything
+			exchange = exchangeResult{}
+		}
+	}
+
+	if exchange.TokenName != "" {
+		c.publishFlowEvent(ExchangeFailedEvent, exchange.AnonymousOAuthState, exchange.Workspace, c.flowUserIdentity(r, exchange.Key), fmt.Errorf("the service provider reported an error: %s", spError))
+	}
+
+	switch {
+	case exchange.ResponseMode == responseModeJson:
+		c.writeCallbackResult(w, r, http.StatusBadRequest, &callbackResult{
+			Result:    "error",
+			Token:     &tokenReference{Name: exchange.TokenName, Namespace: exchange.TokenNamespace},
+			ErrorCode: spError,
+		})
+	case exchange.FailureUrl != "":
+		http.Redirect(w, r, failureRedirect(&exchange, spError, description, ""), http.StatusFound)
+	case c.Templates == nil:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("Error response returned to OAuth callback: %s. Message: %s ", spError, description)))
+	default:
+		if err := c.Templates.Execute(w, CallbackErrorTemplate, ErrorPageData{Title: spError, Message: description}); err != nil {
+			LoggerFromContext(r.Context()).Error("failed to process template", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("Error response returned to OAuth callback: %s. Message: %s ", spError, description)))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRedirectTarget(t *testing.T) {
+	c := commonController{AllowedOrigins: []string{"https://console.example.com/", "http://localhost:3000"}}
+
+	assert.NoError(t, c.validateRedirectTarget(""))
+	assert.NoError(t, c.validateRedirectTarget("https://console.example.com/oauth/done?x=1"))
+	assert.NoError(t, c.validateRedirectTarget("http://localhost:3000/done"))
+	assert.Error(t, c.validateRedirectTarget("https://evil.example.com/done"))
+	assert.Error(t, c.validateRedirectTarget("https://console.example.com.evil.example.com/done"))
+	assert.Error(t, c.validateRedirectTarget("https://user@console.example.com/done"))
+	assert.Error(t, c.validateRedirectTarget("/relative/path"))
+	assert.Error(t, c.validateRedirectTarget("//console.example.com/done"))
+	assert.Error(t, c.validateRedirectTarget("javascript:alert(1)"))
+}
+
+func TestFailureRedirect(t *testing.T) {
+	exchange := &exchangeResult{}
+	exchange.FailureUrl = "https://console.example.com/failed?tab=tokens"
+	exchange.TokenName = "mytoken"
+	exchange.TokenNamespace = "default"
+
+	u, err := url.Parse(failureRedirect(exchange, callbackErrorStorageFailed, "", "abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "console.example.com", u.Host)
+	assert.Equal(t, url.Values{
+		"tab":            {"tokens"},
+		"error":          {callbackErrorStorageFailed},
+		"correlation_id": {"abc"},
+		"token":          {"mytoken"},
+		"namespace":      {"default"},
+	}, u.Query())
+}
+
+func TestCallbackFailed(t *testing.T) {
+	c := commonController{}
+
+	t.Run("error page", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		c.callbackFailed(res, httptest.NewRequest("GET", "/github/callback", nil), &exchangeResult{}, http.StatusInternalServerError, callbackErrorStorageFailed, "failed", errors.New("boom"))
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+	})
+
+	t.Run("failure URL", func(t *testing.T) {
+		exchange := &exchangeResult{}
+		exchange.FailureUrl = "https://console.example.com/failed"
+
+		res := httptest.NewRecorder()
+		c.callbackFailed(res, httptest.NewRequest("GET", "/github/callback", nil), exchange, http.StatusInternalServerError, callbackErrorStorageFailed, "failed", errors.New("boom"))
+		assert.Equal(t, http.StatusFound, res.Code)
+
+		u, err := url.Parse(res.Header().Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, callbackErrorStorageFailed, u.Query().Get("error"))
+		assert.Equal(t, res.Header().Get(correlationIdHeader), u.Query().Get("correlation_id"))
+		assert.NotContains(t, u.RawQuery, "boom")
+	})
+}
+
+func TestServiceProviderError(t *testing.T) {
+	secret := []byte("secret")
+	codec, err := oauthstate.NewCodec(secret)
+	assert.NoError(t, err)
+	publisher := &recordingPublisher{}
+	c := commonController{
+		Config:           config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		JwtSigningSecret: secret,
+		Events:           publisher,
+	}
+
+	callback := func(state string) *httptest.ResponseRecorder {
+		query := url.Values{"error": {"access_denied"}, "error_description": {"denied by the user"}, "state": {state}}
+		req := httptest.NewRequest("GET", "/github/callback?"+query.Encode(), nil)
+		res := httptest.NewRecorder()
+		c.Callback(req.Context(), res, req)
+		return res
+	}
+
+	state := exchangeState{AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "mytoken", TokenNamespace: "default"}}
+	state.FailureUrl = "https://console.example.com/failed"
+	encoded, err := codec.Encode(&state)
+	assert.NoError(t, err)
+
+	t.Run("failure URL", func(t *testing.T) {
+		res := callback(encoded)
+		assert.Equal(t, http.StatusFound, res.Code)
+
+		u, err := url.Parse(res.Header().Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, "console.example.com", u.Host)
+		assert.Equal(t, "access_denied", u.Query().Get("error"))
+		assert.Equal(t, "denied by the user", u.Query().Get("error_description"))
+		assert.Equal(t, "mytoken", u.Query().Get("token"))
+
+		assert.Len(t, publisher.events, 1)
+		assert.Equal(t, ExchangeFailedEvent, publisher.events[0].Type)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		state := state
+		state.ResponseMode = responseModeJson
+		encoded, err := codec.Encode(&state)
+		assert.NoError(t, err)
+
+		res := callback(encoded)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Contains(t, res.Body.String(), `"errorCode":"access_denied"`)
+	})
+
+	t.Run("forged state", func(t *testing.T) {
+		forged, err := oauthstate.NewCodec([]byte("other"))
+		assert.NoError(t, err)
+		encoded, err := forged.Encode(&state)
+		assert.NoError(t, err)
+
+		res := callback(encoded)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Empty(t, res.Header().Get("Location"))
+	})
+}
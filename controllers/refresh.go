@@ -0,0 +1,302 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	refreshErrorInvalidRequest          = "invalid_request"
+	refreshErrorTokenNotFound           = "token_not_found"
+	refreshErrorNoRefreshToken          = "no_refresh_token"
+	refreshErrorReauthorizationRequired = "reauthorization_required"
+	refreshErrorRefreshFailed           = "token_refresh_failed"
+	refreshErrorDisabled                = "token_refresh_disabled"
+
+	// maxTokenResponseSize limits the size of the response read from the token endpoint.
+	maxTokenResponseSize = 1 << 20
+)
+
+// errRefreshTokenInvalidated is returned when the service provider rejects the refresh token as invalid. With
+// the rotating refresh tokens, this also happens when a refresh token is reused, in which case the service provider
+// revokes the whole family of the tokens issued from the original authorization.
+var errRefreshTokenInvalidated = errors.New("the refresh token has been invalidated by the service provider")
+
+// refreshLocks serialize the refreshes of the same token. With the rotating refresh tokens, two concurrent refreshes
+// would use the same refresh token twice, which the service providers treat as a reuse. The locks survive
+// the configuration reloads.
+var refreshLocks = &keyedLocks{locks: map[string]*keyedLock{}}
+
+// Refresh obtains a new access token using the stored refresh token of the SPIAccessToken and stores it. The request
+// needs to be authenticated in Kubernetes with a token that has access to the SPIAccessToken. If the service provider
+// rejects the refresh token, the stored token data are deleted so that the SPIAccessToken is marked as needing
+// a new authorization by the operator.
+func (c commonController) Refresh(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenRef := &tokenReference{Name: vars["name"], Namespace: vars["namespace"]}
+	r = c.withRequestLogger(r)
+	r = r.WithContext(withLoggerFields(r.Context(), zap.String("token", tokenRef.Name), zap.String("namespace", tokenRef.Namespace)))
+
+	ctx, err := WithAuthFromRequestIntoContext(r, r.Context())
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusUnauthorized, callbackErrorK8sAuthRequired, "the refresh request is not authenticated", err)
+		return
+	}
+
+	if workspace := requestParam(r, "workspace"); workspace != "" {
+		if err = acceptWorkspace(workspace); err != nil {
+			c.writeRefreshError(w, r, tokenRef, http.StatusBadRequest, refreshErrorInvalidRequest, "unsupported workspace", err)
+			return
+		}
+		ctx = WithWorkspaceIntoContext(workspace, ctx)
+	}
+
+	accessToken := &v1beta1.SPIAccessToken{}
+	if err = c.K8sClient.Get(ctx, client.ObjectKey{Name: tokenRef.Name, Namespace: tokenRef.Namespace}, accessToken); err != nil {
+		status, errorCode := accessTokenGetError(err, refreshErrorRefreshFailed)
+		c.writeRefreshError(w, r, tokenRef, status, errorCode, "failed to get the SPIAccessToken", err)
+		return
+	}
+
+	if !c.features.enabled(c.Config.ServiceProviderType, FeatureRefresh, tokenRef.Namespace, tokenRef.Name) {
+		c.writeRefreshError(w, r, tokenRef, http.StatusServiceUnavailable, refreshErrorDisabled, "the token refresh is disabled for the SPIAccessToken", nil)
+		return
+	}
+
+	unlock := refreshLocks.lock(string(c.Config.ServiceProviderType) + "/" + tokenRef.Namespace + "/" + tokenRef.Name)
+	defer unlock()
+
+	// read the stored token only after acquiring the lock so that the refresh token rotated by a concurrent refresh is
+	// used
+	stored, err := c.TokenStorage.Get(ctx, accessToken)
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to read the stored token", err)
+		return
+	}
+	if stored == nil || stored.RefreshToken == "" {
+		c.writeRefreshError(w, r, tokenRef, http.StatusConflict, refreshErrorNoRefreshToken, "no refresh token stored for the SPIAccessToken", nil)
+		return
+	}
+
+	oauthCfg, err := c.newOAuth2Config(r, c.organizationOf(requestParam(r, "repository_url")))
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, refreshErrorRefreshFailed, "failed to configure the token refresh", err)
+		return
+	}
+	oauthCfg.Endpoint, err = c.providerEndpoint(ctx)
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusBadGateway, refreshErrorRefreshFailed, "failed to obtain the metadata of the service provider", err)
+		return
+	}
+
+	token, err := c.refreshToken(ctx, &oauthCfg, stored.RefreshToken)
+	if errors.Is(err, errRefreshTokenInvalidated) {
+		LoggerFromContext(ctx).Warn("the refresh token has been rejected, deleting the token data so that the SPIAccessToken needs a new authorization", zap.Error(err))
+		if err := c.deleteTokenData(ctx, accessToken); err != nil {
+			c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to delete the invalidated token data", err)
+			return
+		}
+		c.writeRefreshError(w, r, tokenRef, http.StatusConflict, refreshErrorReauthorizationRequired, "the refresh token has been invalidated", err)
+		return
+	} else if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusBadGateway, refreshErrorRefreshFailed, "failed to refresh the token", err)
+		return
+	}
+
+	// the refreshed token has the same scopes as the original one unless the service provider reports otherwise
+	scopes, err := c.storedScopes(ctx, accessToken)
+	if err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to read the scopes of the stored token", err)
+		return
+	}
+
+	if err = c.storeToken(ctx, accessToken, token, scopes, nil); err != nil {
+		c.writeRefreshError(w, r, tokenRef, http.StatusInternalServerError, callbackErrorStorageFailed, "failed to store the refreshed token", err)
+		return
+	}
+
+	c.writeCallbackResult(w, r, http.StatusOK, &callbackResult{Result: "success", Token: tokenRef})
+}
+
+// writeRefreshError logs the error and writes the JSON result describing it.
+func (c commonController) writeRefreshError(w http.ResponseWriter, r *http.Request, token *tokenReference, status int, errorCode string, msg string, err error) {
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Error(msg, zap.Error(err), zap.String("errorCode", errorCode), zap.String("correlationId", correlationId))
+
+	w.Header().Set(correlationIdHeader, correlationId)
+	c.writeCallbackResult(w, r, status, &callbackResult{
+		Result:        "error",
+		Token:         token,
+		ErrorCode:     errorCode,
+		CorrelationId: correlationId,
+	})
+}
+
+// accessTokenGetError returns the status and the error code of the response reporting the failure to get
+// the SPIAccessToken on behalf of the user. The Kubernetes API errors keep their status, the rest are reported using
+// the provided error code.
+func accessTokenGetError(err error, defaultErrorCode string) (int, string) {
+	status, errorCode := http.StatusInternalServerError, defaultErrorCode
+	if apiStatus := kerrors.APIStatus(nil); errors.As(err, &apiStatus) {
+		status = int(apiStatus.Status().Code)
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		errorCode = callbackErrorK8sAuthRequired
+	case http.StatusNotFound:
+		errorCode = refreshErrorTokenNotFound
+	}
+	return status, errorCode
+}
+
+// deleteTokenData deletes the stored token including its artifacts and the fingerprint of the token.
+func (c commonController) deleteTokenData(ctx context.Context, accessToken *v1beta1.SPIAccessToken) error {
+	if c.ArtifactStorage != nil {
+		for _, kind := range tokenstorage.AllArtifactKinds {
+			if err := c.ArtifactStorage.DeleteArtifact(ctx, accessToken, kind); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.TokenStorage.Delete(ctx, accessToken); err != nil {
+		return err
+	}
+
+	if err := c.clearTokenFingerprint(ctx, accessToken); err != nil {
+		LoggerFromContext(ctx).Warn("failed to clear the fingerprint of the deleted token", zap.Error(err))
+	}
+	return nil
+}
+
+// tokenErrorResponse is the error response of the token endpoint (RFC 6749, section 5.2).
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// refreshToken exchanges the refresh token for a new token at the token endpoint of the service provider
+// (RFC 6749, section 6).
+func (c commonController) refreshToken(ctx context.Context, oauthCfg *oauth2.Config, refreshToken string) (*oauth2.Token, error) {
+	params := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+	if oauthCfg.Endpoint.AuthStyle == oauth2.AuthStyleInParams || !usesClientSecret(c.clientAuthMethod) {
+		params.Set("client_id", oauthCfg.ClientID)
+	}
+
+	req, err := c.newClientAuthenticatedRequest(ctx, oauthCfg, oauthCfg.Endpoint.TokenURL, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = injectExchangeDelay(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := c.providerHttpClient(ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh the token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response of the token refresh: %w", err)
+	}
+
+	// some service providers (e.g. GitHub) report the errors with the 200 status
+	errorResponse := tokenErrorResponse{}
+	_ = json.Unmarshal(body, &errorResponse)
+	if errorResponse.Error == "invalid_grant" {
+		return nil, fmt.Errorf("%w: %s", errRefreshTokenInvalidated, errorResponse.ErrorDescription)
+	}
+	if errorResponse.Error != "" || resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the token refresh failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	raw := map[string]interface{}{}
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse the response of the token refresh: %w", err)
+	}
+
+	token := &oauth2.Token{}
+	token.AccessToken, _ = raw["access_token"].(string)
+	token.TokenType, _ = raw["token_type"].(string)
+	token.RefreshToken, _ = raw["refresh_token"].(string)
+	if expiresIn := extraSeconds(raw["expires_in"]); expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	token = token.WithExtra(raw)
+
+	// the scopes of a refreshed token cannot be broader than the original ones, so only the token itself is checked
+	if err = c.tokenValidation.validateToken(ctx, token, nil); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// keyedLocks is a set of mutexes identified by a key. The mutexes are only kept while in use.
+type keyedLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the mutex of the provided key and returns the function unlocking it.
+func (l *keyedLocks) lock(key string) func() {
+	l.mutex.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		l.locks[key] = lock
+	}
+	lock.users++
+	l.mutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
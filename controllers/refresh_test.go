@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func serveRefresh(c *commonController, authorization string) (*httptest.ResponseRecorder, callbackResult) {
+	router := mux.NewRouter()
+	router.HandleFunc("/github/refresh/{namespace}/{name}", c.Refresh).Methods("POST")
+
+	req := httptest.NewRequest("POST", "/github/refresh/default/token", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	result := callbackResult{}
+	_ = json.Unmarshal(res.Body.Bytes(), &result)
+	return res, result
+}
+
+func tokenEndpoint(t *testing.T, status int, response string, form *url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		if form != nil {
+			*form = r.PostForm
+		}
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "client-id", user)
+		assert.Equal(t, "client-secret", password)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+}
+
+func TestRefresh(t *testing.T) {
+	t.Run("rotated refresh token", func(t *testing.T) {
+		form := url.Values{}
+		srv := tokenEndpoint(t, http.StatusOK, `{"access_token": "new-access", "token_type": "bearer", "refresh_token": "new-refresh", "expires_in": 3600}`, &form)
+		defer srv.Close()
+
+		data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+		c := testController(srv.URL, data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, result := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "success", result.Result)
+		assert.Equal(t, "refresh_token", form.Get("grant_type"))
+		assert.Equal(t, "old-refresh", form.Get("refresh_token"))
+
+		assert.Equal(t, "new-access", data["default/token"].AccessToken)
+		assert.Equal(t, "new-refresh", data["default/token"].RefreshToken)
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), int64(data["default/token"].Expiry), 10)
+	})
+
+	t.Run("refresh token not rotated", func(t *testing.T) {
+		srv := tokenEndpoint(t, http.StatusOK, `{"access_token": "new-access", "token_type": "bearer"}`, nil)
+		defer srv.Close()
+
+		data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+		c := testController(srv.URL, data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, _ := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "new-access", data["default/token"].AccessToken)
+		assert.Equal(t, "old-refresh", data["default/token"].RefreshToken)
+	})
+
+	t.Run("invalidated refresh token", func(t *testing.T) {
+		srv := tokenEndpoint(t, http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "refresh token reused"}`, nil)
+		defer srv.Close()
+
+		data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+		c := testController(srv.URL, data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, result := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusConflict, res.Code)
+		assert.Equal(t, refreshErrorReauthorizationRequired, result.ErrorCode)
+		assert.NotContains(t, data, "default/token")
+	})
+
+	t.Run("error with success status", func(t *testing.T) {
+		srv := tokenEndpoint(t, http.StatusOK, `{"error": "bad_refresh_token", "error_description": "the refresh token is bad"}`, nil)
+		defer srv.Close()
+
+		data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+		c := testController(srv.URL, data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, result := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusBadGateway, res.Code)
+		assert.Equal(t, refreshErrorRefreshFailed, result.ErrorCode)
+		assert.Equal(t, "old-access", data["default/token"].AccessToken)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		srv := tokenEndpoint(t, http.StatusOK, `{"access_token": "", "token_type": "bearer"}`, nil)
+		defer srv.Close()
+
+		data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+		c := testController(srv.URL, data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, _ := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusBadGateway, res.Code)
+		assert.Equal(t, "old-access", data["default/token"].AccessToken)
+	})
+
+	t.Run("no refresh token", func(t *testing.T) {
+		c := testController("https://sp.com/token", map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access"}}, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, result := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusConflict, res.Code)
+		assert.Equal(t, refreshErrorNoRefreshToken, result.ErrorCode)
+	})
+
+	t.Run("refresh not rolled out", func(t *testing.T) {
+		data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+		c := testController("https://sp.com/token", data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		c.features = FeatureFlags{Rollout: map[string]int{FeatureRefresh: 0}}
+		res, result := serveRefresh(c, "Bearer kachny")
+
+		assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+		assert.Equal(t, refreshErrorDisabled, result.ErrorCode)
+		assert.Equal(t, "old-access", data["default/token"].AccessToken)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		c := testController("https://sp.com/token", map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+		res, result := serveRefresh(c, "")
+
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		assert.Equal(t, callbackErrorK8sAuthRequired, result.ErrorCode)
+	})
+}
+
+func TestStoreToken(t *testing.T) {
+	data := map[string]*v1beta1.Token{"default/token": {AccessToken: "old-access", RefreshToken: "old-refresh"}}
+	c := testController("", data, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	owner := &v1beta1.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"}}
+
+	assert.NoError(t, c.storeToken(context.TODO(), owner, &oauth2.Token{AccessToken: "a1"}, nil, nil))
+	assert.Equal(t, "a1", data["default/token"].AccessToken)
+	assert.Equal(t, "old-refresh", data["default/token"].RefreshToken)
+
+	assert.NoError(t, c.storeToken(context.TODO(), owner, &oauth2.Token{AccessToken: "a2", RefreshToken: "r2"}, nil, nil))
+	assert.Equal(t, "a2", data["default/token"].AccessToken)
+	assert.Equal(t, "r2", data["default/token"].RefreshToken)
+}
+
+func TestKeyedLocks(t *testing.T) {
+	locks := &keyedLocks{locks: map[string]*keyedLock{}}
+
+	unlock := locks.lock("a")
+	// a different key is not blocked
+	locks.lock("b")()
+
+	acquired := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer locks.lock("a")()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		assert.Fail(t, "the lock has been acquired twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	wg.Wait()
+	assert.Empty(t, locks.locks)
+}
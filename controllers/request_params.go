@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"mime"
+	"net/http"
+)
+
+// MaxFormSize limits the size of the URL-encoded form in the body of a request. The forms only carry the OAuth states
+// and the Kubernetes tokens, so they are never large.
+const MaxFormSize = 1 << 20
+
+// FormParsingMiddleware parses the URL-encoded forms in the bodies of the requests up front, limiting their size, and
+// rejects the requests with a malformed form. The multipart forms are never parsed, no endpoint accepts them. The other
+// bodies, e.g. the uploaded tokens in JSON, are left for the handlers to read.
+func FormParsingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && isFormContentType(r.Header.Get("Content-Type")) {
+			r.Body = http.MaxBytesReader(w, r.Body, MaxFormSize)
+		}
+		// this also leaves the PostForm empty for the multipart forms, so that they are not parsed later
+		if err := r.ParseForm(); err != nil {
+			LoggerFromContext(r.Context()).Debug("rejecting the request with a malformed form")
+			http.Error(w, "malformed request parameters", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isFormContentType checks whether the content type is the URL-encoded form.
+func isFormContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// requestParam returns the value of the parameter of the request from the only place it is accepted from depending on
+// the method: the query of the GET and HEAD requests and the URL-encoded form in the body of the other requests. Unlike
+// FormValue, the query of a POST request is never used, so that the parameters cannot be injected into a form
+// submitted by the browser through the query string of the URL it is submitted to.
+func requestParam(r *http.Request, name string) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r.URL.Query().Get(name)
+	}
+	if r.PostForm == nil {
+		// not parsed by the FormParsingMiddleware
+		_ = r.ParseForm()
+	}
+	return r.PostForm.Get(name)
+}
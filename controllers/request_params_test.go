@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func formRequest(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestRequestParam(t *testing.T) {
+	assert.Equal(t, "query", requestParam(httptest.NewRequest("GET", "/?state=query", nil), "state"))
+	assert.Equal(t, "query", requestParam(formRequest("GET", "/?state=query", "state=body"), "state"))
+	assert.Equal(t, "", requestParam(formRequest("GET", "/", "state=body"), "state"))
+
+	assert.Equal(t, "body", requestParam(formRequest("POST", "/?state=query", "state=body"), "state"))
+	assert.Equal(t, "", requestParam(formRequest("POST", "/?state=query", ""), "state"))
+	assert.Equal(t, "", requestParam(httptest.NewRequest("POST", "/?state=query", nil), "state"))
+}
+
+func TestFormParsingMiddleware(t *testing.T) {
+	var body string
+	var state string
+	handler := FormParsingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		state = requestParam(r, "state")
+	}))
+
+	serve := func(req *http.Request) int {
+		body, state = "", ""
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	t.Run("form", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(formRequest("POST", "/?state=query", "state=body")))
+		assert.Equal(t, "body", state)
+	})
+
+	t.Run("json body is left alone", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/?state=query", strings.NewReader(`{"access_token":"42"}`))
+		req.Header.Set("Content-Type", "application/json")
+		assert.Equal(t, http.StatusOK, serve(req))
+		assert.Equal(t, `{"access_token":"42"}`, body)
+		assert.Empty(t, state)
+	})
+
+	t.Run("multipart form is not parsed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("--b\r\nContent-Disposition: form-data; name=\"state\"\r\n\r\nbody\r\n--b--\r\n"))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+		assert.Equal(t, http.StatusOK, serve(req))
+		assert.Empty(t, state)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(formRequest("POST", "/", "state=%zz")))
+		assert.Equal(t, http.StatusBadRequest, serve(httptest.NewRequest("GET", "/?state=%zz", nil)))
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(formRequest("POST", "/", "state="+strings.Repeat("a", MaxFormSize))))
+	})
+}
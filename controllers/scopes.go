@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// ScopeDescription is a scope requested from the service provider with its plain-language explanation shown on
+// the consent preview page.
+type ScopeDescription struct {
+	Name        string
+	Description string
+}
+
+// ConsentPreviewData is the data of the consent preview page.
+type ConsentPreviewData struct {
+	// Url is the URL of the service provider to continue the OAuth flow.
+	Url string
+	// ServiceProvider is the type of the service provider.
+	ServiceProvider config.ServiceProviderType
+	// Token identifies the SPIAccessToken the flow obtains the token for.
+	Token tokenReference
+	// Scopes are the requested scopes.
+	Scopes []ScopeDescription
+	// AbortUrl is the URL the user is sent to when aborting the flow. Empty if the flow has no failure URL.
+	AbortUrl string
+}
+
+// githubScopeDescriptions are the explanations of the GitHub OAuth scopes.
+var githubScopeDescriptions = map[string]string{
+	"repo":                  "full access to public and private repositories, including code, commit statuses, invitations, collaborators and settings",
+	"repo:status":           "read and write access to commit statuses in public and private repositories",
+	"repo_deployment":       "access to deployment statuses of public and private repositories",
+	"public_repo":           "read and write access to code, commit statuses, collaborators and settings of public repositories",
+	"repo:invite":           "accept and decline invitations to collaborate on repositories",
+	"security_events":       "read and write access to security events in code scanning",
+	"admin:repo_hook":       "full control of the webhooks of repositories",
+	"write:repo_hook":       "read and write access to the webhooks of repositories",
+	"read:repo_hook":        "read access to the webhooks of repositories",
+	"admin:org":             "full control of organizations, their teams, projects and memberships",
+	"write:org":             "read and write access to organization membership, projects and teams",
+	"read:org":              "read access to organization membership, projects and teams",
+	"admin:public_key":      "full control of the public SSH keys of the user",
+	"write:public_key":      "create, list and view the public SSH keys of the user",
+	"read:public_key":       "list and view the public SSH keys of the user",
+	"admin:org_hook":        "full control of the webhooks of organizations",
+	"gist":                  "write access to gists",
+	"notifications":         "read access to notifications and the ability to mark them as read",
+	"user":                  "read and write access to the profile of the user",
+	"read:user":             "read access to the profile of the user",
+	"user:email":            "read access to the email addresses of the user",
+	"user:follow":           "follow and unfollow other users",
+	"delete_repo":           "delete repositories",
+	"write:packages":        "upload and publish packages to the GitHub package registry",
+	"read:packages":         "download and install packages from the GitHub package registry",
+	"delete:packages":       "delete packages from the GitHub package registry",
+	"admin:gpg_key":         "full control of the GPG keys of the user",
+	"write:gpg_key":         "create, list and view the GPG keys of the user",
+	"read:gpg_key":          "list and view the GPG keys of the user",
+	"workflow":              "update GitHub Actions workflow files",
+	"write:discussion":      "read and write access to team discussions",
+	"read:discussion":       "read access to team discussions",
+	"admin:enterprise":      "full control of enterprises",
+	"codespace":             "create and manage codespaces",
+	"project":               "read and write access to projects",
+	"read:project":          "read access to projects",
+	"admin:ssh_signing_key": "full control of the SSH signing keys of the user",
+}
+
+// quayScopeDescriptions are the explanations of the Quay OAuth scopes.
+var quayScopeDescriptions = map[string]string{
+	"repo:read":   "view and pull all the repositories visible to the user",
+	"repo:write":  "view, push and pull all the repositories the user can write to",
+	"repo:admin":  "full administrative access to all the repositories the user administers",
+	"repo:create": "create repositories in the namespaces the user is allowed to create repositories in",
+	"user:read":   "read the user information, e.g. the username and the email address",
+	"user:admin":  "administer the user information, including the robot accounts",
+	"org:admin":   "administer organizations, including their robot accounts, teams and members",
+}
+
+// defaultScopeDescriptions returns the built-in explanations of the scopes of the service provider.
+func defaultScopeDescriptions(spType config.ServiceProviderType) map[string]string {
+	switch spType {
+	case config.ServiceProviderTypeGitHub:
+		return githubScopeDescriptions
+	case config.ServiceProviderTypeQuay:
+		return quayScopeDescriptions
+	default:
+		return nil
+	}
+}
+
+// describeScopes returns the explanations of the provided scopes. The configured descriptions take precedence over
+// the built-in ones. The unknown scopes have an empty description.
+func describeScopes(scopes []string, defaults map[string]string, configured map[string]string) []ScopeDescription {
+	ret := make([]ScopeDescription, 0, len(scopes))
+	for _, scope := range scopes {
+		description, ok := configured[scope]
+		if !ok {
+			description = defaults[scope]
+		}
+		ret = append(ret, ScopeDescription{Name: scope, Description: description})
+	}
+	return ret
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeScopes(t *testing.T) {
+	descriptions := describeScopes([]string{"repo", "read:org", "custom"}, githubScopeDescriptions, map[string]string{
+		"read:org": "see your organizations",
+	})
+
+	assert.Equal(t, []ScopeDescription{
+		{Name: "repo", Description: githubScopeDescriptions["repo"]},
+		{Name: "read:org", Description: "see your organizations"},
+		{Name: "custom", Description: ""},
+	}, descriptions)
+
+	assert.Empty(t, describeScopes(nil, nil, nil))
+	assert.NotEmpty(t, defaultScopeDescriptions(config.ServiceProviderTypeQuay)["repo:read"])
+}
+
+func TestConsentPreviewTemplate(t *testing.T) {
+	tmpl, err := LoadTemplates("../static", "/prefix", ConsentPreviewTemplate)
+	assert.NoError(t, err)
+
+	res := httptest.NewRecorder()
+	assert.NoError(t, tmpl.Execute(res, ConsentPreviewTemplate, ConsentPreviewData{
+		Url:             "https://github.com/login/oauth/authorize?client_id=id&state=s",
+		ServiceProvider: config.ServiceProviderTypeGitHub,
+		Token:           tokenReference{Name: "mytoken", Namespace: "default"},
+		Scopes:          describeScopes([]string{"repo", "custom"}, githubScopeDescriptions, nil),
+	}))
+
+	body := res.Body.String()
+	assert.Contains(t, body, "Authorize the access to GitHub")
+	assert.Contains(t, body, "default/mytoken")
+	assert.Contains(t, body, "<code>repo</code>")
+	assert.Contains(t, body, "full access to public and private repositories")
+	assert.Contains(t, body, "No description available")
+	assert.Contains(t, body, `href="https://github.com/login/oauth/authorize?client_id=id&amp;state=s"`)
+	assert.Contains(t, body, `href="/prefix/callback_error?error=access_denied`)
+	assert.NotContains(t, body, "http-equiv = \"refresh\"")
+
+	res = httptest.NewRecorder()
+	assert.NoError(t, tmpl.Execute(res, ConsentPreviewTemplate, ConsentPreviewData{
+		Url:      "https://github.com/login/oauth/authorize?client_id=id&state=s",
+		AbortUrl: "https://console.example.com/failed?error=access_denied",
+	}))
+	assert.Contains(t, res.Body.String(), `href="https://console.example.com/failed?error=access_denied"`)
+}
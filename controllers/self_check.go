@@ -0,0 +1,294 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	authz "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// selfCheckTimeout limits the duration of the whole self-check.
+	selfCheckTimeout = 30 * time.Second
+
+	// selfCheckProbeCode is the made-up authorization code exchanged to find out whether the service provider accepts
+	// the client credentials. No service provider issues such a code.
+	selfCheckProbeCode = "spi-oauth-self-check"
+)
+
+// SelfCheckStatus is the result of a single check of the self-check.
+type SelfCheckStatus string
+
+const (
+	SelfCheckPassed  SelfCheckStatus = "passed"
+	SelfCheckFailed  SelfCheckStatus = "failed"
+	SelfCheckSkipped SelfCheckStatus = "skipped"
+)
+
+const (
+	selfCheckCallbackUrl        = "callback-url"
+	selfCheckClientCredentials  = "client-credentials"
+	selfCheckController         = "controller"
+	selfCheckTokenStoragePolicy = "token-storage"
+)
+
+// rejectedClientErrors are the error codes of the token endpoints meaning that the client credentials are not
+// accepted. GitHub uses its own code instead of the one of RFC 6749.
+var rejectedClientErrors = map[string]bool{
+	"invalid_client":               true,
+	"unauthorized_client":          true,
+	"incorrect_client_credentials": true,
+}
+
+// SelfCheckResult is the result of a single check of the live configuration.
+type SelfCheckResult struct {
+	Check string `json:"check"`
+	// ServiceProvider is the type of the checked service provider. Empty for the checks not related to a service
+	// provider.
+	ServiceProvider string `json:"serviceProvider,omitempty"`
+	// Organization is the organization whose OAuth application was checked. Empty for the default application.
+	Organization string          `json:"organization,omitempty"`
+	Status       SelfCheckStatus `json:"status"`
+	Message      string          `json:"message,omitempty"`
+}
+
+// SelfCheckReport is the structured result of the self-check.
+type SelfCheckReport struct {
+	Healthy   bool              `json:"healthy"`
+	CheckedAt time.Time         `json:"checkedAt"`
+	Checks    []SelfCheckResult `json:"checks"`
+}
+
+// SelfChecker re-validates the live configuration against the environment, e.g. after the service has been migrated
+// to another cluster. It checks that the callback URLs of the service providers resolve, that the service providers
+// accept the client credentials and that the token storage is permitted to do what it needs. The self-check can only
+// be requested by the users allowed to list the SPIAccessTokens in all the namespaces.
+type SelfChecker struct {
+	K8sClient        AuthenticatingClient
+	Storage          tokenstorage.TokenStorage
+	ServiceProviders *ServiceProviders
+}
+
+// Check authorizes the request and runs all the checks. The returned error is a Kubernetes API status error if
+// the request is not authorized.
+func (s *SelfChecker) Check(r *http.Request) (*SelfCheckReport, error) {
+	ctx, err := WithAuthFromRequestIntoContext(r, r.Context())
+	if err != nil {
+		return nil, k8serrors.NewUnauthorized(err.Error())
+	}
+
+	review := authz.SelfSubjectAccessReview{
+		Spec: authz.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authz.ResourceAttributes{
+				Verb:     "list",
+				Group:    v1beta1.GroupVersion.Group,
+				Version:  v1beta1.GroupVersion.Version,
+				Resource: "spiaccesstokens",
+			},
+		},
+	}
+	if err := s.K8sClient.Create(ctx, &review); err != nil {
+		return nil, err
+	}
+	if !review.Status.Allowed {
+		return nil, k8serrors.NewForbidden(schema.GroupResource{Group: v1beta1.GroupVersion.Group, Resource: "spiaccesstokens"}, "", errors.New("the self-check requires listing the SPIAccessTokens in all the namespaces"))
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), selfCheckTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	report := &SelfCheckReport{Healthy: true, CheckedAt: time.Now().UTC()}
+	report.Checks = append(report.Checks, s.checkStorage(ctx))
+	for _, sp := range s.ServiceProviders.Providers {
+		report.Checks = append(report.Checks, checkServiceProvider(sp, r)...)
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == SelfCheckFailed {
+			report.Healthy = false
+			LoggerFromContext(ctx).Warn("self-check failed", zap.String("check", check.Check), zap.String("serviceProvider", check.ServiceProvider), zap.String("organization", check.Organization), zap.String("message", check.Message))
+		}
+	}
+	return report, nil
+}
+
+// checkStorage checks the permissions of the token storage if it is able to do so.
+func (s *SelfChecker) checkStorage(ctx context.Context) SelfCheckResult {
+	result := SelfCheckResult{Check: selfCheckTokenStoragePolicy}
+
+	checking, ok := s.Storage.(oauthstorage.SelfCheckingStorage)
+	if !ok {
+		return selfCheckSkipped(result, oauthstorage.ErrSelfCheckNotSupported.Error())
+	}
+	err := checking.SelfCheck(ctx)
+	if errors.Is(err, oauthstorage.ErrSelfCheckNotSupported) {
+		return selfCheckSkipped(result, err.Error())
+	}
+	return selfCheckOutcome(result, err)
+}
+
+// checkServiceProvider runs the checks of the controller of the service provider. The controllers failing to initialize
+// are reported as failed.
+func checkServiceProvider(sp *ServiceProvider, r *http.Request) []SelfCheckResult {
+	controller, err := sp.Controller()
+	if err != nil {
+		return []SelfCheckResult{selfCheckOutcome(SelfCheckResult{Check: selfCheckController, ServiceProvider: string(sp.Config.ServiceProviderType)}, err)}
+	}
+	return controller.SelfCheck(r)
+}
+
+func (c commonController) SelfCheck(r *http.Request) []SelfCheckResult {
+	spType := string(c.Config.ServiceProviderType)
+	results := []SelfCheckResult{c.checkCallbackUrl(r)}
+
+	for _, organization := range c.applicationOrganizations() {
+		result := SelfCheckResult{Check: selfCheckClientCredentials, ServiceProvider: spType, Organization: organization}
+		results = append(results, c.checkClientCredentials(r, result))
+	}
+	return results
+}
+
+// applicationOrganizations returns the organizations of all the OAuth applications of the service provider, starting
+// with the empty organization of the default application followed by the organization applications in the sorted
+// order.
+func (c commonController) applicationOrganizations() []string {
+	organizations := make([]string, 0, len(c.OrganizationApps))
+	for organization := range c.OrganizationApps {
+		organizations = append(organizations, organization)
+	}
+	sort.Strings(organizations)
+	return append([]string{""}, organizations...)
+}
+
+// checkCallbackUrl checks that the host of the callback URL of the service provider resolves.
+func (c commonController) checkCallbackUrl(r *http.Request) SelfCheckResult {
+	result := SelfCheckResult{Check: selfCheckCallbackUrl, ServiceProvider: string(c.Config.ServiceProviderType)}
+
+	redirectUrl := c.redirectUrl(r)
+	parsed, err := url.Parse(redirectUrl)
+	if err != nil {
+		return selfCheckOutcome(result, fmt.Errorf("invalid callback URL '%s': %w", redirectUrl, err))
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return selfCheckOutcome(result, fmt.Errorf("the callback URL '%s' has no host", redirectUrl))
+	}
+	if _, err := net.DefaultResolver.LookupHost(r.Context(), host); err != nil {
+		return selfCheckOutcome(result, fmt.Errorf("the host of the callback URL '%s' doesn't resolve: %w", redirectUrl, err))
+	}
+	result.Message = redirectUrl
+	return selfCheckOutcome(result, nil)
+}
+
+// errClientCredentialsRejected is returned when the token endpoint rejects the client credentials, as opposed to
+// the failures not telling anything about the credentials.
+var errClientCredentialsRejected = errors.New("the token endpoint rejected the client credentials")
+
+// checkClientCredentials checks that the service provider accepts the client credentials of the OAuth application.
+func (c commonController) checkClientCredentials(r *http.Request, result SelfCheckResult) SelfCheckResult {
+	if c.Endpoint.TokenURL == "" && c.discovery.Url == "" {
+		return selfCheckSkipped(result, "the service provider has no token endpoint")
+	}
+
+	if err := c.probeClientCredentials(r, result.Organization); err != nil {
+		return selfCheckOutcome(result, err)
+	}
+
+	result.Message = "the client credentials were accepted"
+	return selfCheckOutcome(result, nil)
+}
+
+// probeClientCredentials exchanges a made-up authorization code at the token endpoint using the client credentials of
+// the OAuth application of the organization. The service provider is expected to reject the code, but not the client.
+// The returned error wraps errClientCredentialsRejected if the client is rejected.
+func (c commonController) probeClientCredentials(r *http.Request, organization string) error {
+	oauthCfg, err := c.newOAuth2Config(r, organization)
+	if err != nil {
+		return err
+	}
+	oauthCfg.Endpoint, err = c.providerEndpoint(r.Context())
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {selfCheckProbeCode},
+		"redirect_uri": {oauthCfg.RedirectURL},
+	}
+	if oauthCfg.Endpoint.AuthStyle == oauth2.AuthStyleInParams || !usesClientSecret(c.clientAuthMethod) {
+		params.Set("client_id", oauthCfg.ClientID)
+	}
+
+	req, err := c.newClientAuthenticatedRequest(r.Context(), &oauthCfg, oauthCfg.Endpoint.TokenURL, params)
+	if err != nil {
+		return err
+	}
+	resp, err := c.providerHttpClient(r.Context()).Do(req)
+	if err != nil {
+		return fmt.Errorf("the token endpoint is not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read the response of the token endpoint: %w", err)
+	}
+
+	errorResponse := tokenErrorResponse{}
+	_ = json.Unmarshal(body, &errorResponse)
+	if rejectedClientErrors[errorResponse.Error] || resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w with status %d: %s %s", errClientCredentialsRejected, resp.StatusCode, errorResponse.Error, errorResponse.ErrorDescription)
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("the token endpoint failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// selfCheckOutcome marks the result as passed or failed depending on the error.
+func selfCheckOutcome(result SelfCheckResult, err error) SelfCheckResult {
+	if err != nil {
+		result.Status = SelfCheckFailed
+		result.Message = err.Error()
+	} else {
+		result.Status = SelfCheckPassed
+	}
+	return result
+}
+
+func selfCheckSkipped(result SelfCheckResult, reason string) SelfCheckResult {
+	result.Status = SelfCheckSkipped
+	result.Message = reason
+	return result
+}
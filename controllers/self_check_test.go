@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// selfCheckTokenEndpoint emulates the token endpoint of GitHub which reports the errors with the 200 status.
+func selfCheckTokenEndpoint(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "authorization_code", r.PostForm.Get("grant_type"))
+		assert.Equal(t, selfCheckProbeCode, r.PostForm.Get("code"))
+
+		errorCode := "bad_verification_code"
+		if id, secret, _ := r.BasicAuth(); id != "client-id" || secret != "client-secret" {
+			errorCode = "incorrect_client_credentials"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"error":"%s","error_description":"nope"}`, errorCode)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestControllerSelfCheck(t *testing.T) {
+	srv := selfCheckTokenEndpoint(t)
+
+	t.Run("healthy", func(t *testing.T) {
+		c := testController(srv.URL, nil, nil)
+		c.BaseUrl = "https://127.0.0.1"
+		c.OrganizationApps = map[string]OrganizationApp{"org": {ClientId: "org-id", ClientSecret: "org-secret"}}
+
+		results := c.SelfCheck(httptest.NewRequest("GET", "/selfcheck", nil))
+		assert.Len(t, results, 3)
+
+		assert.Equal(t, selfCheckCallbackUrl, results[0].Check)
+		assert.Equal(t, SelfCheckPassed, results[0].Status)
+		assert.Equal(t, "https://127.0.0.1/github/callback", results[0].Message)
+
+		assert.Equal(t, selfCheckClientCredentials, results[1].Check)
+		assert.Equal(t, "GitHub", results[1].ServiceProvider)
+		assert.Empty(t, results[1].Organization)
+		assert.Equal(t, SelfCheckPassed, results[1].Status)
+
+		assert.Equal(t, "org", results[2].Organization)
+		assert.Equal(t, SelfCheckFailed, results[2].Status)
+		assert.Contains(t, results[2].Message, "incorrect_client_credentials")
+	})
+
+	t.Run("unresolvable callback", func(t *testing.T) {
+		c := testController(srv.URL, nil, nil)
+		c.BaseUrl = "https://spi-oauth.invalid"
+
+		results := c.SelfCheck(httptest.NewRequest("GET", "/selfcheck", nil))
+		assert.Equal(t, SelfCheckFailed, results[0].Status)
+		assert.Contains(t, results[0].Message, "https://spi-oauth.invalid/github/callback")
+	})
+
+	t.Run("unauthorized client", func(t *testing.T) {
+		tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer tokenEndpoint.Close()
+
+		c := testController(tokenEndpoint.URL, nil, nil)
+		c.BaseUrl = "https://127.0.0.1"
+		results := c.SelfCheck(httptest.NewRequest("GET", "/selfcheck", nil))
+		assert.Equal(t, SelfCheckFailed, results[1].Status)
+		assert.Contains(t, results[1].Message, "status 401")
+	})
+
+	t.Run("no token endpoint", func(t *testing.T) {
+		c := testController("", nil, nil)
+		c.BaseUrl = "https://127.0.0.1"
+		results := c.SelfCheck(httptest.NewRequest("GET", "/selfcheck", nil))
+		assert.Equal(t, SelfCheckSkipped, results[1].Status)
+	})
+}
+
+// selfCheckingStorage is a token storage with the predefined result of the self-check.
+type selfCheckingStorage struct {
+	testTokenStorage
+	err error
+}
+
+func (s selfCheckingStorage) SelfCheck(_ context.Context) error {
+	return s.err
+}
+
+func TestSelfChecker(t *testing.T) {
+	srv := selfCheckTokenEndpoint(t)
+
+	checker := func(allowed bool, strg tokenstorage.TokenStorage, controllers ...Controller) *SelfChecker {
+		var spConfigs []config.ServiceProviderConfiguration
+		for _, c := range controllers {
+			spConfigs = append(spConfigs, c.(*commonController).Config)
+		}
+		i := 0
+		return &SelfChecker{
+			K8sClient: &reviewClient{Client: fake.NewClientBuilder().Build(), allowed: allowed},
+			Storage:   strg,
+			ServiceProviders: NewServiceProviders(spConfigs, func(config.ServiceProviderConfiguration) (Controller, error) {
+				i++
+				return controllers[i-1], nil
+			}),
+		}
+	}
+	request := func(authorization string) *http.Request {
+		req := httptest.NewRequest("GET", "/selfcheck", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		c := testController(srv.URL, nil, nil)
+		c.BaseUrl = "https://127.0.0.1"
+		report, err := checker(true, selfCheckingStorage{}, c).Check(request("Bearer admin"))
+		assert.NoError(t, err)
+		assert.True(t, report.Healthy)
+		assert.False(t, report.CheckedAt.IsZero())
+		assert.Len(t, report.Checks, 3)
+		assert.Equal(t, SelfCheckResult{Check: selfCheckTokenStoragePolicy, Status: SelfCheckPassed}, report.Checks[0])
+
+		data, err := json.Marshal(report)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), `"check":"client-credentials","serviceProvider":"GitHub","status":"passed"`)
+	})
+
+	t.Run("insufficient storage policy", func(t *testing.T) {
+		report, err := checker(true, selfCheckingStorage{err: fmt.Errorf("the Vault policy doesn't allow list on 'spi/metadata/'")}).Check(request("Bearer admin"))
+		assert.NoError(t, err)
+		assert.False(t, report.Healthy)
+		assert.Equal(t, SelfCheckFailed, report.Checks[0].Status)
+		assert.Contains(t, report.Checks[0].Message, "spi/metadata/")
+	})
+
+	t.Run("storage not checkable", func(t *testing.T) {
+		report, err := checker(true, testTokenStorage{}).Check(request("Bearer admin"))
+		assert.NoError(t, err)
+		assert.True(t, report.Healthy)
+		assert.Equal(t, SelfCheckSkipped, report.Checks[0].Status)
+	})
+
+	t.Run("not authenticated", func(t *testing.T) {
+		_, err := checker(true, selfCheckingStorage{}).Check(request(""))
+		assert.True(t, k8serrors.IsUnauthorized(err))
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		_, err := checker(false, selfCheckingStorage{}).Check(request("Bearer user"))
+		assert.True(t, k8serrors.IsForbidden(err))
+	})
+}
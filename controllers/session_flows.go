@@ -0,0 +1,267 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+
+	"github.com/alexedwards/scs"
+	"go.uber.org/zap"
+)
+
+// flowsSessionKey is the key of the session data holding the OAuth flows in progress. The data is a map from the flow
+// key to the encrypted Kubernetes token of the user that initiated the flow.
+const flowsSessionKey = "flows"
+
+// flowBindingSessionKey is the key of the session data holding the random secret the flow keys of the session are
+// bound to.
+const flowBindingSessionKey = "flowBinding"
+
+const (
+	// flowBindingSize is the size of the secret the flow keys of the session are bound to.
+	flowBindingSize = 32
+	// flowKeyNonceSize is the size of the random part of the flow keys.
+	flowKeyNonceSize = 16
+	// flowKeyMacSize is the size of the part of the flow keys binding them to the session.
+	flowKeyMacSize = 16
+)
+
+// newFlowCipher creates the cipher encrypting the Kubernetes tokens in the session data, so that a compromised session
+// store doesn't directly yield the credentials to the cluster.
+func newFlowCipher(sharedSecret []byte) (cipher.AEAD, error) {
+	if len(sharedSecret) == 0 {
+		return nil, fmt.Errorf("the shared secret is needed to encrypt the session data")
+	}
+
+	return newAEAD(flowCipherKeyLabel, sharedSecret)
+}
+
+// newFlowKeyMac creates the MAC deriving the flow keys from the random nonces and the session binding.
+func newFlowKeyMac(sharedSecret []byte) (hash.Hash, error) {
+	if len(sharedSecret) == 0 {
+		return nil, fmt.Errorf("the shared secret is needed to derive the flow keys")
+	}
+
+	return hmac.New(sha256.New, deriveKey(flowKeyMacKeyLabel, sharedSecret)), nil
+}
+
+// flowKeyMac computes the MAC part of the flow key with the provided nonce for the session with the provided binding.
+func (c commonController) flowKeyMac(binding []byte, nonce []byte) ([]byte, error) {
+	mac, err := newFlowKeyMac(c.JwtSigningSecret)
+	if err != nil {
+		return nil, err
+	}
+	mac.Write(binding)
+	mac.Write(nonce)
+	return mac.Sum(nil)[:flowKeyMacSize], nil
+}
+
+// wellFormedFlowKey checks that the flow key has the format of the keys generated by newFlowKey. This is checked
+// before touching the session so that the tampered states don't cost the session store lookups.
+func wellFormedFlowKey(flowKey string) bool {
+	if len(flowKey) != base64.RawURLEncoding.EncodedLen(flowKeyNonceSize+flowKeyMacSize) {
+		return false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(flowKey)
+	return err == nil && len(decoded) == flowKeyNonceSize+flowKeyMacSize
+}
+
+// sessionFlowBinding returns the random secret of the session the flow keys are bound to. If the session doesn't have
+// one yet, it is generated and stored in the session if the response writer is provided, otherwise nil is returned.
+func sessionFlowBinding(w http.ResponseWriter, session *scs.Session) ([]byte, error) {
+	encoded, err := session.GetString(flowBindingSessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode session data: %w", err)
+	}
+	if encoded != "" {
+		binding, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode session data: %w", err)
+		}
+		return binding, nil
+	}
+	if w == nil {
+		return nil, nil
+	}
+
+	binding := make([]byte, flowBindingSize)
+	if _, err = rand.Read(binding); err != nil {
+		return nil, fmt.Errorf("failed to generate the session binding: %w", err)
+	}
+	if err = session.PutString(w, flowBindingSessionKey, base64.RawURLEncoding.EncodeToString(binding)); err != nil {
+		return nil, fmt.Errorf("failed to encode session data: %w", err)
+	}
+	return binding, nil
+}
+
+// newFlowKey generates the key of a new flow in the session. The key consists of a random nonce and the MAC of
+// the nonce and the session binding, so that the keys cannot be guessed and a key is only valid in the session it was
+// generated for.
+func (c commonController) newFlowKey(w http.ResponseWriter, session *scs.Session) (string, error) {
+	binding, err := sessionFlowBinding(w, session)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, flowKeyNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate the flow key: %w", err)
+	}
+	mac, err := c.flowKeyMac(binding, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(nonce, mac...)), nil
+}
+
+// boundFlowKey checks that the well-formed flow key was generated for the session in constant time.
+func (c commonController) boundFlowKey(session *scs.Session, flowKey string) (bool, error) {
+	binding, err := sessionFlowBinding(nil, session)
+	if err != nil || binding == nil {
+		return false, err
+	}
+
+	decoded, _ := base64.RawURLEncoding.DecodeString(flowKey)
+	expected, err := c.flowKeyMac(binding, decoded[:flowKeyNonceSize])
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(decoded[flowKeyNonceSize:], expected), nil
+}
+
+// lookupFlow returns the flow stored under the flow key comparing the key with all the keys in constant time, so that
+// the lookup doesn't tell how close the key is to a stored one.
+func lookupFlow(flows map[string]string, flowKey string) (string, bool) {
+	var found string
+	ok := 0
+	for key, flow := range flows {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(flowKey)) == 1 {
+			found = flow
+			ok = 1
+		}
+	}
+	return found, ok == 1
+}
+
+// startFlow generates the key of a new flow and stores the Kubernetes token of the user in the session under it.
+// The token is encrypted with the flow key as the additional data, so that the encrypted token cannot be moved to
+// another flow.
+func (c commonController) startFlow(w http.ResponseWriter, r *http.Request, token string) (string, error) {
+	aead, err := newFlowCipher(c.JwtSigningSecret)
+	if err != nil {
+		return "", err
+	}
+
+	session := c.SessionManager.Load(r)
+	flowKey, err := c.newFlowKey(w, session)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate the nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(flowKey))
+
+	flows := map[string]string{}
+	if err = session.GetObject(flowsSessionKey, &flows); err != nil {
+		return "", fmt.Errorf("failed to decode session data: %w", err)
+	}
+
+	flows[flowKey] = base64.RawURLEncoding.EncodeToString(sealed)
+
+	if err = session.PutObject(w, flowsSessionKey, flows); err != nil {
+		return "", fmt.Errorf("failed to encode session data: %w", err)
+	}
+	return flowKey, nil
+}
+
+// getFlow returns the Kubernetes token of the user stored in the session under the flow key. An empty string is
+// returned if the key is malformed or not bound to the session, if there is no such flow or if its token cannot be
+// decrypted, e.g. because the shared secret has changed since the flow was initiated. The malformed keys are rejected
+// without loading the session.
+func (c commonController) getFlow(r *http.Request, flowKey string) (string, error) {
+	if !wellFormedFlowKey(flowKey) {
+		LoggerFromContext(r.Context()).Warn("the flow key is malformed")
+		return "", nil
+	}
+
+	session := c.SessionManager.Load(r)
+	bound, err := c.boundFlowKey(session, flowKey)
+	if err != nil {
+		return "", err
+	}
+	if !bound {
+		LoggerFromContext(r.Context()).Warn("the flow key was not generated for the session")
+		return "", nil
+	}
+
+	flows := map[string]string{}
+	if err := session.GetObject(flowsSessionKey, &flows); err != nil {
+		return "", fmt.Errorf("failed to decode session data: %w", err)
+	}
+
+	encoded, ok := lookupFlow(flows, flowKey)
+	if !ok || encoded == "" {
+		return "", nil
+	}
+
+	aead, err := newFlowCipher(c.JwtSigningSecret)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		LoggerFromContext(r.Context()).Warn("the session data of the flow is malformed")
+		return "", nil
+	}
+	token, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(flowKey))
+	if err != nil {
+		LoggerFromContext(r.Context()).Warn("failed to decrypt the session data of the flow, has the shared secret changed?", zap.Error(err))
+		return "", nil
+	}
+	return string(token), nil
+}
+
+// removeFlow removes the flow from the session once the callback has consumed it. Failing to do so is not fatal,
+// the session expires eventually anyway.
+func (c commonController) removeFlow(w http.ResponseWriter, r *http.Request, flowKey string) {
+	if !wellFormedFlowKey(flowKey) {
+		return
+	}
+
+	session := c.SessionManager.Load(r)
+	flows := map[string]string{}
+	if err := session.GetObject(flowsSessionKey, &flows); err != nil {
+		LoggerFromContext(r.Context()).Warn("failed to decode session data", zap.Error(err))
+		return
+	}
+	if _, ok := lookupFlow(flows, flowKey); !ok {
+		return
+	}
+
+	delete(flows, flowKey)
+	if err := session.PutObject(w, flowsSessionKey, flows); err != nil {
+		LoggerFromContext(r.Context()).Warn("failed to remove the finished flow from the session", zap.Error(err))
+	}
+}
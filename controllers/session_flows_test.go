@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionFlows(t *testing.T) {
+	c := commonController{
+		JwtSigningSecret: []byte("secret"),
+		SessionManager:   scs.NewManager(memstore.New(time.Hour)),
+	}
+
+	// stores the flows and returns the request carrying the session cookie
+	res := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	flow1, err := c.startFlow(res, r, "k8s-token")
+	assert.NoError(t, err)
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range res.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	flow2, err := c.startFlow(httptest.NewRecorder(), r, "other-k8s-token")
+	assert.NoError(t, err)
+	assert.NotEqual(t, flow1, flow2)
+
+	t.Run("encrypted", func(t *testing.T) {
+		flows := map[string]string{}
+		assert.NoError(t, c.SessionManager.Load(r).GetObject(flowsSessionKey, &flows))
+		assert.Contains(t, flows, flow1)
+		assert.False(t, strings.Contains(flows[flow1], "k8s-token"))
+	})
+
+	t.Run("get", func(t *testing.T) {
+		token, err := c.getFlow(r, flow1)
+		assert.NoError(t, err)
+		assert.Equal(t, "k8s-token", token)
+
+		token, err = c.getFlow(r, flow2)
+		assert.NoError(t, err)
+		assert.Equal(t, "other-k8s-token", token)
+	})
+
+	t.Run("malformed key", func(t *testing.T) {
+		for _, key := range []string{"", "flow-1", "3f2504e0-4f89-11d3-9a0c-0305e82c3301", flow1 + "A", flow1[:len(flow1)-1] + "!"} {
+			token, err := c.getFlow(r, key)
+			assert.NoError(t, err)
+			assert.Empty(t, token, key)
+		}
+	})
+
+	t.Run("key of another session", func(t *testing.T) {
+		other := httptest.NewRequest("GET", "/", nil)
+		otherKey, err := c.startFlow(httptest.NewRecorder(), other, "k8s-token")
+		assert.NoError(t, err)
+		assert.True(t, wellFormedFlowKey(otherKey))
+
+		token, err := c.getFlow(r, otherKey)
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+	})
+
+	t.Run("tampered key", func(t *testing.T) {
+		decoded, err := base64.RawURLEncoding.DecodeString(flow1)
+		assert.NoError(t, err)
+		decoded[0] ^= 1
+		token, err := c.getFlow(r, base64.RawURLEncoding.EncodeToString(decoded))
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+	})
+
+	t.Run("moved to another flow", func(t *testing.T) {
+		session := c.SessionManager.Load(r)
+		flows := map[string]string{}
+		assert.NoError(t, session.GetObject(flowsSessionKey, &flows))
+		original := flows[flow2]
+		flows[flow2] = flows[flow1]
+		assert.NoError(t, session.PutObject(httptest.NewRecorder(), flowsSessionKey, flows))
+		defer func() {
+			flows[flow2] = original
+			assert.NoError(t, session.PutObject(httptest.NewRecorder(), flowsSessionKey, flows))
+		}()
+
+		token, err := c.getFlow(r, flow2)
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+	})
+
+	t.Run("changed secret", func(t *testing.T) {
+		changed := c
+		changed.JwtSigningSecret = []byte("another-secret")
+		token, err := changed.getFlow(r, flow1)
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		c.removeFlow(httptest.NewRecorder(), r, flow1)
+		token, err := c.getFlow(r, flow1)
+		assert.NoError(t, err)
+		assert.Empty(t, token)
+
+		// the other flows of the session are kept
+		token, err = c.getFlow(r, flow2)
+		assert.NoError(t, err)
+		assert.Equal(t, "other-k8s-token", token)
+
+		// removing a missing flow is a no-op
+		c.removeFlow(httptest.NewRecorder(), r, flow1)
+		c.removeFlow(httptest.NewRecorder(), r, "malformed")
+	})
+}
+
+func TestLookupFlow(t *testing.T) {
+	flows := map[string]string{"a": "1", "b": "2"}
+	flow, ok := lookupFlow(flows, "b")
+	assert.True(t, ok)
+	assert.Equal(t, "2", flow)
+
+	_, ok = lookupFlow(flows, "c")
+	assert.False(t, ok)
+	_, ok = lookupFlow(nil, "a")
+	assert.False(t, ok)
+}
+
+func TestNewFlowKeyMac(t *testing.T) {
+	_, err := newFlowKeyMac(nil)
+	assert.Error(t, err)
+}
+
+func TestNewFlowCipher(t *testing.T) {
+	_, err := newFlowCipher(nil)
+	assert.Error(t, err)
+
+	aead, err := newFlowCipher([]byte("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, 12, aead.NonceSize())
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// errStateEnvironmentMismatch is returned when the OAuth state has been issued for a different environment than
+// the one the OAuth service is configured for.
+var errStateEnvironmentMismatch = errors.New("the OAuth state has been issued for a different environment")
+
+// StateValidation configures the verification of the environment the OAuth states have been issued for. This is needed
+// when several environments (e.g. stage and prod) share the signing secret, because the signature alone then doesn't
+// tell the states of the environments apart.
+type StateValidation struct {
+	// Issuer is the expected `iss` claim of the states, i.e. the identity of the SPI operator issuing them. The states
+	// without the claim or with a different one are rejected. Not checked if empty.
+	Issuer string `yaml:"issuer,omitempty"`
+
+	// Audience is the value expected among the `aud` claims of the states, i.e. the identity of this OAuth service.
+	// The states without the claim or not including the value are rejected. Not checked if empty.
+	Audience string `yaml:"audience,omitempty"`
+}
+
+// stateClaims are the registered JWT claims of the OAuth state identifying the environment it has been issued for.
+// They are copied from the anonymous state to the state sent to the service provider, so that both are validated
+// the same way.
+type stateClaims struct {
+	Issuer   string       `json:"iss,omitempty"`
+	Audience jwt.Audience `json:"aud,omitempty"`
+}
+
+// validate checks that the claims match the expected ones.
+func (v StateValidation) validate(claims stateClaims) error {
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return fmt.Errorf("%w: unexpected issuer '%s'", errStateEnvironmentMismatch, claims.Issuer)
+	}
+	if v.Audience != "" && !claims.Audience.Contains(v.Audience) {
+		return fmt.Errorf("%w: the audience %v doesn't include '%s'", errStateEnvironmentMismatch, []string(claims.Audience), v.Audience)
+	}
+	return nil
+}
+
+// claims returns the claims of the states issued by the OAuth service itself, so that they pass the validation.
+func (v StateValidation) claims() stateClaims {
+	claims := stateClaims{Issuer: v.Issuer}
+	if v.Audience != "" {
+		claims.Audience = jwt.Audience{v.Audience}
+	}
+	return claims
+}
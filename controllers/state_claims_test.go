@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateValidation(t *testing.T) {
+	mismatch := func(t *testing.T, err error) {
+		assert.True(t, errors.Is(err, errStateEnvironmentMismatch), "unexpected error %v", err)
+	}
+
+	assert.NoError(t, StateValidation{}.validate(stateClaims{}))
+	assert.NoError(t, StateValidation{}.validate(stateClaims{Issuer: "spi-stage", Audience: jwt.Audience{"oauth-stage"}}))
+
+	v := StateValidation{Issuer: "spi-prod", Audience: "oauth-prod"}
+	assert.NoError(t, v.validate(stateClaims{Issuer: "spi-prod", Audience: jwt.Audience{"oauth-prod"}}))
+	assert.NoError(t, v.validate(stateClaims{Issuer: "spi-prod", Audience: jwt.Audience{"other", "oauth-prod"}}))
+	mismatch(t, v.validate(stateClaims{}))
+	mismatch(t, v.validate(stateClaims{Issuer: "spi-stage", Audience: jwt.Audience{"oauth-prod"}}))
+	mismatch(t, v.validate(stateClaims{Issuer: "spi-prod", Audience: jwt.Audience{"oauth-stage"}}))
+
+	assert.NoError(t, StateValidation{Issuer: "spi-prod"}.validate(stateClaims{Issuer: "spi-prod"}))
+	assert.NoError(t, StateValidation{Audience: "oauth-prod"}.validate(stateClaims{Audience: jwt.Audience{"oauth-prod"}}))
+}
+
+func TestParseAnonymousStateClaims(t *testing.T) {
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+
+	// the operator may send the audience as a single string
+	encode := func(claims map[string]interface{}) string {
+		claims["tokenName"] = "token"
+		claims["tokenNamespace"] = "default"
+		claims["issuedAt"] = time.Now().Unix()
+		s, err := codec.Encode(claims)
+		assert.NoError(t, err)
+		return s
+	}
+
+	v := StateValidation{Issuer: "spi-prod", Audience: "oauth-prod"}
+
+	state, err := parseAnonymousState(&codec, encode(map[string]interface{}{"iss": "spi-prod", "aud": "oauth-prod"}), v)
+	assert.NoError(t, err)
+	assert.Equal(t, "spi-prod", state.Issuer)
+	assert.Equal(t, jwt.Audience{"oauth-prod"}, state.Audience)
+
+	_, err = parseAnonymousState(&codec, encode(map[string]interface{}{"iss": "spi-prod", "aud": []string{"oauth-stage"}}), v)
+	assert.True(t, errors.Is(err, errStateEnvironmentMismatch))
+
+	_, err = parseAnonymousState(&codec, encode(map[string]interface{}{}), v)
+	assert.True(t, errors.Is(err, errStateEnvironmentMismatch))
+
+	_, err = parseAnonymousState(&codec, encode(map[string]interface{}{}), StateValidation{})
+	assert.NoError(t, err)
+}
+
+func TestExchangeStateCarriesClaims(t *testing.T) {
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+
+	encoded, err := codec.Encode(&exchangeState{
+		AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "token"},
+		stateClaims:         stateClaims{Issuer: "spi-prod", Audience: jwt.Audience{"oauth-prod"}},
+		Key:                 "key",
+	})
+	assert.NoError(t, err)
+
+	state := &exchangeState{}
+	assert.NoError(t, codec.ParseInto(encoded, state))
+	assert.Equal(t, "key", state.Key)
+	assert.NoError(t, StateValidation{Issuer: "spi-prod", Audience: "oauth-prod"}.validate(state.stateClaims))
+}
+
+func TestStateValidationClaims(t *testing.T) {
+	assert.Equal(t, stateClaims{}, StateValidation{}.claims())
+
+	validation := StateValidation{Issuer: "spi-operator", Audience: "spi-oauth"}
+	assert.NoError(t, validation.validate(validation.claims()))
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+)
+
+// stateCodecCache holds the OAuth state codec so that it doesn't have to be constructed on every request. Creating
+// the codec involves setting up the JWT signer which is comparatively expensive and shows up in the profiles under
+// heavy load. The codec is only recreated when the signing secret changes.
+type stateCodecCache struct {
+	lock   sync.RWMutex
+	secret []byte
+	codec  *oauthstate.Codec
+}
+
+// get returns the codec for the provided signing secret, creating it if necessary.
+func (s *stateCodecCache) get(secret []byte) (*oauthstate.Codec, error) {
+	s.lock.RLock()
+	codec := s.codec
+	current := codec != nil && bytes.Equal(s.secret, secret)
+	s.lock.RUnlock()
+
+	if current {
+		return codec, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// someone might have been faster than us...
+	if s.codec != nil && bytes.Equal(s.secret, secret) {
+		return s.codec, nil
+	}
+
+	newCodec, err := oauthstate.NewCodec(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	s.secret = append([]byte(nil), secret...)
+	s.codec = &newCodec
+
+	return s.codec, nil
+}
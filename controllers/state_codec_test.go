@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateCodecCache(t *testing.T) {
+	cache := &stateCodecCache{}
+
+	secret := []byte("secret")
+	codec1, err := cache.get(secret)
+	assert.NoError(t, err)
+
+	codec2, err := cache.get([]byte("secret"))
+	assert.NoError(t, err)
+	assert.Same(t, codec1, codec2)
+
+	// modifying the original slice must not affect the cache
+	secret[0] = 'S'
+	codec3, err := cache.get([]byte("secret"))
+	assert.NoError(t, err)
+	assert.Same(t, codec1, codec3)
+
+	rotated, err := cache.get([]byte("rotated"))
+	assert.NoError(t, err)
+	assert.NotSame(t, codec1, rotated)
+
+	encoded, err := rotated.Encode(&testState)
+	assert.NoError(t, err)
+	_, err = codec1.ParseAnonymous(encoded)
+	assert.Error(t, err)
+	parsed, err := rotated.ParseAnonymous(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, testState, parsed)
+}
+
+var testState = oauthstate.AnonymousOAuthState{
+	TokenName:           "mytoken",
+	TokenNamespace:      "default",
+	IssuedAt:            1,
+	Scopes:              []string{"repo", "user"},
+	ServiceProviderType: config.ServiceProviderTypeGitHub,
+	ServiceProviderUrl:  "https://github.com",
+}
+
+func BenchmarkStateEncode(b *testing.B) {
+	c := &commonController{JwtSigningSecret: []byte("secret"), stateCodecs: &stateCodecCache{}}
+	state := exchangeState{AnonymousOAuthState: testState, Key: "key"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec, err := c.stateCodec()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = codec.Encode(&state); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStateParse(b *testing.B) {
+	c := &commonController{JwtSigningSecret: []byte("secret"), stateCodecs: &stateCodecCache{}}
+	codec, err := c.stateCodec()
+	if err != nil {
+		b.Fatal(err)
+	}
+	encoded, err := codec.Encode(&exchangeState{AnonymousOAuthState: testState, Key: "key"})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec, err := c.stateCodec()
+		if err != nil {
+			b.Fatal(err)
+		}
+		state := &exchangeState{}
+		if err = codec.ParseInto(encoded, state); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStateEncodeUncached shows the cost of creating the codec on every request for comparison.
+func BenchmarkStateEncodeUncached(b *testing.B) {
+	c := &commonController{JwtSigningSecret: []byte("secret")}
+	state := exchangeState{AnonymousOAuthState: testState, Key: "key"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec, err := c.stateCodec()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = codec.Encode(&state); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultStorageGcInterval is the default interval between the runs of the storage garbage collection.
+const DefaultStorageGcInterval = time.Hour
+
+// The results of the runs of the storage garbage collection used as the label of the runs metric.
+const (
+	storageGcSucceeded   = "succeeded"
+	storageGcFailed      = "failed"
+	storageGcUnsupported = "unsupported"
+)
+
+var (
+	storageGcOrphanedEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "storage_gc",
+		Name:      "orphaned_entries",
+		Help:      "The number of the SPIAccessTokens that no longer exist but still have data in the token storage, as found by the last run of the storage garbage collection.",
+	})
+	storageGcReclaimedEntries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "storage_gc",
+		Name:      "reclaimed_entries_total",
+		Help:      "The number of the orphaned SPIAccessTokens whose data has been removed from the token storage.",
+	})
+	storageGcRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "storage_gc",
+		Name:      "runs_total",
+		Help:      "The number of the runs of the storage garbage collection by their result.",
+	}, []string{"result"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(storageGcOrphanedEntries, storageGcReclaimedEntries, storageGcRuns)
+}
+
+// StorageGcReport is the result of a single run of the storage garbage collection.
+type StorageGcReport struct {
+	// Orphaned are the SPIAccessTokens that were found missing in two consecutive runs while still having data in
+	// the token storage.
+	Orphaned []types.NamespacedName
+	// Reclaimed is the number of the orphaned SPIAccessTokens whose data has been removed from the storage. It is
+	// always zero in the report-only mode.
+	Reclaimed int
+}
+
+// StorageGarbageCollector periodically cross-checks the data in the token storage with the SPIAccessTokens in
+// the cluster and removes the data of the SPIAccessTokens that no longer exist, e.g. because the token was deleted
+// while the operator was down or its finalizer failed. The data of a missing SPIAccessToken is only considered
+// orphaned once it is found missing in two consecutive runs, so that a token that is being recreated is never
+// touched. In the report-only mode, the orphaned data is only logged and counted in the metrics.
+//
+// The SPIAccessTokens are looked up using the Kubernetes client of the service itself, which therefore needs
+// the permission to get the SPIAccessTokens in all the namespaces. The collection must not be enabled if the tokens
+// live in kcp workspaces, because the namespaces of the stored data cannot be resolved to the workspaces.
+type StorageGarbageCollector struct {
+	k8sClient  client.Client
+	interval   time.Duration
+	reportOnly bool
+
+	lock       sync.Mutex
+	storage    tokenstorage.TokenStorage
+	candidates map[types.NamespacedName]bool
+}
+
+// NewStorageGarbageCollector creates the garbage collection looking up the SPIAccessTokens using the provided client.
+// The zero interval is replaced by DefaultStorageGcInterval. SetStorage must be called before the collection is
+// started.
+func NewStorageGarbageCollector(cl client.Client, interval time.Duration, reportOnly bool) *StorageGarbageCollector {
+	if interval <= 0 {
+		interval = DefaultStorageGcInterval
+	}
+	return &StorageGarbageCollector{
+		k8sClient:  cl,
+		interval:   interval,
+		reportOnly: reportOnly,
+		candidates: map[types.NamespacedName]bool{},
+	}
+}
+
+// SetStorage sets the token storage to collect. It is called again when the configuration of the storage changes,
+// which also forgets the candidates found in the previous storage.
+func (g *StorageGarbageCollector) SetStorage(storage tokenstorage.TokenStorage) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.storage = storage
+	g.candidates = map[types.NamespacedName]bool{}
+}
+
+// Start runs the collection in the background every interval until the context is done.
+func (g *StorageGarbageCollector) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				g.run(ctx)
+			}
+		}
+	}()
+}
+
+// run performs a single collection, logs its outcome and records it in the metrics.
+func (g *StorageGarbageCollector) run(ctx context.Context) {
+	report, err := g.Collect(ctx)
+	switch {
+	case errors.Is(err, oauthstorage.ErrListingNotSupported):
+		storageGcRuns.WithLabelValues(storageGcUnsupported).Inc()
+		zap.L().Warn("the token storage cannot be garbage collected, because it is not able to list its data")
+	case err != nil:
+		storageGcRuns.WithLabelValues(storageGcFailed).Inc()
+		zap.L().Error("the storage garbage collection failed", zap.Error(err))
+	default:
+		storageGcRuns.WithLabelValues(storageGcSucceeded).Inc()
+		zap.L().Info("the storage garbage collection finished", zap.Int("orphaned", len(report.Orphaned)), zap.Int("reclaimed", report.Reclaimed), zap.Bool("reportOnly", g.reportOnly))
+	}
+}
+
+// Collect performs a single collection. The owners of the data that cannot be checked are kept for the next run,
+// the collection only fails if the data in the storage cannot be listed.
+func (g *StorageGarbageCollector) Collect(ctx context.Context) (StorageGcReport, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	report := StorageGcReport{}
+
+	enumerable, ok := g.storage.(oauthstorage.EnumerableStorage)
+	if !ok {
+		return report, oauthstorage.ErrListingNotSupported
+	}
+
+	owners, err := enumerable.ListOwners(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list the data in the token storage: %w", err)
+	}
+
+	candidates := map[types.NamespacedName]bool{}
+	for _, owner := range owners {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		log := zap.L().With(zap.String("token", owner.Name), zap.String("namespace", owner.Namespace))
+
+		err := g.k8sClient.Get(ctx, owner, &api.SPIAccessToken{})
+		if err == nil {
+			continue
+		}
+		if !kerrors.IsNotFound(err) {
+			log.Warn("failed to check the existence of the SPIAccessToken of the stored data, will retry in the next run", zap.Error(err))
+			if g.candidates[owner] {
+				candidates[owner] = true
+			}
+			continue
+		}
+
+		if !g.candidates[owner] {
+			// give the token the time to be recreated before touching its data
+			candidates[owner] = true
+			continue
+		}
+
+		report.Orphaned = append(report.Orphaned, owner)
+		if g.reportOnly {
+			log.Info("found the orphaned data of a deleted SPIAccessToken in the token storage")
+			continue
+		}
+
+		if err := enumerable.PurgeOwner(ctx, owner); err != nil {
+			log.Error("failed to remove the orphaned data of a deleted SPIAccessToken from the token storage", zap.Error(err))
+			candidates[owner] = true
+			continue
+		}
+		log.Info("removed the orphaned data of a deleted SPIAccessToken from the token storage")
+		report.Reclaimed++
+	}
+
+	if g.reportOnly {
+		for _, owner := range report.Orphaned {
+			candidates[owner] = true
+		}
+	}
+	g.candidates = candidates
+
+	storageGcOrphanedEntries.Set(float64(len(report.Orphaned)))
+	storageGcReclaimedEntries.Add(float64(report.Reclaimed))
+
+	return report, nil
+}
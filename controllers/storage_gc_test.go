@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testEnumerableStorage is the token storage keeping just the set of the owners of the stored data.
+type testEnumerableStorage struct {
+	testTokenStorage
+	owners  map[types.NamespacedName]bool
+	listErr error
+}
+
+func (s *testEnumerableStorage) ListOwners(context.Context) ([]types.NamespacedName, error) {
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+	owners := make([]types.NamespacedName, 0, len(s.owners))
+	for owner := range s.owners {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].String() < owners[j].String() })
+	return owners, nil
+}
+
+func (s *testEnumerableStorage) PurgeOwner(_ context.Context, owner types.NamespacedName) error {
+	delete(s.owners, owner)
+	return nil
+}
+
+func storageGcTestClient(tokens ...string) client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	for _, name := range tokens {
+		builder = builder.WithObjects(&v1beta1.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}})
+	}
+	return builder.Build()
+}
+
+func TestStorageGarbageCollector(t *testing.T) {
+	ctx := context.TODO()
+	live := types.NamespacedName{Namespace: "default", Name: "live"}
+	orphan := types.NamespacedName{Namespace: "default", Name: "orphan"}
+	strg := &testEnumerableStorage{owners: map[types.NamespacedName]bool{live: true, orphan: true}}
+
+	gc := NewStorageGarbageCollector(storageGcTestClient("live"), 0, false)
+	assert.Equal(t, DefaultStorageGcInterval, gc.interval)
+	gc.SetStorage(strg)
+	reclaimed := testutil.ToFloat64(storageGcReclaimedEntries)
+
+	// the first run only remembers the missing token
+	report, err := gc.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Orphaned)
+	assert.Len(t, strg.owners, 2)
+
+	report, err = gc.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, StorageGcReport{Orphaned: []types.NamespacedName{orphan}, Reclaimed: 1}, report)
+	assert.Equal(t, map[types.NamespacedName]bool{live: true}, strg.owners)
+	assert.Equal(t, 1.0, testutil.ToFloat64(storageGcOrphanedEntries))
+	assert.Equal(t, reclaimed+1, testutil.ToFloat64(storageGcReclaimedEntries))
+
+	report, err = gc.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Orphaned)
+	assert.Equal(t, 0.0, testutil.ToFloat64(storageGcOrphanedEntries))
+}
+
+func TestStorageGarbageCollectorRecreatedToken(t *testing.T) {
+	ctx := context.TODO()
+	token := types.NamespacedName{Namespace: "default", Name: "token"}
+	strg := &testEnumerableStorage{owners: map[types.NamespacedName]bool{token: true}}
+
+	gc := NewStorageGarbageCollector(storageGcTestClient(), 0, false)
+	gc.SetStorage(strg)
+	_, err := gc.Collect(ctx)
+	assert.NoError(t, err)
+
+	// the token reappears before the next run
+	gc.k8sClient = storageGcTestClient("token")
+	report, err := gc.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Orphaned)
+
+	// and is gone again, which needs to be confirmed again
+	gc.k8sClient = storageGcTestClient()
+	report, err = gc.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Orphaned)
+	assert.Len(t, strg.owners, 1)
+}
+
+func TestStorageGarbageCollectorReportOnly(t *testing.T) {
+	ctx := context.TODO()
+	orphan := types.NamespacedName{Namespace: "default", Name: "orphan"}
+	strg := &testEnumerableStorage{owners: map[types.NamespacedName]bool{orphan: true}}
+	reclaimed := testutil.ToFloat64(storageGcReclaimedEntries)
+
+	gc := NewStorageGarbageCollector(storageGcTestClient(), 0, true)
+	gc.SetStorage(strg)
+
+	for i := 0; i < 3; i++ {
+		report, err := gc.Collect(ctx)
+		assert.NoError(t, err)
+		if i == 0 {
+			assert.Empty(t, report.Orphaned)
+		} else {
+			assert.Equal(t, StorageGcReport{Orphaned: []types.NamespacedName{orphan}}, report)
+		}
+	}
+	assert.Len(t, strg.owners, 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(storageGcOrphanedEntries))
+	assert.Equal(t, reclaimed, testutil.ToFloat64(storageGcReclaimedEntries))
+}
+
+func TestStorageGarbageCollectorStorageChange(t *testing.T) {
+	ctx := context.TODO()
+	orphan := types.NamespacedName{Namespace: "default", Name: "orphan"}
+
+	gc := NewStorageGarbageCollector(storageGcTestClient(), 0, false)
+	gc.SetStorage(&testEnumerableStorage{owners: map[types.NamespacedName]bool{orphan: true}})
+	_, err := gc.Collect(ctx)
+	assert.NoError(t, err)
+
+	// the candidates found in the previous storage are forgotten
+	strg := &testEnumerableStorage{owners: map[types.NamespacedName]bool{orphan: true}}
+	gc.SetStorage(strg)
+	report, err := gc.Collect(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Orphaned)
+	assert.Len(t, strg.owners, 1)
+}
+
+func TestStorageGarbageCollectorErrors(t *testing.T) {
+	ctx := context.TODO()
+
+	gc := NewStorageGarbageCollector(storageGcTestClient(), 0, false)
+	gc.SetStorage(testTokenStorage{})
+	_, err := gc.Collect(ctx)
+	assert.ErrorIs(t, err, oauthstorage.ErrListingNotSupported)
+
+	gc.SetStorage(oauthstorage.DryRun(testTokenStorage{}))
+	_, err = gc.Collect(ctx)
+	assert.ErrorIs(t, err, oauthstorage.ErrListingNotSupported)
+
+	listErr := errors.New("vault is down")
+	gc.SetStorage(&testEnumerableStorage{listErr: listErr})
+	_, err = gc.Collect(ctx)
+	assert.ErrorIs(t, err, listErr)
+
+	failed := testutil.ToFloat64(storageGcRuns.WithLabelValues(storageGcFailed))
+	gc.run(ctx)
+	assert.Equal(t, failed+1, testutil.ToFloat64(storageGcRuns.WithLabelValues(storageGcFailed)))
+}
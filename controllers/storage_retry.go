@@ -0,0 +1,361 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// DefaultStorageRetryInterval is the default interval between the attempts to store the queued tokens.
+	DefaultStorageRetryInterval = 30 * time.Second
+
+	// DefaultStorageRetryMaxAge is the default duration after which the queued tokens are given up on. The Kubernetes
+	// token of the user that is used to store the token data is not likely to be valid for much longer anyway.
+	DefaultStorageRetryMaxAge = time.Hour
+
+	// storageRetryFileSuffix is the suffix of the files with the queued tokens.
+	storageRetryFileSuffix = ".token"
+)
+
+// queuedTokenExtras are the extra fields of the token response that are needed to store the token artifacts.
+var queuedTokenExtras = []string{"id_token", refreshTokenExpiresInField}
+
+// queuedToken is the token obtained from the service provider that failed to be stored, along with all the data
+// needed to store it later on behalf of the user.
+type queuedToken struct {
+	ServiceProvider     config.ServiceProviderType `json:"serviceProvider"`
+	TokenName           string                     `json:"tokenName"`
+	TokenNamespace      string                     `json:"tokenNamespace"`
+	Workspace           string                     `json:"workspace,omitempty"`
+	Scopes              []string                   `json:"scopes,omitempty"`
+	Automation          bool                       `json:"automation,omitempty"`
+	Restricted          bool                       `json:"restricted,omitempty"`
+	Capabilities        []string                   `json:"capabilities"`
+	AuthorizationHeader string                     `json:"authorizationHeader"`
+	Token               oauth2.Token               `json:"token"`
+	Extra               map[string]interface{}     `json:"extra,omitempty"`
+	QueuedAt            time.Time                  `json:"queuedAt"`
+}
+
+// StorageRetryQueue keeps the tokens that couldn't be stored at the time of the callback, e.g. because the token
+// storage was down, and retries storing them in the background. The queue is kept in files in a local directory so
+// that it survives the restarts of the service, which is why the directory should be backed by a persistent volume.
+// The files are encrypted using a key derived from the shared secret, because they contain both the token
+// of the service provider and the Kubernetes token of the user.
+type StorageRetryQueue struct {
+	dir      string
+	interval time.Duration
+	maxAge   time.Duration
+	aead     cipher.AEAD
+	now      func() time.Time
+
+	// Events is the optional publisher of the events about the queued tokens being stored or given up on.
+	Events FlowEventPublisher
+
+	// Identities optionally enrich the identities of the users recorded in the events.
+	Identities IdentityEnricher
+
+	lock      sync.Mutex
+	k8sClient AuthenticatingClient
+	storage   tokenstorage.TokenStorage
+}
+
+// NewStorageRetryQueue creates the queue keeping the tokens in the provided directory, which is created if it doesn't
+// exist. The zero interval and max age are replaced by DefaultStorageRetryInterval and DefaultStorageRetryMaxAge.
+// SetStorage must be called before the queue is started.
+func NewStorageRetryQueue(dir string, sharedSecret []byte, interval time.Duration, maxAge time.Duration) (*StorageRetryQueue, error) {
+	if len(sharedSecret) == 0 {
+		return nil, fmt.Errorf("the shared secret is needed to encrypt the queued tokens")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the directory of the storage retry queue: %w", err)
+	}
+
+	if interval <= 0 {
+		interval = DefaultStorageRetryInterval
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultStorageRetryMaxAge
+	}
+
+	aead, err := newAEAD(storageRetryKeyLabel, sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StorageRetryQueue{
+		dir:      dir,
+		interval: interval,
+		maxAge:   maxAge,
+		aead:     aead,
+		now:      time.Now,
+	}, nil
+}
+
+// SetStorage sets the Kubernetes client and the token storage the queued tokens are stored with. It is called again
+// when the configuration of the storage changes.
+func (q *StorageRetryQueue) SetStorage(cl AuthenticatingClient, storage tokenstorage.TokenStorage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.k8sClient = cl
+	q.storage = storage
+}
+
+// Start retries storing the queued tokens in the background every interval until the context is done.
+func (q *StorageRetryQueue) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				q.Retry(ctx)
+			}
+		}
+	}()
+}
+
+// Len returns the number of the tokens in the queue.
+func (q *StorageRetryQueue) Len() int {
+	files, err := q.files()
+	if err != nil {
+		return 0
+	}
+	return len(files)
+}
+
+// enqueue persists the result of the exchange that failed to be stored.
+func (q *StorageRetryQueue) enqueue(spType config.ServiceProviderType, exchange *exchangeResult) error {
+	entry := queuedToken{
+		ServiceProvider:     spType,
+		TokenName:           exchange.TokenName,
+		TokenNamespace:      exchange.TokenNamespace,
+		Workspace:           exchange.Workspace,
+		Scopes:              exchange.Scopes,
+		Automation:          exchange.Automation,
+		Restricted:          exchange.restricted,
+		Capabilities:        exchange.capabilities,
+		AuthorizationHeader: exchange.authorizationHeader,
+		Token:               *exchange.token,
+		Extra:               map[string]interface{}{},
+		QueuedAt:            q.now(),
+	}
+	for _, field := range queuedTokenExtras {
+		if value := exchange.token.Extra(field); value != nil {
+			entry.Extra[field] = value
+		}
+	}
+
+	plain, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, q.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	data := q.aead.Seal(nonce, nonce, plain, nil)
+
+	// the files are named by the time they were queued in so that they are retried in the order
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s%s", entry.QueuedAt.UnixNano(), hex.EncodeToString(id), storageRetryFileSuffix)
+
+	// write to a temporary file first so that a crash never leaves a partially written entry in the queue
+	tmp, err := ioutil.TempFile(q.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(q.dir, name))
+}
+
+// Retry tries to store all the queued tokens once. The tokens that are stored or that cannot ever be stored are
+// removed from the queue.
+func (q *StorageRetryQueue) Retry(ctx context.Context) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.storage == nil {
+		return
+	}
+
+	files, err := q.files()
+	if err != nil {
+		zap.L().Error("failed to list the storage retry queue", zap.Error(err))
+		return
+	}
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return
+		}
+
+		entry, err := q.read(file)
+		if err != nil {
+			zap.L().Error("failed to read the queued token, removing it from the queue", zap.String("file", file), zap.Error(err))
+			q.remove(file)
+			continue
+		}
+
+		log := zap.L().With(zap.String("token", entry.TokenName), zap.String("namespace", entry.TokenNamespace), zap.Time("queuedAt", entry.QueuedAt))
+
+		err = q.store(WithLoggerIntoContext(ctx, log), entry)
+		switch {
+		case err == nil:
+			log.Info("the queued token has been stored")
+			q.remove(file)
+			q.publish(TokenStoredEvent, entry, nil)
+		case isPermanentStorageError(err) || q.now().Sub(entry.QueuedAt) > q.maxAge:
+			log.Error("giving up on storing the queued token, the user needs to repeat the OAuth flow", zap.Error(err))
+			q.remove(file)
+			q.publish(StorageFailedEvent, entry, err)
+		default:
+			log.Warn("failed to store the queued token, will retry", zap.Error(err))
+		}
+	}
+}
+
+// store stores the queued token the same way as the callback does.
+func (q *StorageRetryQueue) store(ctx context.Context, entry *queuedToken) error {
+	artifacts, _ := q.storage.(oauthstorage.ArtifactStorage)
+	c := commonController{
+		K8sClient: q.k8sClient,
+		TokenStorage: &tokenstorage.NotifyingTokenStorage{
+			Client:       q.k8sClient,
+			TokenStorage: q.storage,
+		},
+		ArtifactStorage: artifacts,
+	}
+
+	token := entry.Token.WithExtra(entry.Extra)
+	exchange := &exchangeResult{
+		token:               token,
+		authorizationHeader: entry.AuthorizationHeader,
+		restricted:          entry.Restricted,
+		capabilities:        entry.Capabilities,
+	}
+	exchange.TokenName = entry.TokenName
+	exchange.TokenNamespace = entry.TokenNamespace
+	exchange.Workspace = entry.Workspace
+	exchange.Scopes = entry.Scopes
+	exchange.Automation = entry.Automation
+
+	return c.syncTokenData(ctx, exchange)
+}
+
+func (q *StorageRetryQueue) publish(eventType FlowEventType, entry *queuedToken, err error) {
+	if q.Events == nil {
+		return
+	}
+	c := commonController{
+		Config:     config.ServiceProviderConfiguration{ServiceProviderType: entry.ServiceProvider},
+		Events:     q.Events,
+		Identities: q.Identities,
+	}
+	c.publishFlowEvent(eventType, oauthstate.AnonymousOAuthState{
+		TokenName:      entry.TokenName,
+		TokenNamespace: entry.TokenNamespace,
+		Scopes:         entry.Scopes,
+	}, entry.Workspace, c.userIdentity(context.Background(), entry.AuthorizationHeader), err)
+}
+
+// files lists the files of the queue in the order the tokens were queued in.
+func (q *StorageRetryQueue) files() ([]string, error) {
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), storageRetryFileSuffix) {
+			files = append(files, filepath.Join(q.dir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (q *StorageRetryQueue) read(file string) (*queuedToken, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := q.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("the queued token is truncated")
+	}
+	plain, err := q.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the queued token, has the shared secret changed?: %w", err)
+	}
+
+	entry := &queuedToken{}
+	if err = json.Unmarshal(plain, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (q *StorageRetryQueue) remove(file string) {
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		zap.L().Error("failed to remove the file from the storage retry queue", zap.String("file", file), zap.Error(err))
+	}
+}
+
+// isPermanentStorageError checks whether storing the token data failed for a reason that retrying cannot fix, like
+// the user not having the permissions or the SPIAccessToken not existing.
+func isPermanentStorageError(err error) bool {
+	return kerrors.IsUnauthorized(err) || kerrors.IsForbidden(err) || kerrors.IsNotFound(err) || kerrors.IsInvalid(err) || kerrors.IsBadRequest(err)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func queuedExchange(tokenName string) *exchangeResult {
+	exchange := &exchangeResult{
+		token:               (&oauth2.Token{AccessToken: "the-access-token", RefreshToken: "the-refresh-token"}).WithExtra(map[string]interface{}{"id_token": "the-id-token"}),
+		authorizationHeader: "kachny",
+	}
+	exchange.TokenName = tokenName
+	exchange.TokenNamespace = "default"
+	exchange.Scopes = []string{"repo"}
+	return exchange
+}
+
+func TestStorageRetryQueue(t *testing.T) {
+	dir := t.TempDir()
+
+	stored := map[string]*v1beta1.Token{}
+	storageErr := errors.New("the storage is down")
+	c := testController("", nil, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	storage := testTokenStorage{
+		StoreImpl: func(_ context.Context, owner *v1beta1.SPIAccessToken, token *v1beta1.Token) error {
+			if storageErr != nil {
+				return storageErr
+			}
+			stored[owner.Namespace+"/"+owner.Name] = token
+			return nil
+		},
+	}
+
+	q, err := NewStorageRetryQueue(dir, []byte("secret"), 0, 0)
+	assert.NoError(t, err)
+	publisher := &recordingPublisher{}
+	q.Events = publisher
+	q.SetStorage(c.K8sClient, storage)
+
+	assert.NoError(t, q.enqueue(config.ServiceProviderTypeGitHub, queuedExchange("token")))
+	assert.Equal(t, 1, q.Len())
+
+	// the queued data must not be readable without the key
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+storageRetryFileSuffix))
+	assert.Len(t, files, 1)
+	data, err := ioutil.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "the-access-token")
+	assert.NotContains(t, string(data), "kachny")
+
+	// the storage still fails
+	q.Retry(context.TODO())
+	assert.Equal(t, 1, q.Len())
+	assert.Empty(t, publisher.events)
+
+	// the queue survives the restart as long as the shared secret is the same
+	q, err = NewStorageRetryQueue(dir, []byte("secret"), 0, 0)
+	assert.NoError(t, err)
+	q.Events = publisher
+	q.SetStorage(c.K8sClient, storage)
+
+	storageErr = nil
+	q.Retry(context.TODO())
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, "the-access-token", stored["default/token"].AccessToken)
+	assert.Equal(t, "the-refresh-token", stored["default/token"].RefreshToken)
+	assert.Len(t, publisher.events, 1)
+	assert.Equal(t, TokenStoredEvent, publisher.events[0].Type)
+	assert.Equal(t, config.ServiceProviderTypeGitHub, publisher.events[0].ServiceProvider)
+}
+
+func TestStorageRetryQueue_GivingUp(t *testing.T) {
+	c := testController("", nil, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	storage := testTokenStorage{
+		StoreImpl: func(context.Context, *v1beta1.SPIAccessToken, *v1beta1.Token) error {
+			return errors.New("the storage is down")
+		},
+	}
+
+	newQueue := func(dir string, secret string) (*StorageRetryQueue, *recordingPublisher) {
+		q, err := NewStorageRetryQueue(dir, []byte(secret), time.Minute, time.Hour)
+		assert.NoError(t, err)
+		publisher := &recordingPublisher{}
+		q.Events = publisher
+		q.SetStorage(c.K8sClient, storage)
+		return q, publisher
+	}
+
+	t.Run("token not found", func(t *testing.T) {
+		q, publisher := newQueue(t.TempDir(), "secret")
+		assert.NoError(t, q.enqueue(config.ServiceProviderTypeGitHub, queuedExchange("missing")))
+
+		q.Retry(context.TODO())
+		assert.Equal(t, 0, q.Len())
+		assert.Len(t, publisher.events, 1)
+		assert.Equal(t, StorageFailedEvent, publisher.events[0].Type)
+	})
+
+	t.Run("too old", func(t *testing.T) {
+		q, publisher := newQueue(t.TempDir(), "secret")
+		assert.NoError(t, q.enqueue(config.ServiceProviderTypeGitHub, queuedExchange("token")))
+
+		q.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		q.Retry(context.TODO())
+		assert.Equal(t, 0, q.Len())
+		assert.Len(t, publisher.events, 1)
+		assert.Equal(t, StorageFailedEvent, publisher.events[0].Type)
+	})
+
+	t.Run("changed shared secret", func(t *testing.T) {
+		dir := t.TempDir()
+		q, _ := newQueue(dir, "secret")
+		assert.NoError(t, q.enqueue(config.ServiceProviderTypeGitHub, queuedExchange("token")))
+
+		q, _ = newQueue(dir, "other-secret")
+		q.Retry(context.TODO())
+		assert.Equal(t, 0, q.Len())
+	})
+}
+
+func TestNewStorageRetryQueue(t *testing.T) {
+	_, err := NewStorageRetryQueue(t.TempDir(), nil, 0, 0)
+	assert.Error(t, err)
+
+	dir := filepath.Join(t.TempDir(), "queue")
+	q, err := NewStorageRetryQueue(dir, []byte("secret"), 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultStorageRetryInterval, q.interval)
+	assert.Equal(t, DefaultStorageRetryMaxAge, q.maxAge)
+
+	info, err := os.Stat(dir)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestQueueTokenData(t *testing.T) {
+	q, err := NewStorageRetryQueue(t.TempDir(), []byte("secret"), 0, 0)
+	assert.NoError(t, err)
+	c := commonController{
+		Config:         config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		BaseUrl:        "https://spi",
+		StorageRetries: q,
+	}
+
+	assert.False(t, commonController{}.queueTokenData(context.TODO(), queuedExchange("token"), errors.New("the storage is down")))
+	assert.False(t, c.queueTokenData(context.TODO(), queuedExchange("token"), kerrors.NewForbidden(schema.GroupResource{}, "token", errors.New("forbidden"))))
+	assert.Equal(t, 0, q.Len())
+
+	exchange := queuedExchange("token")
+	assert.True(t, c.queueTokenData(context.TODO(), exchange, errors.New("the storage is down")))
+	assert.Equal(t, 1, q.Len())
+
+	t.Run("redirect", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		c.writeCallbackPending(res, httptest.NewRequest("GET", "/github/callback", nil), exchange)
+		assert.Equal(t, http.StatusFound, res.Code)
+		assert.Equal(t, "https://spi/callback_success?pending=true", res.Header().Get("Location"))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		exchange.ResponseMode = responseModeJson
+		res := httptest.NewRecorder()
+		c.writeCallbackPending(res, httptest.NewRequest("GET", "/github/callback", nil), exchange)
+		assert.Equal(t, http.StatusAccepted, res.Code)
+		assert.Contains(t, res.Body.String(), `"result":"pending"`)
+	})
+}
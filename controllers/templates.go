@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// The names of the HTML templates used by the service.
+const (
+	RedirectNoticeTemplate  = "redirect_notice.html"
+	CallbackSuccessTemplate = "callback_success.html"
+	CallbackErrorTemplate   = "callback_error.html"
+	ConsentPreviewTemplate  = "consent_preview.html"
+)
+
+// CallbackSuccessPageData is the data rendered by the callback success template.
+type CallbackSuccessPageData struct {
+	// Pending is true if the token data couldn't be stored yet and has been queued to be stored later.
+	Pending bool
+}
+
+// Templates holds the HTML templates of the service parsed from the files in a directory. The templates can be
+// reloaded when the files change, e.g. when the directory is a mounted ConfigMap, so that fixes in the texts don't
+// require a new rollout.
+//
+// The templates can use the `path` function to construct the links to the endpoints of the service, e.g.
+// `{{ path "/callback_success" }}`, so that the links respect the path prefix the service is exposed under. The
+// embedded static assets are linked using the `asset` and `integrity` functions (see Assets).
+type Templates struct {
+	dir        string
+	pathPrefix string
+	required   []string
+	assets     *Assets
+
+	lock sync.RWMutex
+	tmpl *template.Template
+}
+
+// LoadTemplates parses all the HTML files in the provided directory. The path prefix is used by the `path` function
+// in the templates. An error is returned if any of the required templates is not found in the directory.
+func LoadTemplates(dir string, pathPrefix string, required ...string) (*Templates, error) {
+	assets, err := DefaultAssets(pathPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the static assets: %w", err)
+	}
+
+	t := &Templates{
+		dir:        dir,
+		pathPrefix: pathPrefix,
+		required:   required,
+		assets:     assets,
+	}
+
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Reload re-parses the templates from the directory. If the parsing fails, the previously loaded templates are kept.
+func (t *Templates) Reload() error {
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"path": func(path string) string {
+			return t.pathPrefix + path
+		},
+		"asset":     t.assets.Path,
+		"integrity": t.assets.Integrity,
+	}).ParseGlob(filepath.Join(t.dir, "*.html"))
+	if err != nil {
+		return fmt.Errorf("failed to parse the templates in %s: %w", t.dir, err)
+	}
+
+	for _, name := range t.required {
+		if tmpl.Lookup(name) == nil {
+			return fmt.Errorf("the required template %s not found in %s", name, t.dir)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tmpl = tmpl
+
+	return nil
+}
+
+// Assets returns the static assets the templates link to.
+func (t *Templates) Assets() *Assets {
+	return t.assets
+}
+
+// Execute renders the template with the provided name into the writer.
+func (t *Templates) Execute(w io.Writer, name string, data interface{}) error {
+	t.lock.RLock()
+	tmpl := t.tmpl
+	t.lock.RUnlock()
+
+	return tmpl.ExecuteTemplate(w, name, data)
+}
+
+// Watch starts watching the template directory for changes and reloads the templates when a change is detected.
+// The watching stops when the provided context is cancelled. The call doesn't block.
+func (t *Templates) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// we're watching the directory instead of the individual files because the mounted ConfigMaps are updated by
+	// atomically swapping a symlink in the directory.
+	if err = watcher.Add(t.dir); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer func() {
+			_ = watcher.Close()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if err := t.Reload(); err != nil {
+					zap.L().Error("failed to reload the changed templates, keeping the last good ones", zap.Error(err))
+				} else {
+					zap.L().Info("templates reloaded", zap.String("dir", t.dir))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zap.L().Error("error watching the templates directory", zap.String("dir", t.dir), zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTemplates(t *testing.T) {
+	templates, err := LoadTemplates("../static", "", RedirectNoticeTemplate, CallbackSuccessTemplate, CallbackErrorTemplate)
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, templates.Execute(buf, RedirectNoticeTemplate, map[string]string{"Url": "https://special.sp"}))
+	assert.Contains(t, buf.String(), "https://special.sp")
+
+	_, err = LoadTemplates("../static", "", "non-existent.html")
+	assert.Error(t, err)
+}
+
+func TestTemplatesAssets(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "test.html", `<link rel="stylesheet" href="{{ asset "spi.css" }}" integrity="{{ integrity "spi.css" }}"/>`)
+	writeTemplate(t, dir, "broken.html", `<img src="{{ asset "missing.svg" }}"/>`)
+
+	templates, err := LoadTemplates(dir, "/spi", "test.html")
+	assert.NoError(t, err)
+
+	cssPath, _ := templates.Assets().Path("spi.css")
+	integrity, _ := templates.Assets().Integrity("spi.css")
+	assert.True(t, strings.HasPrefix(cssPath, "/spi/assets/spi."))
+	assert.Equal(t, `<link rel="stylesheet" href="`+cssPath+`" integrity="`+integrity+`"/>`, render(t, templates, "test.html"))
+
+	assert.Error(t, templates.Execute(&bytes.Buffer{}, "broken.html", nil))
+}
+
+func TestTemplatesReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "test.html", "version 1")
+
+	templates, err := LoadTemplates(dir, "", "test.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 1", render(t, templates, "test.html"))
+
+	// the broken template is not applied
+	writeTemplate(t, dir, "test.html", "{{ .Broken")
+	assert.Error(t, templates.Reload())
+	assert.Equal(t, "version 1", render(t, templates, "test.html"))
+
+	writeTemplate(t, dir, "test.html", "version 2")
+	assert.NoError(t, templates.Reload())
+	assert.Equal(t, "version 2", render(t, templates, "test.html"))
+}
+
+func TestTemplatesWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "test.html", "version 1")
+
+	templates, err := LoadTemplates(dir, "", "test.html")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	assert.NoError(t, templates.Watch(ctx))
+
+	writeTemplate(t, dir, "test.html", "version 2")
+
+	assert.Eventually(t, func() bool {
+		return render(t, templates, "test.html") == "version 2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func writeTemplate(t *testing.T, dir string, name string, content string) {
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+}
+
+func render(t *testing.T, templates *Templates, name string) string {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, templates.Execute(buf, name, nil))
+	return buf.String()
+}
+
+func TestTemplatesPathFunction(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "test.html", `<a href="{{ path "/callback_success" }}">`)
+
+	templates, err := LoadTemplates(dir, "/api/spi-oauth", "test.html")
+	assert.NoError(t, err)
+	assert.Equal(t, `<a href="/api/spi-oauth/callback_success">`, render(t, templates, "test.html"))
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	authz "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeRoundTrip casts a function into a http.RoundTripper
+type fakeRoundTrip func(r *http.Request) (*http.Response, error)
+
+var _ http.RoundTripper = fakeRoundTrip(nil)
+
+func (f fakeRoundTrip) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// reviewClient answers the self subject access reviews instead of sending them to the cluster and records the
+// reviewed specs. The reviews fail with err if it is set. Any other object is created using the wrapped client.
+type reviewClient struct {
+	client.Client
+	allowed bool
+	err     error
+
+	lock    sync.Mutex
+	reviews []authz.SelfSubjectAccessReviewSpec
+}
+
+var _ AuthenticatingClient = (*reviewClient)(nil)
+
+func (c *reviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	review, ok := obj.(*authz.SelfSubjectAccessReview)
+	if !ok {
+		return c.Client.Create(ctx, obj, opts...)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reviews = append(c.reviews, review.Spec)
+	if c.err != nil {
+		return c.err
+	}
+	review.Status.Allowed = c.allowed
+	return nil
+}
+
+// resourceAttributes returns the resource attributes of the recorded reviews.
+func (c *reviewClient) resourceAttributes() []authz.ResourceAttributes {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var attributes []authz.ResourceAttributes
+	for _, spec := range c.reviews {
+		if spec.ResourceAttributes != nil {
+			attributes = append(attributes, *spec.ResourceAttributes)
+		}
+	}
+	return attributes
+}
+
+// nonResourceAttributes returns the non-resource attributes of the recorded reviews.
+func (c *reviewClient) nonResourceAttributes() []authz.NonResourceAttributes {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var attributes []authz.NonResourceAttributes
+	for _, spec := range c.reviews {
+		if spec.NonResourceAttributes != nil {
+			attributes = append(attributes, *spec.NonResourceAttributes)
+		}
+	}
+	return attributes
+}
+
+// reviewCount returns the number of the recorded reviews.
+func (c *reviewClient) reviewCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.reviews)
+}
+
+// testArtifactStorage keeps only the access token artifacts, keyed by the namespace and the name of the token.
+type testArtifactStorage map[string]*oauthstorage.Artifact
+
+func (s testArtifactStorage) StoreArtifacts(_ context.Context, owner *v1beta1.SPIAccessToken, artifacts oauthstorage.Artifacts) error {
+	if artifact, ok := artifacts[oauthstorage.AccessTokenArtifact]; ok {
+		s[owner.Namespace+"/"+owner.Name] = &artifact
+	}
+	return nil
+}
+
+func (s testArtifactStorage) GetArtifact(_ context.Context, owner *v1beta1.SPIAccessToken, kind oauthstorage.ArtifactKind) (*oauthstorage.Artifact, error) {
+	if kind != oauthstorage.AccessTokenArtifact {
+		return nil, nil
+	}
+	return s[owner.Namespace+"/"+owner.Name], nil
+}
+
+func (s testArtifactStorage) GetArtifacts(ctx context.Context, owner *v1beta1.SPIAccessToken) (oauthstorage.Artifacts, error) {
+	artifacts := oauthstorage.Artifacts{}
+	if artifact := s[owner.Namespace+"/"+owner.Name]; artifact != nil {
+		artifacts[oauthstorage.AccessTokenArtifact] = *artifact
+	}
+	return artifacts, nil
+}
+
+func (s testArtifactStorage) DeleteArtifact(_ context.Context, owner *v1beta1.SPIAccessToken, _ oauthstorage.ArtifactKind) error {
+	delete(s, owner.Namespace+"/"+owner.Name)
+	return nil
+}
+
+// testController returns the GitHub controller authorizing at GitHub and exchanging the codes and the refresh tokens
+// at the provided token endpoint. Its Kubernetes client is a reviewClient allowing all the reviews in front of the fake client holding
+// the provided objects, its token storage keeps the token data in the provided map and, if artifacts is not nil, it
+// keeps the token artifacts in it.
+func testController(tokenUrl string, data map[string]*v1beta1.Token, artifacts testArtifactStorage, objects ...client.Object) *commonController {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+
+	if data == nil {
+		data = map[string]*v1beta1.Token{}
+	}
+
+	c := &commonController{
+		Config: config.ServiceProviderConfiguration{
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			ClientId:            "client-id",
+			ClientSecret:        "client-secret",
+		},
+		K8sClient: &reviewClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(), allowed: true},
+		TokenStorage: testTokenStorage{
+			StoreImpl: func(_ context.Context, owner *v1beta1.SPIAccessToken, token *v1beta1.Token) error {
+				data[owner.Namespace+"/"+owner.Name] = token
+				return nil
+			},
+			GetImpl: func(_ context.Context, owner *v1beta1.SPIAccessToken) (*v1beta1.Token, error) {
+				return data[owner.Namespace+"/"+owner.Name], nil
+			},
+			DeleteImpl: func(_ context.Context, owner *v1beta1.SPIAccessToken) error {
+				delete(data, owner.Namespace+"/"+owner.Name)
+				return nil
+			},
+		},
+		JwtSigningSecret: []byte("secret"),
+		AuthorizedLinks:  NewAuthorizedLinks(DefaultAuthorizedLinkTtl),
+		Endpoint:         oauth2.Endpoint{AuthURL: github.Endpoint.AuthURL, TokenURL: tokenUrl, AuthStyle: oauth2.AuthStyleInHeader},
+		BaseUrl:          "https://spi",
+	}
+	if artifacts != nil {
+		c.ArtifactStorage = artifacts
+	}
+	return c
+}
+
+// testTokenStorage is the token storage calling the provided functions. The operations without a function do nothing
+// and no token is found.
+type testTokenStorage struct {
+	StoreImpl  func(context.Context, *v1beta1.SPIAccessToken, *v1beta1.Token) error
+	GetImpl    func(context.Context, *v1beta1.SPIAccessToken) (*v1beta1.Token, error)
+	DeleteImpl func(context.Context, *v1beta1.SPIAccessToken) error
+}
+
+var _ tokenstorage.TokenStorage = testTokenStorage{}
+
+func (s testTokenStorage) Store(ctx context.Context, owner *v1beta1.SPIAccessToken, token *v1beta1.Token) error {
+	if s.StoreImpl == nil {
+		return nil
+	}
+	return s.StoreImpl(ctx, owner, token)
+}
+
+func (s testTokenStorage) Get(ctx context.Context, owner *v1beta1.SPIAccessToken) (*v1beta1.Token, error) {
+	if s.GetImpl == nil {
+		return nil, nil
+	}
+	return s.GetImpl(ctx, owner)
+}
+
+func (s testTokenStorage) Delete(ctx context.Context, owner *v1beta1.SPIAccessToken) error {
+	if s.DeleteImpl == nil {
+		return nil
+	}
+	return s.DeleteImpl(ctx, owner)
+}
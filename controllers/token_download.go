@@ -0,0 +1,159 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	authz "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TokenDownloadSubresource is the subresource of the SPIAccessTokens the users need to be allowed to get in order to
+// download the stored token. It doesn't exist in the cluster, it is only used in the access reviews, so the roles
+// granting the access to the SPIAccessTokens don't grant the access to the tokens unless they grant all
+// the subresources.
+const TokenDownloadSubresource = "token"
+
+// downloadedToken is the JSON result of the token download. The refresh token is never returned.
+type downloadedToken struct {
+	Token       tokenReference `json:"token"`
+	AccessToken string         `json:"accessToken"`
+	TokenType   string         `json:"tokenType,omitempty"`
+	// Expiry is the unix time when the access token expires. Zero if it doesn't expire or the expiry is unknown.
+	Expiry       uint64   `json:"expiry,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// TokenDownloader returns the stored token of the SPIAccessToken to the users allowed to get its token subresource,
+// so that the CLI tools can use the token without the users having access to the token storage.
+type TokenDownloader struct {
+	K8sClient AuthenticatingClient
+	Storage   tokenstorage.TokenStorage
+	// Events is the optional publisher of the events about the downloaded tokens.
+	Events FlowEventPublisher
+	// Identities optionally enrich the identities of the users recorded in the events and the logs.
+	Identities IdentityEnricher
+}
+
+// Handle authorizes the request and writes the stored token as JSON. The returned error is a Kubernetes API status
+// error if the request is not authorized or there is no such SPIAccessToken or no stored token. Nothing is written if
+// an error is returned.
+func (d *TokenDownloader) Handle(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	tokenRef := tokenReference{Name: vars["name"], Namespace: vars["namespace"]}
+
+	k8sToken := ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+	if k8sToken == "" {
+		return k8serrors.NewUnauthorized("the token download request is not authenticated")
+	}
+	ctx := WithAuthIntoContext(k8sToken, r.Context())
+
+	workspace := requestParam(r, "workspace")
+	if workspace != "" {
+		if err := acceptWorkspace(workspace); err != nil {
+			return k8serrors.NewBadRequest(err.Error())
+		}
+		ctx = WithWorkspaceIntoContext(workspace, ctx)
+	}
+
+	ctx = withLoggerFields(ctx, zap.String("token", tokenRef.Name), zap.String("namespace", tokenRef.Namespace))
+
+	review := authz.SelfSubjectAccessReview{
+		Spec: authz.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authz.ResourceAttributes{
+				Namespace:   tokenRef.Namespace,
+				Verb:        "get",
+				Group:       api.GroupVersion.Group,
+				Version:     api.GroupVersion.Version,
+				Resource:    "spiaccesstokens",
+				Subresource: TokenDownloadSubresource,
+				Name:        tokenRef.Name,
+			},
+		},
+	}
+	if err := d.K8sClient.Create(ctx, &review); err != nil {
+		return err
+	}
+
+	// the cluster has authenticated the token, so only now its subject can be trusted to identify the user. The
+	// controller only resolves the identity of the user and publishes the event.
+	c := commonController{Events: d.Events, Identities: d.Identities}
+	user := c.userIdentity(ctx, k8sToken)
+	ctx = withLoggerFields(ctx, identityFields(user)...)
+
+	if !review.Status.Allowed {
+		LoggerFromContext(ctx).Info("refused to download the token", zap.String("reason", review.Status.Reason))
+		return k8serrors.NewForbidden(schema.GroupResource{Group: api.GroupVersion.Group, Resource: "spiaccesstokens/" + TokenDownloadSubresource}, tokenRef.Name, errors.New("downloading the token is not allowed"))
+	}
+
+	accessToken := &api.SPIAccessToken{}
+	if err := d.K8sClient.Get(ctx, client.ObjectKey{Name: tokenRef.Name, Namespace: tokenRef.Namespace}, accessToken); err != nil {
+		return err
+	}
+
+	token, err := d.Storage.Get(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+	if token == nil || token.AccessToken == "" {
+		return k8serrors.NewNotFound(schema.GroupResource{Group: api.GroupVersion.Group, Resource: "spiaccesstokens/" + TokenDownloadSubresource}, tokenRef.Name)
+	}
+
+	result := downloadedToken{
+		Token:       tokenRef,
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      token.Expiry,
+	}
+	if artifacts, ok := d.Storage.(oauthstorage.ArtifactStorage); ok {
+		artifact, err := artifacts.GetArtifact(ctx, accessToken, oauthstorage.AccessTokenArtifact)
+		if err != nil {
+			// the scopes are only informative, the token itself is what the caller needs
+			LoggerFromContext(ctx).Warn("failed to read the access token artifact", zap.Error(err))
+		} else if artifact != nil {
+			result.Scopes = artifact.Scopes
+			result.Capabilities = artifact.Capabilities
+		}
+	}
+
+	LoggerFromContext(ctx).Info("the token has been downloaded", zap.Bool("expired", token.Expiry != 0 && uint64(time.Now().Unix()) >= token.Expiry))
+	c.Config.ServiceProviderType = config.ServiceProviderType(accessToken.Labels[api.ServiceProviderTypeLabel])
+	c.publishFlowEvent(TokenDownloadedEvent, oauthstate.AnonymousOAuthState{
+		TokenName:      tokenRef.Name,
+		TokenNamespace: tokenRef.Namespace,
+		Scopes:         result.Scopes,
+	}, workspace, user, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		LoggerFromContext(ctx).Error("failed to write the downloaded token", zap.Error(err))
+	}
+	return nil
+}
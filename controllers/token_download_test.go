@@ -0,0 +1,182 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func serveDownload(d *TokenDownloader, authorization string, path string) (*httptest.ResponseRecorder, error) {
+	var handleErr error
+	router := mux.NewRouter()
+	router.HandleFunc("/token/{namespace}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handleErr = d.Handle(w, r)
+	}).Methods("GET")
+
+	req := httptest.NewRequest("GET", path, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res, handleErr
+}
+
+func downloadTestDownloader(allowed bool) (*TokenDownloader, *reviewClient, *recordingPublisher) {
+	c := testController("",
+		map[string]*v1beta1.Token{"default/mytoken": {AccessToken: "the-access-token", TokenType: "bearer", RefreshToken: "the-refresh-token", Expiry: 42}},
+		testArtifactStorage{"default/mytoken": {Value: "the-access-token", Scopes: []string{"repo"}, Capabilities: []string{CapabilityPush}}},
+		lookupTestToken("mytoken", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("notoken", "github.com", v1beta1.SPIAccessTokenPhaseAwaitingTokenData))
+
+	cl := c.K8sClient.(*reviewClient)
+	cl.allowed = allowed
+	publisher := &recordingPublisher{}
+	return &TokenDownloader{
+		K8sClient: cl,
+		Storage: &struct {
+			tokenstorage.TokenStorage
+			oauthstorage.ArtifactStorage
+		}{c.TokenStorage, c.ArtifactStorage},
+		Events: publisher,
+	}, cl, publisher
+}
+
+func TestTokenDownloader(t *testing.T) {
+	d, cl, publisher := downloadTestDownloader(true)
+	d.Identities = IdentityDirectory{"alice": {Email: "alice@example.com"}}
+
+	res, err := serveDownload(d, "Bearer "+subjectToken(t, "alice"), "/token/default/mytoken")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "no-store", res.Header().Get("Cache-Control"))
+	assert.NotContains(t, res.Body.String(), "the-refresh-token")
+
+	result := downloadedToken{}
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &result))
+	assert.Equal(t, downloadedToken{
+		Token:        tokenReference{Name: "mytoken", Namespace: "default"},
+		AccessToken:  "the-access-token",
+		TokenType:    "bearer",
+		Expiry:       42,
+		Scopes:       []string{"repo"},
+		Capabilities: []string{CapabilityPush},
+	}, result)
+
+	assert.Equal(t, []authz.ResourceAttributes{{
+		Namespace:   "default",
+		Verb:        "get",
+		Group:       v1beta1.GroupVersion.Group,
+		Version:     v1beta1.GroupVersion.Version,
+		Resource:    "spiaccesstokens",
+		Subresource: TokenDownloadSubresource,
+		Name:        "mytoken",
+	}}, cl.resourceAttributes())
+
+	assert.Len(t, publisher.events, 1)
+	assert.Equal(t, TokenDownloadedEvent, publisher.events[0].Type)
+	assert.Equal(t, config.ServiceProviderTypeGitHub, publisher.events[0].ServiceProvider)
+	assert.Equal(t, "mytoken", publisher.events[0].TokenName)
+	assert.Equal(t, &UserIdentity{Username: "alice", Email: "alice@example.com"}, publisher.events[0].User)
+}
+
+func TestTokenDownloaderRefused(t *testing.T) {
+	t.Run("not authenticated", func(t *testing.T) {
+		d, cl, _ := downloadTestDownloader(true)
+		res, err := serveDownload(d, "", "/token/default/mytoken")
+		assert.True(t, k8serrors.IsUnauthorized(err))
+		assert.Empty(t, res.Body.String())
+		assert.Empty(t, cl.resourceAttributes())
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		d, _, publisher := downloadTestDownloader(false)
+		res, err := serveDownload(d, "Bearer k8s-token", "/token/default/mytoken")
+		assert.True(t, k8serrors.IsForbidden(err))
+		assert.NotContains(t, res.Body.String(), "the-access-token")
+		assert.Empty(t, publisher.events)
+	})
+
+	t.Run("no such token", func(t *testing.T) {
+		d, _, _ := downloadTestDownloader(true)
+		_, err := serveDownload(d, "Bearer k8s-token", "/token/default/missing")
+		assert.True(t, k8serrors.IsNotFound(err))
+	})
+
+	t.Run("no stored token", func(t *testing.T) {
+		d, _, publisher := downloadTestDownloader(true)
+		_, err := serveDownload(d, "Bearer k8s-token", "/token/default/notoken")
+		assert.True(t, k8serrors.IsNotFound(err))
+		assert.Empty(t, publisher.events)
+	})
+
+	t.Run("invalid workspace", func(t *testing.T) {
+		d, _, _ := downloadTestDownloader(true)
+		_, err := serveDownload(d, "Bearer k8s-token", "/token/default/mytoken?workspace=not%20valid")
+		assert.True(t, k8serrors.IsBadRequest(err))
+	})
+
+	t.Run("workspace", func(t *testing.T) {
+		// the stored token could belong to the token of the same name in another workspace
+		d, cl, publisher := downloadTestDownloader(true)
+		res, err := serveDownload(d, "Bearer k8s-token", "/token/default/mytoken?workspace=root:org:ws")
+		assert.True(t, k8serrors.IsBadRequest(err))
+		assert.NotContains(t, res.Body.String(), "the-access-token")
+		assert.Empty(t, cl.resourceAttributes())
+		assert.Empty(t, publisher.events)
+	})
+
+	t.Run("not authenticated by the cluster", func(t *testing.T) {
+		// the subject of a token the cluster rejects is never trusted
+		d, cl, publisher := downloadTestDownloader(true)
+		enricher := &countingEnricher{}
+		d.Identities = enricher
+		cl.err = k8serrors.NewUnauthorized("the token is not valid")
+		_, err := serveDownload(d, "Bearer "+subjectToken(t, "alice"), "/token/default/mytoken")
+		assert.True(t, k8serrors.IsUnauthorized(err))
+		assert.Zero(t, enricher.calls)
+		assert.Empty(t, publisher.events)
+	})
+
+	t.Run("failing review", func(t *testing.T) {
+		d, _, _ := downloadTestDownloader(true)
+		d.K8sClient.(*reviewClient).err = errors.New("the API server is down")
+		_, err := serveDownload(d, "Bearer k8s-token", "/token/default/mytoken")
+		assert.Error(t, err)
+	})
+}
+
+// countingEnricher counts the identities it is asked to enrich without enriching them.
+type countingEnricher struct {
+	calls int
+}
+
+func (e *countingEnricher) Enrich(_ context.Context, _ string) (*UserIdentity, error) {
+	e.calls++
+	return nil, nil
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"go.uber.org/zap"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// TokenFingerprintLabel is the label put on the SPIAccessTokens with the fingerprint of their stored access token.
+// The SPIAccessTokens holding the same token of the service provider, e.g. because the user has run the flow for each
+// of them, have the same fingerprint, so they can be found using a label selector.
+const TokenFingerprintLabel = "spi.appstudio.redhat.com/token-fingerprint"
+
+// TokenSharedWithAnnotation is the annotation listing the other SPIAccessTokens in the namespace that had the same
+// fingerprint when the token was stored.
+const TokenSharedWithAnnotation = "spi.appstudio.redhat.com/token-shared-with"
+
+// tokenFingerprintLength is the number of the hexadecimal characters of the fingerprint kept in the label. 128 bits
+// are plenty to tell the tokens apart and fit into the limit of the label values.
+const tokenFingerprintLength = 32
+
+var sharedTokensCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "token_fingerprint",
+	Name:      "shared_total",
+	Help:      "The number of the times a token was stored that is already stored under another SPIAccessToken.",
+}, []string{"service_provider"})
+
+func init() {
+	MetricsRegistry.MustRegister(sharedTokensCounter)
+}
+
+// tokenFingerprint computes the fingerprint of the access token. The fingerprint is salted by the shared secret, so it
+// cannot be used to check a guessed token without knowing the secret.
+func tokenFingerprint(sharedSecret []byte, accessToken string) string {
+	mac := hmac.New(sha256.New, deriveKey(tokenFingerprintKeyLabel, sharedSecret))
+	mac.Write([]byte(accessToken))
+	return hex.EncodeToString(mac.Sum(nil))[:tokenFingerprintLength]
+}
+
+// recordTokenFingerprint labels the SPIAccessToken with the fingerprint of the stored access token and annotates it
+// with the other SPIAccessTokens in the namespace holding the same token. If the SPIAccessTokens cannot be listed,
+// the label is still updated so that the linkage can be found later.
+func (c commonController) recordTokenFingerprint(ctx context.Context, accessToken *v1beta1.SPIAccessToken, token string) error {
+	if token == "" {
+		return nil
+	}
+	fingerprint := tokenFingerprint(c.JwtSigningSecret, token)
+	lg := LoggerFromContext(ctx)
+
+	var sharedWith []string
+	list := &v1beta1.SPIAccessTokenList{}
+	if err := c.K8sClient.List(ctx, list, client.InNamespace(accessToken.Namespace), client.MatchingLabels{TokenFingerprintLabel: fingerprint}); err != nil {
+		lg.Debug("failed to list the SPIAccessTokens sharing the token", zap.Error(err))
+	} else {
+		for _, other := range list.Items {
+			if other.Name != accessToken.Name {
+				sharedWith = append(sharedWith, other.Name)
+			}
+		}
+		sort.Strings(sharedWith)
+	}
+
+	if len(sharedWith) > 0 {
+		lg.Info("the token is also stored under other SPIAccessTokens", zap.Strings("sharedWith", sharedWith))
+		sharedTokensCounter.WithLabelValues(string(c.Config.ServiceProviderType)).Inc()
+	}
+
+	return c.patchTokenFingerprint(ctx, accessToken, fingerprint, strings.Join(sharedWith, ","))
+}
+
+// clearTokenFingerprint removes the fingerprint metadata from the SPIAccessToken whose token data has been deleted.
+func (c commonController) clearTokenFingerprint(ctx context.Context, accessToken *v1beta1.SPIAccessToken) error {
+	return c.patchTokenFingerprint(ctx, accessToken, "", "")
+}
+
+// patchTokenFingerprint sets the fingerprint label and the annotation listing the SPIAccessTokens sharing the token,
+// removing them if empty. The SPIAccessToken is not patched if it already has them.
+func (c commonController) patchTokenFingerprint(ctx context.Context, accessToken *v1beta1.SPIAccessToken, fingerprint string, sharedWith string) error {
+	if accessToken.Labels[TokenFingerprintLabel] == fingerprint && accessToken.Annotations[TokenSharedWithAnnotation] == sharedWith {
+		return nil
+	}
+
+	patch := client.MergeFrom(accessToken.DeepCopy())
+	if fingerprint == "" {
+		delete(accessToken.Labels, TokenFingerprintLabel)
+	} else {
+		if accessToken.Labels == nil {
+			accessToken.Labels = map[string]string{}
+		}
+		accessToken.Labels[TokenFingerprintLabel] = fingerprint
+	}
+	if sharedWith == "" {
+		delete(accessToken.Annotations, TokenSharedWithAnnotation)
+	} else {
+		if accessToken.Annotations == nil {
+			accessToken.Annotations = map[string]string{}
+		}
+		accessToken.Annotations[TokenSharedWithAnnotation] = sharedWith
+	}
+
+	if err := c.K8sClient.Patch(ctx, accessToken, patch); err != nil {
+		return fmt.Errorf("failed to update the fingerprint of the token of the SPIAccessToken: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestTokenFingerprint(t *testing.T) {
+	fingerprint := tokenFingerprint([]byte("secret"), "token")
+	assert.Len(t, fingerprint, tokenFingerprintLength)
+	assert.Equal(t, fingerprint, tokenFingerprint([]byte("secret"), "token"))
+	assert.NotEqual(t, fingerprint, tokenFingerprint([]byte("secret"), "other-token"))
+	assert.NotEqual(t, fingerprint, tokenFingerprint([]byte("other-secret"), "token"))
+}
+
+func TestRecordTokenFingerprint(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+
+	token := func(name string, namespace string) *v1beta1.SPIAccessToken {
+		return &v1beta1.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	}
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		token("a", "default"), token("b", "default"), token("c", "default"), token("a", "other"),
+	).Build()
+
+	c := testController("", nil, nil, lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	c.K8sClient = cl
+	c.JwtSigningSecret = []byte("secret")
+
+	get := func(name string, namespace string) *v1beta1.SPIAccessToken {
+		obj := &v1beta1.SPIAccessToken{}
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Name: name, Namespace: namespace}, obj))
+		return obj
+	}
+	store := func(name string, namespace string, accessToken string) *v1beta1.SPIAccessToken {
+		assert.NoError(t, c.storeTokenData(context.TODO(), get(name, namespace), &oauth2.Token{AccessToken: accessToken}, nil, nil, ""))
+		return get(name, namespace)
+	}
+	fingerprint := tokenFingerprint(c.JwtSigningSecret, "shared")
+	shared := func() float64 {
+		return testutil.ToFloat64(sharedTokensCounter.WithLabelValues(string(config.ServiceProviderTypeGitHub)))
+	}
+	before := shared()
+
+	a := store("a", "default", "shared")
+	assert.Equal(t, fingerprint, a.Labels[TokenFingerprintLabel])
+	assert.NotContains(t, a.Annotations, TokenSharedWithAnnotation)
+
+	// the tokens in the other namespaces are not linked
+	assert.NotContains(t, store("a", "other", "shared").Annotations, TokenSharedWithAnnotation)
+
+	b := store("b", "default", "different")
+	assert.NotEqual(t, fingerprint, b.Labels[TokenFingerprintLabel])
+	assert.NotContains(t, b.Annotations, TokenSharedWithAnnotation)
+	assert.Equal(t, before, shared())
+
+	b = store("b", "default", "shared")
+	assert.Equal(t, fingerprint, b.Labels[TokenFingerprintLabel])
+	assert.Equal(t, "a", b.Annotations[TokenSharedWithAnnotation])
+
+	assert.Equal(t, "a,b", store("c", "default", "shared").Annotations[TokenSharedWithAnnotation])
+	assert.Equal(t, before+2, shared())
+
+	// storing a different token removes the linkage
+	b = store("b", "default", "rotated")
+	assert.NotEqual(t, fingerprint, b.Labels[TokenFingerprintLabel])
+	assert.NotContains(t, b.Annotations, TokenSharedWithAnnotation)
+
+	assert.NoError(t, c.deleteTokenData(context.TODO(), get("c", "default")))
+	c2 := get("c", "default")
+	assert.NotContains(t, c2.Labels, TokenFingerprintLabel)
+	assert.NotContains(t, c2.Annotations, TokenSharedWithAnnotation)
+}
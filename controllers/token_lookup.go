@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"go.uber.org/zap"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The error codes reported only by the token lookup. The other problems are reported using the codes of the other
+// endpoints.
+const (
+	lookupErrorStorageFailed = "token_storage_failed"
+	lookupErrorFailed        = "token_lookup_failed"
+)
+
+// lookupResult is the JSON result of the token lookup.
+type lookupResult struct {
+	Found bool            `json:"found"`
+	Token *tokenReference `json:"token,omitempty"`
+	// Scopes are the scopes granted to the found token.
+	Scopes []string `json:"scopes,omitempty"`
+	// Capabilities are the capabilities of the found token.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// ErrorCode is the reason why the lookup failed.
+	ErrorCode string `json:"errorCode,omitempty"`
+	// CorrelationId identifies the log entry with the details of the error.
+	CorrelationId string `json:"correlationId,omitempty"`
+}
+
+// Lookup lists the SPIAccessTokens of the service provider in the namespace that are for the host of the repository and
+// reports the first one (by name) whose stored token is not expired and has been granted all the required scopes and
+// capabilities. The scopes are matched against the scopes recorded when the token was obtained, falling back to the token
+// metadata maintained by the operator. The capabilities are matched against the capabilities recorded when the token was
+// obtained, falling back to the capabilities implied by the granted scopes. Only the SPIAccessTokens the caller is
+// allowed to list are considered.
+func (c commonController) Lookup(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	r = c.withRequestLogger(r)
+
+	ctx, err := WithAuthFromRequestIntoContext(r, r.Context())
+	if err != nil {
+		c.writeLookupError(w, r, http.StatusUnauthorized, callbackErrorK8sAuthRequired, "the lookup request is not authenticated", err)
+		return
+	}
+
+	if workspace := requestParam(r, "workspace"); workspace != "" {
+		if err = acceptWorkspace(workspace); err != nil {
+			c.writeLookupError(w, r, http.StatusBadRequest, refreshErrorInvalidRequest, "unsupported workspace", err)
+			return
+		}
+		ctx = WithWorkspaceIntoContext(workspace, ctx)
+	}
+
+	repositoryUrl, err := url.Parse(requestParam(r, "repository_url"))
+	if err != nil || repositoryUrl.Host == "" {
+		c.writeLookupError(w, r, http.StatusBadRequest, refreshErrorInvalidRequest, "the repository_url must be an absolute URL", err)
+		return
+	}
+	requiredScopes := parseGrantedScopes(requestParam(r, "scopes"))
+	requiredCapabilities := parseGrantedScopes(requestParam(r, "capabilities"))
+
+	tokens := &v1beta1.SPIAccessTokenList{}
+	if err = c.K8sClient.List(ctx, tokens, client.InNamespace(namespace), client.MatchingLabels{
+		v1beta1.ServiceProviderTypeLabel: string(c.Config.ServiceProviderType),
+		v1beta1.ServiceProviderHostLabel: repositoryUrl.Host,
+	}); err != nil {
+		status, errorCode := http.StatusInternalServerError, lookupErrorFailed
+		if apiStatus := kerrors.APIStatus(nil); errors.As(err, &apiStatus) && (kerrors.IsUnauthorized(err) || kerrors.IsForbidden(err)) {
+			status, errorCode = int(apiStatus.Status().Code), callbackErrorK8sAuthRequired
+		}
+		c.writeLookupError(w, r, status, errorCode, "failed to list the SPIAccessTokens", err)
+		return
+	}
+
+	sort.Slice(tokens.Items, func(i, j int) bool { return tokens.Items[i].Name < tokens.Items[j].Name })
+
+	now := time.Now()
+	for i := range tokens.Items {
+		accessToken := &tokens.Items[i]
+		scopes, capabilities, ok, err := c.usableToken(ctx, accessToken, requiredScopes, requiredCapabilities, now)
+		if err != nil {
+			c.writeLookupError(w, r, http.StatusInternalServerError, lookupErrorStorageFailed, "failed to read the stored token", err)
+			return
+		}
+		if ok {
+			c.writeJsonResult(w, r, http.StatusOK, &lookupResult{
+				Found:        true,
+				Token:        &tokenReference{Name: accessToken.Name, Namespace: accessToken.Namespace},
+				Scopes:       scopes,
+				Capabilities: capabilities,
+			})
+			return
+		}
+	}
+
+	c.writeJsonResult(w, r, http.StatusOK, &lookupResult{Found: false})
+}
+
+// writeLookupError logs the error and writes the JSON result of the lookup describing it.
+func (c commonController) writeLookupError(w http.ResponseWriter, r *http.Request, status int, errorCode string, msg string, err error) {
+	correlationId := NewCorrelationId()
+	LoggerFromContext(r.Context()).Error(msg, zap.Error(err), zap.String("errorCode", errorCode), zap.String("correlationId", correlationId))
+
+	w.Header().Set(correlationIdHeader, correlationId)
+	c.writeJsonResult(w, r, status, &lookupResult{
+		Found:         false,
+		ErrorCode:     errorCode,
+		CorrelationId: correlationId,
+	})
+}
+
+// usableToken checks whether the token data of the SPIAccessToken are stored, not expired and granted all
+// the required scopes and capabilities. The granted scopes and capabilities are returned along with the result.
+func (c commonController) usableToken(ctx context.Context, accessToken *v1beta1.SPIAccessToken, requiredScopes []string, requiredCapabilities []string, now time.Time) ([]string, []string, bool, error) {
+	if accessToken.Status.Phase == v1beta1.SPIAccessTokenPhaseInvalid || accessToken.Status.Phase == v1beta1.SPIAccessTokenPhaseError {
+		return nil, nil, false, nil
+	}
+
+	stored, err := c.TokenStorage.Get(ctx, accessToken)
+	if err != nil || stored == nil {
+		return nil, nil, false, err
+	}
+	// an expired token is still usable if it can be refreshed
+	if stored.Expiry != 0 && now.Unix() >= int64(stored.Expiry) && stored.RefreshToken == "" {
+		return nil, nil, false, nil
+	}
+
+	artifact, err := c.accessTokenArtifact(ctx, accessToken)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	granted := recordedScopes(artifact, accessToken)
+	for _, scope := range requiredScopes {
+		if !scopeGranted(scope, granted) {
+			return granted, nil, false, nil
+		}
+	}
+
+	capabilities := c.recordedCapabilities(artifact, granted)
+	for _, capability := range requiredCapabilities {
+		if !containsFold(capabilities, capability) {
+			return granted, capabilities, false, nil
+		}
+	}
+	return granted, capabilities, true, nil
+}
+
+// accessTokenArtifact returns the access token artifact recorded when the token was obtained or nil if there is none,
+// e.g. because the token storage doesn't support the artifacts.
+func (c commonController) accessTokenArtifact(ctx context.Context, accessToken *v1beta1.SPIAccessToken) (*tokenstorage.Artifact, error) {
+	if c.ArtifactStorage == nil {
+		return nil, nil
+	}
+	return c.ArtifactStorage.GetArtifact(ctx, accessToken, tokenstorage.AccessTokenArtifact)
+}
+
+// storedScopes returns the scopes granted to the stored token (see recordedScopes).
+func (c commonController) storedScopes(ctx context.Context, accessToken *v1beta1.SPIAccessToken) ([]string, error) {
+	artifact, err := c.accessTokenArtifact(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	return recordedScopes(artifact, accessToken), nil
+}
+
+// recordedScopes returns the scopes granted to the stored token. These are recorded in the access token artifact when
+// the token is obtained. The token metadata of the SPIAccessToken is used for the tokens stored without the artifacts.
+func recordedScopes(artifact *tokenstorage.Artifact, accessToken *v1beta1.SPIAccessToken) []string {
+	if artifact != nil && len(artifact.Scopes) > 0 {
+		return artifact.Scopes
+	}
+	if accessToken.Status.TokenMetadata != nil {
+		return accessToken.Status.TokenMetadata.Scopes
+	}
+	return nil
+}
+
+// recordedCapabilities returns the capabilities of the stored token. These are recorded in the access token artifact
+// when the token is obtained. The capabilities of the tokens stored without them are derived from the granted scopes.
+func (c commonController) recordedCapabilities(artifact *tokenstorage.Artifact, granted []string) []string {
+	if artifact != nil && artifact.Capabilities != nil {
+		return artifact.Capabilities
+	}
+	return capabilitiesFromScopes(c.Config.ServiceProviderType, granted)
+}
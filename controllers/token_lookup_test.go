@@ -0,0 +1,196 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func lookupTestToken(name, host string, phase v1beta1.SPIAccessTokenPhase, metadataScopes ...string) *v1beta1.SPIAccessToken {
+	token := &v1beta1.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				v1beta1.ServiceProviderTypeLabel: string(config.ServiceProviderTypeGitHub),
+				v1beta1.ServiceProviderHostLabel: host,
+			},
+		},
+		Status: v1beta1.SPIAccessTokenStatus{Phase: phase},
+	}
+	if len(metadataScopes) > 0 {
+		token.Status.TokenMetadata = &v1beta1.TokenMetadata{Scopes: metadataScopes}
+	}
+	return token
+}
+
+func serveLookup(c *commonController, authorization string, query string) (*httptest.ResponseRecorder, lookupResult) {
+	router := mux.NewRouter()
+	router.HandleFunc("/github/lookup/{namespace}", c.Lookup).Methods("GET", "POST")
+
+	req := httptest.NewRequest("GET", "/github/lookup/default?"+query, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	result := lookupResult{}
+	_ = json.Unmarshal(res.Body.Bytes(), &result)
+	return res, result
+}
+
+func TestLookup(t *testing.T) {
+	expired := uint64(time.Now().Add(-time.Hour).Unix())
+	data := map[string]*v1beta1.Token{
+		"default/a-expired":  {AccessToken: "a", Expiry: expired},
+		"default/b-narrow":   {AccessToken: "b"},
+		"default/c-wide":     {AccessToken: "c"},
+		"default/d-wide":     {AccessToken: "d"},
+		"default/e-metadata": {AccessToken: "e", Expiry: expired, RefreshToken: "refresh"},
+		"default/f-invalid":  {AccessToken: "f"},
+		"default/g-gitlab":   {AccessToken: "g"},
+	}
+	artifacts := testArtifactStorage{
+		"default/a-expired": {Scopes: []string{"repo", "user"}},
+		"default/b-narrow":  {Scopes: []string{"read:user"}},
+		"default/c-wide":    {Scopes: []string{"repo", "user"}, Capabilities: []string{CapabilityPush}},
+		"default/d-wide":    {Scopes: []string{"repo", "user"}},
+		"default/f-invalid": {Scopes: []string{"repo", "user", "admin:org"}},
+		"default/g-gitlab":  {Scopes: []string{"repo", "user", "admin:org"}},
+	}
+	c := testController("", data, artifacts,
+		lookupTestToken("a-expired", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("b-narrow", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("c-wide", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("d-wide", "github.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("e-metadata", "github.com", v1beta1.SPIAccessTokenPhaseReady, "repo", "admin:org"),
+		lookupTestToken("f-invalid", "github.com", v1beta1.SPIAccessTokenPhaseInvalid),
+		lookupTestToken("g-gitlab", "gitlab.com", v1beta1.SPIAccessTokenPhaseReady),
+		lookupTestToken("h-no-data", "github.com", v1beta1.SPIAccessTokenPhaseAwaitingTokenData, "repo", "admin:org"),
+	)
+
+	t.Run("first matching by name", func(t *testing.T) {
+		res, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo&scopes=repo,read:user")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.True(t, result.Found)
+		assert.Equal(t, &tokenReference{Name: "c-wide", Namespace: "default"}, result.Token)
+		assert.Equal(t, []string{"repo", "user"}, result.Scopes)
+		assert.Equal(t, []string{CapabilityPush}, result.Capabilities)
+	})
+
+	t.Run("capabilities required", func(t *testing.T) {
+		_, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo&capabilities=push,create_webhooks")
+		assert.True(t, result.Found)
+		assert.Equal(t, "d-wide", result.Token.Name)
+		assert.Equal(t, []string{CapabilityPush, CapabilityReadPrivate, CapabilityCreateWebhooks}, result.Capabilities)
+	})
+
+	t.Run("no scopes required", func(t *testing.T) {
+		_, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo")
+		assert.True(t, result.Found)
+		assert.Equal(t, "b-narrow", result.Token.Name)
+	})
+
+	t.Run("scopes from the token metadata", func(t *testing.T) {
+		_, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo&scopes=write:org")
+		assert.True(t, result.Found)
+		assert.Equal(t, "e-metadata", result.Token.Name)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		res, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo&scopes=delete_repo")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.False(t, result.Found)
+		assert.Nil(t, result.Token)
+	})
+
+	t.Run("different host", func(t *testing.T) {
+		_, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.example.com/org/repo")
+		assert.False(t, result.Found)
+	})
+
+	t.Run("invalid repository url", func(t *testing.T) {
+		res, result := serveLookup(c, "Bearer kachny", "repository_url=org/repo")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.False(t, result.Found)
+		assert.Equal(t, refreshErrorInvalidRequest, result.ErrorCode)
+		assert.NotEmpty(t, result.CorrelationId)
+		assert.Equal(t, result.CorrelationId, res.Header().Get(correlationIdHeader))
+	})
+
+	t.Run("workspace", func(t *testing.T) {
+		res, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo&workspace=root:org:ws")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.False(t, result.Found)
+		assert.Equal(t, refreshErrorInvalidRequest, result.ErrorCode)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		res, result := serveLookup(c, "", "repository_url=https://github.com/org/repo")
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		assert.Equal(t, callbackErrorK8sAuthRequired, result.ErrorCode)
+	})
+}
+
+// countingArtifactStorage counts the reads of the artifacts.
+type countingArtifactStorage struct {
+	testArtifactStorage
+	reads int
+}
+
+func (s *countingArtifactStorage) GetArtifact(ctx context.Context, owner *v1beta1.SPIAccessToken, kind oauthstorage.ArtifactKind) (*oauthstorage.Artifact, error) {
+	s.reads++
+	return s.testArtifactStorage.GetArtifact(ctx, owner, kind)
+}
+
+func TestLookupReadsArtifactOnce(t *testing.T) {
+	c := testController("", map[string]*v1beta1.Token{"default/token": {AccessToken: "token"}}, nil,
+		lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	artifacts := &countingArtifactStorage{testArtifactStorage: testArtifactStorage{"default/token": {Scopes: []string{"repo"}}}}
+	c.ArtifactStorage = artifacts
+
+	_, result := serveLookup(c, "Bearer kachny", "repository_url=https://github.com/org/repo&scopes=repo&capabilities=push")
+	assert.True(t, result.Found)
+	assert.Equal(t, 1, artifacts.reads)
+}
+
+func TestStoredScopes(t *testing.T) {
+	c := testController("", nil, testArtifactStorage{"default/token": {Scopes: []string{"repo"}}})
+
+	scopes, err := c.storedScopes(context.TODO(), lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady, "user"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"repo"}, scopes)
+
+	scopes, err = c.storedScopes(context.TODO(), lookupTestToken("other", "github.com", v1beta1.SPIAccessTokenPhaseReady, "user"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user"}, scopes)
+
+	c.ArtifactStorage = nil
+	scopes, err = c.storedScopes(context.TODO(), lookupTestToken("token", "github.com", v1beta1.SPIAccessTokenPhaseReady))
+	assert.NoError(t, err)
+	assert.Empty(t, scopes)
+}
@@ -48,7 +48,7 @@ func TestTokenUploader_Handle(t *testing.T) {
 
 	strg := tokenstorage.NotifyingTokenStorage{
 		Client: cl,
-		TokenStorage: tokenstorage.TestTokenStorage{
+		TokenStorage: testTokenStorage{
 			StoreImpl: func(ctx context.Context, token *v1beta1.SPIAccessToken, data *v1beta1.Token) error {
 				return nil
 			},
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// The modes of checking the scopes granted by the service provider against the requested ones.
+const (
+	// ScopeCheckOverlap requires at least one of the requested scopes to be granted. The missing scopes are only
+	// logged. This is the default.
+	ScopeCheckOverlap = "overlap"
+	// ScopeCheckStrict requires all the requested scopes to be granted.
+	ScopeCheckStrict = "strict"
+	// ScopeCheckDisabled doesn't check the granted scopes at all.
+	ScopeCheckDisabled = "disabled"
+)
+
+// defaultTokenTypes are the token types accepted if none are configured.
+var defaultTokenTypes = []string{"bearer"}
+
+// errInvalidTokenResponse is returned when the token endpoint of the service provider responds with a token that
+// doesn't look valid. Such tokens are never stored.
+var errInvalidTokenResponse = errors.New("invalid token response")
+
+// TokenValidation configures the checks of the tokens returned from the token endpoint of the service provider.
+type TokenValidation struct {
+	// TokenTypes are the accepted values of the token_type, compared case-insensitively. Defaults to `bearer`.
+	TokenTypes []string `yaml:"tokenTypes,omitempty"`
+
+	// Scopes is the mode of checking the granted scopes against the requested ones. One of `overlap`, `strict` or
+	// `disabled`. Defaults to `overlap`.
+	Scopes string `yaml:"scopes,omitempty"`
+}
+
+func validateTokenValidation(cfg TokenValidation) error {
+	switch cfg.Scopes {
+	case "", ScopeCheckOverlap, ScopeCheckStrict, ScopeCheckDisabled:
+	default:
+		return fmt.Errorf("unsupported scope check mode '%s'", cfg.Scopes)
+	}
+	for _, tokenType := range cfg.TokenTypes {
+		if strings.TrimSpace(tokenType) == "" {
+			return fmt.Errorf("the accepted token types cannot be empty")
+		}
+	}
+	return nil
+}
+
+// validateToken checks that the token obtained from the service provider contains an access token of an accepted
+// type and that the granted scopes are plausible given the requested ones. Some service providers respond with
+// a success and an empty or otherwise broken token on partial errors. The scopes are not checked if no scopes are
+// requested or if the service provider doesn't report the granted scopes, in which case they are the same as
+// the requested ones (RFC 6749, section 5.1).
+func (v TokenValidation) validateToken(ctx context.Context, token *oauth2.Token, requestedScopes []string) error {
+	if token == nil || strings.TrimSpace(token.AccessToken) == "" {
+		return fmt.Errorf("%w: no access token", errInvalidTokenResponse)
+	}
+
+	tokenTypes := v.TokenTypes
+	if len(tokenTypes) == 0 {
+		tokenTypes = defaultTokenTypes
+	}
+	if !containsFold(tokenTypes, token.TokenType) {
+		return fmt.Errorf("%w: unexpected token type '%s'", errInvalidTokenResponse, token.TokenType)
+	}
+
+	if v.Scopes == ScopeCheckDisabled || len(requestedScopes) == 0 {
+		return nil
+	}
+	grantedValue, _ := token.Extra("scope").(string)
+	granted := parseGrantedScopes(grantedValue)
+	if len(granted) == 0 {
+		return nil
+	}
+
+	var missing []string
+	for _, requested := range requestedScopes {
+		if !scopeGranted(requested, granted) {
+			missing = append(missing, requested)
+		}
+	}
+
+	switch {
+	case len(missing) == 0:
+		return nil
+	case v.Scopes == ScopeCheckStrict:
+		return fmt.Errorf("%w: the requested scopes %v were not granted", errInvalidTokenResponse, missing)
+	case len(missing) == len(requestedScopes):
+		return fmt.Errorf("%w: none of the requested scopes %v were granted, the granted scopes are %v", errInvalidTokenResponse, requestedScopes, granted)
+	default:
+		LoggerFromContext(ctx).Warn("some of the requested scopes were not granted", zap.Strings("missing", missing), zap.Strings("granted", granted))
+		return nil
+	}
+}
+
+// parseGrantedScopes parses the scope field of the token response. The scopes are separated by spaces (RFC 6749,
+// section 3.3), but some service providers (e.g. GitHub) separate them by commas.
+func parseGrantedScopes(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// impliedScopes lists the scopes that are implied by the broader scopes, e.g. GitHub grants `repo` when `public_repo`
+// is requested and the user already granted `repo` before.
+var impliedScopes = map[string][]string{
+	"repo": {"repo:status", "repo_deployment", "public_repo", "repo:invite", "security_events"},
+	"user": {"read:user", "user:email", "user:follow"},
+}
+
+// scopeGranted checks whether the requested scope is covered by the granted scopes, either directly or by a broader
+// scope. Besides the explicitly listed ones, `admin:x` implies `write:x` which implies `read:x`. The same holds for
+// `x:admin`, `x:write` and `x:read`.
+func scopeGranted(requested string, granted []string) bool {
+	for _, g := range granted {
+		if g == requested || containsFold(impliedScopes[g], requested) || scopeLevelImplies(g, requested) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeLevels are the levels of access of the scopes from the most to the least privileged.
+var scopeLevels = []string{"admin", "write", "read"}
+
+func scopeLevelImplies(granted string, requested string) bool {
+	split := func(scope string) (level int, resource string, prefix bool) {
+		for i, l := range scopeLevels {
+			if strings.HasPrefix(scope, l+":") {
+				return i, scope[len(l)+1:], true
+			}
+			if strings.HasSuffix(scope, ":"+l) {
+				return i, scope[:len(scope)-len(l)-1], false
+			}
+		}
+		return -1, "", false
+	}
+
+	grantedLevel, grantedResource, grantedPrefix := split(granted)
+	requestedLevel, requestedResource, requestedPrefix := split(requested)
+	return grantedLevel >= 0 && requestedLevel >= 0 &&
+		grantedResource == requestedResource && grantedPrefix == requestedPrefix &&
+		grantedLevel <= requestedLevel
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestValidateToken(t *testing.T) {
+	token := func(accessToken, tokenType, scope string) *oauth2.Token {
+		tkn := &oauth2.Token{AccessToken: accessToken, TokenType: tokenType}
+		if scope != "" {
+			tkn = tkn.WithExtra(map[string]interface{}{"scope": scope})
+		}
+		return tkn
+	}
+	invalid := func(t *testing.T, err error) {
+		assert.Error(t, err)
+		assert.True(t, errors.Is(err, errInvalidTokenResponse))
+	}
+
+	v := TokenValidation{}
+
+	assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", ""), []string{"repo"}))
+	assert.NoError(t, v.validateToken(context.TODO(), token("abc", "Bearer", "repo"), []string{"repo"}))
+	invalid(t, v.validateToken(context.TODO(), nil, nil))
+	invalid(t, v.validateToken(context.TODO(), token("", "bearer", ""), nil))
+	invalid(t, v.validateToken(context.TODO(), token("  ", "bearer", ""), nil))
+	invalid(t, v.validateToken(context.TODO(), token("abc", "", ""), nil))
+	invalid(t, v.validateToken(context.TODO(), token("abc", "mac", ""), nil))
+
+	t.Run("token types", func(t *testing.T) {
+		v := TokenValidation{TokenTypes: []string{"bearer", "DPoP"}}
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "dpop", ""), nil))
+		invalid(t, v.validateToken(context.TODO(), token("abc", "mac", ""), nil))
+	})
+
+	t.Run("overlapping scopes", func(t *testing.T) {
+		// GitHub separates the scopes by commas
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "repo,user"), []string{"repo", "user"}))
+		// the user can deselect some scopes
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "repo"), []string{"repo", "user"}))
+		// the broader scopes already granted before
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "repo"), []string{"public_repo"}))
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "admin:org"), []string{"read:org"}))
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "repo:admin"), []string{"repo:read"}))
+		invalid(t, v.validateToken(context.TODO(), token("abc", "bearer", "read:org"), []string{"admin:org"}))
+		invalid(t, v.validateToken(context.TODO(), token("abc", "bearer", "gist notifications"), []string{"repo", "user"}))
+	})
+
+	t.Run("strict scopes", func(t *testing.T) {
+		v := TokenValidation{Scopes: ScopeCheckStrict}
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "repo user gist"), []string{"repo", "user"}))
+		invalid(t, v.validateToken(context.TODO(), token("abc", "bearer", "repo"), []string{"repo", "user"}))
+	})
+
+	t.Run("disabled scope check", func(t *testing.T) {
+		v := TokenValidation{Scopes: ScopeCheckDisabled}
+		assert.NoError(t, v.validateToken(context.TODO(), token("abc", "bearer", "gist"), []string{"repo"}))
+		invalid(t, v.validateToken(context.TODO(), token("", "bearer", "gist"), []string{"repo"}))
+	})
+}
+
+func TestValidateTokenValidation(t *testing.T) {
+	assert.NoError(t, validateTokenValidation(TokenValidation{}))
+	assert.NoError(t, validateTokenValidation(TokenValidation{Scopes: ScopeCheckStrict, TokenTypes: []string{"bearer"}}))
+	assert.Error(t, validateTokenValidation(TokenValidation{Scopes: "lenient"}))
+	assert.Error(t, validateTokenValidation(TokenValidation{TokenTypes: []string{" "}}))
+}
+
+func TestScopeGranted(t *testing.T) {
+	assert.True(t, scopeGranted("repo", []string{"repo"}))
+	assert.True(t, scopeGranted("user:email", []string{"user"}))
+	assert.True(t, scopeGranted("read:packages", []string{"write:packages"}))
+	assert.False(t, scopeGranted("write:packages", []string{"read:packages"}))
+	assert.False(t, scopeGranted("read:org", []string{"admin:repo_hook"}))
+	assert.False(t, scopeGranted("repo", []string{"public_repo"}))
+}
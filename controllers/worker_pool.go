@@ -0,0 +1,217 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultWorkerQueueSize is the default number of the requests that can wait for a worker of a single stage.
+	DefaultWorkerQueueSize = 100
+
+	// DefaultWorkerQueueTimeout is the default maximum time a request waits for a worker of a single stage.
+	DefaultWorkerQueueTimeout = 10 * time.Second
+)
+
+// WorkerStage is a stage of the processing of the callbacks that has its own limit of the concurrent work.
+type WorkerStage string
+
+const (
+	// WorkerStageKubernetes covers the requests to the Kubernetes API server.
+	WorkerStageKubernetes WorkerStage = "kubernetes"
+	// WorkerStageExchange covers the token exchanges with the service providers.
+	WorkerStageExchange WorkerStage = "exchange"
+	// WorkerStageStorage covers the writes to the token storage.
+	WorkerStageStorage WorkerStage = "storage"
+)
+
+// The reasons of rejecting the requests waiting for a worker used as the label of the rejected requests metric.
+const (
+	workerRejectedQueueFull = "queue_full"
+	workerRejectedTimeout   = "timeout"
+)
+
+// ErrOverloaded is returned when a request doesn't get a free worker of a stage in time or when too many requests
+// already wait for one. Retrying the request later may succeed.
+var ErrOverloaded = errors.New("the service is overloaded")
+
+var (
+	workerPoolWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worker_pool",
+		Name:      "workers",
+		Help:      "The maximum number of the concurrent requests of the stage of the callback processing.",
+	}, []string{"stage"})
+	workerPoolBusyWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worker_pool",
+		Name:      "busy_workers",
+		Help:      "The number of the requests of the stage of the callback processing that are in progress.",
+	}, []string{"stage"})
+	workerPoolQueuedRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worker_pool",
+		Name:      "queued_requests",
+		Help:      "The number of the requests waiting for a free worker of the stage of the callback processing.",
+	}, []string{"stage"})
+	workerPoolQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worker_pool",
+		Name:      "queue_wait_seconds",
+		Help:      "The time the requests waited for a free worker of the stage of the callback processing.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"stage"})
+	workerPoolRejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "worker_pool",
+		Name:      "rejected_requests_total",
+		Help:      "The number of the requests that didn't get a worker of the stage of the callback processing, by the reason.",
+	}, []string{"stage", "reason"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(workerPoolWorkers, workerPoolBusyWorkers, workerPoolQueuedRequests, workerPoolQueueWait, workerPoolRejectedRequests)
+}
+
+// WorkerPoolOptions configure the limits of the WorkerPool.
+type WorkerPoolOptions struct {
+	// Workers are the maximum numbers of the concurrent requests of the stages. The stages that are not listed or have
+	// a non-positive limit are not limited.
+	Workers map[WorkerStage]int
+	// QueueSize is the maximum number of the requests waiting for a worker of a single stage. The requests over
+	// the limit are rejected right away. Defaults to DefaultWorkerQueueSize.
+	QueueSize int
+	// QueueTimeout is the maximum time a request waits for a worker of a single stage. Defaults to
+	// DefaultWorkerQueueTimeout.
+	QueueTimeout time.Duration
+}
+
+// WorkerPool limits the number of the concurrent requests in the stages of the callback processing, so that a burst
+// of the callbacks doesn't pile up the goroutines and overload the Kubernetes API server, the service providers and
+// the token storage. The requests over the limit wait in a bounded queue for a free worker and are rejected with
+// ErrOverloaded if the queue is full or they don't get a worker in time. A nil pool doesn't limit anything.
+type WorkerPool struct {
+	stages map[WorkerStage]*workerStage
+}
+
+// workerStage holds the workers of a single stage. The workers are the slots in the buffered channel.
+type workerStage struct {
+	name         WorkerStage
+	slots        chan struct{}
+	queueSize    int
+	queueTimeout time.Duration
+
+	lock   sync.Mutex
+	queued int
+}
+
+// NewWorkerPool creates the pool with the provided limits.
+func NewWorkerPool(opts WorkerPoolOptions) *WorkerPool {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultWorkerQueueSize
+	}
+	if opts.QueueTimeout <= 0 {
+		opts.QueueTimeout = DefaultWorkerQueueTimeout
+	}
+
+	pool := &WorkerPool{stages: map[WorkerStage]*workerStage{}}
+	for stage, workers := range opts.Workers {
+		if workers <= 0 {
+			continue
+		}
+		pool.stages[stage] = &workerStage{
+			name:         stage,
+			slots:        make(chan struct{}, workers),
+			queueSize:    opts.QueueSize,
+			queueTimeout: opts.QueueTimeout,
+		}
+		workerPoolWorkers.WithLabelValues(string(stage)).Set(float64(workers))
+	}
+	return pool
+}
+
+// run performs the work once a worker of the stage is free. The error of the work is returned as is.
+func (p *WorkerPool) run(ctx context.Context, stage WorkerStage, work func(ctx context.Context) error) error {
+	if p == nil || p.stages[stage] == nil {
+		return work(ctx)
+	}
+
+	s := p.stages[stage]
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+
+	return work(ctx)
+}
+
+func (s *workerStage) acquire(ctx context.Context) error {
+	start := time.Now()
+
+	// the fast path without touching the queue
+	select {
+	case s.slots <- struct{}{}:
+		s.acquired(start)
+		return nil
+	default:
+	}
+
+	s.lock.Lock()
+	if s.queued >= s.queueSize {
+		s.lock.Unlock()
+		workerPoolRejectedRequests.WithLabelValues(string(s.name), workerRejectedQueueFull).Inc()
+		return fmt.Errorf("%w: too many requests wait for a free %s worker", ErrOverloaded, s.name)
+	}
+	s.queued++
+	s.lock.Unlock()
+	workerPoolQueuedRequests.WithLabelValues(string(s.name)).Inc()
+
+	defer func() {
+		s.lock.Lock()
+		s.queued--
+		s.lock.Unlock()
+		workerPoolQueuedRequests.WithLabelValues(string(s.name)).Dec()
+	}()
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		s.acquired(start)
+		return nil
+	case <-timer.C:
+		workerPoolRejectedRequests.WithLabelValues(string(s.name), workerRejectedTimeout).Inc()
+		return fmt.Errorf("%w: no %s worker got free in %s", ErrOverloaded, s.name, s.queueTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *workerStage) acquired(start time.Time) {
+	workerPoolQueueWait.WithLabelValues(string(s.name)).Observe(time.Since(start).Seconds())
+	workerPoolBusyWorkers.WithLabelValues(string(s.name)).Inc()
+}
+
+func (s *workerStage) release() {
+	workerPoolBusyWorkers.WithLabelValues(string(s.name)).Dec()
+	<-s.slots
+}
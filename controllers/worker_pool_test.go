@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilWorkerPool(t *testing.T) {
+	var pool *WorkerPool
+	called := false
+	assert.NoError(t, pool.run(context.TODO(), WorkerStageExchange, func(ctx context.Context) error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+}
+
+func TestWorkerPoolUnlimitedStage(t *testing.T) {
+	pool := NewWorkerPool(WorkerPoolOptions{Workers: map[WorkerStage]int{WorkerStageExchange: 1, WorkerStageStorage: 0}})
+
+	// the unlimited stage doesn't wait even if called from within a busy limited stage
+	err := pool.run(context.TODO(), WorkerStageExchange, func(ctx context.Context) error {
+		return pool.run(ctx, WorkerStageStorage, func(ctx context.Context) error {
+			return pool.run(ctx, WorkerStageKubernetes, func(ctx context.Context) error {
+				return errors.New("work failed")
+			})
+		})
+	})
+	assert.EqualError(t, err, "work failed")
+}
+
+func TestWorkerPoolLimitsConcurrency(t *testing.T) {
+	pool := NewWorkerPool(WorkerPoolOptions{Workers: map[WorkerStage]int{WorkerStageExchange: 2}})
+
+	lock := sync.Mutex{}
+	running, maxRunning := 0, 0
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, pool.run(context.TODO(), WorkerStageExchange, func(ctx context.Context) error {
+				lock.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				lock.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				lock.Lock()
+				running--
+				lock.Unlock()
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2, maxRunning)
+}
+
+func TestWorkerPoolRejects(t *testing.T) {
+	pool := NewWorkerPool(WorkerPoolOptions{
+		Workers:      map[WorkerStage]int{WorkerStageStorage: 1},
+		QueueSize:    1,
+		QueueTimeout: 50 * time.Millisecond,
+	})
+
+	busy := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = pool.run(context.TODO(), WorkerStageStorage, func(ctx context.Context) error {
+			close(busy)
+			<-done
+			return nil
+		})
+	}()
+	<-busy
+	defer close(done)
+
+	queued := make(chan error)
+	go func() {
+		queued <- pool.run(context.TODO(), WorkerStageStorage, func(ctx context.Context) error { return nil })
+	}()
+
+	t.Run("queue full", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			pool.stages[WorkerStageStorage].lock.Lock()
+			defer pool.stages[WorkerStageStorage].lock.Unlock()
+			return pool.stages[WorkerStageStorage].queued == 1
+		}, time.Second, time.Millisecond)
+
+		err := pool.run(context.TODO(), WorkerStageStorage, func(ctx context.Context) error { return nil })
+		assert.True(t, errors.Is(err, ErrOverloaded))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert.True(t, errors.Is(<-queued, ErrOverloaded))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		err := pool.run(ctx, WorkerStageStorage, func(ctx context.Context) error { return nil })
+		assert.True(t, errors.Is(err, context.Canceled))
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// workspacePathPrefix is the prefix of the paths in the Kubernetes API that address a kcp logical cluster.
+const workspacePathPrefix = "/clusters/"
+
+// workspaceRegexp matches the logical cluster paths of kcp workspaces, e.g. `root:org:ws`.
+var workspaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(:[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// errWorkspaceNotSupported refuses the SPIAccessTokens in the kcp workspaces. The token storage keys the token data
+// by the namespace and the name of the SPIAccessToken only (the same way as the SPI operator reads it), so the tokens
+// of the same namespace and name in two workspaces would read and overwrite each other's data.
+var errWorkspaceNotSupported = errors.New("the kcp workspaces are not supported because the token storage doesn't record the workspaces of the tokens")
+
+type workspaceContextKey struct{}
+
+// ValidateWorkspace checks that the provided kcp workspace is a valid logical cluster path.
+func ValidateWorkspace(workspace string) error {
+	if !workspaceRegexp.MatchString(workspace) {
+		return fmt.Errorf("invalid workspace '%s'", workspace)
+	}
+	return nil
+}
+
+// acceptWorkspace checks the kcp workspace of the SPIAccessToken requested by the state of the flow or by the request.
+// No workspace is accepted until the token storage is workspace-aware, see errWorkspaceNotSupported.
+func acceptWorkspace(workspace string) error {
+	if err := ValidateWorkspace(workspace); err != nil {
+		return err
+	}
+	return errWorkspaceNotSupported
+}
+
+// WithWorkspaceIntoContext stores the kcp workspace into the returned context which is based on the provided context.
+// If used with a client constructed from configuration augmented using the AugmentConfiguration function, the requests
+// to the Kubernetes API will be sent to that workspace. An empty workspace leaves the requests unchanged.
+func WithWorkspaceIntoContext(workspace string, ctx context.Context) context.Context {
+	if workspace == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, workspaceContextKey{}, workspace)
+}
+
+// WorkspaceFromContext returns the kcp workspace stored in the context or an empty string if there is none.
+func WorkspaceFromContext(ctx context.Context) string {
+	workspace, _ := ctx.Value(workspaceContextKey{}).(string)
+	return workspace
+}
+
+// workspaceRoundTripper sends the requests to the kcp workspace stored in the context of the request, replacing
+// the workspace the client is configured with, if any.
+type workspaceRoundTripper struct {
+	http.RoundTripper
+}
+
+var _ http.RoundTripper = (*workspaceRoundTripper)(nil)
+
+func (t *workspaceRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	workspace := WorkspaceFromContext(r.Context())
+	if workspace == "" {
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	path := r.URL.Path
+	if strings.HasPrefix(path, workspacePathPrefix) {
+		path = path[len(workspacePathPrefix):]
+		if i := strings.Index(path, "/"); i >= 0 {
+			path = path[i:]
+		} else {
+			path = ""
+		}
+	}
+
+	scoped := r.Clone(r.Context())
+	scoped.URL.Path = workspacePathPrefix + workspace + path
+	scoped.URL.RawPath = ""
+	return t.RoundTripper.RoundTrip(scoped)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateWorkspace(t *testing.T) {
+	assert.NoError(t, ValidateWorkspace("root"))
+	assert.NoError(t, ValidateWorkspace("root:org:my-ws"))
+	assert.Error(t, ValidateWorkspace(""))
+	assert.Error(t, ValidateWorkspace("root:"))
+	assert.Error(t, ValidateWorkspace("root/../other"))
+	assert.Error(t, ValidateWorkspace("Root"))
+}
+
+func TestAcceptWorkspace(t *testing.T) {
+	assert.True(t, errors.Is(acceptWorkspace("root:org:my-ws"), errWorkspaceNotSupported))
+	assert.False(t, errors.Is(acceptWorkspace("Root"), errWorkspaceNotSupported))
+	assert.Error(t, acceptWorkspace("Root"))
+}
+
+func TestWorkspaceContext(t *testing.T) {
+	ctx := context.TODO()
+	assert.Equal(t, ctx, WithWorkspaceIntoContext("", ctx))
+	assert.Equal(t, "", WorkspaceFromContext(ctx))
+	assert.Equal(t, "root:ws", WorkspaceFromContext(WithWorkspaceIntoContext("root:ws", ctx)))
+}
+
+func TestWorkspaceRoundTripper(t *testing.T) {
+	var receivedPath string
+	rt := &workspaceRoundTripper{RoundTripper: fakeRoundTrip(func(r *http.Request) (*http.Response, error) {
+		receivedPath = r.URL.Path
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})}
+
+	send := func(ctx context.Context, path string) string {
+		req := httptest.NewRequest("GET", "https://kcp"+path, nil).WithContext(ctx)
+		_, err := rt.RoundTrip(req)
+		assert.NoError(t, err)
+		return receivedPath
+	}
+
+	ws := WithWorkspaceIntoContext("root:org:ws", context.TODO())
+
+	assert.Equal(t, "/api/v1/namespaces", send(context.TODO(), "/api/v1/namespaces"))
+	assert.Equal(t, "/clusters/root:org:ws/api/v1/namespaces", send(ws, "/api/v1/namespaces"))
+	assert.Equal(t, "/clusters/root:org:ws/api/v1/namespaces", send(ws, "/clusters/root/api/v1/namespaces"))
+	assert.Equal(t, "/clusters/root:org:ws", send(ws, "/clusters/root"))
+}
+
+func TestParseAnonymousStateWithWorkspace(t *testing.T) {
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+
+	encode := func(workspace string) string {
+		s, err := codec.Encode(&anonymousState{
+			AnonymousOAuthState: oauthstate.AnonymousOAuthState{TokenName: "token", TokenNamespace: "default", IssuedAt: time.Now().Unix()},
+			Workspace:           workspace,
+		})
+		assert.NoError(t, err)
+		return s
+	}
+
+	state, err := parseAnonymousState(&codec, encode(""), StateValidation{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", state.Workspace)
+	assert.Equal(t, "token", state.TokenName)
+
+	// the token storage doesn't record the workspaces of the tokens
+	_, err = parseAnonymousState(&codec, encode("root:ws"), StateValidation{})
+	assert.True(t, errors.Is(err, errWorkspaceNotSupported))
+
+	_, err = parseAnonymousState(&codec, encode("root/ws"), StateValidation{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,562 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/oauthservice"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	authz "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// loadTestCommand is the hidden command running the synthetic load test instead of the service.
+const loadTestCommand = "load-test"
+
+// loadTestArgs are the arguments of the load-test command.
+type loadTestArgs struct {
+	ConfigFile      string        `arg:"-c, --config-file" default:"" help:"the configuration file with the storage section selecting the storage backend to test. A process-local in-memory storage is used if not specified."`
+	ServiceProvider string        `arg:"--service-provider" default:"GitHub" help:"the type of the service provider simulated by the mock provider"`
+	Namespace       string        `arg:"--namespace" default:"spi-load-test" help:"the namespace of the synthetic SPIAccessTokens"`
+	Rate            float64       `arg:"-r, --rate" default:"10" help:"the number of the flows started per second"`
+	Duration        time.Duration `arg:"-d, --duration" default:"30s" help:"how long to keep starting new flows"`
+	Concurrency     int           `arg:"--concurrency" default:"50" help:"the maximum number of the flows in progress. No new flows are started until some of them finish."`
+	ProviderLatency time.Duration `arg:"--provider-latency" default:"0s" help:"the simulated response time of the token endpoint of the mock provider"`
+	TemplatesDir    string        `arg:"--templates-dir" default:"static" help:"the directory with the HTML templates"`
+	DevMode         bool          `arg:"--dev-mode" default:"false" help:"create the storage in the dev mode"`
+}
+
+// loadTestReport summarizes the results of the load test.
+type loadTestReport struct {
+	Flows    int
+	Failed   int
+	Duration time.Duration
+	// Latencies are the sorted durations of the successful flows.
+	Latencies []time.Duration
+	// Errors counts the failed flows by the error message.
+	Errors map[string]int
+	// Deleted and DeleteFailed count the synthetic tokens whose data is deleted from the storage after the test.
+	Deleted      int
+	DeleteFailed int
+}
+
+// runLoadTest parses the arguments of the load-test command, runs the test and prints the report. It returns the exit
+// code of the process.
+func runLoadTest(argv []string) int {
+	args := loadTestArgs{}
+	parser, err := arg.NewParser(arg.Config{Program: "spi-oauth " + loadTestCommand}, &args)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = parser.Parse(argv); err == arg.ErrHelp {
+		parser.WriteHelp(os.Stdout)
+		return 0
+	} else if err != nil {
+		parser.Fail(err.Error())
+	}
+
+	// the errors of the individual flows are collected in the report, only the more serious problems are logged
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
+	if logger, err := loggerConfig.Build(zap.WrapCore(controllers.DefaultRedactor.WrapCore)); err == nil {
+		defer zap.ReplaceGlobals(logger)()
+	}
+
+	report, err := loadTest(context.Background(), args)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to run the load test: %s\n", err.Error())
+		return 1
+	}
+
+	report.Print(os.Stdout)
+	if report.DeleteFailed > 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "failed to delete the data of some of the synthetic tokens from the storage")
+		return 1
+	}
+	return 0
+}
+
+// loadTest drives the complete OAuth flows of synthetic users through the service. The service provider is simulated
+// by the in-process mock provider and so is the Kubernetes cluster, the tokens are stored in the configured storage.
+// The data of the synthetic tokens is deleted from the storage once all the flows finish.
+func loadTest(ctx context.Context, args loadTestArgs) (*loadTestReport, error) {
+	if args.Rate <= 0 || args.Concurrency <= 0 {
+		return nil, fmt.Errorf("the rate and the concurrency must be positive")
+	}
+
+	spType := config.ServiceProviderType(args.ServiceProvider)
+	sharedSecret := make([]byte, 32)
+	if _, err := rand.Read(sharedSecret); err != nil {
+		return nil, err
+	}
+
+	fileCfg := controllers.FileConfiguration{}
+	if args.ConfigFile != "" {
+		loaded, err := controllers.LoadFileConfiguration(args.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		// only the storage (and the shared options it can derive its defaults from) is taken from the configuration
+		fileCfg.Storage = loaded.Storage
+		fileCfg.VaultHost = loaded.VaultHost
+		fileCfg.ServiceAccountTokenFilePath = loaded.ServiceAccountTokenFilePath
+	}
+
+	var strg tokenstorage.TokenStorage = &memoryTokenStorage{tokens: map[client.ObjectKey]v1beta1.Token{}}
+	if args.ConfigFile != "" {
+		var err error
+		if strg, err = oauthstorage.New(fileCfg.Storage, fileCfg.Configuration, args.DevMode); err != nil {
+			return nil, err
+		}
+		if closer, ok := strg.(io.Closer); ok {
+			defer func() {
+				_ = closer.Close()
+			}()
+		}
+	}
+
+	cl, err := newLoadTestClient()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	baseUrl := "http://" + listener.Addr().String()
+	fileCfg.BaseUrl = baseUrl
+	fileCfg.SharedSecret = sharedSecret
+	fileCfg.ServiceProviders = []config.ServiceProviderConfiguration{
+		{
+			ServiceProviderType: spType,
+			ClientId:            "load-test",
+			ClientSecret:        "load-test",
+		},
+	}
+
+	service, err := oauthservice.New(oauthservice.Config{
+		OAuthServiceConfiguration: controllers.OAuthServiceConfiguration{FileConfiguration: fileCfg},
+		Client:                    cl,
+		TokenStorage:              strg,
+		TemplatesDir:              args.TemplatesDir,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = service.Start(ctx); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = service.Stop(context.Background())
+	}()
+
+	provider := &mockProvider{latency: args.ProviderLatency}
+	server := &http.Server{
+		Handler: service.Handler(),
+		// the token exchange reaches the mock provider instead of the real one
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: provider})
+		},
+	}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			zap.L().Error("the load test server failed", zap.Error(err))
+		}
+	}()
+	defer server.Close()
+
+	codec, err := oauthstate.NewCodec(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	driver := &loadTestDriver{
+		args:       args,
+		client:     cl,
+		codec:      &codec,
+		provider:   provider,
+		serviceUrl: fmt.Sprintf("%s/%s", baseUrl, strings.ToLower(string(spType))),
+	}
+
+	report := driver.run(ctx)
+	report.Deleted, report.DeleteFailed = deleteLoadTestTokens(context.Background(), strg, driver.created)
+	return report, nil
+}
+
+// deleteLoadTestTokens deletes all the data stored for the synthetic SPIAccessTokens, so that the load test doesn't
+// leave it behind in the tested storage. It returns the numbers of the tokens whose data was and wasn't deleted.
+func deleteLoadTestTokens(ctx context.Context, strg tokenstorage.TokenStorage, owners []*v1beta1.SPIAccessToken) (int, int) {
+	deleted, failed := 0, 0
+	for _, owner := range owners {
+		if err := deleteLoadTestToken(ctx, strg, owner); err != nil {
+			zap.L().Error("failed to delete the data of the synthetic token", zap.String("token", owner.Name), zap.String("namespace", owner.Namespace), zap.Error(err))
+			failed++
+			continue
+		}
+		deleted++
+	}
+	return deleted, failed
+}
+
+func deleteLoadTestToken(ctx context.Context, strg tokenstorage.TokenStorage, owner *v1beta1.SPIAccessToken) error {
+	if enumerable, ok := strg.(oauthstorage.EnumerableStorage); ok {
+		return enumerable.PurgeOwner(ctx, client.ObjectKeyFromObject(owner))
+	}
+
+	if artifacts, ok := strg.(oauthstorage.ArtifactStorage); ok {
+		for _, kind := range oauthstorage.AllArtifactKinds {
+			if err := artifacts.DeleteArtifact(ctx, owner, kind); err != nil {
+				return err
+			}
+		}
+	}
+	if credentials, ok := strg.(oauthstorage.CredentialsStorage); ok {
+		if err := credentials.DeleteCredentials(ctx, owner); err != nil {
+			return err
+		}
+	}
+	return strg.Delete(ctx, owner)
+}
+
+// loadTestDriver plays the role of the users' browsers in the synthetic flows.
+type loadTestDriver struct {
+	args       loadTestArgs
+	client     client.Client
+	codec      *oauthstate.Codec
+	provider   *mockProvider
+	serviceUrl string
+
+	// created are the synthetic SPIAccessTokens created for the flows.
+	lock    sync.Mutex
+	created []*v1beta1.SPIAccessToken
+}
+
+// run starts the flows at the configured rate until the configured duration passes and waits for them to finish.
+func (d *loadTestDriver) run(ctx context.Context) *loadTestReport {
+	report := &loadTestReport{Errors: map[string]int{}}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	inFlight := make(chan struct{}, d.args.Concurrency)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / d.args.Rate))
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithTimeout(ctx, d.args.Duration)
+	defer cancel()
+
+	start := time.Now()
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+
+		select {
+		case <-ctx.Done():
+			break loop
+		case inFlight <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			latency, err := d.flow(i)
+
+			lock.Lock()
+			defer lock.Unlock()
+			report.Flows++
+			if err != nil {
+				report.Failed++
+				report.Errors[err.Error()]++
+				return
+			}
+			report.Latencies = append(report.Latencies, latency)
+		}(i)
+	}
+	wg.Wait()
+
+	report.Duration = time.Since(start)
+	sort.Slice(report.Latencies, func(i, j int) bool { return report.Latencies[i] < report.Latencies[j] })
+	return report
+}
+
+// redirectUrlRegexp finds the URL of the service provider in the redirect notice page.
+var redirectUrlRegexp = regexp.MustCompile(`url=([^"]+)"`)
+
+// flow performs a single complete OAuth flow and returns its duration. The preparation of the SPIAccessToken is not
+// included in the duration.
+func (d *loadTestDriver) flow(i int) (time.Duration, error) {
+	token := &v1beta1.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("load-test-%d", i),
+			Namespace: d.args.Namespace,
+		},
+	}
+	if err := d.client.Create(context.Background(), token); err != nil {
+		return 0, fmt.Errorf("failed to prepare the SPIAccessToken: %w", err)
+	}
+	d.lock.Lock()
+	d.created = append(d.created, token)
+	d.lock.Unlock()
+
+	state, err := d.codec.Encode(&oauthstate.AnonymousOAuthState{
+		TokenName:           token.Name,
+		TokenNamespace:      token.Namespace,
+		IssuedAt:            time.Now().Unix(),
+		Scopes:              []string{"repo"},
+		ServiceProviderType: config.ServiceProviderType(d.args.ServiceProvider),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return 0, err
+	}
+	browser := &http.Client{
+		Jar:     jar,
+		Timeout: time.Minute,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+
+	res, err := browser.Get(d.serviceUrl + "/authenticate?" + url.Values{"state": {state}, "k8s_token": {"load-test"}}.Encode())
+	if err != nil {
+		return 0, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status of the authenticate endpoint: %d", res.StatusCode)
+	}
+
+	matches := redirectUrlRegexp.FindSubmatch(body)
+	if len(matches) != 2 {
+		return 0, fmt.Errorf("no redirect to the service provider found in the authenticate response")
+	}
+	authUrl, err := url.Parse(html.UnescapeString(string(matches[1])))
+	if err != nil {
+		return 0, err
+	}
+
+	res, err = browser.Get(d.serviceUrl + "/callback?" + d.provider.authorize(authUrl).Encode())
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		return 0, fmt.Errorf("unexpected status of the callback endpoint: %d", res.StatusCode)
+	}
+
+	return time.Since(start), nil
+}
+
+// Percentile returns the latency below which the provided fraction of the successful flows finished.
+func (r *loadTestReport) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(r.Latencies)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return r.Latencies[idx]
+}
+
+// Print writes the human-readable report.
+func (r *loadTestReport) Print(w io.Writer) {
+	throughput := 0.0
+	if r.Duration > 0 {
+		throughput = float64(r.Flows-r.Failed) / r.Duration.Seconds()
+	}
+
+	_, _ = fmt.Fprintf(w, "flows:      %d (%d failed)\n", r.Flows, r.Failed)
+	_, _ = fmt.Fprintf(w, "duration:   %s\n", r.Duration.Round(time.Millisecond))
+	_, _ = fmt.Fprintf(w, "throughput: %.2f flows/s\n", throughput)
+	_, _ = fmt.Fprintf(w, "latency:    p50 %s, p90 %s, p95 %s, p99 %s, max %s\n",
+		r.Percentile(0.5), r.Percentile(0.9), r.Percentile(0.95), r.Percentile(0.99), r.Percentile(1))
+	_, _ = fmt.Fprintf(w, "cleanup:    %d tokens deleted (%d failed)\n", r.Deleted, r.DeleteFailed)
+
+	if len(r.Errors) > 0 {
+		_, _ = fmt.Fprintln(w, "errors:")
+		messages := make([]string, 0, len(r.Errors))
+		for msg := range r.Errors {
+			messages = append(messages, msg)
+		}
+		sort.Strings(messages)
+		for _, msg := range messages {
+			_, _ = fmt.Fprintf(w, "  %6d  %s\n", r.Errors[msg], msg)
+		}
+	}
+}
+
+// mockProvider is the service provider simulated in-process. It authorizes all the requests and its token endpoint
+// issues random tokens for any code.
+type mockProvider struct {
+	latency time.Duration
+}
+
+// authorize simulates the user approving the access in the service provider. It returns the query parameters of
+// the redirect back to the callback of the service.
+func (p *mockProvider) authorize(authUrl *url.URL) url.Values {
+	return url.Values{
+		"state": {authUrl.Query().Get("state")},
+		"code":  {randomString()},
+	}
+}
+
+// RoundTrip implements the token endpoint of the mock provider.
+func (p *mockProvider) RoundTrip(r *http.Request) (*http.Response, error) {
+	if p.latency > 0 {
+		select {
+		case <-time.After(p.latency):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+
+	status := http.StatusOK
+	var body []byte
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost || r.PostForm.Get("code") == "" {
+		status = http.StatusBadRequest
+		body = []byte(`{"error": "invalid_request"}`)
+	} else {
+		body, _ = json.Marshal(map[string]interface{}{
+			"access_token":  randomString(),
+			"refresh_token": randomString(),
+			"token_type":    "bearer",
+			"expires_in":    3600,
+		})
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func randomString() string {
+	data := make([]byte, 16)
+	_, _ = rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// loadTestClient is the Kubernetes client simulating the cluster in which all the users have access to all
+// the SPIAccessTokens.
+type loadTestClient struct {
+	client.Client
+}
+
+func newLoadTestClient() (controllers.AuthenticatingClient, error) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := v1beta1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := authz.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	return &loadTestClient{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}, nil
+}
+
+func (c *loadTestClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok {
+		review.Status.Allowed = true
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// memoryTokenStorage is the process-local token storage used when no storage is configured for the load test. It
+// measures the overhead of the service alone.
+type memoryTokenStorage struct {
+	lock   sync.Mutex
+	tokens map[client.ObjectKey]v1beta1.Token
+}
+
+func (s *memoryTokenStorage) Store(_ context.Context, owner *v1beta1.SPIAccessToken, token *v1beta1.Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens[client.ObjectKeyFromObject(owner)] = *token
+	return nil
+}
+
+func (s *memoryTokenStorage) Get(_ context.Context, owner *v1beta1.SPIAccessToken) (*v1beta1.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	token, ok := s.tokens[client.ObjectKeyFromObject(owner)]
+	if !ok {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+func (s *memoryTokenStorage) Delete(_ context.Context, owner *v1beta1.SPIAccessToken) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.tokens, client.ObjectKeyFromObject(owner))
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestLoadTest(t *testing.T) {
+	report, err := loadTest(context.TODO(), loadTestArgs{
+		ServiceProvider: "GitHub",
+		Namespace:       "default",
+		Rate:            100,
+		Duration:        200 * time.Millisecond,
+		Concurrency:     5,
+		TemplatesDir:    "static",
+	})
+	assert.NoError(t, err)
+
+	assert.NotZero(t, report.Flows)
+	assert.Zero(t, report.Failed, report.Errors)
+	assert.Len(t, report.Latencies, report.Flows)
+	assert.Equal(t, report.Flows, report.Deleted)
+	assert.Zero(t, report.DeleteFailed)
+
+	out := &bytes.Buffer{}
+	report.Print(out)
+	assert.Contains(t, out.String(), "0 failed")
+}
+
+func TestDeleteLoadTestTokens(t *testing.T) {
+	owners := []*v1beta1.SPIAccessToken{
+		{ObjectMeta: metav1.ObjectMeta{Name: "load-test-0", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "load-test-1", Namespace: "default"}},
+	}
+
+	t.Run("tokens", func(t *testing.T) {
+		strg := &memoryTokenStorage{tokens: map[client.ObjectKey]v1beta1.Token{}}
+		for _, owner := range owners {
+			assert.NoError(t, strg.Store(context.TODO(), owner, &v1beta1.Token{AccessToken: "access"}))
+		}
+		deleted, failed := deleteLoadTestTokens(context.TODO(), strg, owners)
+		assert.Equal(t, 2, deleted)
+		assert.Zero(t, failed)
+		assert.Empty(t, strg.tokens)
+	})
+
+	t.Run("purged", func(t *testing.T) {
+		strg := &purgingStorage{memoryTokenStorage: memoryTokenStorage{tokens: map[client.ObjectKey]v1beta1.Token{}}, fail: "load-test-1"}
+		deleted, failed := deleteLoadTestTokens(context.TODO(), strg, owners)
+		assert.Equal(t, 1, deleted)
+		assert.Equal(t, 1, failed)
+		assert.Equal(t, []types.NamespacedName{{Name: "load-test-0", Namespace: "default"}}, strg.purged)
+	})
+}
+
+// purgingStorage records the purged owners, failing to purge the one named fail.
+type purgingStorage struct {
+	memoryTokenStorage
+	fail   string
+	purged []types.NamespacedName
+}
+
+func (s *purgingStorage) ListOwners(_ context.Context) ([]types.NamespacedName, error) {
+	return nil, nil
+}
+
+func (s *purgingStorage) PurgeOwner(_ context.Context, owner types.NamespacedName) error {
+	if owner.Name == s.fail {
+		return errors.New("purge failed")
+	}
+	s.purged = append(s.purged, owner)
+	return nil
+}
+
+func TestLoadTestInvalidArgs(t *testing.T) {
+	_, err := loadTest(context.TODO(), loadTestArgs{Rate: 0, Concurrency: 1})
+	assert.Error(t, err)
+}
+
+func TestLoadTestReportPercentile(t *testing.T) {
+	report := &loadTestReport{}
+	assert.Zero(t, report.Percentile(0.5))
+
+	for i := 1; i <= 100; i++ {
+		report.Latencies = append(report.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, report.Percentile(0.5))
+	assert.Equal(t, 99*time.Millisecond, report.Percentile(0.99))
+	assert.Equal(t, 100*time.Millisecond, report.Percentile(1))
+	assert.Equal(t, time.Millisecond, report.Percentile(0))
+}
+
+func TestLoadTestReportPrint(t *testing.T) {
+	report := &loadTestReport{Errors: map[string]int{"boom": 2}, Flows: 3, Failed: 2, Duration: time.Second}
+	out := &bytes.Buffer{}
+	report.Print(out)
+	assert.Contains(t, out.String(), "3 (2 failed)")
+	assert.Contains(t, out.String(), "boom")
+}
@@ -14,101 +14,97 @@
 package main
 
 import (
-	stderrors "errors"
+	"context"
+	"errors"
 	"fmt"
-	"html/template"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
-	authz "k8s.io/api/authorization/v1"
-	"k8s.io/apimachinery/pkg/api/meta"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-
 	certutil "k8s.io/client-go/util/cert"
 
-	"github.com/alexedwards/scs"
-	"github.com/alexedwards/scs/stores/memstore"
-	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
-	"k8s.io/apimachinery/pkg/api/errors"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/alexflint/go-arg"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
-	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/oauthservice"
 
-	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
 type cliArgs struct {
 	ConfigFile string `arg:"-c, --config-file, env" default:"/etc/spi/config.yaml" help:"The location of the configuration file"`
+	ConfigFrom string `arg:"--config-from, env" default:"" help:"The source of the configuration, overrides the config file. Either a file path, secret://namespace/name[/key] or configmap://namespace/name[/key]. The configuration in a Secret or ConfigMap is watched for changes."`
 	Port       int    `arg:"-p, --port, env" default:"8000" help:"The port to listen on"`
 	DevMode    bool   `arg:"-d, --dev-mode, env" default:"false" help:"use dev-mode logging"`
 	KubeConfig string `arg:"-k, --kubeconfig, env" default:"" help:""`
 	// snake-case used because of environment variable naming (API_SERVER and API_SERVER_CA_PATH)
-	Api_Server         string `arg:"-a, --api-server, env" default:"" help:"host:port of the Kubernetes API server to use when handling HTTP requests"`
-	Api_Server_CA_Path string `arg:"-t, --ca-path, env" default:"" help:"the path to the CA certificate to use when connecting to the Kubernetes API server"`
-}
-
-type viewData struct {
-	Title   string
-	Message string
+	Api_Server           string        `arg:"-a, --api-server, env" default:"" help:"host:port of the Kubernetes API server to use when handling HTTP requests"`
+	Api_Server_CA_Path   string        `arg:"-t, --ca-path, env" default:"" help:"the path to the CA certificate to use when connecting to the Kubernetes API server"`
+	AllowedOrigins       []string      `arg:"--allowed-origins, env" help:"comma-separated list of origins allowed to read the JSON responses of the callback endpoint"`
+	TemplatesDir         string        `arg:"--templates-dir, env" default:"static" help:"the directory with the HTML templates. The templates are reloaded when the files in the directory change."`
+	PathPrefix           string        `arg:"--path-prefix, env" default:"" help:"the path prefix under which all the endpoints are exposed, e.g. /api/spi-oauth when running behind an ingress path"`
+	VerboseErrors        bool          `arg:"--verbose-errors, env" default:"false" help:"show the details of the errors to the users instead of just a generic message with the correlation ID. Useful in the debugging environments."`
+	TrustedProxies       []string      `arg:"--trusted-proxies, env" help:"comma-separated list of IP addresses or CIDR ranges of the reverse proxies whose X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers are used to construct the public URLs of the service"`
+	ConsentPreview       bool          `arg:"--consent-preview, env" default:"false" help:"show the requested scopes and the target SPIAccessToken and let the users confirm them before redirecting to the service provider"`
+	DisableCompression   bool          `arg:"--disable-compression, env" default:"false" help:"do not compress the HTML and JSON responses even if the clients accept it, e.g. when the compression is done by the ingress"`
+	EventsSink           string        `arg:"--events-sink, env:K_SINK" default:"" help:"the URL to which the events of the OAuth flows are sent as CloudEvents, e.g. a Knative broker or a KafkaSink. The events are disabled if not specified."`
+	EventsSource         string        `arg:"--events-source, env" default:"/spi-oauth" help:"the source attribute of the CloudEvents"`
+	IdentityDirectory    string        `arg:"--identity-directory, env" default:"" help:"the YAML file mapping the Kubernetes usernames to the email and the displayName of the users, recorded along with the usernames in the flow events and the logs"`
+	IdentityLookupUrl    string        `arg:"--identity-lookup-url, env" default:"" help:"the URL of the HTTP service returning the email and the displayName of the Kubernetes user as JSON, e.g. a user directory. The {username} in the URL is replaced by the username. Consulted for the users not found in the --identity-directory."`
+	IdentityCacheTtl     time.Duration `arg:"--identity-cache-ttl, env" default:"10m" help:"the time for which the identities returned by the --identity-lookup-url are cached"`
+	AlertWebhook         string        `arg:"--alert-webhook, env" default:"" help:"the URL to which the alerts about the high failure rates of the token exchanges and of the token storage are posted. The alerts are disabled if not specified."`
+	AlertFormat          string        `arg:"--alert-format, env" default:"generic" help:"the format of the alerts, either generic or slack"`
+	AlertFailureRate     float64       `arg:"--alert-failure-rate, env" default:"0.5" help:"the fraction of the failed operations within the alert window that raises the alert"`
+	AlertMinOperations   int           `arg:"--alert-min-operations, env" default:"5" help:"the minimum number of the operations within the alert window for the failure rate to be considered"`
+	AlertWindow          time.Duration `arg:"--alert-window, env" default:"10m" help:"the duration over which the failure rate is computed"`
+	DryRun               bool          `arg:"--dry-run, env" default:"false" help:"perform the OAuth flows including the token exchanges, but never write to the token storage and send all the changes to the cluster as server-side dry runs. The would-be actions are logged instead."`
+	StorageRetryDir      string        `arg:"--storage-retry-dir, env" default:"" help:"the directory, ideally on a persistent volume, in which the tokens that fail to be stored are queued (encrypted) and from which their storing is retried in the background. The tokens that fail to be stored are discarded if not specified."`
+	StorageRetryInterval time.Duration `arg:"--storage-retry-interval, env" default:"30s" help:"the interval between the attempts to store the queued tokens"`
+	StorageRetryMaxAge   time.Duration `arg:"--storage-retry-max-age, env" default:"1h" help:"the duration after which the queued tokens that still cannot be stored are discarded"`
+	StorageGcInterval    time.Duration `arg:"--storage-gc-interval, env" default:"0" help:"the interval between the runs of the garbage collection removing the data of the deleted SPIAccessTokens from the token storage. The garbage collection is disabled if not specified. Must not be enabled with the SPIAccessTokens in kcp workspaces."`
+	StorageGcReportOnly  bool          `arg:"--storage-gc-report-only, env" default:"false" help:"only log and count the data of the deleted SPIAccessTokens found by the storage garbage collection instead of removing it. Always the case in the dry-run mode."`
+	CredentialsInterval  time.Duration `arg:"--credentials-check-interval, env" default:"6h" help:"the interval between the validations of the client credentials of the service providers warning about the rejected and the soon expiring credentials. The validation is disabled if set to 0."`
+	CredentialsWarning   time.Duration `arg:"--credentials-expiry-warning, env" default:"336h" help:"the time before the expiry of a client secret or a client certificate since which its upcoming expiry is logged as a warning"`
+	MetadataRefresh      time.Duration `arg:"--metadata-refresh-interval, env" default:"1h" help:"the interval between the refreshes of the metadata documents and the JWKS of the service providers configured with the discovery"`
+	KubernetesInterval   time.Duration `arg:"--kubernetes-check-interval, env" default:"1m" help:"the interval between the checks that the Kubernetes API server accepts the credentials of the service (e.g. its service account token) that re-initialize the Kubernetes client if it doesn't. The failed checks make the service not ready. The checks are disabled if set to 0."`
+	KubernetesWarning    time.Duration `arg:"--kubernetes-expiry-warning, env" default:"10m" help:"the time before the expiry of the Kubernetes token or client certificate of the service since which its upcoming expiry is logged as a warning"`
+	MetadataMaxStale     time.Duration `arg:"--metadata-max-stale, env" default:"24h" help:"the time for which the metadata of a service provider that cannot be refreshed is still used. The flows with the service provider fail afterwards until its metadata can be fetched again."`
+	KubernetesWorkers    int           `arg:"--kubernetes-workers, env" default:"0" help:"the maximum number of the concurrent requests to the Kubernetes API server made by the callbacks. Not limited if not specified."`
+	ExchangeWorkers      int           `arg:"--exchange-workers, env" default:"0" help:"the maximum number of the concurrent token exchanges with the service providers. Not limited if not specified."`
+	StorageWorkers       int           `arg:"--storage-workers, env" default:"0" help:"the maximum number of the concurrent writes to the token storage made by the callbacks. Not limited if not specified."`
+	WorkerQueueSize      int           `arg:"--worker-queue-size, env" default:"100" help:"the maximum number of the callbacks waiting for a free worker of a single stage. The callbacks over the limit are rejected right away."`
+	WorkerQueueTimeout   time.Duration `arg:"--worker-queue-timeout, env" default:"10s" help:"the maximum time a callback waits for a free worker of a single stage before it is rejected"`
+	AnonymousNamespaces  []string      `arg:"--anonymous-namespaces, env" help:"comma-separated list of the namespaces in which the OAuth flows can be initiated without the Kubernetes token of the user, using the identity of the service instead. Meant only for the single-user and development clusters. Disabled if not specified."`
+	Fips                 bool          `arg:"--fips, env" default:"false" help:"only allow the algorithms and keys approved by FIPS 140 for the shared secret, the client assertions and the ID token signatures, and refuse to start if the configuration requires anything else. Doesn't replace a FIPS-validated cryptographic module."`
+	FaultInjection       bool          `arg:"--fault-injection, env" default:"false" help:"inject the faults requested in the X-Spi-Fault-Injection header of the requests and the --injected-faults into the processing of the requests. Meant only for the end-to-end testing, not available in the release builds."`
+	InjectedFaults       string        `arg:"--injected-faults, env" default:"" help:"comma-separated list of the faults injected into every request when the fault injection is enabled: storage-write-failure, slow-exchange=<duration> and expired-session"`
+	ShutdownTimeout      time.Duration `arg:"--shutdown-timeout, env" default:"30s" help:"the time the service has to finish the requests in flight and to stop its background jobs when it is terminated"`
 }
 
-func OkHandler(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
-}
-
-func CallbackSuccessHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "static/callback_success.html")
-}
+// The names of the components of the binary managed by its lifecycle.
+const (
+	componentEvents       = "events"
+	componentOAuthService = "oauth-service"
+	componentHttpServer   = "http-server"
+)
 
-func CallbackErrorHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	errorMsg := q.Get("error")
-	errorDescription := q.Get("error_description")
-	data := viewData{
-		Title:   errorMsg,
-		Message: errorDescription,
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == loadTestCommand {
+		os.Exit(runLoadTest(os.Args[2:]))
 	}
-	tmpl, _ := template.ParseFiles("static/callback_error.html")
-
-	err := tmpl.Execute(w, data)
-	if err == nil {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		zap.L().Error("failed to process template: %s", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("Error response returned to OAuth callback: %s. Message: %s ", errorMsg, errorDescription)))
+	if len(os.Args) > 1 && os.Args[1] == migrateStorageCommand {
+		os.Exit(runMigrateStorage(os.Args[2:]))
 	}
 
-}
-
-func handleUpload(uploader *controllers.TokenUploader) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if err := uploader.Handle(r); err != nil {
-			if status := errors.APIStatus(nil); stderrors.As(err, &status) {
-				w.WriteHeader(int(status.Status().Code))
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			zap.L().Error("error handling token upload", zap.Error(err))
-			return
-		}
-
-		w.WriteHeader(http.StatusNoContent)
-	}
-}
-
-func main() {
 	args := cliArgs{}
 	arg.MustParse(&args)
 
@@ -120,7 +116,8 @@ func main() {
 	}
 	loggerConfig.OutputPaths = []string{"stdout"}
 	loggerConfig.ErrorOutputPaths = []string{"stdout"}
-	logger, err := loggerConfig.Build()
+	// all the log entries are scrubbed of the tokens, authorization codes and the configured secrets
+	logger, err := loggerConfig.Build(zap.WrapCore(controllers.DefaultRedactor.WrapCore))
 	if err != nil {
 		// there's nothing we can do about the error to print to stderr, but the linter requires us to at least pretend
 		_, _ = fmt.Fprintf(os.Stderr, "failed to initialize logging: %s", err.Error())
@@ -137,11 +134,33 @@ func main() {
 
 	zap.L().Debug("environment", zap.Strings("env", os.Environ()))
 
-	cfg, err := config.LoadFrom(args.ConfigFile)
+	sourceUrl := args.ConfigFrom
+	if sourceUrl == "" {
+		sourceUrl = args.ConfigFile
+	}
+
+	source, err := newConfigSource(sourceUrl, func() (kubernetes.Interface, error) {
+		return serviceClientset(&args)
+	})
+	if err != nil {
+		zap.L().Error("failed to initialize the configuration source", zap.Error(err))
+		os.Exit(1)
+	}
+
+	cfg, err := source.Load(context.Background())
 	if err != nil {
 		zap.L().Error("failed to initialize the configuration", zap.Error(err))
 		os.Exit(1)
 	}
+	controllers.DefaultRedactor.SetSecrets(controllers.FileConfigurationSecrets(cfg)...)
+
+	if args.Fips {
+		if err := controllers.ValidateFips(cfg); err != nil {
+			zap.L().Error("the configuration is not compliant with the FIPS mode", zap.Error(err))
+			os.Exit(1)
+		}
+		zap.L().Info("running in the FIPS mode")
+	}
 
 	kubeConfig, err := kubernetesConfig(&args)
 	if err != nil {
@@ -149,87 +168,233 @@ func main() {
 		os.Exit(1)
 	}
 
-	start(cfg, args.Port, kubeConfig, args.DevMode)
-}
+	trustedProxies, err := controllers.ParseTrustedProxies(args.TrustedProxies)
+	if err != nil {
+		zap.L().Error("failed to parse the trusted proxies", zap.Error(err))
+		os.Exit(1)
+	}
 
-func start(cfg config.Configuration, port int, kubeConfig *rest.Config, devmode bool) {
-	router := mux.NewRouter()
+	serviceCfg := controllers.OAuthServiceConfiguration{
+		FileConfiguration:  cfg,
+		AllowedOrigins:     args.AllowedOrigins,
+		PathPrefix:         controllers.NormalizePathPrefix(args.PathPrefix),
+		TrustedProxies:     trustedProxies,
+		VerboseErrors:      args.VerboseErrors,
+		ConsentPreview:     args.ConsentPreview,
+		DisableCompression: args.DisableCompression,
+		DryRun:             args.DryRun,
+		Fips:               args.Fips,
+		FaultInjection:     args.FaultInjection,
+	}
 
-	// insecure mode only allowed when the trusted root certificate is not specified...
-	if devmode && kubeConfig.TLSClientConfig.CAFile == "" {
-		kubeConfig.Insecure = true
+	if args.FaultInjection {
+		if !controllers.FaultInjectionAvailable {
+			zap.L().Error("the fault injection is not available in the release builds")
+			os.Exit(1)
+		}
+		serviceCfg.Faults, err = controllers.ParseFaults(args.InjectedFaults)
+		if err != nil {
+			zap.L().Error("failed to parse the injected faults", zap.Error(err))
+			os.Exit(1)
+		}
+		zap.L().Warn("the fault injection is enabled, the requests may fail on purpose", zap.String("injectedFaults", args.InjectedFaults))
 	}
 
-	// we can't use the default dynamic rest mapper, because we don't have a token that would enable us to connect
-	// to the cluster just yet. Therefore, we need to list all the resources that we are ever going to query using our
-	// client here thus making the mapper not reach out to the target cluster at all.
-	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{})
-	mapper.Add(authz.SchemeGroupVersion.WithKind("SelfSubjectAccessReview"), meta.RESTScopeRoot)
-	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessToken"), meta.RESTScopeNamespace)
-	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessTokenDataUpdate"), meta.RESTScopeNamespace)
+	lifecycle := controllers.NewLifecycle()
+	lifecycle.ShutdownTimeout = args.ShutdownTimeout
 
-	cl, err := controllers.CreateClient(kubeConfig, client.Options{
-		Mapper: mapper,
-	})
+	var publishers controllers.FlowEventPublishers
+	if args.EventsSink != "" {
+		events, err := controllers.NewCloudEventsPublisher(args.EventsSink, args.EventsSource)
+		if err != nil {
+			zap.L().Error("failed to initialize the events publisher", zap.Error(err))
+			os.Exit(1)
+		}
+		// registered first so that the events of the flows in progress are still sent when the rest is stopping
+		lifecycle.Add(controllers.Component{
+			Name: componentEvents,
+			Start: func(ctx context.Context) error {
+				events.Start(ctx)
+				return nil
+			},
+		})
+		publishers = append(publishers, events)
+	}
+	if args.AlertWebhook != "" {
+		alerts, err := controllers.NewFailureAlerts(controllers.FailureAlertOptions{
+			WebhookUrl:    args.AlertWebhook,
+			Format:        args.AlertFormat,
+			FailureRate:   args.AlertFailureRate,
+			MinOperations: args.AlertMinOperations,
+			Window:        args.AlertWindow,
+		})
+		if err != nil {
+			zap.L().Error("failed to initialize the failure alerts", zap.Error(err))
+			os.Exit(1)
+		}
+		publishers = append(publishers, alerts)
+	}
+	if len(publishers) > 0 {
+		serviceCfg.Events = publishers
+	}
+	var identities controllers.IdentityEnrichers
+	if args.IdentityDirectory != "" {
+		directory, err := controllers.LoadIdentityDirectory(args.IdentityDirectory)
+		if err != nil {
+			zap.L().Error("failed to load the identity directory", zap.Error(err))
+			os.Exit(1)
+		}
+		identities = append(identities, directory)
+	}
+	if args.IdentityLookupUrl != "" {
+		lookup, err := controllers.NewHttpIdentityLookup(args.IdentityLookupUrl, args.IdentityCacheTtl)
+		if err != nil {
+			zap.L().Error("failed to initialize the identity lookup", zap.Error(err))
+			os.Exit(1)
+		}
+		identities = append(identities, lookup)
+	}
+	if len(identities) > 0 {
+		serviceCfg.Identities = identities
+	}
+	if args.StorageRetryDir != "" {
+		retries, err := controllers.NewStorageRetryQueue(args.StorageRetryDir, cfg.SharedSecret, args.StorageRetryInterval, args.StorageRetryMaxAge)
+		if err != nil {
+			zap.L().Error("failed to initialize the storage retry queue", zap.Error(err))
+			os.Exit(1)
+		}
+		retries.Events = serviceCfg.Events
+		retries.Identities = serviceCfg.Identities
+		serviceCfg.StorageRetries = retries
+	}
+	if args.KubernetesWorkers > 0 || args.ExchangeWorkers > 0 || args.StorageWorkers > 0 {
+		serviceCfg.Workers = controllers.NewWorkerPool(controllers.WorkerPoolOptions{
+			Workers: map[controllers.WorkerStage]int{
+				controllers.WorkerStageKubernetes: args.KubernetesWorkers,
+				controllers.WorkerStageExchange:   args.ExchangeWorkers,
+				controllers.WorkerStageStorage:    args.StorageWorkers,
+			},
+			QueueSize:    args.WorkerQueueSize,
+			QueueTimeout: args.WorkerQueueTimeout,
+		})
+	}
+	if len(args.AnonymousNamespaces) > 0 {
+		if err := controllers.ValidateAnonymousNamespaces(args.AnonymousNamespaces); err != nil {
+			zap.L().Error("invalid configuration of the anonymous mode", zap.Error(err))
+			os.Exit(1)
+		}
+		restConfig, err := serviceConfig(&args)
+		if err != nil {
+			zap.L().Error("failed to read the kubernetes configuration of the service for the anonymous mode", zap.Error(err))
+			os.Exit(1)
+		}
+		token, err := controllers.ServiceTokenSource(restConfig)
+		if err != nil {
+			zap.L().Error("the anonymous mode requires the service to authenticate using a token", zap.Error(err))
+			os.Exit(1)
+		}
+		zap.L().Warn("the anonymous mode is enabled, anyone able to reach the service can authorize the SPIAccessTokens in the allowed namespaces", zap.Strings("namespaces", args.AnonymousNamespaces))
+		serviceCfg.Anonymous = &controllers.AnonymousMode{Namespaces: args.AnonymousNamespaces, Token: token}
+	}
+	if args.StorageGcInterval > 0 {
+		cl, err := serviceClient(&args)
+		if err != nil {
+			zap.L().Error("failed to create the kubernetes client of the storage garbage collection", zap.Error(err))
+			os.Exit(1)
+		}
+		serviceCfg.StorageGc = controllers.NewStorageGarbageCollector(cl, args.StorageGcInterval, args.StorageGcReportOnly || args.DryRun)
+	}
+	if args.CredentialsInterval > 0 {
+		serviceCfg.CredentialsMonitor = controllers.NewCredentialsMonitor(args.CredentialsInterval, args.CredentialsWarning)
+	}
+	serviceCfg.ProviderMetadata = controllers.NewProviderMetadataCache(args.MetadataRefresh, args.MetadataMaxStale)
+	if args.KubernetesInterval > 0 {
+		serviceCfg.KubernetesMonitor = controllers.NewKubernetesClientMonitor(args.KubernetesInterval, args.KubernetesWarning)
+	}
 
-	if err != nil {
-		zap.L().Error("failed to create kubernetes client", zap.Error(err))
-		return
+	reloadKubeConfig := func() (*rest.Config, error) {
+		return kubernetesConfig(&args)
 	}
+	if err := start(lifecycle, serviceCfg, source, args.TemplatesDir, args.Port, kubeConfig, reloadKubeConfig, args.DevMode); err != nil {
+		zap.L().Error("the service failed", zap.Error(err))
+		os.Exit(1)
+	}
+}
 
-	strg, err := tokenstorage.NewVaultStorage("spi-oauth", cfg.VaultHost, cfg.ServiceAccountTokenFilePath, devmode)
+// start runs the OAuth service and the HTTP server serving it until the service is terminated or one of them fails.
+func start(lifecycle *controllers.Lifecycle, cfg controllers.OAuthServiceConfiguration, source configSource, templatesDir string, port int, kubeConfig *rest.Config, reloadKubeConfig func() (*rest.Config, error), devmode bool) error {
+	service, err := oauthservice.New(oauthservice.Config{
+		OAuthServiceConfiguration: cfg,
+		KubeConfig:                kubeConfig,
+		ReloadKubeConfig:          reloadKubeConfig,
+		TemplatesDir:              templatesDir,
+		DevMode:                   devmode,
+		WatchConfiguration:        source.Watch,
+	})
 	if err != nil {
-		zap.L().Error("failed to create token storage interface", zap.Error(err))
-		return
+		return err
 	}
+	lifecycle.Add(controllers.Component{
+		Name:  componentOAuthService,
+		Start: service.Start,
+		Stop:  service.Stop,
+	})
 
-	tokenUploader := controllers.TokenUploader{
-		K8sClient: cl,
-		Storage: tokenstorage.NotifyingTokenStorage{
-			Client:       cl,
-			TokenStorage: strg,
-		},
-	}
+	server := &http.Server{Handler: service.Handler()}
+	lifecycle.Add(controllers.Component{
+		Name:      componentHttpServer,
+		DependsOn: []string{componentOAuthService},
+		Start: func(_ context.Context) error {
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				return fmt.Errorf("failed to start the HTTP server: %w", err)
+			}
 
-	// the session has 15 minutes timeout and stale sessions are cleaned every 5 minutes
-	sessionManager := scs.NewManager(memstore.New(5 * time.Minute))
-	sessionManager.Name("appstudio_spi_session")
-	sessionManager.IdleTimeout(15 * time.Minute)
+			zap.L().Info("Starting the server", zap.Int("port", port), zap.String("pathPrefix", cfg.PathPrefix))
+			go func() {
+				if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					lifecycle.Fail(componentHttpServer, err)
+				}
+			}()
+			return nil
+		},
+		// the requests in flight are finished before the service is stopped
+		Stop: server.Shutdown,
+	})
 
-	//static routes first
-	router.HandleFunc("/health", OkHandler).Methods("GET")
-	router.HandleFunc("/ready", OkHandler).Methods("GET")
-	router.HandleFunc("/callback_success", CallbackSuccessHandler).Methods("GET")
-	router.NewRoute().Path("/{type}/callback").Queries("error", "", "error_description", "").HandlerFunc(CallbackErrorHandler)
-	router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(handleUpload(&tokenUploader)).Methods("POST")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return lifecycle.Run(ctx)
+}
 
-	redirectTpl, err := template.ParseFiles("static/redirect_notice.html")
+// serviceClientset creates the Kubernetes client authenticated as the service itself (as opposed to the clients
+// authenticated using the tokens of the users).
+func serviceClientset(args *cliArgs) (kubernetes.Interface, error) {
+	cfg, err := serviceConfig(args)
 	if err != nil {
-		zap.L().Error("failed to parse the redirect notice HTML template", zap.Error(err))
-		return
+		return nil, err
 	}
 
-	for _, sp := range cfg.ServiceProviders {
-		zap.L().Debug("initializing service provider controller", zap.String("type", string(sp.ServiceProviderType)), zap.String("url", sp.ServiceProviderBaseUrl))
-
-		controller, err := controllers.FromConfiguration(cfg, sp, sessionManager, cl, strg, redirectTpl)
-		if err != nil {
-			zap.L().Error("failed to initialize controller: %s", zap.Error(err))
-		}
-
-		prefix := strings.ToLower(string(sp.ServiceProviderType))
+	return kubernetes.NewForConfig(cfg)
+}
 
-		router.Handle(fmt.Sprintf("/%s/authenticate", prefix), http.HandlerFunc(controller.Authenticate)).Methods("GET", "POST")
-		router.Handle(fmt.Sprintf("/%s/callback", prefix), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			controller.Callback(r.Context(), w, r)
-		})).Methods("GET")
+// serviceClient creates the controller-runtime client authenticated as the service itself, able to work with the SPI
+// resources.
+func serviceClient(args *cliArgs) (client.Client, error) {
+	cfg, err := serviceConfig(args)
+	if err != nil {
+		return nil, err
 	}
 
-	zap.L().Info("Starting the server", zap.Int("port", port))
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), router)
-	if err != nil {
-		zap.L().Error("failed to start the HTTP server", zap.Error(err))
+	return controllers.CreateClient(cfg, client.Options{})
+}
+
+// serviceConfig returns the configuration of the Kubernetes clients authenticated as the service itself.
+func serviceConfig(args *cliArgs) (*rest.Config, error) {
+	if args.KubeConfig != "" {
+		return clientcmd.BuildConfigFromFlags("", args.KubeConfig)
 	}
+	return rest.InClusterConfig()
 }
 
 func kubernetesConfig(args *cliArgs) (*rest.Config, error) {
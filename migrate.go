@@ -0,0 +1,291 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/alexflint/go-arg"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// migrateStorageCommand is the command copying all the data from one token storage to another instead of running
+// the service.
+const migrateStorageCommand = "migrate-storage"
+
+// migrateStorageArgs are the arguments of the migrate-storage command.
+type migrateStorageArgs struct {
+	SourceConfig      string `arg:"--source-config,required" help:"the configuration file with the storage section of the storage to migrate the data from"`
+	DestinationConfig string `arg:"--destination-config" default:"" help:"the configuration file with the storage section of the storage to migrate the data to. If not specified, the shadow storage of the source configuration is used."`
+	ProgressFile      string `arg:"--progress-file" default:"" help:"the file recording the migrated SPIAccessTokens. The SPIAccessTokens already recorded in it are not copied again so that an interrupted migration can be resumed."`
+	SkipVerification  bool   `arg:"--skip-verification" default:"false" help:"do not compare the data in the destination storage with the source storage after copying it"`
+	DevMode           bool   `arg:"--dev-mode" default:"false" help:"create the storages in the dev mode"`
+}
+
+// migrationReport summarizes the results of the migration.
+type migrationReport struct {
+	Owners int
+	Copied int
+	// Skipped is the number of the owners copied by a previous run according to the progress file.
+	Skipped  int
+	Verified bool
+	// Failed maps the owners that failed to be copied or verified to the error message.
+	Failed map[types.NamespacedName]string
+	// Diverged maps the owners that have different data in the destination storage to the names of the fields.
+	Diverged map[types.NamespacedName][]string
+}
+
+// runMigrateStorage parses the arguments of the migrate-storage command, runs the migration and prints the report. It
+// returns the exit code of the process, which is non-zero if any of the data failed to be migrated.
+func runMigrateStorage(argv []string) int {
+	args := migrateStorageArgs{}
+	parser, err := arg.NewParser(arg.Config{Program: "spi-oauth " + migrateStorageCommand}, &args)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = parser.Parse(argv); err == arg.ErrHelp {
+		parser.WriteHelp(os.Stdout)
+		return 0
+	} else if err != nil {
+		parser.Fail(err.Error())
+	}
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
+	if logger, err := loggerConfig.Build(zap.WrapCore(controllers.DefaultRedactor.WrapCore)); err == nil {
+		defer zap.ReplaceGlobals(logger)()
+	}
+
+	source, destination, err := migrationStorages(args)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to create the storages: %s\n", err.Error())
+		return 1
+	}
+
+	// the migration stops after the owner being copied on interrupt so that it can be resumed later
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := migrateStorage(ctx, source, destination, args)
+	if report != nil {
+		report.Print(os.Stdout)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to migrate the storage: %s\n", err.Error())
+		return 1
+	}
+	if len(report.Failed) > 0 || len(report.Diverged) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrationStorages creates the source and the destination storage from the configuration files in the arguments.
+// The shadow storages of the configurations are not used, except as the destination if no destination configuration
+// is specified.
+func migrationStorages(args migrateStorageArgs) (tokenstorage.TokenStorage, tokenstorage.TokenStorage, error) {
+	sourceCfg, err := controllers.LoadFileConfiguration(args.SourceConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	sourceStorageCfg := sourceCfg.Storage
+	sourceStorageCfg.Shadow = nil
+
+	destinationCfg := sourceCfg
+	var destinationStorageCfg oauthstorage.Configuration
+	if args.DestinationConfig != "" {
+		if destinationCfg, err = controllers.LoadFileConfiguration(args.DestinationConfig); err != nil {
+			return nil, nil, err
+		}
+		destinationStorageCfg = destinationCfg.Storage
+	} else if sourceCfg.Storage.Shadow != nil {
+		destinationStorageCfg = *sourceCfg.Storage.Shadow
+	} else {
+		return nil, nil, fmt.Errorf("no destination configuration is specified and the source configuration has no shadow storage")
+	}
+	destinationStorageCfg.Shadow = nil
+
+	source, err := oauthstorage.New(sourceStorageCfg, sourceCfg.Configuration, args.DevMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("source storage: %w", err)
+	}
+	destination, err := oauthstorage.New(destinationStorageCfg, destinationCfg.Configuration, args.DevMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("destination storage: %w", err)
+	}
+	return source, destination, nil
+}
+
+// migrateStorage copies the data of all the SPIAccessTokens from the source storage to the destination storage and
+// then verifies that the destination storage has the same data. The owners copied successfully are appended to
+// the progress file, if specified, as they are copied and the owners already in it are not copied again. The failures
+// of the individual owners are collected in the report, the returned error means the migration could not run at all
+// or was interrupted.
+func migrateStorage(ctx context.Context, source tokenstorage.TokenStorage, destination tokenstorage.TokenStorage, args migrateStorageArgs) (*migrationReport, error) {
+	if err := oauthstorage.CheckMigration(source, destination); err != nil {
+		return nil, err
+	}
+
+	owners, err := source.(oauthstorage.EnumerableStorage).ListOwners(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the data in the source storage: %w", err)
+	}
+
+	done, progress, err := openMigrationProgress(args.ProgressFile)
+	if err != nil {
+		return nil, err
+	}
+	if progress != nil {
+		defer progress.Close()
+	}
+
+	report := &migrationReport{
+		Owners:   len(owners),
+		Failed:   map[types.NamespacedName]string{},
+		Diverged: map[types.NamespacedName][]string{},
+	}
+
+	for _, owner := range owners {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if done[owner.String()] {
+			report.Skipped++
+			continue
+		}
+
+		if err := oauthstorage.CopyOwner(ctx, source, destination, owner); err != nil {
+			zap.L().Warn("failed to copy the data of the SPIAccessToken", zap.Stringer("owner", owner), zap.Error(err))
+			report.Failed[owner] = err.Error()
+			continue
+		}
+		report.Copied++
+
+		if progress != nil {
+			if _, err := fmt.Fprintln(progress, owner.String()); err != nil {
+				return report, fmt.Errorf("failed to record the progress: %w", err)
+			}
+			if err := progress.Sync(); err != nil {
+				return report, fmt.Errorf("failed to record the progress: %w", err)
+			}
+		}
+	}
+
+	if args.SkipVerification {
+		return report, nil
+	}
+
+	for _, owner := range owners {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if _, failed := report.Failed[owner]; failed {
+			continue
+		}
+
+		different, err := oauthstorage.CompareOwner(ctx, source, destination, owner)
+		if err != nil {
+			zap.L().Warn("failed to verify the data of the SPIAccessToken", zap.Stringer("owner", owner), zap.Error(err))
+			report.Failed[owner] = err.Error()
+		} else if len(different) > 0 {
+			report.Diverged[owner] = different
+		}
+	}
+	report.Verified = true
+
+	return report, nil
+}
+
+// openMigrationProgress reads the owners recorded in the progress file and opens it for appending. Nothing is returned
+// if no progress file is specified.
+func openMigrationProgress(path string) (map[string]bool, *os.File, error) {
+	done := map[string]bool{}
+	if path == "" {
+		return done, nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open the progress file: %w", err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("failed to read the progress file: %w", err)
+	}
+
+	// the scanner has read the file till the end, so the new records are appended
+	if _, err = file.Seek(0, io.SeekEnd); err != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("failed to read the progress file: %w", err)
+	}
+	return done, file, nil
+}
+
+// Print writes the human-readable report.
+func (r *migrationReport) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "tokens:   %d (%d copied, %d already copied, %d failed)\n", r.Owners, r.Copied, r.Skipped, len(r.Failed))
+	if r.Verified {
+		_, _ = fmt.Fprintf(w, "verified: %d diverged\n", len(r.Diverged))
+	} else {
+		_, _ = fmt.Fprintln(w, "verified: no")
+	}
+
+	if len(r.Failed) > 0 {
+		_, _ = fmt.Fprintln(w, "failed:")
+		for _, owner := range sortedMigrationOwners(r.Failed) {
+			_, _ = fmt.Fprintf(w, "  %s: %s\n", owner, r.Failed[owner])
+		}
+	}
+	if len(r.Diverged) > 0 {
+		_, _ = fmt.Fprintln(w, "diverged:")
+		owners := map[types.NamespacedName]string{}
+		for owner, fields := range r.Diverged {
+			owners[owner] = strings.Join(fields, ", ")
+		}
+		for _, owner := range sortedMigrationOwners(owners) {
+			_, _ = fmt.Fprintf(w, "  %s: %s\n", owner, owners[owner])
+		}
+	}
+}
+
+func sortedMigrationOwners(owners map[types.NamespacedName]string) []types.NamespacedName {
+	ret := make([]types.NamespacedName, 0, len(owners))
+	for owner := range owners {
+		ret = append(ret, owner)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].String() < ret[j].String()
+	})
+	return ret
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// enumerableMemoryStorage is the memoryTokenStorage able to list the tokens it keeps.
+type enumerableMemoryStorage struct {
+	*memoryTokenStorage
+}
+
+func newEnumerableMemoryStorage(tokens map[client.ObjectKey]v1beta1.Token) *enumerableMemoryStorage {
+	return &enumerableMemoryStorage{&memoryTokenStorage{tokens: tokens}}
+}
+
+func (s *enumerableMemoryStorage) ListOwners(context.Context) ([]types.NamespacedName, error) {
+	owners := make([]types.NamespacedName, 0, len(s.tokens))
+	for owner := range s.tokens {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].String() < owners[j].String() })
+	return owners, nil
+}
+
+func (s *enumerableMemoryStorage) PurgeOwner(ctx context.Context, owner types.NamespacedName) error {
+	return s.Delete(ctx, &v1beta1.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: owner.Name, Namespace: owner.Namespace}})
+}
+
+func TestMigrateStorage(t *testing.T) {
+	ctx := context.TODO()
+	a := types.NamespacedName{Namespace: "default", Name: "a"}
+	b := types.NamespacedName{Namespace: "default", Name: "b"}
+	source := newEnumerableMemoryStorage(map[client.ObjectKey]v1beta1.Token{
+		a: {AccessToken: "token-a"},
+		b: {AccessToken: "token-b"},
+	})
+	destination := newEnumerableMemoryStorage(map[client.ObjectKey]v1beta1.Token{})
+	progressFile := filepath.Join(t.TempDir(), "progress")
+
+	report, err := migrateStorage(ctx, source, destination, migrateStorageArgs{ProgressFile: progressFile})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Owners)
+	assert.Equal(t, 2, report.Copied)
+	assert.True(t, report.Verified)
+	assert.Empty(t, report.Failed)
+	assert.Empty(t, report.Diverged)
+	assert.Equal(t, source.tokens, destination.tokens)
+
+	progress, err := ioutil.ReadFile(progressFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "default/a\ndefault/b\n", string(progress))
+
+	t.Run("resumes", func(t *testing.T) {
+		source.tokens[types.NamespacedName{Namespace: "default", Name: "c"}] = v1beta1.Token{AccessToken: "token-c"}
+		// the owners already migrated are not copied again, so the verification finds the divergence
+		source.tokens[a] = v1beta1.Token{AccessToken: "changed"}
+
+		report, err := migrateStorage(ctx, source, destination, migrateStorageArgs{ProgressFile: progressFile})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, report.Owners)
+		assert.Equal(t, 1, report.Copied)
+		assert.Equal(t, 2, report.Skipped)
+		assert.Equal(t, map[types.NamespacedName][]string{a: {"accessToken"}}, report.Diverged)
+		assert.Equal(t, "token-c", destination.tokens[types.NamespacedName{Namespace: "default", Name: "c"}].AccessToken)
+
+		out := &bytes.Buffer{}
+		report.Print(out)
+		assert.Contains(t, out.String(), "1 copied, 2 already copied")
+		assert.Contains(t, out.String(), "default/a: accessToken")
+	})
+
+	t.Run("skips verification", func(t *testing.T) {
+		report, err := migrateStorage(ctx, source, destination, migrateStorageArgs{SkipVerification: true})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, report.Copied)
+		assert.False(t, report.Verified)
+		assert.Equal(t, "changed", destination.tokens[a].AccessToken)
+	})
+
+	t.Run("stops on interrupt", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := migrateStorage(canceled, source, destination, migrateStorageArgs{})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestMigrateStorageNotEnumerable(t *testing.T) {
+	_, err := migrateStorage(context.TODO(), &memoryTokenStorage{}, &memoryTokenStorage{}, migrateStorageArgs{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,388 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauthservice
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexedwards/scs"
+	"github.com/alexedwards/scs/stores/memstore"
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	oauthstorage "github.com/redhat-appstudio/service-provider-integration-oauth/tokenstorage"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+func OkHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// routedMethods are the methods checked when listing the methods allowed for a path in the Allow header.
+var routedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// MethodNotAllowedHandler responds with 405 to the requests whose path is routed, but not for their method. The Allow
+// header lists the methods the path is routed for.
+func MethodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := []string{}
+		for _, method := range routedMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			match := mux.RouteMatch{}
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+func CallbackSuccessHandler(templates *controllers.Templates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := controllers.CallbackSuccessPageData{Pending: r.URL.Query().Get("pending") == "true"}
+		if err := templates.Execute(w, controllers.CallbackSuccessTemplate, data); err != nil {
+			controllers.LoggerFromContext(r.Context()).Error("failed to process template", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+func CallbackErrorHandler(templates *controllers.Templates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		errorMsg := q.Get("error")
+		errorDescription := q.Get("error_description")
+		data := controllers.ErrorPageData{
+			Title:   errorMsg,
+			Message: errorDescription,
+		}
+
+		err := templates.Execute(w, controllers.CallbackErrorTemplate, data)
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			controllers.LoggerFromContext(r.Context()).Error("failed to process template", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(fmt.Sprintf("Error response returned to OAuth callback: %s. Message: %s ", errorMsg, errorDescription)))
+		}
+	}
+}
+
+// uploader is the common interface of the TokenUploader and the CredentialsUploader.
+type uploader interface {
+	Handle(r *http.Request) error
+}
+
+func handleUpload(uploader uploader) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := uploader.Handle(r); err != nil {
+			w.WriteHeader(apiErrorStatus(err))
+			controllers.LoggerFromContext(r.Context()).Error("error handling upload", zap.String("path", r.URL.Path), zap.Error(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiErrorStatus returns the HTTP status of the Kubernetes API error or 500 for the other errors.
+func apiErrorStatus(err error) int {
+	if status := errors.APIStatus(nil); stderrors.As(err, &status) {
+		return int(status.Status().Code)
+	}
+	return http.StatusInternalServerError
+}
+
+// handleDownload responds with the status of the Kubernetes API error if the token cannot be downloaded.
+func handleDownload(downloader *controllers.TokenDownloader) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := downloader.Handle(w, r); err != nil {
+			w.WriteHeader(apiErrorStatus(err))
+			controllers.LoggerFromContext(r.Context()).Error("error handling the token download", zap.String("path", r.URL.Path), zap.Error(err))
+		}
+	}
+}
+
+// serviceProviderHandler returns a handler that delegates to the provided function with the controller of the service
+// provider. If the controller of the service provider failed to initialize, the handler responds with 503.
+func serviceProviderHandler(sp *controllers.ServiceProvider, errorPages *controllers.ErrorPages, handler func(controllers.Controller, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		controller, err := sp.Controller()
+		if err != nil {
+			errorPages.Error(w, r, http.StatusServiceUnavailable, fmt.Sprintf("service provider %s is not available", sp.Config.ServiceProviderType), err)
+			return
+		}
+
+		handler(controller, w, r)
+	}
+}
+
+// ReadyzHandler returns the detailed readiness of the service. The service is considered ready if at least one of the
+// configured service providers can be used and all the components of the lifecycle (if not nil) are running and
+// healthy.
+func ReadyzHandler(sps *controllers.ServiceProviders, lifecycle *controllers.Lifecycle) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		ready := sps.Ready()
+
+		var components []controllers.ComponentStatus
+		if lifecycle != nil {
+			components = lifecycle.Status()
+			for _, component := range components {
+				if component.State != controllers.ComponentRunning || component.Error != "" {
+					ready = false
+				}
+			}
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJson(w, status, struct {
+			Ready            bool                                `json:"ready"`
+			ServiceProviders []controllers.ServiceProviderStatus `json:"serviceProviders"`
+			Components       []controllers.ComponentStatus       `json:"components,omitempty"`
+		}{
+			Ready:            ready,
+			ServiceProviders: sps.Status(),
+			Components:       components,
+		})
+	}
+}
+
+// ProvidersHandler returns the list of the configured service providers along with their status.
+func ProvidersHandler(sps *controllers.ServiceProviders) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJson(w, http.StatusOK, sps.Status())
+	}
+}
+
+// SelfCheckHandler returns the report of the self-check of the live configuration. The response has the 503 status if
+// any of the checks failed.
+func SelfCheckHandler(checker *controllers.SelfChecker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := checker.Check(r)
+		if err != nil {
+			w.WriteHeader(apiErrorStatus(err))
+			controllers.LoggerFromContext(r.Context()).Error("failed to authorize the self-check", zap.Error(err))
+			return
+		}
+
+		status := http.StatusOK
+		if !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		writeJson(w, status, report)
+	}
+}
+
+// FlowStatsHandler serves the flow statistics to the authorized users.
+func FlowStatsHandler(reporter *controllers.FlowStatsReporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := reporter.Report(r)
+		if err != nil {
+			w.WriteHeader(apiErrorStatus(err))
+			controllers.LoggerFromContext(r.Context()).Debug("failed to authorize the flow statistics", zap.Error(err))
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJson(w, http.StatusOK, report)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		zap.L().Error("failed to write the JSON response", zap.Error(err))
+	}
+}
+
+// newTokenStorage creates the token storage from the configuration. In the dry-run mode, the returned storage never
+// writes anything.
+func newTokenStorage(cfg controllers.FileConfiguration, dryRun bool, devmode bool) (tokenstorage.TokenStorage, error) {
+	strg, err := oauthstorage.New(cfg.Storage, cfg.Configuration, devmode)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		strg = oauthstorage.DryRun(strg)
+	}
+	return strg, nil
+}
+
+// closeTokenStorage releases the resources of the token storage if it holds any.
+func closeTokenStorage(strg tokenstorage.TokenStorage) error {
+	if closer, ok := strg.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// storageChanged checks whether the token storage needs to be recreated after the configuration change.
+func storageChanged(oldCfg, newCfg controllers.FileConfiguration) bool {
+	return !oldCfg.Storage.Equal(newCfg.Storage) ||
+		// the storages can derive their defaults from these
+		oldCfg.VaultHost != newCfg.VaultHost ||
+		oldCfg.ServiceAccountTokenFilePath != newCfg.ServiceAccountTokenFilePath
+}
+
+// sessionCookieName is the name of the cookie identifying the session of the user.
+const sessionCookieName = "appstudio_spi_session"
+
+// newSessionManager creates the manager of the sessions keeping the OAuth flows in progress.
+func newSessionManager() *scs.Manager {
+	// the session times out together with the flows it keeps and stale sessions are cleaned every 5 minutes
+	sessionManager := scs.NewManager(memstore.New(5 * time.Minute))
+	sessionManager.Name(sessionCookieName)
+	sessionManager.IdleTimeout(controllers.MaxFlowDuration)
+	return sessionManager
+}
+
+// newRouter sets up all the routes of the service based on the provided configuration. All the routes are registered
+// under the configured path prefix.
+func newRouter(cfg controllers.OAuthServiceConfiguration, cl controllers.AuthenticatingClient, strg tokenstorage.TokenStorage, sessionManager *scs.Manager, templates *controllers.Templates, lifecycle *controllers.Lifecycle) *mux.Router {
+	root := mux.NewRouter()
+	root.Use(controllers.RequestLoggerMiddleware)
+	if !cfg.DisableCompression {
+		root.Use(controllers.CompressionMiddleware)
+	}
+	if cfg.FaultInjection {
+		root.Use(controllers.FaultInjectionMiddleware(cfg.Faults, sessionCookieName))
+	}
+	root.Use(controllers.FormParsingMiddleware)
+	router := root
+	if cfg.PathPrefix != "" {
+		router = root.PathPrefix(cfg.PathPrefix).Subrouter()
+	}
+	router.MethodNotAllowedHandler = MethodNotAllowedHandler(router)
+
+	tokenUploader := controllers.TokenUploader{
+		K8sClient: cl,
+		Storage: tokenstorage.NotifyingTokenStorage{
+			Client:       cl,
+			TokenStorage: strg,
+		},
+	}
+
+	//static routes first
+	router.HandleFunc("/health", OkHandler).Methods("GET")
+	router.HandleFunc("/ready", OkHandler).Methods("GET")
+	router.Handle("/metrics", controllers.MetricsHandler()).Methods("GET")
+	router.HandleFunc("/callback_success", CallbackSuccessHandler(templates)).Methods("GET")
+	router.PathPrefix(controllers.AssetsPath).Handler(templates.Assets()).Methods("GET", "HEAD")
+	router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(handleUpload(&tokenUploader)).Methods("POST")
+	tokenDownloader := controllers.TokenDownloader{
+		K8sClient:  cl,
+		Storage:    strg,
+		Events:     cfg.Events,
+		Identities: cfg.Identities,
+	}
+	router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(handleDownload(&tokenDownloader)).Methods("GET")
+	if credentialsStorage, ok := strg.(oauthstorage.CredentialsStorage); ok {
+		credentialsUploader := controllers.CredentialsUploader{
+			K8sClient: cl,
+			Storage:   credentialsStorage,
+		}
+		router.NewRoute().Path("/credentials/{namespace}/{name}").HandlerFunc(handleUpload(&credentialsUploader)).Methods("POST")
+	}
+
+	errorPages := &controllers.ErrorPages{Templates: templates, Verbose: cfg.VerboseErrors}
+
+	serviceProviders := controllers.NewServiceProviders(cfg.ServiceProviders, func(sp config.ServiceProviderConfiguration) (controllers.Controller, error) {
+		zap.L().Debug("initializing service provider controller", zap.String("type", string(sp.ServiceProviderType)), zap.String("url", sp.ServiceProviderBaseUrl))
+		return controllers.FromConfiguration(cfg, sp, sessionManager, cl, strg, templates)
+	})
+
+	if cfg.CredentialsMonitor != nil {
+		cfg.CredentialsMonitor.SetServiceProviders(serviceProviders)
+	}
+	if cfg.ProviderMetadata != nil {
+		cfg.ProviderMetadata.SetServiceProviders(serviceProviders)
+	}
+
+	router.HandleFunc("/readyz", ReadyzHandler(serviceProviders, lifecycle)).Methods("GET")
+	router.HandleFunc("/providers", ProvidersHandler(serviceProviders)).Methods("GET")
+	router.HandleFunc("/selfcheck", SelfCheckHandler(&controllers.SelfChecker{K8sClient: cl, Storage: strg, ServiceProviders: serviceProviders})).Methods("GET")
+	if cfg.Stats != nil {
+		router.HandleFunc("/stats", FlowStatsHandler(&controllers.FlowStatsReporter{K8sClient: cl, Stats: cfg.Stats, ServiceProviders: serviceProviders})).Methods("GET")
+	}
+
+	for _, sp := range serviceProviders.Providers {
+		// initialize the controllers eagerly so that we know about the misconfigured service providers early, but
+		// carry on serving the rest of them if some fail.
+		if _, err := sp.Controller(); err != nil {
+			zap.L().Error("failed to initialize controller, the service provider will not be available", zap.String("type", string(sp.Config.ServiceProviderType)), zap.Error(err))
+		}
+
+		prefix := sp.UrlPrefix()
+
+		router.Handle(fmt.Sprintf("/%s/authenticate", prefix), serviceProviderHandler(sp, errorPages, func(c controllers.Controller, w http.ResponseWriter, r *http.Request) {
+			c.Authenticate(w, r)
+		})).Methods("GET", "POST")
+		router.Handle(fmt.Sprintf("/%s/authenticate/link", prefix), serviceProviderHandler(sp, errorPages, func(c controllers.Controller, w http.ResponseWriter, r *http.Request) {
+			c.AuthenticateLink(w, r)
+		})).Methods("POST")
+		router.Handle(fmt.Sprintf("/%s/callback", prefix), serviceProviderHandler(sp, errorPages, func(c controllers.Controller, w http.ResponseWriter, r *http.Request) {
+			c.Callback(r.Context(), w, r)
+		})).Methods("GET")
+		router.Handle(fmt.Sprintf("/%s/refresh/{namespace}/{name}", prefix), serviceProviderHandler(sp, errorPages, func(c controllers.Controller, w http.ResponseWriter, r *http.Request) {
+			c.Refresh(w, r)
+		})).Methods("POST")
+		router.Handle(fmt.Sprintf("/%s/lookup/{namespace}", prefix), serviceProviderHandler(sp, errorPages, func(c controllers.Controller, w http.ResponseWriter, r *http.Request) {
+			c.Lookup(w, r)
+		})).Methods("GET", "POST")
+		router.Handle(fmt.Sprintf("/%s/reauthorize/{namespace}/{name}", prefix), serviceProviderHandler(sp, errorPages, func(c controllers.Controller, w http.ResponseWriter, r *http.Request) {
+			c.Reauthorize(w, r)
+		})).Methods("POST")
+	}
+
+	// the errors reported by the known service providers are handled by their controllers so that the users can be
+	// redirected to the failure URL of the flow
+	router.NewRoute().Path("/{type}/callback").Queries("error", "", "error_description", "").HandlerFunc(CallbackErrorHandler(templates)).Methods("GET")
+
+	return root
+}
+
+// reloadableHandler is an HTTP handler delegating to another handler that can be swapped at runtime.
+type reloadableHandler struct {
+	lock    sync.RWMutex
+	handler http.Handler
+}
+
+func (h *reloadableHandler) Set(handler http.Handler) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handler = handler
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.RLock()
+	handler := h.handler
+	h.lock.RUnlock()
+
+	handler.ServeHTTP(w, r)
+}
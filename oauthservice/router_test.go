@@ -0,0 +1,391 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauthservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestHealthCheckHandler(t *testing.T) {
+	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
+	// pass 'nil' as the third parameter.
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(OkHandler)
+
+	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+	// directly and pass in our Request and ResponseRecorder.
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestReadyCheckHandler(t *testing.T) {
+	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
+	// pass 'nil' as the third parameter.
+	req, err := http.NewRequest("GET", "/ready", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(OkHandler)
+
+	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+	// directly and pass in our Request and ResponseRecorder.
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestCallbackSuccessHandler(t *testing.T) {
+	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
+	// pass 'nil' as the third parameter.
+	req, err := http.NewRequest("GET", "/callback_success", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := CallbackSuccessHandler(loadTemplates(t))
+
+	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+	// directly and pass in our Request and ResponseRecorder.
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	assert.NotContains(t, rr.Body.String(), "finalized shortly")
+
+	req, err = http.NewRequest("GET", "/callback_success?pending=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "finalized shortly")
+}
+
+func TestCallbackErrorHandler(t *testing.T) {
+	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
+	// pass 'nil' as the third parameter.
+	req, err := http.NewRequest("GET", "/github/callback?error=foo&error_description=bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+	handler := CallbackErrorHandler(loadTemplates(t))
+
+	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
+	// directly and pass in our Request and ResponseRecorder.
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	sps := controllers.NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, func(spConfig config.ServiceProviderConfiguration) (controllers.Controller, error) {
+		return nil, fmt.Errorf("broken")
+	})
+
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	ReadyzHandler(sps, nil)(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	body := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	assert.Equal(t, false, body["ready"])
+	assert.Len(t, body["serviceProviders"], 1)
+}
+
+func TestReadyzHandlerComponents(t *testing.T) {
+	sps := controllers.NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, func(spConfig config.ServiceProviderConfiguration) (controllers.Controller, error) {
+		return nil, nil
+	})
+
+	lifecycle := controllers.NewLifecycle()
+	lifecycle.Add(controllers.Component{Name: "server", Start: func(_ context.Context) error { return nil }})
+
+	serve := func() (int, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		ReadyzHandler(sps, lifecycle)(rr, httptest.NewRequest("GET", "/readyz", nil))
+		body := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		return rr.Code, body
+	}
+
+	status, body := serve()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "server", "state": "pending"}}, body["components"])
+
+	assert.NoError(t, lifecycle.Start(context.TODO()))
+	status, body = serve()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, body["ready"])
+}
+
+func TestProvidersHandler(t *testing.T) {
+	sps := controllers.NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+		{ServiceProviderType: config.ServiceProviderTypeQuay},
+	}, func(spConfig config.ServiceProviderConfiguration) (controllers.Controller, error) {
+		if spConfig.ServiceProviderType == config.ServiceProviderTypeQuay {
+			return nil, fmt.Errorf("broken")
+		}
+		return nil, nil
+	})
+
+	req, err := http.NewRequest("GET", "/providers", nil)
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	ProvidersHandler(sps)(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var statuses []controllers.ServiceProviderStatus
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&statuses))
+	assert.Len(t, statuses, 2)
+	assert.True(t, statuses[0].Ready)
+	assert.False(t, statuses[1].Ready)
+	assert.Equal(t, controllers.ServiceProviderReasonInitializationFailed, statuses[1].Reason)
+	assert.NotContains(t, rr.Body.String(), "broken")
+}
+
+func TestRouterPathPrefix(t *testing.T) {
+	cfg := controllers.OAuthServiceConfiguration{
+		PathPrefix: controllers.NormalizePathPrefix("api/spi-oauth/"),
+	}
+	router := newRouter(cfg, nil, nil, nil, loadTemplates(t), nil)
+
+	test := func(path string, expectedStatus int) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, expectedStatus, rr.Code, path)
+	}
+
+	test("/api/spi-oauth/health", http.StatusOK)
+	test("/api/spi-oauth/callback_success", http.StatusOK)
+	test("/health", http.StatusNotFound)
+	test("/callback_success", http.StatusNotFound)
+}
+
+func TestRouterAssets(t *testing.T) {
+	prefix := "/api/spi-oauth"
+	templates, err := controllers.LoadTemplates("../static", prefix)
+	assert.NoError(t, err)
+	router := newRouter(controllers.OAuthServiceConfiguration{PathPrefix: prefix}, nil, nil, nil, templates, nil)
+
+	// the rendered page links to the stylesheet served by the router
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", prefix+"/callback_success", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	stylesheet, err := templates.Assets().Path("spi.css")
+	assert.NoError(t, err)
+	assert.Contains(t, rr.Body.String(), `href="`+stylesheet+`"`)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", stylesheet, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "public, max-age=31536000, immutable", rr.Header().Get("Cache-Control"))
+	assert.Contains(t, rr.Body.String(), ".masthead")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", prefix+"/assets/missing.css", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	for _, prefix := range []string{"", "/api/spi-oauth"} {
+		cfg := controllers.OAuthServiceConfiguration{
+			PathPrefix: prefix,
+		}
+		cfg.ServiceProviders = []config.ServiceProviderConfiguration{{ServiceProviderType: config.ServiceProviderTypeGitHub}}
+		router := newRouter(cfg, nil, nil, nil, loadTemplates(t), nil)
+
+		test := func(method string, path string, expectedStatus int, expectedAllow string) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(method, prefix+path, nil))
+			assert.Equal(t, expectedStatus, rr.Code, method+" "+prefix+path)
+			assert.Equal(t, expectedAllow, rr.Header().Get("Allow"), method+" "+prefix+path)
+		}
+
+		test("POST", "/health", http.StatusMethodNotAllowed, "GET")
+		test("DELETE", "/token/default/mytoken", http.StatusMethodNotAllowed, "GET, POST")
+		test("POST", "/github/callback?error=access_denied&error_description=denied", http.StatusMethodNotAllowed, "GET")
+		test("GET", "/github/refresh/default/mytoken", http.StatusMethodNotAllowed, "POST")
+		test("PUT", "/github/authenticate", http.StatusMethodNotAllowed, "GET, POST")
+		test("POST", "/nonexistent", http.StatusNotFound, "")
+	}
+}
+
+func TestRouterMalformedForm(t *testing.T) {
+	router := newRouter(controllers.OAuthServiceConfiguration{}, nil, nil, nil, loadTemplates(t), nil)
+
+	req := httptest.NewRequest("POST", "/token/default/mytoken", strings.NewReader("state="+strings.Repeat("a", controllers.MaxFormSize)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func loadTemplates(t *testing.T) *controllers.Templates {
+	templates, err := controllers.LoadTemplates("../static", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+// allowingClient allows all the self subject access reviews.
+type allowingClient struct {
+	client.Client
+}
+
+func (c *allowingClient) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok {
+		review.Status.Allowed = true
+	}
+	return nil
+}
+
+// emptyTokenStorage is the token storage that doesn't store anything.
+type emptyTokenStorage struct{}
+
+var _ tokenstorage.TokenStorage = emptyTokenStorage{}
+
+func (emptyTokenStorage) Store(context.Context, *v1beta1.SPIAccessToken, *v1beta1.Token) error {
+	return nil
+}
+
+func (emptyTokenStorage) Get(context.Context, *v1beta1.SPIAccessToken) (*v1beta1.Token, error) {
+	return nil, nil
+}
+
+func (emptyTokenStorage) Delete(context.Context, *v1beta1.SPIAccessToken) error {
+	return nil
+}
+
+func TestSelfCheckHandler(t *testing.T) {
+	sps := controllers.NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, func(spConfig config.ServiceProviderConfiguration) (controllers.Controller, error) {
+		return nil, fmt.Errorf("broken")
+	})
+	handler := SelfCheckHandler(&controllers.SelfChecker{K8sClient: &allowingClient{}, Storage: emptyTokenStorage{}, ServiceProviders: sps})
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/selfcheck", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest("GET", "/selfcheck", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	report := controllers.SelfCheckReport{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+	assert.False(t, report.Healthy)
+	assert.Len(t, report.Checks, 2)
+	assert.Equal(t, controllers.SelfCheckFailed, report.Checks[1].Status)
+	assert.Equal(t, "broken", report.Checks[1].Message)
+}
+
+func TestFlowStatsHandler(t *testing.T) {
+	sps := controllers.NewServiceProviders([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, func(spConfig config.ServiceProviderConfiguration) (controllers.Controller, error) {
+		return nil, fmt.Errorf("broken")
+	})
+	handler := FlowStatsHandler(&controllers.FlowStatsReporter{K8sClient: &allowingClient{}, Stats: controllers.NewFlowStats(), ServiceProviders: sps})
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest("GET", "/stats?window=0s", nil)
+	req.Header.Set("Authorization", "Bearer dashboard")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req = httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Authorization", "Bearer dashboard")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+
+	report := controllers.FlowStatsReport{}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+	assert.Equal(t, 0, report.Pending[config.ServiceProviderTypeGitHub])
+	assert.Len(t, report.Windows, len(controllers.DefaultFlowStatsWindows))
+	assert.Contains(t, report.Windows[0].ServiceProviders, config.ServiceProviderTypeGitHub)
+}
+
+func TestApiErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusForbidden, apiErrorStatus(errors.NewForbidden(schema.GroupResource{Resource: "spiaccesstokens"}, "token", fmt.Errorf("nope"))))
+	assert.Equal(t, http.StatusNotFound, apiErrorStatus(fmt.Errorf("wrapped: %w", errors.NewNotFound(schema.GroupResource{Resource: "spiaccesstokens"}, "token"))))
+	assert.Equal(t, http.StatusInternalServerError, apiErrorStatus(fmt.Errorf("broken")))
+}
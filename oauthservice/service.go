@@ -0,0 +1,375 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oauthservice provides the OAuth service as a library, so that its routes can be mounted into an existing HTTP
+// server instead of running the service as a separate deployment.
+package oauthservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/alexedwards/scs"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	authz "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The names of the components of the service managed by its lifecycle.
+const (
+	componentKubernetesClient = "kubernetes-client"
+	componentSessionStore     = "session-store"
+	componentTemplates        = "templates"
+	componentTokenStorage     = "token-storage"
+	componentStorageRetries   = "storage-retries"
+	componentStorageGc        = "storage-gc"
+	componentCredentials      = "credentials-monitor"
+	componentProviderMetadata = "provider-metadata"
+	componentRouter           = "router"
+	componentConfigWatcher    = "config-watcher"
+)
+
+// Config is the configuration of the embedded OAuth service.
+type Config struct {
+	controllers.OAuthServiceConfiguration
+
+	// KubeConfig is the configuration of the client of the Kubernetes API server the requests are made to with
+	// the tokens of the users. Required unless the Client is provided.
+	KubeConfig *rest.Config
+	// ReloadKubeConfig loads the KubeConfig again when the Kubernetes client is re-initialized by the KubernetesMonitor,
+	// so that the refreshed credentials are picked up. Optional, the KubeConfig is reused if not specified.
+	ReloadKubeConfig func() (*rest.Config, error)
+	// Client is the client of the Kubernetes API server to use instead of the one created from the KubeConfig, e.g. in
+	// the tests.
+	Client controllers.AuthenticatingClient
+	// TokenStorage is the token storage to use instead of the one created from the configuration, e.g. in the tests.
+	// The storage is then not recreated when the configuration changes.
+	TokenStorage tokenstorage.TokenStorage
+	// TemplatesDir is the directory with the HTML templates. Required.
+	TemplatesDir string
+	// DevMode allows the insecure connections to the Kubernetes API server if no CA certificate is configured and makes
+	// the token storage use its development defaults.
+	DevMode bool
+	// WatchConfiguration starts watching the configuration for changes and calls onChange with the changed
+	// configuration until the context is cancelled. Optional, the configuration is not reloaded if not specified.
+	WatchConfiguration func(ctx context.Context, onChange func(controllers.FileConfiguration)) error
+}
+
+// Service is the OAuth service. Its routes are served by the Handler once the service is started.
+type Service struct {
+	cfg       Config
+	lifecycle *controllers.Lifecycle
+	handler   *reloadableHandler
+
+	cl             controllers.AuthenticatingClient
+	sessionManager *scs.Manager
+	templates      *controllers.Templates
+	strg           tokenstorage.TokenStorage
+}
+
+// New creates the OAuth service from the configuration. The service must be started before its handler can serve
+// the requests.
+func New(cfg Config) (*Service, error) {
+	if cfg.KubeConfig == nil && cfg.Client == nil {
+		return nil, fmt.Errorf("either the kubernetes configuration or the kubernetes client must be provided")
+	}
+	if cfg.TemplatesDir == "" {
+		return nil, fmt.Errorf("the directory with the HTML templates must be provided")
+	}
+
+	if cfg.Stats == nil {
+		cfg.Stats = controllers.NewFlowStats()
+	}
+	if cfg.AuthorizedLinks == nil {
+		cfg.AuthorizedLinks = controllers.NewAuthorizedLinks(controllers.DefaultAuthorizedLinkTtl)
+	}
+
+	s := &Service{
+		cfg:       cfg,
+		lifecycle: controllers.NewLifecycle(),
+		handler:   &reloadableHandler{},
+	}
+	s.handler.Set(http.HandlerFunc(notRunningHandler))
+	s.addComponents()
+	return s, nil
+}
+
+// Start starts the subsystems of the service. If any of them fails to start, the already started ones are stopped and
+// the error is returned. The service cannot be started again once stopped.
+func (s *Service) Start(ctx context.Context) error {
+	return s.lifecycle.Start(ctx)
+}
+
+// Stop stops the subsystems of the service within the deadline of the context. The handler responds with 503 once
+// the service is stopped.
+func (s *Service) Stop(ctx context.Context) error {
+	return s.lifecycle.Stop(ctx)
+}
+
+// Handler returns the HTTP handler serving all the routes of the service under the configured path prefix. It responds
+// with 503 until the service is started.
+func (s *Service) Handler() http.Handler {
+	return s.handler
+}
+
+// Status reports the status of the subsystems of the service.
+func (s *Service) Status() []controllers.ComponentStatus {
+	return s.lifecycle.Status()
+}
+
+func (s *Service) addComponents() {
+	cfg := s.cfg
+
+	s.lifecycle.Add(controllers.Component{
+		Name: componentKubernetesClient,
+		Start: func(ctx context.Context) error {
+			cl := cfg.Client
+			if cl == nil {
+				var err error
+				if cl, err = newClient(cfg.KubeConfig, cfg.DevMode); err != nil {
+					return fmt.Errorf("failed to create kubernetes client: %w", err)
+				}
+				if cfg.KubernetesMonitor != nil && controllers.HasServiceCredentials(cfg.KubeConfig) {
+					reloadable := controllers.NewReloadableClient(cl)
+					cfg.KubernetesMonitor.SetClient(reloadable, cfg.KubeConfig, s.reinitializeClient)
+					cfg.KubernetesMonitor.Start(ctx)
+					cl = reloadable
+				}
+			}
+			if cfg.DryRun {
+				zap.L().Warn("running in the dry-run mode, the tokens are not stored and nothing is changed in the cluster")
+				cl = controllers.NewDryRunClient(cl)
+			}
+			s.cl = cl
+			return nil
+		},
+		Health: func() error {
+			if cfg.KubernetesMonitor == nil {
+				return nil
+			}
+			return cfg.KubernetesMonitor.Health()
+		},
+	})
+
+	s.lifecycle.Add(controllers.Component{
+		Name: componentSessionStore,
+		Start: func(_ context.Context) error {
+			s.sessionManager = newSessionManager()
+			return nil
+		},
+	})
+
+	s.lifecycle.Add(controllers.Component{
+		Name: componentTemplates,
+		Start: func(ctx context.Context) error {
+			requiredTemplates := []string{controllers.RedirectNoticeTemplate, controllers.CallbackSuccessTemplate, controllers.CallbackErrorTemplate}
+			if cfg.ConsentPreview {
+				requiredTemplates = append(requiredTemplates, controllers.ConsentPreviewTemplate)
+			}
+			templates, err := controllers.LoadTemplates(cfg.TemplatesDir, cfg.PathPrefix, requiredTemplates...)
+			if err != nil {
+				return fmt.Errorf("failed to parse the HTML templates: %w", err)
+			}
+
+			if err = templates.Watch(ctx); err != nil {
+				return fmt.Errorf("failed to start watching the HTML templates for changes: %w", err)
+			}
+			s.templates = templates
+			return nil
+		},
+	})
+
+	s.lifecycle.Add(controllers.Component{
+		Name: componentTokenStorage,
+		Start: func(_ context.Context) error {
+			if cfg.TokenStorage != nil {
+				s.strg = cfg.TokenStorage
+				return nil
+			}
+			strg, err := newTokenStorage(cfg.FileConfiguration, cfg.DryRun, cfg.DevMode)
+			if err != nil {
+				return fmt.Errorf("failed to create token storage interface: %w", err)
+			}
+			s.strg = strg
+			return nil
+		},
+		Stop: func(_ context.Context) error {
+			if cfg.TokenStorage != nil {
+				return nil
+			}
+			return closeTokenStorage(s.strg)
+		},
+	})
+
+	if cfg.StorageRetries != nil {
+		s.lifecycle.Add(controllers.Component{
+			Name:      componentStorageRetries,
+			DependsOn: []string{componentKubernetesClient, componentTokenStorage},
+			Start: func(ctx context.Context) error {
+				cfg.StorageRetries.SetStorage(s.cl, s.strg)
+				cfg.StorageRetries.Start(ctx)
+				return nil
+			},
+		})
+	}
+	if cfg.StorageGc != nil {
+		s.lifecycle.Add(controllers.Component{
+			Name:      componentStorageGc,
+			DependsOn: []string{componentTokenStorage},
+			Start: func(ctx context.Context) error {
+				cfg.StorageGc.SetStorage(s.strg)
+				cfg.StorageGc.Start(ctx)
+				return nil
+			},
+		})
+	}
+
+	s.lifecycle.Add(controllers.Component{
+		Name:      componentRouter,
+		DependsOn: []string{componentKubernetesClient, componentSessionStore, componentTemplates, componentTokenStorage},
+		Start: func(_ context.Context) error {
+			s.handler.Set(newRouter(cfg.OAuthServiceConfiguration, s.cl, s.strg, s.sessionManager, s.templates, s.lifecycle))
+			return nil
+		},
+		Stop: func(_ context.Context) error {
+			s.handler.Set(http.HandlerFunc(notRunningHandler))
+			return nil
+		},
+	})
+
+	if cfg.CredentialsMonitor != nil {
+		s.lifecycle.Add(controllers.Component{
+			Name:      componentCredentials,
+			DependsOn: []string{componentRouter},
+			Start: func(ctx context.Context) error {
+				cfg.CredentialsMonitor.Start(ctx)
+				return nil
+			},
+		})
+	}
+
+	if cfg.ProviderMetadata != nil {
+		s.lifecycle.Add(controllers.Component{
+			Name:      componentProviderMetadata,
+			DependsOn: []string{componentRouter},
+			Start: func(ctx context.Context) error {
+				cfg.ProviderMetadata.Start(ctx)
+				return nil
+			},
+		})
+	}
+
+	if cfg.WatchConfiguration != nil {
+		s.lifecycle.Add(controllers.Component{
+			Name:      componentConfigWatcher,
+			DependsOn: []string{componentRouter},
+			Start: func(ctx context.Context) error {
+				if err := cfg.WatchConfiguration(ctx, s.reload); err != nil {
+					return fmt.Errorf("failed to start watching the configuration for changes: %w", err)
+				}
+				return nil
+			},
+		})
+	}
+}
+
+// reload applies the changed configuration. The session manager and the kubernetes client survive the configuration
+// changes so that the OAuth flows in progress can finish. The rest is rebuilt from the new configuration.
+func (s *Service) reload(newCfg controllers.FileConfiguration) {
+	if s.cfg.Fips {
+		if err := controllers.ValidateFips(newCfg); err != nil {
+			zap.L().Error("the changed configuration is not compliant with the FIPS mode, keeping the current configuration", zap.Error(err))
+			return
+		}
+	}
+
+	reloadedCfg := s.cfg.OAuthServiceConfiguration
+	reloadedCfg.FileConfiguration = newCfg
+
+	if s.cfg.TokenStorage == nil && storageChanged(s.cfg.FileConfiguration, newCfg) {
+		newStrg, err := newTokenStorage(newCfg, s.cfg.DryRun, s.cfg.DevMode)
+		if err != nil {
+			zap.L().Error("failed to create token storage interface for the changed configuration, keeping the current configuration", zap.Error(err))
+			return
+		}
+		oldStrg := s.strg
+		s.strg = newStrg
+		// the requests in flight can still use the previous storage, it only stops renewing its credentials
+		if err := closeTokenStorage(oldStrg); err != nil {
+			zap.L().Warn("failed to close the previous token storage", zap.Error(err))
+		}
+		if s.cfg.StorageRetries != nil {
+			s.cfg.StorageRetries.SetStorage(s.cl, s.strg)
+		}
+		if s.cfg.StorageGc != nil {
+			s.cfg.StorageGc.SetStorage(s.strg)
+		}
+	}
+
+	// keep redacting the previous secrets too, they can still appear in the errors of the requests in flight
+	controllers.DefaultRedactor.SetSecrets(append(controllers.FileConfigurationSecrets(s.cfg.FileConfiguration), controllers.FileConfigurationSecrets(newCfg)...)...)
+	s.cfg.FileConfiguration = newCfg
+
+	s.handler.Set(newRouter(reloadedCfg, s.cl, s.strg, s.sessionManager, s.templates, s.lifecycle))
+	zap.L().Info("the changed configuration applied")
+}
+
+// newClient creates the client of the Kubernetes API server authenticating using the tokens of the users.
+func newClient(kubeConfig *rest.Config, devmode bool) (controllers.AuthenticatingClient, error) {
+	// insecure mode only allowed when the trusted root certificate is not specified...
+	if devmode && kubeConfig.TLSClientConfig.CAFile == "" {
+		kubeConfig.Insecure = true
+	}
+
+	// we can't use the default dynamic rest mapper, because we don't have a token that would enable us to connect
+	// to the cluster just yet. Therefore, we need to list all the resources that we are ever going to query using our
+	// client here thus making the mapper not reach out to the target cluster at all.
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{})
+	mapper.Add(authz.SchemeGroupVersion.WithKind("SelfSubjectAccessReview"), meta.RESTScopeRoot)
+	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessToken"), meta.RESTScopeNamespace)
+	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessTokenDataUpdate"), meta.RESTScopeNamespace)
+	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessTokenBinding"), meta.RESTScopeNamespace)
+
+	return controllers.CreateClient(kubeConfig, client.Options{
+		Mapper: mapper,
+	})
+}
+
+// reinitializeClient creates a new Kubernetes client with the configuration loaded again, if possible.
+func (s *Service) reinitializeClient() (controllers.AuthenticatingClient, *rest.Config, error) {
+	kubeConfig := rest.CopyConfig(s.cfg.KubeConfig)
+	if s.cfg.ReloadKubeConfig != nil {
+		var err error
+		if kubeConfig, err = s.cfg.ReloadKubeConfig(); err != nil {
+			return nil, nil, fmt.Errorf("failed to load the kubernetes configuration: %w", err)
+		}
+	}
+
+	cl, err := newClient(kubeConfig, s.cfg.DevMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return cl, kubeConfig, nil
+}
+
+// notRunningHandler responds to all the requests made while the service is not running.
+func notRunningHandler(w http.ResponseWriter, _ *http.Request) {
+	http.Error(w, "the OAuth service is not running", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauthservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewValidation(t *testing.T) {
+	_, err := New(Config{TemplatesDir: "../static"})
+	assert.Error(t, err)
+
+	_, err = New(Config{Client: fake.NewClientBuilder().Build()})
+	assert.Error(t, err)
+}
+
+func TestService(t *testing.T) {
+	var onChange func(controllers.FileConfiguration)
+	fileCfg := controllers.FileConfiguration{}
+	fileCfg.ServiceProviders = []config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub, ClientId: "id", ClientSecret: "secret"},
+	}
+	fileCfg.BaseUrl = "https://spi.example.com"
+	fileCfg.SharedSecret = []byte("secret")
+
+	service, err := New(Config{
+		OAuthServiceConfiguration: controllers.OAuthServiceConfiguration{
+			FileConfiguration: fileCfg,
+			PathPrefix:        "/api/spi-oauth",
+		},
+		Client:       fake.NewClientBuilder().Build(),
+		TokenStorage: emptyTokenStorage{},
+		TemplatesDir: "../static",
+		WatchConfiguration: func(_ context.Context, f func(controllers.FileConfiguration)) error {
+			onChange = f
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		service.Handler().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+	providers := func() []controllers.ServiceProviderStatus {
+		var statuses []controllers.ServiceProviderStatus
+		assert.NoError(t, json.NewDecoder(get("/api/spi-oauth/providers").Body).Decode(&statuses))
+		return statuses
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, get("/api/spi-oauth/health").Code)
+
+	assert.NoError(t, service.Start(context.TODO()))
+	assert.Equal(t, http.StatusOK, get("/api/spi-oauth/health").Code)
+	assert.Equal(t, http.StatusOK, get("/api/spi-oauth/readyz").Code)
+	assert.Len(t, providers(), 1)
+	for _, status := range service.Status() {
+		assert.Equal(t, controllers.ComponentRunning, status.State, status.Name)
+	}
+
+	t.Run("configuration reloaded", func(t *testing.T) {
+		reloaded := fileCfg
+		reloaded.ServiceProviders = append(reloaded.ServiceProviders, config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeQuay, ClientId: "id", ClientSecret: "secret"})
+		onChange(reloaded)
+		assert.Len(t, providers(), 2)
+	})
+
+	assert.NoError(t, service.Stop(context.TODO()))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/api/spi-oauth/health").Code)
+}
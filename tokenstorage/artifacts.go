@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+)
+
+// ArtifactKind identifies the individual artifacts obtained from the service provider for a single SPIAccessToken.
+type ArtifactKind string
+
+const (
+	AccessTokenArtifact  ArtifactKind = "access_token"
+	RefreshTokenArtifact ArtifactKind = "refresh_token"
+	IdTokenArtifact      ArtifactKind = "id_token"
+)
+
+// AllArtifactKinds lists all the known artifact kinds.
+var AllArtifactKinds = []ArtifactKind{AccessTokenArtifact, RefreshTokenArtifact, IdTokenArtifact}
+
+// Artifact is a single token artifact with its own lifecycle.
+type Artifact struct {
+	// Value is the value of the artifact, e.g. the access token itself.
+	Value string `json:"value"`
+	// TokenType is the type of the token as reported by the service provider, e.g. "bearer".
+	TokenType string `json:"tokenType,omitempty"`
+	// ExpiresAt is the unix time when the artifact expires. Zero means the artifact doesn't expire or the expiry is
+	// unknown.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Scopes are the scopes granted to the access token. Only set on the access token artifact, where it is used to
+	// find the stored tokens usable for a request without performing a new OAuth flow.
+	Scopes []string `json:"scopes,omitempty"`
+	// Capabilities are the capabilities of the access token relevant to SPI, e.g. "push", determined when the token is
+	// obtained. Only set on the access token artifact.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Artifacts are the artifacts of a single SPIAccessToken.
+type Artifacts map[ArtifactKind]Artifact
+
+// ArtifactStorage is implemented by the token storages that are able to store the token artifacts as distinct
+// entries. This enables the individual artifacts (e.g. the refresh token) to be managed independently of the others.
+type ArtifactStorage interface {
+	// StoreArtifacts stores the provided artifacts. The artifacts not present in the map are left untouched.
+	StoreArtifacts(ctx context.Context, owner *api.SPIAccessToken, artifacts Artifacts) error
+	// GetArtifact returns the artifact of given kind or nil if it is not stored.
+	GetArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) (*Artifact, error)
+	// GetArtifacts returns all the stored artifacts of the token.
+	GetArtifacts(ctx context.Context, owner *api.SPIAccessToken) (Artifacts, error)
+	// DeleteArtifact deletes the artifact of given kind. Deleting a non-existent artifact is not an error.
+	DeleteArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) error
+}
+
+// Expired checks whether the artifact is expired at the provided time.
+func (a *Artifact) Expired(now time.Time) bool {
+	return a.ExpiresAt != 0 && now.Unix() >= a.ExpiresAt
+}
+
+// blobArtifactStorage stores each artifact as a separate blob.
+type blobArtifactStorage struct {
+	store BlobStore
+}
+
+var _ ArtifactStorage = (*blobArtifactStorage)(nil)
+
+// NewBlobArtifactStorage returns the artifact storage storing each artifact as a separate entry in the blob store.
+func NewBlobArtifactStorage(store BlobStore) ArtifactStorage {
+	return &blobArtifactStorage{store: store}
+}
+
+func (s *blobArtifactStorage) StoreArtifacts(ctx context.Context, owner *api.SPIAccessToken, artifacts Artifacts) error {
+	for kind, artifact := range artifacts {
+		data, err := json.Marshal(artifact)
+		if err != nil {
+			return err
+		}
+		if err = s.store.Write(ctx, artifactPath(owner, kind), data); err != nil {
+			return fmt.Errorf("failed to store the %s artifact: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+func (s *blobArtifactStorage) GetArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) (*Artifact, error) {
+	data, err := s.store.Read(ctx, artifactPath(owner, kind))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	artifact := &Artifact{}
+	if err = json.Unmarshal(data, artifact); err != nil {
+		return nil, fmt.Errorf("corrupted %s artifact of the token %s/%s: %w", kind, owner.Namespace, owner.Name, err)
+	}
+	return artifact, nil
+}
+
+func (s *blobArtifactStorage) GetArtifacts(ctx context.Context, owner *api.SPIAccessToken) (Artifacts, error) {
+	artifacts := Artifacts{}
+	for _, kind := range AllArtifactKinds {
+		artifact, err := s.GetArtifact(ctx, owner, kind)
+		if err != nil {
+			return nil, err
+		}
+		if artifact != nil {
+			artifacts[kind] = *artifact
+		}
+	}
+	return artifacts, nil
+}
+
+func (s *blobArtifactStorage) DeleteArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) error {
+	return s.store.Delete(ctx, artifactPath(owner, kind))
+}
+
+func artifactPath(owner *api.SPIAccessToken, kind ArtifactKind) string {
+	return owner.Namespace + "/" + owner.Name + "/" + string(kind)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobArtifactStorage(t *testing.T) {
+	store := &memoryBlobStore{}
+	strg := NewBlobArtifactStorage(store)
+	ctx := context.TODO()
+
+	artifacts, err := strg.GetArtifacts(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Empty(t, artifacts)
+
+	assert.NoError(t, strg.StoreArtifacts(ctx, testOwner, Artifacts{
+		AccessTokenArtifact:  {Value: "access", TokenType: "bearer", ExpiresAt: 42},
+		RefreshTokenArtifact: {Value: "refresh", ExpiresAt: 4200},
+	}))
+	assert.ElementsMatch(t, []string{"default/token/access_token", "default/token/refresh_token"}, store.paths(""))
+
+	access, err := strg.GetArtifact(ctx, testOwner, AccessTokenArtifact)
+	assert.NoError(t, err)
+	assert.Equal(t, &Artifact{Value: "access", TokenType: "bearer", ExpiresAt: 42}, access)
+
+	idToken, err := strg.GetArtifact(ctx, testOwner, IdTokenArtifact)
+	assert.NoError(t, err)
+	assert.Nil(t, idToken)
+
+	// storing a single artifact leaves the others untouched
+	assert.NoError(t, strg.StoreArtifacts(ctx, testOwner, Artifacts{AccessTokenArtifact: {Value: "access2"}}))
+	artifacts, err = strg.GetArtifacts(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Artifacts{
+		AccessTokenArtifact:  {Value: "access2"},
+		RefreshTokenArtifact: {Value: "refresh", ExpiresAt: 4200},
+	}, artifacts)
+
+	assert.NoError(t, strg.DeleteArtifact(ctx, testOwner, RefreshTokenArtifact))
+	assert.NoError(t, strg.DeleteArtifact(ctx, testOwner, IdTokenArtifact))
+	artifacts, err = strg.GetArtifacts(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Artifacts{AccessTokenArtifact: {Value: "access2"}}, artifacts)
+}
+
+func TestBlobArtifactStorageCorrupted(t *testing.T) {
+	store := &memoryBlobStore{}
+	assert.NoError(t, store.Write(context.TODO(), "default/token/access_token", []byte("{")))
+
+	_, err := NewBlobArtifactStorage(store).GetArtifact(context.TODO(), testOwner, AccessTokenArtifact)
+	assert.Error(t, err)
+}
+
+func TestArtifactExpired(t *testing.T) {
+	now := time.Unix(100, 0)
+	assert.False(t, (&Artifact{}).Expired(now))
+	assert.False(t, (&Artifact{ExpiresAt: 101}).Expired(now))
+	assert.True(t, (&Artifact{ExpiresAt: 100}).Expired(now))
+}
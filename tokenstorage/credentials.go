@@ -0,0 +1,235 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxChunkSize is the default maximum size of a single chunk written to the BlobStore. It is set so that
+// the chunk fits into the commonly used size limits of the storage backends (e.g. 512KiB of Consul behind Vault) even
+// after the base64 encoding.
+const DefaultMaxChunkSize = 256 * 1024
+
+// credentialKeyRegex is the allowed format of the keys of the credentials. It is the same as the format of the keys
+// of the Kubernetes secrets.
+var credentialKeyRegex = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// Credentials are the arbitrary keyed credential data associated with an SPIAccessToken that don't fit into
+// the fixed fields of the token, e.g. GitHub App private keys, kubeconfigs or multi-part robot account credentials.
+type Credentials map[string][]byte
+
+// CredentialsStorage is implemented by the token storages that are able to store the arbitrary credentials alongside
+// the tokens.
+type CredentialsStorage interface {
+	// StoreCredentials replaces the credentials associated with the token.
+	StoreCredentials(ctx context.Context, owner *api.SPIAccessToken, credentials Credentials) error
+	// GetCredentials returns the credentials associated with the token or nil if there are none.
+	GetCredentials(ctx context.Context, owner *api.SPIAccessToken) (Credentials, error)
+	// DeleteCredentials deletes the credentials associated with the token.
+	DeleteCredentials(ctx context.Context, owner *api.SPIAccessToken) error
+}
+
+// BlobStore is the minimal interface of a backend able to store opaque binary data under hierarchical paths. It is
+// used to implement the CredentialsStorage on top of the backends with the size limits of the individual entries.
+type BlobStore interface {
+	// Write stores the data under the path, replacing the previous data, if any.
+	Write(ctx context.Context, path string, data []byte) error
+	// Read returns the data stored under the path or nil if there is no data.
+	Read(ctx context.Context, path string) ([]byte, error)
+	// Delete deletes the data stored under the path. Deleting non-existent data is not an error.
+	Delete(ctx context.Context, path string) error
+}
+
+// chunkedCredentialsStorage implements the CredentialsStorage by splitting the credentials into chunks of limited
+// size. A manifest stored under the path of the token describes the chunks.
+type chunkedCredentialsStorage struct {
+	store        BlobStore
+	maxChunkSize int
+}
+
+// credentialsManifest describes the chunks of the stored credentials. The chunks of each store operation are
+// written under a new generation so that the readers never see a mix of the old and new chunks.
+type credentialsManifest struct {
+	Generation string         `json:"generation"`
+	Chunks     map[string]int `json:"chunks"`
+}
+
+var _ CredentialsStorage = (*chunkedCredentialsStorage)(nil)
+
+// NewChunkedCredentialsStorage returns the credentials storage that splits the credentials into chunks of at most
+// maxChunkSize bytes stored in the provided blob store. DefaultMaxChunkSize is used if maxChunkSize is not positive.
+func NewChunkedCredentialsStorage(store BlobStore, maxChunkSize int) CredentialsStorage {
+	if maxChunkSize <= 0 {
+		maxChunkSize = DefaultMaxChunkSize
+	}
+	return &chunkedCredentialsStorage{store: store, maxChunkSize: maxChunkSize}
+}
+
+func (s *chunkedCredentialsStorage) StoreCredentials(ctx context.Context, owner *api.SPIAccessToken, credentials Credentials) error {
+	for key := range credentials {
+		if !credentialKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid credentials key '%s', only alphanumeric characters, '-', '_' and '.' are allowed", key)
+		}
+	}
+
+	old, err := s.readManifest(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	generation, err := newGeneration()
+	if err != nil {
+		return err
+	}
+
+	manifest := &credentialsManifest{Generation: generation, Chunks: map[string]int{}}
+	for _, key := range sortedKeys(credentials) {
+		data := credentials[key]
+		count := 0
+		for start := 0; start < len(data) || count == 0; start += s.maxChunkSize {
+			end := start + s.maxChunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if err = s.store.Write(ctx, chunkPath(owner, generation, key, count), data[start:end]); err != nil {
+				return fmt.Errorf("failed to write the chunk %d of the credentials key %s: %w", count, key, err)
+			}
+			count++
+		}
+		manifest.Chunks[key] = count
+	}
+
+	if err = s.writeManifest(ctx, owner, manifest); err != nil {
+		return err
+	}
+
+	// the new credentials are in place, the failure to clean up the old ones is not fatal
+	if old != nil {
+		if err = s.deleteChunks(ctx, owner, old); err != nil {
+			zap.L().Warn("failed to delete the previous chunks of the credentials", zap.String("token", owner.Name), zap.String("namespace", owner.Namespace), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+func (s *chunkedCredentialsStorage) GetCredentials(ctx context.Context, owner *api.SPIAccessToken) (Credentials, error) {
+	manifest, err := s.readManifest(ctx, owner)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+
+	credentials := Credentials{}
+	for key, count := range manifest.Chunks {
+		var data []byte
+		for i := 0; i < count; i++ {
+			chunk, err := s.store.Read(ctx, chunkPath(owner, manifest.Generation, key, i))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the chunk %d of the credentials key %s: %w", i, key, err)
+			}
+			if chunk == nil {
+				return nil, fmt.Errorf("the chunk %d of the credentials key %s is missing", i, key)
+			}
+			data = append(data, chunk...)
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		credentials[key] = data
+	}
+
+	return credentials, nil
+}
+
+func (s *chunkedCredentialsStorage) DeleteCredentials(ctx context.Context, owner *api.SPIAccessToken) error {
+	manifest, err := s.readManifest(ctx, owner)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	// delete the manifest first so that no one sees partially deleted credentials
+	if err = s.store.Delete(ctx, manifestPath(owner)); err != nil {
+		return err
+	}
+
+	return s.deleteChunks(ctx, owner, manifest)
+}
+
+func (s *chunkedCredentialsStorage) readManifest(ctx context.Context, owner *api.SPIAccessToken) (*credentialsManifest, error) {
+	data, err := s.store.Read(ctx, manifestPath(owner))
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	manifest := &credentialsManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("corrupted credentials manifest of the token %s/%s: %w", owner.Namespace, owner.Name, err)
+	}
+	return manifest, nil
+}
+
+func (s *chunkedCredentialsStorage) writeManifest(ctx context.Context, owner *api.SPIAccessToken, manifest *credentialsManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return s.store.Write(ctx, manifestPath(owner), data)
+}
+
+func (s *chunkedCredentialsStorage) deleteChunks(ctx context.Context, owner *api.SPIAccessToken, manifest *credentialsManifest) error {
+	for key, count := range manifest.Chunks {
+		for i := 0; i < count; i++ {
+			if err := s.store.Delete(ctx, chunkPath(owner, manifest.Generation, key, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func manifestPath(owner *api.SPIAccessToken) string {
+	return owner.Namespace + "/" + owner.Name
+}
+
+func chunkPath(owner *api.SPIAccessToken, generation string, key string, index int) string {
+	return manifestPath(owner) + "/" + generation + "/" + key + "/" + strconv.Itoa(index)
+}
+
+func newGeneration() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func sortedKeys(credentials Credentials) []string {
+	keys := make([]string, 0, len(credentials))
+	for k := range credentials {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
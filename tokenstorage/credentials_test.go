@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type memoryBlobStore struct {
+	lock  sync.Mutex
+	blobs map[string][]byte
+}
+
+func (m *memoryBlobStore) Write(_ context.Context, path string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.blobs == nil {
+		m.blobs = map[string][]byte{}
+	}
+	m.blobs[path] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memoryBlobStore) Read(_ context.Context, path string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.blobs[path], nil
+}
+
+func (m *memoryBlobStore) Delete(_ context.Context, path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.blobs, path)
+	return nil
+}
+
+func (m *memoryBlobStore) paths(prefix string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var ret []string
+	for p := range m.blobs {
+		if strings.HasPrefix(p, prefix) {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// testTokenStorage is the token storage calling the provided functions. The operations without a function do nothing
+// and no token is found.
+type testTokenStorage struct {
+	StoreImpl  func(context.Context, *api.SPIAccessToken, *api.Token) error
+	GetImpl    func(context.Context, *api.SPIAccessToken) (*api.Token, error)
+	DeleteImpl func(context.Context, *api.SPIAccessToken) error
+}
+
+var _ tokenstorage.TokenStorage = testTokenStorage{}
+
+func (s testTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	if s.StoreImpl == nil {
+		return nil
+	}
+	return s.StoreImpl(ctx, owner, token)
+}
+
+func (s testTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	if s.GetImpl == nil {
+		return nil, nil
+	}
+	return s.GetImpl(ctx, owner)
+}
+
+func (s testTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	if s.DeleteImpl == nil {
+		return nil
+	}
+	return s.DeleteImpl(ctx, owner)
+}
+
+var testOwner = &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"}}
+
+func TestChunkedCredentialsStorage(t *testing.T) {
+	store := &memoryBlobStore{}
+	strg := NewChunkedCredentialsStorage(store, 10)
+	ctx := context.TODO()
+
+	creds, err := strg.GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Nil(t, creds)
+
+	privateKey := bytes.Repeat([]byte("0123456789"), 5)
+	privateKey = append(privateKey, 'x')
+
+	assert.NoError(t, strg.StoreCredentials(ctx, testOwner, Credentials{
+		"private-key": privateKey,
+		"app.id":      []byte("42"),
+		"empty":       {},
+	}))
+
+	// 1 manifest + 6 chunks of the private key + 1 chunk of the app ID + 1 chunk of the empty value
+	assert.Len(t, store.paths("default/token"), 9)
+	for _, p := range store.paths("default/token/") {
+		assert.LessOrEqual(t, len(store.blobs[p]), 10, p)
+	}
+
+	creds, err = strg.GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{"private-key": privateKey, "app.id": []byte("42"), "empty": {}}, creds)
+
+	// overwriting removes the old chunks
+	assert.NoError(t, strg.StoreCredentials(ctx, testOwner, Credentials{"app.id": []byte("43")}))
+	assert.Len(t, store.paths("default/token"), 2)
+
+	creds, err = strg.GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{"app.id": []byte("43")}, creds)
+
+	assert.NoError(t, strg.DeleteCredentials(ctx, testOwner))
+	assert.Empty(t, store.paths("default/token"))
+
+	creds, err = strg.GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Nil(t, creds)
+}
+
+func TestChunkedCredentialsStorageInvalidKey(t *testing.T) {
+	store := &memoryBlobStore{}
+	strg := NewChunkedCredentialsStorage(store, 0)
+
+	assert.Error(t, strg.StoreCredentials(context.TODO(), testOwner, Credentials{"../escape": []byte("data")}))
+	assert.Empty(t, store.paths(""))
+}
+
+func TestChunkedCredentialsStorageMissingChunk(t *testing.T) {
+	store := &memoryBlobStore{}
+	strg := NewChunkedCredentialsStorage(store, 2)
+
+	assert.NoError(t, strg.StoreCredentials(context.TODO(), testOwner, Credentials{"key": []byte("12345")}))
+
+	for _, p := range store.paths("default/token/") {
+		if strings.HasSuffix(p, "/1") {
+			assert.NoError(t, store.Delete(context.TODO(), p))
+		}
+	}
+
+	_, err := strg.GetCredentials(context.TODO(), testOwner)
+	assert.Error(t, err)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DryRun wraps the provided storage such that it never writes anything. The reads are delegated to the storage and
+// the would-be writes are only logged, without the secret values. The returned storage supports the artifacts and
+// the credentials only if the provided storage does. Listing the owners is delegated to the storage, failing with
+// ErrListingNotSupported if it is not an EnumerableStorage, the same way the self-check fails with
+// ErrSelfCheckNotSupported if it is not a SelfCheckingStorage.
+func DryRun(storage tokenstorage.TokenStorage) tokenstorage.TokenStorage {
+	tokens := &dryRunTokenStorage{storage: storage}
+	artifactStorage, hasArtifacts := storage.(ArtifactStorage)
+	credentialsStorage, hasCredentials := storage.(CredentialsStorage)
+
+	switch {
+	case hasArtifacts && hasCredentials:
+		return &struct {
+			*dryRunTokenStorage
+			*dryRunArtifactStorage
+			*dryRunCredentialsStorage
+		}{tokens, &dryRunArtifactStorage{storage: artifactStorage}, &dryRunCredentialsStorage{storage: credentialsStorage}}
+	case hasArtifacts:
+		return &struct {
+			*dryRunTokenStorage
+			*dryRunArtifactStorage
+		}{tokens, &dryRunArtifactStorage{storage: artifactStorage}}
+	case hasCredentials:
+		return &struct {
+			*dryRunTokenStorage
+			*dryRunCredentialsStorage
+		}{tokens, &dryRunCredentialsStorage{storage: credentialsStorage}}
+	default:
+		return tokens
+	}
+}
+
+type dryRunTokenStorage struct {
+	storage tokenstorage.TokenStorage
+}
+
+func (s *dryRunTokenStorage) Store(_ context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	logDryRun("store the token", owner,
+		zap.String("tokenType", token.TokenType),
+		zap.Bool("hasRefreshToken", token.RefreshToken != ""),
+		zap.Uint64("expiry", token.Expiry))
+	return nil
+}
+
+func (s *dryRunTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	return s.storage.Get(ctx, owner)
+}
+
+func (s *dryRunTokenStorage) Delete(_ context.Context, owner *api.SPIAccessToken) error {
+	logDryRun("delete the token", owner)
+	return nil
+}
+
+func (s *dryRunTokenStorage) ListOwners(ctx context.Context) ([]types.NamespacedName, error) {
+	enumerable, ok := s.storage.(EnumerableStorage)
+	if !ok {
+		return nil, ErrListingNotSupported
+	}
+	return enumerable.ListOwners(ctx)
+}
+
+func (s *dryRunTokenStorage) PurgeOwner(_ context.Context, owner types.NamespacedName) error {
+	if _, ok := s.storage.(EnumerableStorage); !ok {
+		return ErrListingNotSupported
+	}
+	zap.L().Info("dry run: would purge the data of the token", zap.String("token", owner.Name), zap.String("namespace", owner.Namespace))
+	return nil
+}
+
+// Close closes the wrapped storage if it needs closing.
+func (s *dryRunTokenStorage) Close() error {
+	if closer, ok := s.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *dryRunTokenStorage) SelfCheck(ctx context.Context) error {
+	checking, ok := s.storage.(SelfCheckingStorage)
+	if !ok {
+		return ErrSelfCheckNotSupported
+	}
+	return checking.SelfCheck(ctx)
+}
+
+type dryRunArtifactStorage struct {
+	storage ArtifactStorage
+}
+
+func (s *dryRunArtifactStorage) StoreArtifacts(_ context.Context, owner *api.SPIAccessToken, artifacts Artifacts) error {
+	kinds := make([]string, 0, len(artifacts))
+	for kind := range artifacts {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	logDryRun("store the token artifacts", owner, zap.Strings("artifacts", kinds))
+	return nil
+}
+
+func (s *dryRunArtifactStorage) GetArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) (*Artifact, error) {
+	return s.storage.GetArtifact(ctx, owner, kind)
+}
+
+func (s *dryRunArtifactStorage) GetArtifacts(ctx context.Context, owner *api.SPIAccessToken) (Artifacts, error) {
+	return s.storage.GetArtifacts(ctx, owner)
+}
+
+func (s *dryRunArtifactStorage) DeleteArtifact(_ context.Context, owner *api.SPIAccessToken, kind ArtifactKind) error {
+	logDryRun("delete the token artifact", owner, zap.String("artifact", string(kind)))
+	return nil
+}
+
+type dryRunCredentialsStorage struct {
+	storage CredentialsStorage
+}
+
+func (s *dryRunCredentialsStorage) StoreCredentials(_ context.Context, owner *api.SPIAccessToken, credentials Credentials) error {
+	keys := make([]string, 0, len(credentials))
+	for key := range credentials {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	logDryRun("store the credentials", owner, zap.Strings("keys", keys))
+	return nil
+}
+
+func (s *dryRunCredentialsStorage) GetCredentials(ctx context.Context, owner *api.SPIAccessToken) (Credentials, error) {
+	return s.storage.GetCredentials(ctx, owner)
+}
+
+func (s *dryRunCredentialsStorage) DeleteCredentials(_ context.Context, owner *api.SPIAccessToken) error {
+	logDryRun("delete the credentials", owner)
+	return nil
+}
+
+// logDryRun logs the would-be action on the data of the token.
+func logDryRun(action string, owner *api.SPIAccessToken, fields ...zap.Field) {
+	zap.L().Info("dry run: would "+action, append([]zap.Field{zap.String("token", owner.Name), zap.String("namespace", owner.Namespace)}, fields...)...)
+}
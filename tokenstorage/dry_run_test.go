@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	ctx := context.TODO()
+	store := &memoryBlobStore{}
+	stored := &api.Token{AccessToken: "stored"}
+
+	artifacts := NewBlobArtifactStorage(store)
+	credentials := NewChunkedCredentialsStorage(store, DefaultMaxChunkSize)
+	assert.NoError(t, artifacts.StoreArtifacts(ctx, testOwner, Artifacts{AccessTokenArtifact: {Value: "access"}}))
+	assert.NoError(t, credentials.StoreCredentials(ctx, testOwner, Credentials{"key": []byte("value")}))
+	blobs := store.paths("")
+
+	writes := 0
+	tokens := testTokenStorage{
+		StoreImpl: func(context.Context, *api.SPIAccessToken, *api.Token) error {
+			writes++
+			return nil
+		},
+		GetImpl: func(context.Context, *api.SPIAccessToken) (*api.Token, error) {
+			return stored, nil
+		},
+		DeleteImpl: func(context.Context, *api.SPIAccessToken) error {
+			writes++
+			return nil
+		},
+	}
+
+	strg := DryRun(&struct {
+		testTokenStorage
+		ArtifactStorage
+		CredentialsStorage
+	}{tokens, artifacts, credentials})
+
+	assert.NoError(t, strg.Store(ctx, testOwner, &api.Token{AccessToken: "new", RefreshToken: "refresh"}))
+	assert.NoError(t, strg.Delete(ctx, testOwner))
+	assert.Equal(t, 0, writes)
+
+	token, err := strg.Get(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, stored, token)
+
+	dryArtifacts, ok := strg.(ArtifactStorage)
+	assert.True(t, ok)
+	assert.NoError(t, dryArtifacts.StoreArtifacts(ctx, testOwner, Artifacts{AccessTokenArtifact: {Value: "new"}}))
+	assert.NoError(t, dryArtifacts.DeleteArtifact(ctx, testOwner, AccessTokenArtifact))
+	access, err := dryArtifacts.GetArtifact(ctx, testOwner, AccessTokenArtifact)
+	assert.NoError(t, err)
+	assert.Equal(t, "access", access.Value)
+
+	dryCredentials, ok := strg.(CredentialsStorage)
+	assert.True(t, ok)
+	assert.NoError(t, dryCredentials.StoreCredentials(ctx, testOwner, Credentials{"key": []byte("new")}))
+	assert.NoError(t, dryCredentials.DeleteCredentials(ctx, testOwner))
+	creds, err := dryCredentials.GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{"key": []byte("value")}, creds)
+
+	assert.Equal(t, blobs, store.paths(""))
+}
+
+func TestDryRunCapabilities(t *testing.T) {
+	strg := DryRun(testTokenStorage{})
+	_, ok := strg.(ArtifactStorage)
+	assert.False(t, ok)
+	_, ok = strg.(CredentialsStorage)
+	assert.False(t, ok)
+
+	strg = DryRun(&struct {
+		testTokenStorage
+		ArtifactStorage
+	}{testTokenStorage{}, NewBlobArtifactStorage(&memoryBlobStore{})})
+	_, ok = strg.(ArtifactStorage)
+	assert.True(t, ok)
+	_, ok = strg.(CredentialsStorage)
+	assert.False(t, ok)
+}
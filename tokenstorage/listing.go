@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ErrListingNotSupported is returned by the EnumerableStorage wrappers if the wrapped storage is not able to enumerate
+// its data.
+var ErrListingNotSupported = errors.New("the token storage is not able to enumerate the stored data")
+
+// EnumerableStorage is implemented by the token storages that are able to enumerate the SPIAccessTokens they keep any
+// data for. This enables finding and removing the data left behind by the SPIAccessTokens that no longer exist.
+type EnumerableStorage interface {
+	// ListOwners returns the namespaces and names of all the SPIAccessTokens the storage keeps the token,
+	// the credentials or the artifacts for, sorted and without duplicates.
+	ListOwners(ctx context.Context) ([]types.NamespacedName, error)
+
+	// PurgeOwner permanently removes all the data kept for the SPIAccessToken, including any data the storage
+	// keeps after the token, the credentials or the artifacts are deleted, so that the owner is no longer listed.
+	PurgeOwner(ctx context.Context, owner types.NamespacedName) error
+}
+
+// sortedOwners returns the owners sorted by the namespace and the name.
+func sortedOwners(owners map[types.NamespacedName]bool) []types.NamespacedName {
+	ret := make([]types.NamespacedName, 0, len(owners))
+	for owner := range owners {
+		ret = append(ret, owner)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Namespace != ret[j].Namespace {
+			return ret[i].Namespace < ret[j].Namespace
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestVaultStorage(t *testing.T) (*fakeVault, *vaultStorage) {
+	fake, srv := newFakeVault(t)
+
+	cfg := vault.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := vault.NewClient(cfg)
+	assert.NoError(t, err)
+	client.SetToken("vault-token")
+
+	return fake, &vaultStorage{
+		TokenStorage:       &vaultTokenStorage{client: client},
+		CredentialsStorage: NewChunkedCredentialsStorage(&vaultBlobStore{client: client, prefix: vaultCredentialsPathPrefix}, 0),
+		ArtifactStorage:    NewBlobArtifactStorage(&vaultBlobStore{client: client, prefix: vaultArtifactsPathPrefix}),
+		client:             client,
+	}
+}
+
+func TestVaultStorageListOwners(t *testing.T) {
+	fake, strg := newTestVaultStorage(t)
+	ctx := context.TODO()
+
+	owners, err := strg.ListOwners(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, owners)
+
+	token := func(namespace, name string) *api.SPIAccessToken {
+		return &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	}
+	assert.NoError(t, strg.Store(ctx, token("default", "token"), &api.Token{AccessToken: "access"}))
+	assert.NoError(t, strg.StoreArtifacts(ctx, token("default", "token"), Artifacts{AccessTokenArtifact: {Value: "access"}}))
+	assert.NoError(t, strg.StoreCredentials(ctx, token("other", "creds-only"), Credentials{"key": []byte("value")}))
+	assert.NoError(t, strg.StoreArtifacts(ctx, token("default", "artifacts-only"), Artifacts{RefreshTokenArtifact: {Value: "refresh"}}))
+	assert.NoError(t, strg.Store(ctx, token("other", "a-token"), &api.Token{AccessToken: "access"}))
+	// the namespaces can be named the same as the directories of the credentials and the artifacts
+	assert.NoError(t, strg.Store(ctx, token("credentials", "token"), &api.Token{AccessToken: "access"}))
+	assert.NoError(t, strg.Store(ctx, token("artifacts", "token"), &api.Token{AccessToken: "access"}))
+	assert.Contains(t, fake.data, "spi/data/_credentials/other/creds-only")
+
+	owners, err = strg.ListOwners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{
+		{Namespace: "artifacts", Name: "token"},
+		{Namespace: "credentials", Name: "token"},
+		{Namespace: "default", Name: "artifacts-only"},
+		{Namespace: "default", Name: "token"},
+		{Namespace: "other", Name: "a-token"},
+		{Namespace: "other", Name: "creds-only"},
+	}, owners)
+}
+
+func TestVaultStoragePurgeOwner(t *testing.T) {
+	fake, strg := newTestVaultStorage(t)
+	ctx := context.TODO()
+	other := &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}}
+
+	assert.NoError(t, strg.Store(ctx, testOwner, &api.Token{AccessToken: "access"}))
+	assert.NoError(t, strg.StoreArtifacts(ctx, testOwner, Artifacts{AccessTokenArtifact: {Value: "access"}, RefreshTokenArtifact: {Value: "refresh"}}))
+	assert.NoError(t, strg.StoreCredentials(ctx, testOwner, Credentials{"key": []byte("value")}))
+	assert.NoError(t, strg.Store(ctx, other, &api.Token{AccessToken: "other"}))
+
+	// the deleted data is still listed
+	assert.NoError(t, strg.Delete(ctx, testOwner))
+	owners, err := strg.ListOwners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "other"}, {Namespace: "default", Name: "token"}}, owners)
+
+	assert.NoError(t, strg.PurgeOwner(ctx, types.NamespacedName{Namespace: "default", Name: "token"}))
+	assert.Equal(t, []string{"spi/data/default/other"}, keysOf(fake.data))
+
+	owners, err = strg.ListOwners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "other"}}, owners)
+}
+
+func keysOf(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDryRunListOwners(t *testing.T) {
+	_, strg := newTestVaultStorage(t)
+	ctx := context.TODO()
+	assert.NoError(t, strg.Store(ctx, testOwner, &api.Token{AccessToken: "access"}))
+
+	owners, err := DryRun(strg).(EnumerableStorage).ListOwners(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "token"}}, owners)
+
+	// the dry run never purges anything
+	assert.NoError(t, DryRun(strg).(EnumerableStorage).PurgeOwner(ctx, owners[0]))
+	owners, err = strg.ListOwners(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, owners, 1)
+
+	_, err = DryRun(testTokenStorage{}).(EnumerableStorage).ListOwners(ctx)
+	assert.ErrorIs(t, err, ErrListingNotSupported)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// CheckMigration checks whether all the data of the source storage can be migrated to the destination storage, i.e.
+// the source storage is able to enumerate its data and the destination storage supports the artifacts and
+// the credentials if the source storage does.
+func CheckMigration(source tokenstorage.TokenStorage, destination tokenstorage.TokenStorage) error {
+	if _, ok := source.(EnumerableStorage); !ok {
+		return fmt.Errorf("the source storage: %w", ErrListingNotSupported)
+	}
+	if _, ok := source.(ArtifactStorage); ok {
+		if _, ok := destination.(ArtifactStorage); !ok {
+			return fmt.Errorf("the destination storage doesn't support the token artifacts the source storage keeps")
+		}
+	}
+	if _, ok := source.(CredentialsStorage); ok {
+		if _, ok := destination.(CredentialsStorage); !ok {
+			return fmt.Errorf("the destination storage doesn't support the credentials the source storage keeps")
+		}
+	}
+	return nil
+}
+
+// CopyOwner copies the token, the artifacts and the credentials kept for the SPIAccessToken from the source storage to
+// the destination storage. The data is read decrypted from the source storage and written through the destination
+// storage, so it ends up encrypted however the destination storage encrypts it. The data the source storage doesn't
+// have is left untouched in the destination storage.
+func CopyOwner(ctx context.Context, source tokenstorage.TokenStorage, destination tokenstorage.TokenStorage, owner types.NamespacedName) error {
+	spiToken := ownerToken(owner)
+
+	token, err := source.Get(ctx, spiToken)
+	if err != nil {
+		return fmt.Errorf("failed to read the token: %w", err)
+	}
+	if token != nil {
+		if err = destination.Store(ctx, spiToken, token); err != nil {
+			return fmt.Errorf("failed to store the token: %w", err)
+		}
+	}
+
+	if sourceArtifacts, ok := source.(ArtifactStorage); ok {
+		artifacts, err := sourceArtifacts.GetArtifacts(ctx, spiToken)
+		if err != nil {
+			return fmt.Errorf("failed to read the artifacts: %w", err)
+		}
+		if len(artifacts) > 0 {
+			if err = destination.(ArtifactStorage).StoreArtifacts(ctx, spiToken, artifacts); err != nil {
+				return fmt.Errorf("failed to store the artifacts: %w", err)
+			}
+		}
+	}
+
+	if sourceCredentials, ok := source.(CredentialsStorage); ok {
+		credentials, err := sourceCredentials.GetCredentials(ctx, spiToken)
+		if err != nil {
+			return fmt.Errorf("failed to read the credentials: %w", err)
+		}
+		if len(credentials) > 0 {
+			if err = destination.(CredentialsStorage).StoreCredentials(ctx, spiToken, credentials); err != nil {
+				return fmt.Errorf("failed to store the credentials: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CompareOwner compares the data kept for the SPIAccessToken in the source and the destination storage. It returns
+// the names of the fields that differ (never the values), or nil if the destination storage has the same data as
+// the source one.
+func CompareOwner(ctx context.Context, source tokenstorage.TokenStorage, destination tokenstorage.TokenStorage, owner types.NamespacedName) ([]string, error) {
+	spiToken := ownerToken(owner)
+	var different []string
+
+	sourceToken, err := source.Get(ctx, spiToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the token from the source storage: %w", err)
+	}
+	destinationToken, err := destination.Get(ctx, spiToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the token from the destination storage: %w", err)
+	}
+	switch {
+	case sourceToken == nil && destinationToken == nil:
+	case sourceToken == nil || destinationToken == nil:
+		different = append(different, "token")
+	default:
+		different = append(different, differentTokenFields(sourceToken, destinationToken)...)
+	}
+
+	if sourceArtifacts, ok := source.(ArtifactStorage); ok {
+		artifacts, err := sourceArtifacts.GetArtifacts(ctx, spiToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the artifacts from the source storage: %w", err)
+		}
+		destinationArtifacts, err := destination.(ArtifactStorage).GetArtifacts(ctx, spiToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the artifacts from the destination storage: %w", err)
+		}
+		different = append(different, differentArtifacts(artifacts, destinationArtifacts)...)
+	}
+
+	if sourceCredentials, ok := source.(CredentialsStorage); ok {
+		credentials, err := sourceCredentials.GetCredentials(ctx, spiToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the credentials from the source storage: %w", err)
+		}
+		destinationCredentials, err := destination.(CredentialsStorage).GetCredentials(ctx, spiToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the credentials from the destination storage: %w", err)
+		}
+		for _, key := range differentCredentialKeys(credentials, destinationCredentials) {
+			different = append(different, "credentials."+key)
+		}
+	}
+
+	return different, nil
+}
+
+// ownerToken returns the SPIAccessToken object identifying the owner of the data in the storages.
+func ownerToken(owner types.NamespacedName) *api.SPIAccessToken {
+	return &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: owner.Name, Namespace: owner.Namespace}}
+}
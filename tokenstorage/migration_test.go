@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCheckMigration(t *testing.T) {
+	full := func() tokenstorage.TokenStorage {
+		store := &memoryBlobStore{}
+		return &struct {
+			testTokenStorage
+			EnumerableStorage
+			ArtifactStorage
+			CredentialsStorage
+		}{testTokenStorage{}, nil, NewBlobArtifactStorage(store), NewChunkedCredentialsStorage(store, DefaultMaxChunkSize)}
+	}
+
+	assert.NoError(t, CheckMigration(full(), full()))
+	assert.ErrorIs(t, CheckMigration(testTokenStorage{}, full()), ErrListingNotSupported)
+	assert.Error(t, CheckMigration(full(), testTokenStorage{}))
+	assert.Error(t, CheckMigration(full(), &struct {
+		testTokenStorage
+		ArtifactStorage
+	}{testTokenStorage{}, NewBlobArtifactStorage(&memoryBlobStore{})}))
+}
+
+func TestCopyAndCompareOwner(t *testing.T) {
+	ctx := context.TODO()
+	owner := types.NamespacedName{Namespace: testOwner.Namespace, Name: testOwner.Name}
+
+	withData := func(tokens map[string]*api.Token, store BlobStore) tokenstorage.TokenStorage {
+		return &struct {
+			testTokenStorage
+			ArtifactStorage
+			CredentialsStorage
+		}{testTokens(tokens, nil), NewBlobArtifactStorage(store), NewChunkedCredentialsStorage(store, DefaultMaxChunkSize)}
+	}
+	sourceTokens := map[string]*api.Token{"token": {AccessToken: "access", TokenType: "bearer"}}
+	sourceStore := &memoryBlobStore{}
+	source := withData(sourceTokens, sourceStore)
+	destinationTokens := map[string]*api.Token{}
+	destination := withData(destinationTokens, &memoryBlobStore{})
+
+	assert.NoError(t, source.(ArtifactStorage).StoreArtifacts(ctx, testOwner, Artifacts{
+		AccessTokenArtifact:  {Value: "access", Scopes: []string{"repo"}},
+		RefreshTokenArtifact: {Value: "refresh"},
+	}))
+	assert.NoError(t, source.(CredentialsStorage).StoreCredentials(ctx, testOwner, Credentials{"key": []byte("value")}))
+
+	different, err := CompareOwner(ctx, source, destination, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"token", "access_token", "refresh_token", "credentials.key"}, different)
+
+	assert.NoError(t, CopyOwner(ctx, source, destination, owner))
+	assert.Equal(t, sourceTokens["token"], destinationTokens["token"])
+
+	different, err = CompareOwner(ctx, source, destination, owner)
+	assert.NoError(t, err)
+	assert.Empty(t, different)
+
+	destinationTokens["token"] = &api.Token{AccessToken: "other", TokenType: "bearer"}
+	assert.NoError(t, destination.(CredentialsStorage).StoreCredentials(ctx, testOwner, Credentials{"key": []byte("value"), "extra": []byte("x")}))
+	different, err = CompareOwner(ctx, source, destination, owner)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"accessToken", "credentials.extra"}, different)
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tokenstorage contains the registry of the token storage backends available to the OAuth service. The backend
+// is selected by name in the `storage` section of the configuration file. Custom builds can add their own backends by
+// calling Register from an init function of a package imported by the main package.
+package tokenstorage
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultStorageType is the type of the storage used when none is configured.
+const DefaultStorageType = VaultStorageType
+
+// Factory creates a new instance of the token storage from the provided parameters.
+type Factory func(params FactoryParams) (tokenstorage.TokenStorage, error)
+
+// FactoryParams are the parameters passed to the storage factories.
+type FactoryParams struct {
+	// Configuration is the configuration shared with the SPI operator. The factories can use it to derive the default
+	// values of the options not explicitly specified.
+	Configuration config.Configuration
+
+	// Options are the backend-specific options from the storage section of the configuration file.
+	Options Options
+
+	// DevMode is true if the service runs in the development mode, in which the factories can relax e.g. the TLS
+	// verification.
+	DevMode bool
+}
+
+// Configuration is the storage section of the configuration file.
+type Configuration struct {
+	// Type is the name of the storage backend as registered using the Register function. DefaultStorageType is used
+	// if not specified.
+	Type string `yaml:"type,omitempty"`
+
+	// Options are the backend-specific options.
+	Options Options `yaml:"options,omitempty"`
+
+	// Shadow is the optional configuration of the storage run in the shadow mode alongside this one. All the writes
+	// are mirrored to it and all the reads are compared with it, but only this storage is authoritative. See Shadowed.
+	Shadow *Configuration `yaml:"shadow,omitempty"`
+}
+
+// Equal checks whether the two storage configurations are the same, including the shadow storage.
+func (c Configuration) Equal(other Configuration) bool {
+	if c.Type != other.Type || !c.Options.Equal(other.Options) {
+		return false
+	}
+	if c.Shadow == nil || other.Shadow == nil {
+		return c.Shadow == nil && other.Shadow == nil
+	}
+	return c.Shadow.Equal(*other.Shadow)
+}
+
+// Options holds the backend-specific storage options as they appear in the configuration file. The factories decode
+// them into their own option structs.
+type Options struct {
+	node *yaml.Node
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Factory{}
+)
+
+// Register makes the storage factory available under the provided name. It panics if the name is already taken or
+// the factory is nil, which is a programming error.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("tokenstorage: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("tokenstorage: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// Registered returns the sorted names of all the registered storage backends.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the token storage configured in the storage configuration. If the configuration has a shadow storage,
+// the returned storage mirrors the data to it.
+func New(storageConfig Configuration, sharedConfig config.Configuration, devMode bool) (tokenstorage.TokenStorage, error) {
+	strg, err := newBackend(storageConfig, sharedConfig, devMode)
+	if err != nil || storageConfig.Shadow == nil {
+		return strg, err
+	}
+
+	if storageConfig.Shadow.Shadow != nil {
+		return nil, fmt.Errorf("the shadow token storage cannot have a shadow storage of its own")
+	}
+	shadow, err := newBackend(*storageConfig.Shadow, sharedConfig, devMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the shadow token storage: %w", err)
+	}
+
+	return Shadowed(strg, shadow), nil
+}
+
+// newBackend creates the token storage of the configured type ignoring the shadow storage.
+func newBackend(storageConfig Configuration, sharedConfig config.Configuration, devMode bool) (tokenstorage.TokenStorage, error) {
+	storageType := storageConfig.Type
+	if storageType == "" {
+		storageType = DefaultStorageType
+	}
+
+	registryLock.RLock()
+	factory, ok := registry[storageType]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown token storage type %s, the available types are: %s", storageType, strings.Join(Registered(), ", "))
+	}
+
+	strg, err := factory(FactoryParams{
+		Configuration: sharedConfig,
+		Options:       storageConfig.Options,
+		DevMode:       devMode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the %s token storage: %w", storageType, err)
+	}
+
+	return strg, nil
+}
+
+// Decode decodes the options into the provided value, which is typically a pointer to a struct with yaml tags. If
+// there are no options in the configuration, the value is left untouched.
+func (o Options) Decode(into interface{}) error {
+	if o.node == nil {
+		return nil
+	}
+	return o.node.Decode(into)
+}
+
+// Equal checks whether the two options are the same. This is used to detect whether the storage needs to be
+// recreated after a configuration change.
+func (o Options) Equal(other Options) bool {
+	var a, b interface{}
+	if o.Decode(&a) != nil || other.Decode(&b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (o *Options) UnmarshalYAML(value *yaml.Node) error {
+	o.node = value
+	return nil
+}
+
+func (o Options) MarshalYAML() (interface{}, error) {
+	return o.node, nil
+}
+
+// IsZero tells yaml whether the options are empty.
+func (o Options) IsZero() bool {
+	return o.node == nil
+}
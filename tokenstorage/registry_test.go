@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+type testOptions struct {
+	Name string `yaml:"name"`
+}
+
+func TestRegistry(t *testing.T) {
+	var receivedParams FactoryParams
+	Register("test", func(params FactoryParams) (tokenstorage.TokenStorage, error) {
+		receivedParams = params
+		return &testTokenStorage{}, nil
+	})
+
+	assert.Contains(t, Registered(), "test")
+	assert.Contains(t, Registered(), VaultStorageType)
+
+	assert.Panics(t, func() {
+		Register("test", func(params FactoryParams) (tokenstorage.TokenStorage, error) { return nil, nil })
+	})
+
+	storageCfg := Configuration{}
+	assert.NoError(t, yaml.Unmarshal([]byte("type: test\noptions:\n  name: my-storage\n"), &storageCfg))
+
+	strg, err := New(storageCfg, config.Configuration{VaultHost: "http://vault"}, true)
+	assert.NoError(t, err)
+	assert.NotNil(t, strg)
+	assert.True(t, receivedParams.DevMode)
+	assert.Equal(t, "http://vault", receivedParams.Configuration.VaultHost)
+
+	opts := testOptions{}
+	assert.NoError(t, receivedParams.Options.Decode(&opts))
+	assert.Equal(t, "my-storage", opts.Name)
+}
+
+func TestNewUnknownType(t *testing.T) {
+	_, err := New(Configuration{Type: "nonexistent"}, config.Configuration{}, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), VaultStorageType)
+}
+
+func TestOptions(t *testing.T) {
+	parse := func(data string) Options {
+		cfg := Configuration{}
+		assert.NoError(t, yaml.Unmarshal([]byte(data), &cfg))
+		return cfg.Options
+	}
+
+	empty := Options{}
+	opts := testOptions{Name: "default"}
+	assert.NoError(t, empty.Decode(&opts))
+	assert.Equal(t, "default", opts.Name)
+
+	assert.True(t, empty.Equal(Options{}))
+	assert.True(t, parse("options:\n  name: a\n").Equal(parse("options: {name: a}\n")))
+	assert.False(t, parse("options:\n  name: a\n").Equal(parse("options:\n  name: b\n")))
+	assert.False(t, parse("options:\n  name: a\n").Equal(empty))
+}
+
+func TestNewShadowed(t *testing.T) {
+	Register("shadow-test", func(params FactoryParams) (tokenstorage.TokenStorage, error) {
+		return &testTokenStorage{}, nil
+	})
+
+	storageCfg := Configuration{}
+	assert.NoError(t, yaml.Unmarshal([]byte("type: shadow-test\nshadow:\n  type: shadow-test\n"), &storageCfg))
+	strg, err := New(storageCfg, config.Configuration{}, false)
+	assert.NoError(t, err)
+	_, ok := strg.(*shadowTokenStorage)
+	assert.True(t, ok)
+
+	storageCfg.Shadow.Shadow = &Configuration{Type: "shadow-test"}
+	_, err = New(storageCfg, config.Configuration{}, false)
+	assert.Error(t, err)
+
+	storageCfg.Shadow = &Configuration{Type: "nonexistent"}
+	_, err = New(storageCfg, config.Configuration{}, false)
+	assert.Error(t, err)
+}
+
+func TestConfigurationEqual(t *testing.T) {
+	parse := func(data string) Configuration {
+		cfg := Configuration{}
+		assert.NoError(t, yaml.Unmarshal([]byte(data), &cfg))
+		return cfg
+	}
+
+	assert.True(t, parse("type: a\n").Equal(parse("type: a\n")))
+	assert.False(t, parse("type: a\n").Equal(parse("type: b\n")))
+	assert.True(t, parse("type: a\nshadow: {type: b}\n").Equal(parse("type: a\nshadow: {type: b}\n")))
+	assert.False(t, parse("type: a\nshadow: {type: b}\n").Equal(parse("type: a\n")))
+	assert.False(t, parse("type: a\nshadow: {type: b}\n").Equal(parse("type: a\nshadow: {type: b, options: {name: c}}\n")))
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// vaultSelfCheckOwner is the made-up owner whose paths are used to check the permissions of the storage in Vault. The
+// paths are never written to.
+const vaultSelfCheckOwner = "spi-self-check/probe"
+
+// vaultRequiredCapabilities are the capabilities the storage needs on the paths in the KV secrets engine of Vault.
+var vaultRequiredCapabilities = []struct {
+	path         string
+	capabilities []string
+}{
+	{vaultTokensPathPrefix + vaultSelfCheckOwner, []string{"create", "read", "update", "delete"}},
+	{vaultCredentialsPathPrefix + vaultSelfCheckOwner, []string{"create", "read", "update", "delete"}},
+	{vaultArtifactsPathPrefix + vaultSelfCheckOwner, []string{"create", "read", "update", "delete"}},
+	{vaultMetadataPathPrefix, []string{"list"}},
+	{vaultMetadataPathPrefix + vaultSelfCheckOwner, []string{"delete"}},
+	{vaultMetadataPathPrefix + vaultCredentialsDir + "/" + vaultSelfCheckOwner, []string{"list", "delete"}},
+	{vaultMetadataPathPrefix + vaultArtifactsDir + "/" + vaultSelfCheckOwner, []string{"list", "delete"}},
+}
+
+// ErrSelfCheckNotSupported is returned by the SelfCheckingStorage wrappers if the wrapped storage is not able to check
+// its permissions.
+var ErrSelfCheckNotSupported = errors.New("the token storage is not able to check its permissions")
+
+// SelfCheckingStorage is implemented by the token storages that are able to verify that they are still permitted to do
+// everything they need, e.g. after the policies of the backing store have changed.
+type SelfCheckingStorage interface {
+	// SelfCheck returns an error describing what the storage is not allowed to do. It must not modify any data.
+	SelfCheck(ctx context.Context) error
+}
+
+// SelfCheck checks the capabilities of the Vault token of the storage on the paths of the tokens, the credentials and
+// the artifacts.
+func (v *vaultStorage) SelfCheck(_ context.Context) error {
+	var missing []string
+	for _, required := range vaultRequiredCapabilities {
+		capabilities, err := v.client.Sys().CapabilitiesSelf(required.path)
+		if err != nil {
+			return fmt.Errorf("failed to check the capabilities on '%s': %w", required.path, err)
+		}
+		for _, capability := range required.capabilities {
+			if !hasVaultCapability(capabilities, capability) {
+				missing = append(missing, fmt.Sprintf("%s on '%s'", capability, required.path))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("the Vault policy doesn't allow %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// hasVaultCapability checks whether the capabilities include the required one. The root capability allows anything
+// while deny allows nothing.
+func hasVaultCapability(capabilities []string, required string) bool {
+	for _, c := range capabilities {
+		if c == "deny" {
+			return false
+		}
+	}
+	for _, c := range capabilities {
+		if c == required || c == "root" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultStorageSelfCheck(t *testing.T) {
+	fake, strg := newTestVaultStorage(t)
+
+	t.Run("sufficient policy", func(t *testing.T) {
+		assert.NoError(t, strg.SelfCheck(context.TODO()))
+		assert.Empty(t, fake.data)
+	})
+
+	t.Run("missing capabilities", func(t *testing.T) {
+		fake.capabilities = map[string][]string{
+			"spi/data/spi-self-check/probe":                {"read", "update"},
+			"spi/metadata/_artifacts/spi-self-check/probe": {"deny"},
+		}
+		err := strg.SelfCheck(context.TODO())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "create on 'spi/data/spi-self-check/probe'")
+		assert.Contains(t, err.Error(), "delete on 'spi/data/spi-self-check/probe'")
+		assert.Contains(t, err.Error(), "list on 'spi/metadata/_artifacts/spi-self-check/probe'")
+		assert.NotContains(t, err.Error(), "read on")
+	})
+}
+
+func TestHasVaultCapability(t *testing.T) {
+	assert.True(t, hasVaultCapability([]string{"read", "list"}, "list"))
+	assert.True(t, hasVaultCapability([]string{"root"}, "delete"))
+	assert.False(t, hasVaultCapability([]string{"read"}, "create"))
+	assert.False(t, hasVaultCapability([]string{"root", "deny"}, "read"))
+	assert.False(t, hasVaultCapability(nil, "read"))
+}
+
+func TestDryRunSelfCheck(t *testing.T) {
+	fake, strg := newTestVaultStorage(t)
+	fake.capabilities = map[string][]string{"spi/metadata/": {"read"}}
+
+	err := DryRun(strg).(SelfCheckingStorage).SelfCheck(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "list on 'spi/metadata/'")
+
+	assert.Equal(t, ErrSelfCheckNotSupported, DryRun(testTokenStorage{}).(SelfCheckingStorage).SelfCheck(context.TODO()))
+}
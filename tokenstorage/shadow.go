@@ -0,0 +1,411 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The reasons of the divergences between the primary and the shadow storage.
+const (
+	// shadowMissing means that the shadow storage doesn't have the data the primary storage has, e.g. because it has
+	// not been migrated yet.
+	shadowMissing = "missing"
+	// shadowUnexpected means that the shadow storage has the data the primary storage doesn't have.
+	shadowUnexpected = "unexpected"
+	// shadowDifferent means that the two storages have different data.
+	shadowDifferent = "different"
+)
+
+// MetricsNamespace is the prefix of the names of all the metrics of the service. It is defined here rather than in the
+// controllers package so that the metrics of the storages can use it as well.
+const MetricsNamespace = "spi_oauth"
+
+var (
+	shadowComparisonsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "storage_shadow",
+		Name:      "comparisons_total",
+		Help:      "The number of the reads from the primary token storage compared with the shadow token storage",
+	}, []string{"operation"})
+
+	shadowDivergencesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "storage_shadow",
+		Name:      "divergences_total",
+		Help:      "The number of the reads from the shadow token storage returning different data than the primary token storage",
+	}, []string{"operation", "reason"})
+
+	shadowFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "storage_shadow",
+		Name:      "failures_total",
+		Help:      "The number of the operations failed by the shadow token storage",
+	}, []string{"operation"})
+)
+
+// ShadowCollectors returns the metrics of the shadow storages so that they can be registered by the service.
+func ShadowCollectors() []prometheus.Collector {
+	return []prometheus.Collector{shadowComparisonsMetric, shadowDivergencesMetric, shadowFailuresMetric}
+}
+
+// Shadowed wraps the primary storage such that all the writes also go to the shadow storage and all the reads are
+// also done from the shadow storage and compared with the primary ones. Only the primary storage is authoritative:
+// its results are returned, the failures of the shadow storage are only logged and counted and the divergences are
+// counted by the reason without ever logging the secret values. This enables migrating to another storage backend by
+// running it in the shadow mode until it has all the data and doesn't diverge anymore.
+//
+// The returned storage supports the artifacts and the credentials if the primary storage does. They are only mirrored
+// to the shadow storage if it supports them, too. The same applies to listing and purging the owners and to
+// the self-check, which fails if either of the storages fails it.
+func Shadowed(primary tokenstorage.TokenStorage, shadow tokenstorage.TokenStorage) tokenstorage.TokenStorage {
+	tokens := &shadowTokenStorage{primary: primary, shadow: shadow}
+	primaryArtifacts, hasArtifacts := primary.(ArtifactStorage)
+	primaryCredentials, hasCredentials := primary.(CredentialsStorage)
+	shadowArtifacts, _ := shadow.(ArtifactStorage)
+	shadowCredentials, _ := shadow.(CredentialsStorage)
+	artifacts := &shadowArtifactStorage{primary: primaryArtifacts, shadow: shadowArtifacts}
+	credentials := &shadowCredentialsStorage{primary: primaryCredentials, shadow: shadowCredentials}
+
+	switch {
+	case hasArtifacts && hasCredentials:
+		return &struct {
+			*shadowTokenStorage
+			*shadowArtifactStorage
+			*shadowCredentialsStorage
+		}{tokens, artifacts, credentials}
+	case hasArtifacts:
+		return &struct {
+			*shadowTokenStorage
+			*shadowArtifactStorage
+		}{tokens, artifacts}
+	case hasCredentials:
+		return &struct {
+			*shadowTokenStorage
+			*shadowCredentialsStorage
+		}{tokens, credentials}
+	default:
+		return tokens
+	}
+}
+
+type shadowTokenStorage struct {
+	primary tokenstorage.TokenStorage
+	shadow  tokenstorage.TokenStorage
+}
+
+func (s *shadowTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	if err := s.primary.Store(ctx, owner, token); err != nil {
+		// the shadow storage never gets the data the primary storage doesn't have
+		return err
+	}
+	shadowFailed("store", owner, s.shadow.Store(ctx, owner, token))
+	return nil
+}
+
+func (s *shadowTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	token, err := s.primary.Get(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	shadowToken, err := s.shadow.Get(ctx, owner)
+	if !shadowFailed("get", owner, err) {
+		compareShadow("get", owner, token == nil, shadowToken == nil, func() []string {
+			return differentTokenFields(token, shadowToken)
+		})
+	}
+	return token, nil
+}
+
+func (s *shadowTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	if err := s.primary.Delete(ctx, owner); err != nil {
+		return err
+	}
+	shadowFailed("delete", owner, s.shadow.Delete(ctx, owner))
+	return nil
+}
+
+func (s *shadowTokenStorage) ListOwners(ctx context.Context) ([]types.NamespacedName, error) {
+	enumerable, ok := s.primary.(EnumerableStorage)
+	if !ok {
+		return nil, ErrListingNotSupported
+	}
+	return enumerable.ListOwners(ctx)
+}
+
+func (s *shadowTokenStorage) PurgeOwner(ctx context.Context, owner types.NamespacedName) error {
+	enumerable, ok := s.primary.(EnumerableStorage)
+	if !ok {
+		return ErrListingNotSupported
+	}
+	if err := enumerable.PurgeOwner(ctx, owner); err != nil {
+		return err
+	}
+	if shadow, ok := s.shadow.(EnumerableStorage); ok {
+		shadowFailed("purge", ownerToken(owner), shadow.PurgeOwner(ctx, owner))
+	}
+	return nil
+}
+
+func (s *shadowTokenStorage) SelfCheck(ctx context.Context) error {
+	primary, primaryChecks := s.primary.(SelfCheckingStorage)
+	shadow, shadowChecks := s.shadow.(SelfCheckingStorage)
+	if !primaryChecks && !shadowChecks {
+		return ErrSelfCheckNotSupported
+	}
+
+	if primaryChecks {
+		if err := primary.SelfCheck(ctx); err != nil {
+			return err
+		}
+	}
+	if shadowChecks {
+		if err := shadow.SelfCheck(ctx); err != nil {
+			return fmt.Errorf("shadow storage: %w", err)
+		}
+	}
+	return nil
+}
+
+type shadowArtifactStorage struct {
+	primary ArtifactStorage
+	// shadow is nil if the shadow storage doesn't support the artifacts.
+	shadow ArtifactStorage
+}
+
+func (s *shadowArtifactStorage) StoreArtifacts(ctx context.Context, owner *api.SPIAccessToken, artifacts Artifacts) error {
+	if err := s.primary.StoreArtifacts(ctx, owner, artifacts); err != nil {
+		return err
+	}
+	if s.shadow != nil {
+		shadowFailed("store_artifacts", owner, s.shadow.StoreArtifacts(ctx, owner, artifacts))
+	}
+	return nil
+}
+
+func (s *shadowArtifactStorage) GetArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) (*Artifact, error) {
+	artifact, err := s.primary.GetArtifact(ctx, owner, kind)
+	if err != nil || s.shadow == nil {
+		return artifact, err
+	}
+
+	shadowArtifact, err := s.shadow.GetArtifact(ctx, owner, kind)
+	if !shadowFailed("get_artifact", owner, err) {
+		compareShadow("get_artifact", owner, artifact == nil, shadowArtifact == nil, func() []string {
+			return differentArtifactFields(kind, *artifact, *shadowArtifact)
+		})
+	}
+	return artifact, nil
+}
+
+func (s *shadowArtifactStorage) GetArtifacts(ctx context.Context, owner *api.SPIAccessToken) (Artifacts, error) {
+	artifacts, err := s.primary.GetArtifacts(ctx, owner)
+	if err != nil || s.shadow == nil {
+		return artifacts, err
+	}
+
+	shadowArtifacts, err := s.shadow.GetArtifacts(ctx, owner)
+	if !shadowFailed("get_artifacts", owner, err) {
+		compareShadow("get_artifacts", owner, len(artifacts) == 0, len(shadowArtifacts) == 0, func() []string {
+			return differentArtifacts(artifacts, shadowArtifacts)
+		})
+	}
+	return artifacts, nil
+}
+
+func (s *shadowArtifactStorage) DeleteArtifact(ctx context.Context, owner *api.SPIAccessToken, kind ArtifactKind) error {
+	if err := s.primary.DeleteArtifact(ctx, owner, kind); err != nil {
+		return err
+	}
+	if s.shadow != nil {
+		shadowFailed("delete_artifact", owner, s.shadow.DeleteArtifact(ctx, owner, kind))
+	}
+	return nil
+}
+
+type shadowCredentialsStorage struct {
+	primary CredentialsStorage
+	// shadow is nil if the shadow storage doesn't support the credentials.
+	shadow CredentialsStorage
+}
+
+func (s *shadowCredentialsStorage) StoreCredentials(ctx context.Context, owner *api.SPIAccessToken, credentials Credentials) error {
+	if err := s.primary.StoreCredentials(ctx, owner, credentials); err != nil {
+		return err
+	}
+	if s.shadow != nil {
+		shadowFailed("store_credentials", owner, s.shadow.StoreCredentials(ctx, owner, credentials))
+	}
+	return nil
+}
+
+func (s *shadowCredentialsStorage) GetCredentials(ctx context.Context, owner *api.SPIAccessToken) (Credentials, error) {
+	credentials, err := s.primary.GetCredentials(ctx, owner)
+	if err != nil || s.shadow == nil {
+		return credentials, err
+	}
+
+	shadowCredentials, err := s.shadow.GetCredentials(ctx, owner)
+	if !shadowFailed("get_credentials", owner, err) {
+		compareShadow("get_credentials", owner, credentials == nil, shadowCredentials == nil, func() []string {
+			return differentCredentialKeys(credentials, shadowCredentials)
+		})
+	}
+	return credentials, nil
+}
+
+func (s *shadowCredentialsStorage) DeleteCredentials(ctx context.Context, owner *api.SPIAccessToken) error {
+	if err := s.primary.DeleteCredentials(ctx, owner); err != nil {
+		return err
+	}
+	if s.shadow != nil {
+		shadowFailed("delete_credentials", owner, s.shadow.DeleteCredentials(ctx, owner))
+	}
+	return nil
+}
+
+// shadowFailed logs and counts the failure of the shadow storage. It returns true if there was a failure.
+func shadowFailed(operation string, owner *api.SPIAccessToken, err error) bool {
+	if err == nil {
+		return false
+	}
+	shadowFailuresMetric.WithLabelValues(operation).Inc()
+	zap.L().Warn("the shadow token storage failed", zap.String("operation", operation), zap.String("token", owner.Name), zap.String("namespace", owner.Namespace), zap.Error(err))
+	return true
+}
+
+// compareShadow counts the comparison of the data read from the primary and the shadow storage and the divergence,
+// if any. The different function is only called if both storages have the data and returns the names of the fields
+// that differ.
+func compareShadow(operation string, owner *api.SPIAccessToken, primaryEmpty bool, shadowEmpty bool, different func() []string) {
+	shadowComparisonsMetric.WithLabelValues(operation).Inc()
+
+	var reason string
+	var fields []string
+	switch {
+	case primaryEmpty && shadowEmpty:
+		return
+	case shadowEmpty:
+		reason = shadowMissing
+	case primaryEmpty:
+		reason = shadowUnexpected
+	default:
+		if fields = different(); len(fields) == 0 {
+			return
+		}
+		reason = shadowDifferent
+	}
+
+	shadowDivergencesMetric.WithLabelValues(operation, reason).Inc()
+	zap.L().Info("the shadow token storage diverges from the primary one", zap.String("operation", operation), zap.String("reason", reason), zap.Strings("fields", fields), zap.String("token", owner.Name), zap.String("namespace", owner.Namespace))
+}
+
+// differentTokenFields returns the names of the fields of the tokens that differ.
+func differentTokenFields(a *api.Token, b *api.Token) []string {
+	var different []string
+	if a.AccessToken != b.AccessToken {
+		different = append(different, "accessToken")
+	}
+	if a.TokenType != b.TokenType {
+		different = append(different, "tokenType")
+	}
+	if a.RefreshToken != b.RefreshToken {
+		different = append(different, "refreshToken")
+	}
+	if a.Expiry != b.Expiry {
+		different = append(different, "expiry")
+	}
+	return different
+}
+
+// differentArtifactFields returns the names of the fields of the artifacts of the provided kind that differ.
+func differentArtifactFields(kind ArtifactKind, a Artifact, b Artifact) []string {
+	var different []string
+	if a.Value != b.Value {
+		different = append(different, string(kind)+".value")
+	}
+	if a.TokenType != b.TokenType {
+		different = append(different, string(kind)+".tokenType")
+	}
+	if a.ExpiresAt != b.ExpiresAt {
+		different = append(different, string(kind)+".expiresAt")
+	}
+	if !reflect.DeepEqual(a.Scopes, b.Scopes) {
+		different = append(different, string(kind)+".scopes")
+	}
+	if !reflect.DeepEqual(a.Capabilities, b.Capabilities) {
+		different = append(different, string(kind)+".capabilities")
+	}
+	return different
+}
+
+// differentArtifacts returns the names of the fields of all the artifacts that differ.
+func differentArtifacts(a Artifacts, b Artifacts) []string {
+	var different []string
+	for _, kind := range unionArtifactKinds(a, b) {
+		artifactA, inA := a[kind]
+		artifactB, inB := b[kind]
+		if inA != inB {
+			different = append(different, string(kind))
+			continue
+		}
+		different = append(different, differentArtifactFields(kind, artifactA, artifactB)...)
+	}
+	return different
+}
+
+// differentCredentialKeys returns the sorted keys of the credentials that differ.
+func differentCredentialKeys(a Credentials, b Credentials) []string {
+	keys := map[string]bool{}
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+
+	var different []string
+	for key := range keys {
+		if !reflect.DeepEqual(a[key], b[key]) {
+			different = append(different, key)
+		}
+	}
+	sort.Strings(different)
+	return different
+}
+
+func unionArtifactKinds(a Artifacts, b Artifacts) []ArtifactKind {
+	seen := map[ArtifactKind]bool{}
+	var kinds []ArtifactKind
+	for _, artifacts := range []Artifacts{a, b} {
+		for kind := range artifacts {
+			if !seen[kind] {
+				seen[kind] = true
+				kinds = append(kinds, kind)
+			}
+		}
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+	return kinds
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTokens is a token storage keeping the tokens in a map and optionally failing all the operations.
+func testTokens(tokens map[string]*api.Token, failure error) testTokenStorage {
+	return testTokenStorage{
+		StoreImpl: func(_ context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			if failure != nil {
+				return failure
+			}
+			tokens[owner.Name] = token
+			return nil
+		},
+		GetImpl: func(_ context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+			if failure != nil {
+				return nil, failure
+			}
+			return tokens[owner.Name], nil
+		},
+		DeleteImpl: func(_ context.Context, owner *api.SPIAccessToken) error {
+			if failure != nil {
+				return failure
+			}
+			delete(tokens, owner.Name)
+			return nil
+		},
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	ctx := context.TODO()
+	primaryTokens := map[string]*api.Token{}
+	shadowTokens := map[string]*api.Token{}
+	strg := Shadowed(testTokens(primaryTokens, nil), testTokens(shadowTokens, nil))
+
+	divergences := func(reason string) float64 {
+		return testutil.ToFloat64(shadowDivergencesMetric.WithLabelValues("get", reason))
+	}
+
+	t.Run("mirrors the writes", func(t *testing.T) {
+		assert.NoError(t, strg.Store(ctx, testOwner, &api.Token{AccessToken: "access"}))
+		assert.Equal(t, "access", primaryTokens["token"].AccessToken)
+		assert.Equal(t, "access", shadowTokens["token"].AccessToken)
+
+		comparisons := testutil.ToFloat64(shadowComparisonsMetric.WithLabelValues("get"))
+		different := divergences(shadowDifferent)
+		token, err := strg.Get(ctx, testOwner)
+		assert.NoError(t, err)
+		assert.Equal(t, "access", token.AccessToken)
+		assert.Equal(t, comparisons+1, testutil.ToFloat64(shadowComparisonsMetric.WithLabelValues("get")))
+		assert.Equal(t, different, divergences(shadowDifferent))
+
+		assert.NoError(t, strg.Delete(ctx, testOwner))
+		assert.Empty(t, primaryTokens)
+		assert.Empty(t, shadowTokens)
+	})
+
+	t.Run("counts the divergences", func(t *testing.T) {
+		defer func() {
+			delete(primaryTokens, "token")
+			delete(shadowTokens, "token")
+		}()
+
+		primaryTokens["token"] = &api.Token{AccessToken: "access"}
+		missing := divergences(shadowMissing)
+		token, err := strg.Get(ctx, testOwner)
+		assert.NoError(t, err)
+		assert.Equal(t, "access", token.AccessToken)
+		assert.Equal(t, missing+1, divergences(shadowMissing))
+
+		shadowTokens["token"] = &api.Token{AccessToken: "other"}
+		different := divergences(shadowDifferent)
+		token, err = strg.Get(ctx, testOwner)
+		assert.NoError(t, err)
+		assert.Equal(t, "access", token.AccessToken)
+		assert.Equal(t, different+1, divergences(shadowDifferent))
+
+		delete(primaryTokens, "token")
+		unexpected := divergences(shadowUnexpected)
+		token, err = strg.Get(ctx, testOwner)
+		assert.NoError(t, err)
+		assert.Nil(t, token)
+		assert.Equal(t, unexpected+1, divergences(shadowUnexpected))
+	})
+
+	t.Run("primary failures fail the operation", func(t *testing.T) {
+		failure := errors.New("primary failure")
+		strg := Shadowed(testTokens(primaryTokens, failure), testTokens(shadowTokens, nil))
+
+		assert.ErrorIs(t, strg.Store(ctx, testOwner, &api.Token{AccessToken: "access"}), failure)
+		assert.Empty(t, shadowTokens)
+		_, err := strg.Get(ctx, testOwner)
+		assert.ErrorIs(t, err, failure)
+	})
+
+	t.Run("shadow failures are ignored", func(t *testing.T) {
+		strg := Shadowed(testTokens(primaryTokens, nil), testTokens(shadowTokens, errors.New("shadow failure")))
+		defer delete(primaryTokens, "token")
+
+		failures := testutil.ToFloat64(shadowFailuresMetric.WithLabelValues("store"))
+		assert.NoError(t, strg.Store(ctx, testOwner, &api.Token{AccessToken: "access"}))
+		assert.Equal(t, failures+1, testutil.ToFloat64(shadowFailuresMetric.WithLabelValues("store")))
+
+		token, err := strg.Get(ctx, testOwner)
+		assert.NoError(t, err)
+		assert.Equal(t, "access", token.AccessToken)
+	})
+}
+
+func TestShadowedArtifactsAndCredentials(t *testing.T) {
+	ctx := context.TODO()
+	primaryStore := &memoryBlobStore{}
+	shadowStore := &memoryBlobStore{}
+	withData := func(store BlobStore) tokenstorage.TokenStorage {
+		return &struct {
+			testTokenStorage
+			ArtifactStorage
+			CredentialsStorage
+		}{testTokenStorage{}, NewBlobArtifactStorage(store), NewChunkedCredentialsStorage(store, DefaultMaxChunkSize)}
+	}
+	strg := Shadowed(withData(primaryStore), withData(shadowStore))
+
+	artifacts, ok := strg.(ArtifactStorage)
+	assert.True(t, ok)
+	assert.NoError(t, artifacts.StoreArtifacts(ctx, testOwner, Artifacts{AccessTokenArtifact: {Value: "access"}}))
+	credentials, ok := strg.(CredentialsStorage)
+	assert.True(t, ok)
+	assert.NoError(t, credentials.StoreCredentials(ctx, testOwner, Credentials{"key": []byte("value")}))
+	assert.Len(t, shadowStore.paths(""), len(primaryStore.paths("")))
+
+	// make the shadow storage diverge
+	assert.NoError(t, NewChunkedCredentialsStorage(shadowStore, DefaultMaxChunkSize).StoreCredentials(ctx, testOwner, Credentials{"key": []byte("other")}))
+	different := testutil.ToFloat64(shadowDivergencesMetric.WithLabelValues("get_credentials", shadowDifferent))
+	creds, err := credentials.GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{"key": []byte("value")}, creds)
+	assert.Equal(t, different+1, testutil.ToFloat64(shadowDivergencesMetric.WithLabelValues("get_credentials", shadowDifferent)))
+
+	different = testutil.ToFloat64(shadowDivergencesMetric.WithLabelValues("get_artifacts", shadowDifferent))
+	all, err := artifacts.GetArtifacts(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, "access", all[AccessTokenArtifact].Value)
+	assert.Equal(t, different, testutil.ToFloat64(shadowDivergencesMetric.WithLabelValues("get_artifacts", shadowDifferent)))
+
+	assert.NoError(t, artifacts.DeleteArtifact(ctx, testOwner, AccessTokenArtifact))
+	assert.NoError(t, credentials.DeleteCredentials(ctx, testOwner))
+	assert.Empty(t, primaryStore.paths(""))
+	assert.Empty(t, shadowStore.paths(""))
+}
+
+func TestShadowedCapabilities(t *testing.T) {
+	strg := Shadowed(testTokenStorage{}, &struct {
+		testTokenStorage
+		ArtifactStorage
+	}{testTokenStorage{}, NewBlobArtifactStorage(&memoryBlobStore{})})
+	_, ok := strg.(ArtifactStorage)
+	assert.False(t, ok)
+	_, ok = strg.(CredentialsStorage)
+	assert.False(t, ok)
+	assert.ErrorIs(t, strg.(SelfCheckingStorage).SelfCheck(context.TODO()), ErrSelfCheckNotSupported)
+
+	strg = Shadowed(&struct {
+		testTokenStorage
+		ArtifactStorage
+	}{testTokenStorage{}, NewBlobArtifactStorage(&memoryBlobStore{})}, testTokenStorage{})
+	_, ok = strg.(ArtifactStorage)
+	assert.True(t, ok)
+	_, ok = strg.(CredentialsStorage)
+	assert.False(t, ok)
+}
@@ -0,0 +1,389 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// VaultStorageType is the name of the storage backend storing the tokens in Vault.
+const VaultStorageType = "vault"
+
+// The directories in Vault under which the credentials and the token artifacts are stored next to the namespaces of
+// the tokens. Their names start with an underscore which is not valid in the namespace names (DNS-1123 labels), so
+// they can never collide with the tokens of any namespace.
+const (
+	vaultCredentialsDir = "_credentials"
+	vaultArtifactsDir   = "_artifacts"
+)
+
+// The paths in Vault under which the tokens, the credentials and the token artifacts are stored. The path of the tokens
+// is shared with the SPI operator.
+const (
+	vaultTokensPathPrefix      = "spi/data/"
+	vaultCredentialsPathPrefix = vaultTokensPathPrefix + vaultCredentialsDir + "/"
+	vaultArtifactsPathPrefix   = vaultTokensPathPrefix + vaultArtifactsDir + "/"
+)
+
+// vaultMetadataPathPrefix is the path listing the keys in the KV secrets engine used by the storage.
+const vaultMetadataPathPrefix = "spi/metadata/"
+
+// VaultOptions are the options of the Vault token storage. All the options are optional.
+type VaultOptions struct {
+	// Host is the URL of Vault. Defaults to the vaultHost of the shared configuration.
+	Host string `yaml:"host,omitempty"`
+
+	// Role is the role used to authenticate with Vault using the Kubernetes auth method. Defaults to `spi-oauth`.
+	Role string `yaml:"role,omitempty"`
+
+	// ServiceAccountTokenFilePath is the path to the token of the service account used to authenticate with Vault.
+	// Defaults to the token path in the shared configuration.
+	ServiceAccountTokenFilePath string `yaml:"serviceAccountTokenFilePath,omitempty"`
+
+	// Insecure disables the TLS verification of the connection to Vault. Always true in the dev mode.
+	Insecure bool `yaml:"insecure,omitempty"`
+
+	// MaxChunkSize is the maximum size in bytes of a single entry written to Vault when storing the credentials.
+	// Defaults to DefaultMaxChunkSize.
+	MaxChunkSize int `yaml:"maxChunkSize,omitempty"`
+
+	// Auth configures the method used to authenticate with Vault. Defaults to the Kubernetes auth method.
+	Auth VaultAuthOptions `yaml:"auth,omitempty"`
+}
+
+type vaultStorage struct {
+	tokenstorage.TokenStorage
+	CredentialsStorage
+	ArtifactStorage
+
+	client *vault.Client
+	login  *vaultLogin
+}
+
+var _ EnumerableStorage = (*vaultStorage)(nil)
+var _ io.Closer = (*vaultStorage)(nil)
+
+// vaultBlobStore stores the blobs as base64-encoded strings under the path prefix in the KV secrets engine of Vault.
+type vaultBlobStore struct {
+	client *vault.Client
+	prefix string
+}
+
+var _ BlobStore = (*vaultBlobStore)(nil)
+
+func init() {
+	Register(VaultStorageType, newVaultStorage)
+}
+
+func newVaultStorage(params FactoryParams) (tokenstorage.TokenStorage, error) {
+	opts := VaultOptions{
+		Host:                        params.Configuration.VaultHost,
+		Role:                        "spi-oauth",
+		ServiceAccountTokenFilePath: params.Configuration.ServiceAccountTokenFilePath,
+	}
+	if err := params.Options.Decode(&opts); err != nil {
+		return nil, err
+	}
+	insecure := opts.Insecure || params.DevMode
+
+	client, login, err := newVaultClient(opts, insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	// the token storage of the SPI operator is not used, it never logs in again after its Vault token expires
+	return &vaultStorage{
+		TokenStorage:       &vaultTokenStorage{client: client},
+		CredentialsStorage: NewChunkedCredentialsStorage(&vaultBlobStore{client: client, prefix: vaultCredentialsPathPrefix}, opts.MaxChunkSize),
+		ArtifactStorage:    NewBlobArtifactStorage(&vaultBlobStore{client: client, prefix: vaultArtifactsPathPrefix}),
+		client:             client,
+		login:              login,
+	}, nil
+}
+
+// Close stops keeping the Vault client of the storage logged in.
+func (v *vaultStorage) Close() error {
+	v.login.Stop()
+	return nil
+}
+
+// newVaultClient creates the Vault client authenticated using the configured auth method. The client is kept logged
+// in until the returned login is stopped.
+func newVaultClient(opts VaultOptions, insecure bool) (*vault.Client, *vaultLogin, error) {
+	authMethod, err := vaultAuthMethod(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := vault.DefaultConfig()
+	config.Address = opts.Host
+
+	if tlsConfig := opts.Auth.tlsConfig(insecure); tlsConfig != nil {
+		if err := config.ConfigureTLS(tlsConfig); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := opts.Auth.configureClientCertificate(config); err != nil {
+		return nil, nil, err
+	}
+
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	login, err := loginToVault(client, authMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, login, nil
+}
+
+// ListOwners lists the tokens, the credentials and the artifacts stored in Vault.
+func (v *vaultStorage) ListOwners(_ context.Context) ([]types.NamespacedName, error) {
+	owners := map[types.NamespacedName]bool{}
+
+	namespaces, err := v.listKeys(vaultMetadataPathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, namespace := range namespaces {
+		// the directories of the credentials and the artifacts are listed below, no namespace can be named the same
+		if namespace == vaultCredentialsDir || namespace == vaultArtifactsDir {
+			continue
+		}
+		if err := v.listOwnersInto(owners, vaultMetadataPathPrefix+namespace+"/", namespace); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, prefix := range []string{vaultMetadataPathPrefix + vaultCredentialsDir + "/", vaultMetadataPathPrefix + vaultArtifactsDir + "/"} {
+		namespaces, err := v.listKeys(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, namespace := range namespaces {
+			if err := v.listOwnersInto(owners, prefix+namespace+"/", namespace); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return sortedOwners(owners), nil
+}
+
+// PurgeOwner deletes the metadata of all the keys of the token, its credentials and its artifacts, which permanently
+// deletes all their versions in the KV v2 engine. The deleted data of the owner is still listed otherwise.
+func (v *vaultStorage) PurgeOwner(_ context.Context, owner types.NamespacedName) error {
+	paths := []string{vaultMetadataPathPrefix + owner.Namespace + "/" + owner.Name}
+	for _, prefix := range []string{vaultMetadataPathPrefix + vaultCredentialsDir + "/", vaultMetadataPathPrefix + vaultArtifactsDir + "/"} {
+		ownerPath := prefix + owner.Namespace + "/" + owner.Name
+		paths = append(paths, ownerPath)
+		leaves, err := v.listLeaves(ownerPath + "/")
+		if err != nil {
+			return err
+		}
+		paths = append(paths, leaves...)
+	}
+
+	for _, path := range paths {
+		if _, err := v.client.Logical().Delete(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listLeaves recursively lists the paths of all the secrets under the directory.
+func (v *vaultStorage) listLeaves(dir string) ([]string, error) {
+	secret, err := v.client.Logical().List(dir)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	listed, _ := secret.Data["keys"].([]interface{})
+	var leaves []string
+	for _, k := range listed {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected key listed in Vault at '%s'", dir)
+		}
+		if strings.HasSuffix(key, "/") {
+			nested, err := v.listLeaves(dir + key)
+			if err != nil {
+				return nil, err
+			}
+			leaves = append(leaves, nested...)
+		} else {
+			leaves = append(leaves, dir+key)
+		}
+	}
+	return leaves, nil
+}
+
+// listOwnersInto adds the names listed in the path to the owners in the namespace.
+func (v *vaultStorage) listOwnersInto(owners map[types.NamespacedName]bool, path string, namespace string) error {
+	names, err := v.listKeys(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		owners[types.NamespacedName{Namespace: namespace, Name: name}] = true
+	}
+	return nil
+}
+
+// listKeys lists the keys in the path without the trailing slashes of the directories. A key that is both a secret
+// and a directory is listed only once.
+func (v *vaultStorage) listKeys(path string) ([]string, error) {
+	secret, err := v.client.Logical().List(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	listed, _ := secret.Data["keys"].([]interface{})
+	keys := make([]string, 0, len(listed))
+	seen := map[string]bool{}
+	for _, k := range listed {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected key listed in Vault at '%s'", path)
+		}
+		key = strings.TrimSuffix(key, "/")
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (v *vaultBlobStore) Write(_ context.Context, path string, data []byte) error {
+	s, err := v.client.Logical().Write(v.prefix+path, map[string]interface{}{
+		"data": map[string]interface{}{
+			"blob": base64.StdEncoding.EncodeToString(data),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("failed to store the data, no error but returned nil")
+	}
+	return nil
+}
+
+func (v *vaultBlobStore) Read(_ context.Context, path string) ([]byte, error) {
+	secret, err := v.client.Logical().Read(v.prefix + path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		// deleted data in the KV v2 engine has nil data
+		return nil, nil
+	}
+
+	blob, ok := data["blob"].(string)
+	if !ok {
+		return nil, fmt.Errorf("corrupted data in Vault at '%s'", path)
+	}
+
+	return base64.StdEncoding.DecodeString(blob)
+}
+
+func (v *vaultBlobStore) Delete(_ context.Context, path string) error {
+	_, err := v.client.Logical().Delete(v.prefix + path)
+	return err
+}
+
+// vaultTokenStorage stores the token data in Vault in the same format as the token storage of the SPI operator. It is
+// used when the OAuth service authenticates with Vault using a method the operator storage doesn't support.
+type vaultTokenStorage struct {
+	client *vault.Client
+}
+
+var _ tokenstorage.TokenStorage = (*vaultTokenStorage)(nil)
+
+func (v *vaultTokenStorage) Store(_ context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	s, err := v.client.Logical().Write(vaultTokenPath(owner), map[string]interface{}{
+		"data": token,
+	})
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("failed to store the token, no error but returned nil")
+	}
+	return nil
+}
+
+func (v *vaultTokenStorage) Get(_ context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	path := vaultTokenPath(owner)
+	secret, err := v.client.Logical().Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	token := &api.Token{}
+	token.AccessToken, _ = data["access_token"].(string)
+	token.TokenType, _ = data["token_type"].(string)
+	token.RefreshToken, _ = data["refresh_token"].(string)
+	if expiry, ok := data["expiry"].(json.Number); ok {
+		if token.Expiry, err = strconv.ParseUint(expiry.String(), 10, 64); err != nil {
+			return nil, fmt.Errorf("corrupted expiry of the token in Vault at '%s': %w", path, err)
+		}
+	}
+	return token, nil
+}
+
+func (v *vaultTokenStorage) Delete(_ context.Context, owner *api.SPIAccessToken) error {
+	_, err := v.client.Logical().Delete(vaultTokenPath(owner))
+	return err
+}
+
+func vaultTokenPath(owner *api.SPIAccessToken) string {
+	return vaultTokensPathPrefix + owner.Namespace + "/" + owner.Name
+}
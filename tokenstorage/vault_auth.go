@@ -0,0 +1,338 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	auth "github.com/hashicorp/vault/api/auth/kubernetes"
+	"go.uber.org/zap"
+)
+
+// The methods that can be used to authenticate with Vault.
+const (
+	// VaultAuthKubernetes authenticates using the token of the Kubernetes service account. This is the default.
+	VaultAuthKubernetes = "kubernetes"
+	// VaultAuthJwt authenticates using a JWT read from a file, e.g. a SPIFFE JWT-SVID written by the SPIFFE helper or
+	// a token issued by a workload identity federation.
+	VaultAuthJwt = "jwt"
+	// VaultAuthCert authenticates using a TLS client certificate read from files, e.g. a SPIFFE X.509-SVID.
+	VaultAuthCert = "cert"
+)
+
+// VaultAuthOptions configure the method used to authenticate with Vault. The role used for the authentication is
+// the Role of the VaultOptions.
+type VaultAuthOptions struct {
+	// Method is the auth method, one of `kubernetes`, `jwt` or `cert`. Defaults to `kubernetes`.
+	Method string `yaml:"method,omitempty"`
+
+	// MountPath is the path under which the auth method is mounted in Vault. Defaults to the name of the method.
+	MountPath string `yaml:"mountPath,omitempty"`
+
+	// JwtFilePath is the path to the file with the JWT used by the `jwt` method. The file is re-read on each login so
+	// that the rotated tokens are picked up.
+	JwtFilePath string `yaml:"jwtFilePath,omitempty"`
+
+	// CertFilePath and KeyFilePath are the paths to the PEM-encoded client certificate and its private key used by
+	// the `cert` method. The files are re-read on each TLS handshake so that the rotated certificates are picked up.
+	CertFilePath string `yaml:"certFilePath,omitempty"`
+	KeyFilePath  string `yaml:"keyFilePath,omitempty"`
+
+	// CaFilePath is the path to the PEM-encoded bundle used to verify the certificate of Vault, e.g. the SPIFFE trust
+	// bundle. Optional for all the methods.
+	CaFilePath string `yaml:"caFilePath,omitempty"`
+}
+
+// method returns the configured auth method, defaulting to VaultAuthKubernetes.
+func (o *VaultAuthOptions) method() string {
+	if o.Method == "" {
+		return VaultAuthKubernetes
+	}
+	return o.Method
+}
+
+// validate checks that the options required by the configured method are present.
+func (o *VaultAuthOptions) validate() error {
+	switch o.method() {
+	case VaultAuthKubernetes:
+		return nil
+	case VaultAuthJwt:
+		if o.JwtFilePath == "" {
+			return fmt.Errorf("the jwtFilePath must be specified for the %s Vault auth method", VaultAuthJwt)
+		}
+		return nil
+	case VaultAuthCert:
+		if o.CertFilePath == "" || o.KeyFilePath == "" {
+			return fmt.Errorf("the certFilePath and keyFilePath must be specified for the %s Vault auth method", VaultAuthCert)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported Vault auth method '%s'", o.Method)
+	}
+}
+
+// tlsConfig returns the TLS configuration of the Vault client required by the auth options or nil if the default
+// configuration should be used.
+func (o *VaultAuthOptions) tlsConfig(insecure bool) *vault.TLSConfig {
+	cfg := &vault.TLSConfig{Insecure: insecure, CACert: o.CaFilePath}
+	if o.method() == VaultAuthCert {
+		cfg.ClientCert = o.CertFilePath
+		cfg.ClientKey = o.KeyFilePath
+	}
+
+	if *cfg == (vault.TLSConfig{}) {
+		return nil
+	}
+	return cfg
+}
+
+// configureClientCertificate makes the Vault client read the client certificate required by the auth options from its
+// files on each TLS handshake instead of using the certificate loaded when the client was configured.
+func (o *VaultAuthOptions) configureClientCertificate(config *vault.Config) error {
+	if o.method() != VaultAuthCert {
+		return nil
+	}
+	transport, ok := config.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("unexpected type of the Vault client transport: %T", config.HttpClient.Transport)
+	}
+	transport.TLSClientConfig.GetClientCertificate = clientCertificateLoader(o.CertFilePath, o.KeyFilePath)
+	return nil
+}
+
+// clientCertificateLoader returns the function reading the TLS client certificate and its private key from the files.
+func clientCertificateLoader(certFilePath, keyFilePath string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFilePath, keyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client certificate for Vault authentication: %w", err)
+		}
+		return &cert, nil
+	}
+}
+
+// vaultAuthMethod creates the Vault auth method based on the options.
+func vaultAuthMethod(opts VaultOptions) (vault.AuthMethod, error) {
+	a := opts.Auth
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+
+	mountPath := a.MountPath
+	if mountPath == "" {
+		mountPath = a.method()
+	}
+
+	switch a.method() {
+	case VaultAuthJwt:
+		return &jwtAuth{mountPath: mountPath, role: opts.Role, jwtFilePath: a.JwtFilePath}, nil
+	case VaultAuthCert:
+		return &certAuth{mountPath: mountPath, role: opts.Role}, nil
+	}
+
+	return &kubernetesAuth{mountPath: mountPath, role: opts.Role, tokenFilePath: opts.ServiceAccountTokenFilePath}, nil
+}
+
+// kubernetesAuth is the Vault auth method logging in using the token of the Kubernetes service account. Unlike
+// the auth method of the Vault client, which reads the token once when created, it re-reads the token on each login.
+type kubernetesAuth struct {
+	mountPath     string
+	role          string
+	tokenFilePath string
+}
+
+var _ vault.AuthMethod = (*kubernetesAuth)(nil)
+
+func (a *kubernetesAuth) Login(ctx context.Context, client *vault.Client) (*vault.Secret, error) {
+	k8sOpts := []auth.LoginOption{auth.WithMountPath(a.mountPath)}
+	if a.tokenFilePath != "" {
+		k8sOpts = append(k8sOpts, auth.WithServiceAccountTokenPath(a.tokenFilePath))
+	}
+	k8sAuth, err := auth.NewKubernetesAuth(a.role, k8sOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return k8sAuth.Login(ctx, client)
+}
+
+// jwtAuth is the Vault auth method logging in using the JWT read from a file.
+type jwtAuth struct {
+	mountPath   string
+	role        string
+	jwtFilePath string
+}
+
+var _ vault.AuthMethod = (*jwtAuth)(nil)
+
+func (a *jwtAuth) Login(_ context.Context, client *vault.Client) (*vault.Secret, error) {
+	jwt, err := ioutil.ReadFile(a.jwtFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the JWT for Vault authentication: %w", err)
+	}
+
+	return client.Logical().Write(loginPath(a.mountPath), map[string]interface{}{
+		"role": a.role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+// certAuth is the Vault auth method logging in using the TLS client certificate the Vault client is configured with.
+type certAuth struct {
+	mountPath string
+	role      string
+}
+
+var _ vault.AuthMethod = (*certAuth)(nil)
+
+func (a *certAuth) Login(_ context.Context, client *vault.Client) (*vault.Secret, error) {
+	return client.Logical().Write(loginPath(a.mountPath), map[string]interface{}{
+		"name": a.role,
+	})
+}
+
+func loginPath(mountPath string) string {
+	return "auth/" + strings.Trim(mountPath, "/") + "/login"
+}
+
+// The intervals of the Vault logins. The variables are only changed by the tests.
+var (
+	// vaultMinLoginInterval is the minimum time between the logins, it prevents logging in again and again when
+	// Vault issues the tokens with the TTL too short to renew them.
+	vaultMinLoginInterval = 10 * time.Second
+	// vaultMaxLoginRetryInterval is the maximum time between the retries of a failed login.
+	vaultMaxLoginRetryInterval = 5 * time.Minute
+)
+
+// vaultLogin keeps the Vault client logged in. It renews the token of the client while Vault allows it and logs in
+// again once the token cannot be renewed any more. Each login re-reads the token files of the `kubernetes` and `jwt`
+// methods and, because the idle connections are closed before it, makes a new TLS handshake re-reading the files of
+// the `cert` method.
+type vaultLogin struct {
+	client *vault.Client
+	method vault.AuthMethod
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// loginToVault logs the client in and starts keeping it logged in in the background until stopped.
+func loginToVault(client *vault.Client, method vault.AuthMethod) (*vaultLogin, error) {
+	l := &vaultLogin{client: client, method: method, stop: make(chan struct{}), done: make(chan struct{})}
+	authInfo, err := l.login()
+	if err != nil {
+		return nil, err
+	}
+	go l.run(authInfo)
+	return l, nil
+}
+
+// Stop stops keeping the client logged in. The current token of the client is valid until it expires.
+func (l *vaultLogin) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+}
+
+func (l *vaultLogin) login() (*vault.Secret, error) {
+	if transport, ok := l.client.CloneConfig().HttpClient.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	authInfo, err := l.client.Auth().Login(context.TODO(), l.method)
+	if err != nil {
+		return nil, err
+	}
+	if authInfo == nil || authInfo.Auth == nil {
+		return nil, fmt.Errorf("no auth info was returned after login to vault")
+	}
+	return authInfo, nil
+}
+
+func (l *vaultLogin) run(authInfo *vault.Secret) {
+	defer close(l.done)
+	for {
+		loggedInAt := time.Now()
+		if stopped := l.watch(authInfo); stopped {
+			return
+		}
+		if stopped := l.wait(time.Until(loggedInAt.Add(vaultMinLoginInterval))); stopped {
+			return
+		}
+
+		retryInterval := vaultMinLoginInterval
+		for {
+			var err error
+			if authInfo, err = l.login(); err == nil {
+				zap.L().Debug("logged in to Vault again")
+				break
+			}
+			zap.L().Error("failed to log in to Vault again, retrying", zap.Error(err), zap.Duration("retryInterval", retryInterval))
+			if stopped := l.wait(retryInterval); stopped {
+				return
+			}
+			if retryInterval *= 2; retryInterval > vaultMaxLoginRetryInterval {
+				retryInterval = vaultMaxLoginRetryInterval
+			}
+		}
+	}
+}
+
+// watch renews the token until it cannot be renewed any more. The tokens without a TTL never need a new login.
+func (l *vaultLogin) watch(authInfo *vault.Secret) (stopped bool) {
+	if authInfo.Auth.LeaseDuration <= 0 {
+		<-l.stop
+		return true
+	}
+
+	watcher, err := l.client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: authInfo})
+	if err != nil {
+		zap.L().Error("failed to watch the lifetime of the Vault token, logging in again", zap.Error(err))
+		return false
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return true
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				zap.L().Warn("failed to renew the Vault token, logging in again", zap.Error(err))
+			}
+			return false
+		case <-watcher.RenewCh():
+			zap.L().Debug("renewed the Vault token")
+		}
+	}
+}
+
+func (l *vaultLogin) wait(d time.Duration) (stopped bool) {
+	if d <= 0 {
+		return false
+	}
+	select {
+	case <-l.stop:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
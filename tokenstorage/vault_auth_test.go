@@ -0,0 +1,299 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokenstorage
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeVault emulates the login endpoints, the capabilities endpoint and the KV v2 secrets engine of Vault. The deleted
+// secrets have nil data. The token has the root capability on the paths without explicit capabilities.
+type fakeVault struct {
+	lock         sync.Mutex
+	logins       map[string]map[string]interface{}
+	leaseSeconds int
+	data         map[string]interface{}
+	capabilities map[string][]string
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	body := map[string]interface{}{}
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	if strings.HasPrefix(path, "auth/") {
+		f.logins[path] = body
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "vault-token", "lease_duration": f.leaseSeconds}})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != "vault-token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if path == "sys/capabilities-self" {
+		checked, _ := body["path"].(string)
+		capabilities, ok := f.capabilities[checked]
+		if !ok {
+			capabilities = []string{"root"}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{checked: capabilities}})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("list") == "true" {
+			f.list(w, path)
+			return
+		}
+		data, ok := f.data[path]
+		if !ok || data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data}})
+	case http.MethodDelete:
+		if strings.HasPrefix(path, "spi/metadata/") {
+			// deleting the metadata deletes all the versions of the secret
+			delete(f.data, strings.Replace(path, "/metadata/", "/data/", 1))
+		} else if _, ok := f.data[path]; ok {
+			// deleting the data only deletes the latest version, the secret is still listed
+			f.data[path] = nil
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.data[path] = body["data"]
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+	}
+}
+
+// list lists the keys of the secrets and the directories under the metadata path like the KV v2 engine does.
+func (f *fakeVault) list(w http.ResponseWriter, path string) {
+	prefix := strings.Replace(strings.TrimSuffix(path, "/")+"/", "/metadata/", "/data/", 1)
+	seen := map[string]bool{}
+	keys := []interface{}{}
+	for stored := range f.data {
+		if !strings.HasPrefix(stored, prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(stored, prefix)
+		if i := strings.Index(key, "/"); i >= 0 {
+			key = key[:i+1]
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+}
+
+// login returns the body of the last login request to the path.
+func (f *fakeVault) login(path string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.logins[path]
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	fake := &fakeVault{logins: map[string]map[string]interface{}{}, data: map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func TestVaultStorageJwtAuth(t *testing.T) {
+	fake, srv := newFakeVault(t)
+
+	jwtFile := filepath.Join(t.TempDir(), "jwt_svid.token")
+	assert.NoError(t, ioutil.WriteFile(jwtFile, []byte("the-svid\n"), 0600))
+
+	storageCfg := Configuration{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+type: vault
+options:
+  role: spiffe-role
+  auth:
+    method: jwt
+    mountPath: spiffe
+    jwtFilePath: `+jwtFile+`
+`), &storageCfg))
+
+	strg, err := New(storageCfg, config.Configuration{VaultHost: srv.URL}, false)
+	assert.NoError(t, err)
+	defer strg.(io.Closer).Close()
+	assert.Equal(t, map[string]interface{}{"role": "spiffe-role", "jwt": "the-svid"}, fake.logins["auth/spiffe/login"])
+
+	ctx := context.TODO()
+	token := &api.Token{AccessToken: "access", TokenType: "bearer", RefreshToken: "refresh", Expiry: 42}
+	assert.NoError(t, strg.Store(ctx, testOwner, token))
+	assert.Contains(t, fake.data, "spi/data/default/token")
+
+	stored, err := strg.Get(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, token, stored)
+
+	// the other storages share the authenticated client
+	assert.NoError(t, strg.(CredentialsStorage).StoreCredentials(ctx, testOwner, Credentials{"key": []byte("value")}))
+	creds, err := strg.(CredentialsStorage).GetCredentials(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Equal(t, Credentials{"key": []byte("value")}, creds)
+
+	assert.NoError(t, strg.(ArtifactStorage).StoreArtifacts(ctx, testOwner, Artifacts{AccessTokenArtifact: {Value: "access"}}))
+	assert.Contains(t, fake.data, "spi/data/_artifacts/default/token/access_token")
+
+	assert.NoError(t, strg.Delete(ctx, testOwner))
+	stored, err = strg.Get(ctx, testOwner)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+func TestVaultStorageCertAuth(t *testing.T) {
+	fake, srv := newFakeVault(t)
+
+	auth, err := vaultAuthMethod(VaultOptions{Role: "spiffe-role", Auth: VaultAuthOptions{Method: VaultAuthCert, CertFilePath: "svid.pem", KeyFilePath: "svid_key.pem"}})
+	assert.NoError(t, err)
+
+	cfg := vault.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := vault.NewClient(cfg)
+	assert.NoError(t, err)
+	_, err = auth.Login(context.TODO(), client)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "spiffe-role"}, fake.logins["auth/cert/login"])
+}
+
+func TestVaultAuthOptionsValidation(t *testing.T) {
+	assert.NoError(t, (&VaultAuthOptions{}).validate())
+	assert.Error(t, (&VaultAuthOptions{Method: VaultAuthJwt}).validate())
+	assert.NoError(t, (&VaultAuthOptions{Method: VaultAuthJwt, JwtFilePath: "jwt"}).validate())
+	assert.Error(t, (&VaultAuthOptions{Method: VaultAuthCert, CertFilePath: "cert"}).validate())
+	assert.NoError(t, (&VaultAuthOptions{Method: VaultAuthCert, CertFilePath: "cert", KeyFilePath: "key"}).validate())
+	assert.Error(t, (&VaultAuthOptions{Method: "ldap"}).validate())
+}
+
+func TestVaultAuthTlsConfig(t *testing.T) {
+	assert.Nil(t, (&VaultAuthOptions{}).tlsConfig(false))
+	assert.True(t, (&VaultAuthOptions{}).tlsConfig(true).Insecure)
+
+	cfg := (&VaultAuthOptions{Method: VaultAuthCert, CertFilePath: "cert", KeyFilePath: "key", CaFilePath: "bundle"}).tlsConfig(false)
+	assert.Equal(t, "cert", cfg.ClientCert)
+	assert.Equal(t, "key", cfg.ClientKey)
+	assert.Equal(t, "bundle", cfg.CACert)
+}
+
+func TestVaultLoginAgainAfterTokenExpiry(t *testing.T) {
+	interval := vaultMinLoginInterval
+	vaultMinLoginInterval = 10 * time.Millisecond
+	t.Cleanup(func() { vaultMinLoginInterval = interval })
+
+	fake, srv := newFakeVault(t)
+	fake.leaseSeconds = 1
+
+	jwtFile := filepath.Join(t.TempDir(), "jwt_svid.token")
+	assert.NoError(t, ioutil.WriteFile(jwtFile, []byte("the-svid"), 0600))
+
+	client, login, err := newVaultClient(VaultOptions{Host: srv.URL, Role: "spiffe-role", Auth: VaultAuthOptions{Method: VaultAuthJwt, JwtFilePath: jwtFile}}, false)
+	assert.NoError(t, err)
+	defer login.Stop()
+	assert.Equal(t, "vault-token", client.Token())
+	assert.Equal(t, "the-svid", fake.login("auth/jwt/login")["jwt"])
+
+	// the rotated JWT is read for the next login
+	assert.NoError(t, ioutil.WriteFile(jwtFile, []byte("the-rotated-svid"), 0600))
+	assert.Eventually(t, func() bool {
+		return fake.login("auth/jwt/login")["jwt"] == "the-rotated-svid"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClientCertificateLoader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "svid.pem")
+	keyFile := filepath.Join(dir, "svid_key.pem")
+	load := clientCertificateLoader(certFile, keyFile)
+
+	_, err := load(nil)
+	assert.Error(t, err)
+
+	writeTestCertificate(t, certFile, keyFile, 1)
+	cert, err := load(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), leaf.SerialNumber.Int64())
+
+	// the rotated certificate is read for the next handshake
+	writeTestCertificate(t, certFile, keyFile, 2)
+	cert, err = load(nil)
+	assert.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), leaf.SerialNumber.Int64())
+}
+
+func TestConfigureClientCertificate(t *testing.T) {
+	cfg := vault.DefaultConfig()
+	assert.NoError(t, (&VaultAuthOptions{}).configureClientCertificate(cfg))
+	assert.Nil(t, cfg.HttpClient.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate)
+
+	assert.NoError(t, (&VaultAuthOptions{Method: VaultAuthCert, CertFilePath: "cert", KeyFilePath: "key"}).configureClientCertificate(cfg))
+	assert.NotNil(t, cfg.HttpClient.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate)
+}
+
+// writeTestCertificate writes a self-signed certificate with the serial number and its private key to the files.
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(serial), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}